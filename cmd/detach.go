@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+// detachedVarsEnv names the file handing the variables given on the command
+// line or at the prompt, and the values read from the vault, to a background
+// run. The file is readable only by its owner and removed once read, so the
+// values show up neither in the process arguments nor in its environment.
+const detachedVarsEnv = "MIGRAINE_DETACHED_VARS_FILE"
+
+// detachedVars is the content of the file named by detachedVarsEnv
+type detachedVars struct {
+	Variables map[string]string `json:"variables"`
+	// Vault holds the variables resolved from the vault, which the
+	// background run cannot unlock without a terminal to ask for the
+	// passphrase
+	Vault map[string]string `json:"vault"`
+}
+
+// Output formats accepted by --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// jsonOutput receives the run events in --output json mode. Everything else
+// migraine prints goes to stderr so stdout only carries JSON lines.
+var jsonOutput io.Writer = os.Stdout
+
+// runOptions holds the execution flags shared by `run` and `workflow run`
+type runOptions struct {
+	actions []string
+	detach  bool
+	dryRun  bool   // Print what would run instead of running it
+	jobs    int    // Steps with `needs` that may run at once
+	output  string // outputText or outputJSON
+	// resume is a previous run whose succeeded steps are skipped
+	resume   int64
+	fromStep int // First step to run, 0 to run them all
+	// selection picks the steps to run with --only, --skip, --tags and --steps
+	selection workflow.StepSelection
+	noSudo    bool // Refuse to run steps with sudo
+	// secrets are the variable values redacted from the output, set once
+	// the variables are resolved
+	secrets []string
+	// runID is set in a background process, which carries out the run
+	// record created by the command that detached it
+	runID int64
+}
+
+func runOptionsFromFlags(cmd *cobra.Command) runOptions {
+	actions, _ := cmd.Flags().GetStringArray("action")
+	detach, _ := cmd.Flags().GetBool("detach")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	runID, _ := cmd.Flags().GetInt64("run-id")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	output, _ := cmd.Flags().GetString("output")
+	resume, _ := cmd.Flags().GetInt64("resume")
+	fromStep, _ := cmd.Flags().GetInt("from-step")
+	only, _ := cmd.Flags().GetStringSlice("only")
+	skip, _ := cmd.Flags().GetStringSlice("skip")
+	tags, _ := cmd.Flags().GetStringSlice("tags")
+	steps, _ := cmd.Flags().GetString("steps")
+	noSudo, _ := cmd.Flags().GetBool("no-sudo")
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	return runOptions{
+		actions:  actions,
+		detach:   detach,
+		dryRun:   dryRun,
+		jobs:     jobs,
+		output:   output,
+		resume:   resume,
+		fromStep: fromStep,
+		selection: workflow.StepSelection{
+			Only:  only,
+			Skip:  skip,
+			Tags:  tags,
+			Steps: steps,
+		},
+		noSudo: noSudo,
+		runID:  runID,
+	}
+}
+
+// shouldDetach reports whether the workflow must be handed off to a background
+// process, either because --detach was given or the workflow sets background.
+// A dry run never detaches.
+func (o runOptions) shouldDetach(background bool) bool {
+	return o.runID == 0 && !o.dryRun && (o.detach || background)
+}
+
+// addRunFlags registers the execution flags shared by `run` and `workflow run`
+func addRunFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("var", "v", []string{}, "Variables in KEY=VALUE format")
+	cmd.Flags().StringArrayP("action", "a", []string{}, "Action to run")
+	cmd.Flags().BoolP("detach", "d", false, "Run the workflow in the background and return its run ID")
+	cmd.Flags().Bool("dry-run", false, "Print the resolved commands, variables and hooks without running anything")
+	cmd.Flags().IntP("jobs", "j", 0, "Maximum number of steps with needs to run at once (default: number of CPUs)")
+	cmd.Flags().StringP("output", "o", outputText, "Output format: text, or json for newline-delimited JSON events")
+	cmd.Flags().Int64("resume", 0, "Resume a previous run: reuse its variables and skip the steps that succeeded")
+	cmd.Flags().Int("from-step", 0, "Skip the steps before this position (starting at 1)")
+	cmd.Flags().StringSlice("only", nil, "Run only the steps with these names or ids (comma-separated)")
+	cmd.Flags().StringSlice("skip", nil, "Skip the steps with these names or ids (comma-separated)")
+	cmd.Flags().StringSlice("tags", nil, "Run only the steps with any of these tags (comma-separated)")
+	cmd.Flags().String("steps", "", "Run only the steps at these positions, e.g. 2-4 or 1,3")
+	cmd.Flags().Bool("no-sudo", false, "Refuse to run steps with sudo: true")
+	cmd.Flags().Int64("run-id", 0, "Run record to execute (used by background runs)")
+	cmd.Flags().MarkHidden("run-id")
+	cmd.PreRunE = setupRunOutput
+}
+
+// setupRunOutput validates --output. In json mode it keeps stdout for the
+// events and sends the rest of the output, such as prompts, to stderr.
+func setupRunOutput(cmd *cobra.Command, args []string) error {
+	if fromStep, _ := cmd.Flags().GetInt("from-step"); fromStep < 0 {
+		return fmt.Errorf("invalid --from-step %d (must be 1 or more)", fromStep)
+	}
+
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case outputText:
+	case outputJSON:
+		jsonOutput = os.Stdout
+		os.Stdout = os.Stderr
+	default:
+		return fmt.Errorf("invalid output format %q (must be text or json)", output)
+	}
+	return nil
+}
+
+// inheritDetachedVars merges the variables handed over by the detaching
+// command into variables and returns the values it read from the vault, nil
+// when there are none to take over. The file holding them is removed and
+// the environment entry cleared so workflow commands do not inherit it.
+func inheritDetachedVars(variables map[string]string) map[string]string {
+	path, ok := os.LookupEnv(detachedVarsEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(detachedVarsEnv)
+
+	encoded, err := os.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		utils.LogWarning(fmt.Sprintf("Ignoring background variables: %v", err))
+		return nil
+	}
+
+	var inherited detachedVars
+	if err := json.Unmarshal(encoded, &inherited); err != nil {
+		utils.LogWarning(fmt.Sprintf("Ignoring malformed background variables: %v", err))
+		return nil
+	}
+
+	for k, v := range inherited.Variables {
+		if _, exists := variables[k]; !exists {
+			variables[k] = v
+		}
+	}
+	return inherited.Vault
+}
+
+// vaultValues returns the resolved variables whose value came from the vault
+func vaultValues(variables, sources map[string]string) map[string]string {
+	values := make(map[string]string)
+	for k, v := range variables {
+		if sources[k] == workflow.SourceVault {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// inheritResumedVars merges the variables recorded with the run being
+// resumed into variables, without overriding the ones given again. Values
+// masked because they held a secret are not recorded, so they have to be
+// given again. It exits when the run does not exist or belongs to another
+// workflow.
+func inheritResumedVars(runID int64, workflowID string, variables map[string]string) {
+	run, err := sqlite.GetStorageService().RunStore().GetRun(runID)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Cannot resume run %d: %v", runID, err))
+		os.Exit(1)
+	}
+	if run.WorkflowID != workflowID {
+		utils.LogError(fmt.Sprintf("Cannot resume run %d: it ran workflow '%s', not '%s'", runID, run.WorkflowID, workflowID))
+		os.Exit(1)
+	}
+
+	for k, v := range run.Variables {
+		if strings.Contains(v, execution.RedactedValue) {
+			continue
+		}
+		if _, exists := variables[k]; !exists {
+			variables[k] = v
+		}
+	}
+}
+
+// startDetachedRun records a new run and re-executes migraine in its own
+// session to carry it out, with output going to a per-run log file. It
+// returns as soon as the background process has started. The values read
+// from the vault are handed over along with variables, so that the
+// background run does not need to unlock the vault. The values of secrets
+// are masked in the run record.
+func startDetachedRun(cmd *cobra.Command, workflowName, workflowID string, variables, vault map[string]string, secrets []string) {
+	storage := sqlite.GetStorageService()
+	store := storage.RunStore()
+
+	resumeFrom, _ := cmd.Flags().GetInt64("resume")
+	runID, err := store.CreateRun(sqlite.Run{
+		WorkflowID:  workflowID,
+		Status:      sqlite.RunStatusRunning,
+		StartedAt:   time.Now().UTC(),
+		TriggeredBy: currentInvoker(),
+		ResumedFrom: resumeFrom,
+		Variables:   execution.NewRedactor(secrets).Map(variables),
+	})
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to record background run: %v", err))
+		os.Exit(1)
+	}
+
+	fail := func(err error) {
+		utils.LogError(err.Error())
+		completedAt := time.Now().UTC()
+		store.UpdateRun(sqlite.Run{ID: runID, Status: sqlite.RunStatusFailed, CompletedAt: &completedAt})
+		os.Exit(1)
+	}
+
+	logDir := filepath.Join(storage.GetDB().DataDir(), "runs")
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		fail(fmt.Errorf("failed to create run log directory: %v", err))
+	}
+	logPath := filepath.Join(logDir, fmt.Sprintf("%d.log", runID))
+
+	executable, err := os.Executable()
+	if err != nil {
+		fail(fmt.Errorf("failed to locate the migraine executable: %v", err))
+	}
+
+	varsPath, err := writeDetachedVars(logDir, runID, detachedVars{Variables: variables, Vault: vault})
+	if err != nil {
+		fail(fmt.Errorf("failed to hand over variables: %v", err))
+	}
+	env := append(os.Environ(), fmt.Sprintf("%s=%s", detachedVarsEnv, varsPath))
+
+	pid, err := execution.StartDetached(executable, detachedRunArgs(cmd, workflowName, runID), env, logPath)
+	if err != nil {
+		os.Remove(varsPath)
+		fail(err)
+	}
+
+	if err := store.SetRunProcess(runID, pid, logPath); err != nil {
+		utils.LogWarning(fmt.Sprintf("Failed to record background process: %v", err))
+	}
+
+	if output, _ := cmd.Flags().GetString("output"); output == outputJSON {
+		json.NewEncoder(jsonOutput).Encode(map[string]interface{}{
+			"type":     "run_detached",
+			"time":     time.Now(),
+			"workflow": workflowID,
+			"run_id":   runID,
+			"pid":      pid,
+			"log_file": logPath,
+		})
+		return
+	}
+
+	utils.LogSuccess(fmt.Sprintf("Started run #%d of '%s' in the background (pid %d)", runID, workflowID, pid))
+	utils.LogInfo(fmt.Sprintf("Logs: %s", logPath))
+	utils.LogInfo(fmt.Sprintf("Follow it with 'migraine runs attach %d' or stop it with 'migraine runs cancel %d'", runID, runID))
+}
+
+// writeDetachedVars writes vars to a file in dir for the background process
+// of run runID to take over. os.CreateTemp makes it readable by the current
+// user only. It returns the path of the file.
+func writeDetachedVars(dir string, runID int64, vars detachedVars) (string, error) {
+	encoded, err := json.Marshal(vars)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, fmt.Sprintf("%d-vars-*.json", runID))
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(encoded)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// detachedRunArgs builds the arguments of the background process from the
+// flags of the current invocation. Variables travel through a file named in
+// the environment instead, and --detach is replaced by the run to adopt.
+func detachedRunArgs(cmd *cobra.Command, workflowName string, runID int64) []string {
+	args := []string{"run"}
+	if workflowName != "" {
+		args = append(args, workflowName)
+	}
+
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		switch f.Name {
+		case "var", "detach", "run-id":
+			return
+		}
+
+		if values, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range values.GetSlice() {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+
+	return append(args, fmt.Sprintf("--run-id=%d", runID))
+}
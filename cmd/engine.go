@@ -0,0 +1,374 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tesh254/migraine/internal/engine"
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/ui"
+	"github.com/tesh254/migraine/internal/workflow"
+	"github.com/tesh254/migraine/pkg/utils"
+	"golang.org/x/term"
+)
+
+// runContext is cancelled when migraine receives Ctrl-C or SIGTERM, which
+// stops the running command's process group instead of orphaning it
+var runContext = sync.OnceValue(func() context.Context {
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx
+})
+
+// runWorkflow runs a workflow through the engine, printing its progress, and
+// exits with a non-zero code when it does not succeed. kind names the source
+// of the workflow in the final message, e.g. "Project workflow". inputs are
+// the variables given on the command line or at prompts, recorded so the run
+// can be resumed. With --output json the events are written as JSON lines
+// instead.
+func runWorkflow(kind string, wf *workflow.YAMLWorkflow, workflowID string, variables, inputs map[string]string, opts runOptions) {
+	runnerOpts := engine.Options{
+		Store:    sqlite.GetStorageService().RunStore(),
+		Resolver: workflow.NewVariableResolver(sqlite.GetStorageService()),
+		Jobs:     opts.jobs,
+		// Background runs have no terminal to ask for the sudo password
+		PromptSudo: opts.runID == 0 && stdinIsTerminal(),
+	}
+	if opts.output == outputJSON {
+		encoder := json.NewEncoder(jsonOutput)
+		runnerOpts.OnEvent = func(e engine.Event) { encoder.Encode(e) }
+		runnerOpts.OutputEvents = true
+	} else {
+		reporter := &consoleReporter{kind: kind, actions: len(opts.actions) > 0, selection: opts.selection.String()}
+		runnerOpts.OnEvent = reporter.handle
+	}
+	runner := engine.New(runnerOpts)
+	ui.SetRedaction(execution.NewRedactor(opts.secrets).String)
+
+	result := runner.Run(runContext(), engine.Request{
+		Workflow:    wf,
+		WorkflowID:  workflowID,
+		Variables:   variables,
+		Actions:     opts.actions,
+		Selection:   opts.selection,
+		RunID:       opts.runID,
+		TriggeredBy: currentInvoker(),
+		Inputs:      inputs,
+		ResumeFrom:  opts.resume,
+		FromStep:    opts.fromStep,
+		NoSudo:      opts.noSudo,
+		Secrets:     opts.secrets,
+	})
+	if code := result.ExitCode(); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// runPreChecks runs only the pre-checks of a workflow, without recording
+// them in the run history, and exits with a non-zero code when one fails.
+// The values of secrets are redacted from the output.
+func runPreChecks(wf *workflow.YAMLWorkflow, variables map[string]string, secrets []string) {
+	reporter := &consoleReporter{preChecksOnly: true}
+	ui.SetRedaction(execution.NewRedactor(secrets).String)
+	runner := engine.New(engine.Options{
+		Resolver:   workflow.NewVariableResolver(sqlite.GetStorageService()),
+		OnEvent:    reporter.handle,
+		PromptSudo: stdinIsTerminal(),
+	})
+
+	result := runner.Run(runContext(), engine.Request{
+		Workflow:      wf,
+		Variables:     variables,
+		PreChecksOnly: true,
+		Secrets:       secrets,
+	})
+	if code := result.ExitCode(); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// stdinIsTerminal reports whether migraine reads from a terminal, where sudo
+// and the vault can ask for a password
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// dbWorkflowToYAML converts the metadata of a database workflow back to the
+// workflow it was stored from
+func dbWorkflowToYAML(dbWf *sqlite.Workflow) (*workflow.YAMLWorkflow, error) {
+	metadataBytes, err := json.Marshal(dbWf.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal workflow metadata: %v", err)
+	}
+
+	var config workflow.ProjectConfig
+	if err := json.Unmarshal(metadataBytes, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal workflow metadata: %v", err)
+	}
+
+	return &workflow.YAMLWorkflow{
+		Name:        dbWf.Name,
+		Description: config.Description,
+		PreChecks:   config.PreChecks,
+		Steps:       config.Steps,
+		Actions:     config.Actions,
+		OnSuccess:   config.OnSuccess,
+		OnFailure:   config.OnFailure,
+		Finally:     config.Finally,
+		Dir:         config.Dir,
+		Env:         config.Env,
+		Shell:       config.Shell,
+		Config:      config.Config,
+		UseVault:    dbWf.UseVault,
+	}, nil
+}
+
+// consoleReporter prints the events of a run to the terminal
+type consoleReporter struct {
+	kind          string
+	actions       bool // Actions run instead of the steps
+	preChecksOnly bool
+	selection     string // Step selection flags, shown in the header
+}
+
+func (c *consoleReporter) handle(e engine.Event) {
+	switch e.Type {
+	case engine.EventRunStarted:
+		if c.preChecksOnly {
+			ui.WorkflowHeader(e.Workflow, "pre-check")
+		} else if c.selection != "" {
+			ui.WorkflowHeader(e.Workflow, "run", "STEPS: "+c.selection)
+		} else {
+			ui.WorkflowHeader(e.Workflow, "run")
+		}
+
+	case engine.EventPhaseStarted:
+		switch e.Phase {
+		case sqlite.RunPhasePrecheck:
+			ui.SectionHeader("PRECHECKS")
+		case sqlite.RunPhaseStep:
+			ui.SectionHeader("SCRIPTS")
+		case sqlite.RunPhaseAction:
+			ui.SectionHeader("ACTIONS")
+		case sqlite.RunPhaseOnSuccess:
+			ui.SectionHeader("ON SUCCESS")
+		case sqlite.RunPhaseOnFailure:
+			ui.SectionHeader("ON FAILURE")
+		case sqlite.RunPhaseFinally:
+			ui.SectionHeader("FINALLY")
+		}
+
+	case engine.EventStepStarted:
+		if e.Phase != sqlite.RunPhasePrecheck {
+			ui.ScriptProgress(e.Position, e.Total, attemptLabel(e.Name, e.Attempt, e.Attempts), e.Duration)
+		}
+
+	case engine.EventStepRetrying:
+		ui.LogWarningBordered(fmt.Sprintf("Attempt %d/%d of %s failed: %v. Retrying in %s",
+			e.Attempt, e.Attempts, stepLabel(e), e.Err, ui.FormatDuration(e.Delay)))
+
+	case engine.EventStepSkipped:
+		reason := e.Reason
+		if reason == "" {
+			reason = "when: " + e.Condition
+		}
+		if e.Phase == sqlite.RunPhasePrecheck {
+			ui.PrecheckResult(e.Name, "skip", 0, reason)
+		} else {
+			ui.ScriptSkipped(e.Position, e.Total, e.Name, reason)
+		}
+
+	case engine.EventStepFinished:
+		c.stepFinished(e)
+
+	case engine.EventHookFired:
+		if actionName, ok := strings.CutPrefix(e.Hook, "action:"); ok {
+			ui.LogInfoBordered(fmt.Sprintf("Executing hook action: %s", actionName))
+		} else if command, ok := strings.CutPrefix(e.Hook, "run:"); ok {
+			ui.LogInfoBordered(fmt.Sprintf("Executing hook command: %s", command))
+		}
+
+	case engine.EventHookFinished:
+		if e.Err != nil {
+			ui.LogErrorBordered(fmt.Sprintf("%s %s hook failed: %v", stepTitle(e), e.Trigger, e.Err))
+		}
+
+	case engine.EventWarning:
+		utils.LogWarning(e.Message)
+
+	case engine.EventRunFinished:
+		c.runFinished(e)
+	}
+}
+
+func (c *consoleReporter) stepFinished(e engine.Event) {
+	// An interrupted run is reported once when it finishes
+	if errors.Is(e.Err, execution.ErrInterrupted) {
+		return
+	}
+
+	if e.Phase == sqlite.RunPhasePrecheck {
+		status := "ok"
+		switch {
+		case errors.Is(e.Err, execution.ErrTimeout):
+			status = "timeout"
+		case e.AllowedFailure:
+			status = "warn"
+		case e.Err != nil:
+			status = "fail"
+		}
+		message := ""
+		if e.AllowedFailure {
+			message = e.Err.Error()
+		}
+		ui.PrecheckResult(e.Name, status, e.Duration, message)
+	}
+
+	if e.AllowedFailure {
+		// severity: warn pre-checks were reported on their result line
+		if e.Phase == sqlite.RunPhaseStep {
+			ui.LogWarningBordered(fmt.Sprintf("%s failed (allowed): %v", stepTitle(e), e.Err))
+		}
+		return
+	}
+	if e.Err != nil {
+		ui.LogErrorBordered(fmt.Sprintf("%s failed: %v", stepTitle(e), e.Err))
+		return
+	}
+
+	switch e.Phase {
+	case sqlite.RunPhasePrecheck:
+		if !c.preChecksOnly {
+			ui.LogInfoBordered("Pre-check completed successfully")
+		}
+	case sqlite.RunPhaseStep:
+		if len(e.Outputs) > 0 {
+			ui.LogInfoBordered(fmt.Sprintf("Step completed successfully, outputs: %s", outputsText(e.Outputs)))
+		} else {
+			ui.LogInfoBordered("Step completed successfully")
+		}
+	case sqlite.RunPhaseAction:
+		ui.LogInfoBordered("Action completed successfully")
+	default:
+		ui.LogInfoBordered("Hook step completed successfully")
+	}
+}
+
+// outputsText lists step outputs as name=value pairs sorted by name
+func outputsText(outputs map[string]string) string {
+	pairs := make([]string, 0, len(outputs))
+	for name, value := range outputs {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func (c *consoleReporter) runFinished(e engine.Event) {
+	result := e.Result
+	if result.Status == sqlite.RunStatusCancelled {
+		if c.preChecksOnly {
+			ui.LogWarningBordered("Pre-checks interrupted")
+		} else {
+			ui.LogWarningBordered("Workflow interrupted")
+		}
+		return
+	}
+
+	// Step failures were reported as they happened
+	var stepErr *engine.StepError
+	if result.Err != nil && !errors.As(result.Err, &stepErr) {
+		ui.LogErrorBordered(fmt.Sprintf("Workflow failed: %v", result.Err))
+	}
+
+	switch {
+	case c.preChecksOnly:
+		switch result.Status {
+		case sqlite.RunStatusSuccess:
+			ui.LogSuccessBordered("All pre-checks passed successfully")
+		case sqlite.RunStatusWarning:
+			ui.LogWarningBordered("Pre-checks passed with warnings")
+		}
+	case c.actions:
+		if result.Succeeded() {
+			ui.LogSuccessBordered(fmt.Sprintf("%s actions completed successfully", c.kind))
+		}
+	default:
+		ui.Summary(summaryStatus(result), result.Duration, result.PreChecksPassed, result.PreChecksFailed, result.PreChecksWarned,
+			result.StepsTotal, result.StepsCompleted, result.StepsSkipped, result.StepsWarned, "", "")
+		switch result.Status {
+		case sqlite.RunStatusSuccess:
+			ui.LogSuccessBordered(fmt.Sprintf("%s '%s' completed successfully", c.kind, e.Workflow))
+		case sqlite.RunStatusWarning:
+			ui.LogWarningBordered(fmt.Sprintf("%s '%s' completed with warnings", c.kind, e.Workflow))
+		}
+	}
+}
+
+// summaryStatus returns the status shown in the summary of a run
+func summaryStatus(result *engine.Result) string {
+	switch result.Status {
+	case sqlite.RunStatusSuccess:
+		return "SUCCESS"
+	case sqlite.RunStatusWarning:
+		return "PASSED WITH WARNINGS"
+	case sqlite.RunStatusTimedOut:
+		return "TIMED OUT"
+	default:
+		return "FAILED"
+	}
+}
+
+// attemptLabel adds the attempt number to a step description when the step can be retried
+func attemptLabel(description string, attempt, attempts int) string {
+	if attempts <= 1 {
+		return description
+	}
+	return fmt.Sprintf("%s (attempt %d/%d)", description, attempt, attempts)
+}
+
+// stepLabel names a step the way it is labelled in the run logs, e.g. "step 2"
+func stepLabel(e engine.Event) string {
+	if e.Phase == sqlite.RunPhaseAction {
+		return fmt.Sprintf("action %s", e.StepID)
+	}
+	return fmt.Sprintf("%s %d", e.Phase, e.Position)
+}
+
+// stepTitle names a step at the start of a message, e.g. "Pre-check 1"
+func stepTitle(e engine.Event) string {
+	switch e.Phase {
+	case sqlite.RunPhasePrecheck:
+		return fmt.Sprintf("Pre-check %d", e.Position)
+	case sqlite.RunPhaseAction:
+		return fmt.Sprintf("Action '%s'", e.StepID)
+	case sqlite.RunPhaseStep:
+		return fmt.Sprintf("Step %d", e.Position)
+	default:
+		return fmt.Sprintf("%s step %d", e.Phase, e.Position)
+	}
+}
+
+// currentInvoker identifies who started a run as user@host
+func currentInvoker() string {
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return username
+	}
+
+	return fmt.Sprintf("%s@%s", username, host)
+}
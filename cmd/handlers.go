@@ -4,17 +4,72 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/spf13/cobra"
-	execution "github.com/tesh254/migraine/internal/execution"
 	"github.com/tesh254/migraine/internal/storage/sqlite"
 	"github.com/tesh254/migraine/internal/ui"
 	"github.com/tesh254/migraine/internal/workflow"
 	"github.com/tesh254/migraine/pkg/utils"
+	"golang.org/x/term"
 )
 
+// settingsText returns the scripts and the dir and env values of a workflow
+// and of its steps, which can use {{variables}} like the commands
+func settingsText(wf *workflow.YAMLWorkflow) string {
+	steps := append(append(slices.Clone(wf.PreChecks), wf.Steps...), wf.HookSteps()...)
+	for _, action := range wf.Actions {
+		steps = append(steps, action)
+	}
+
+	text := wf.Dir + "\n"
+	for _, value := range wf.Env {
+		text += value + "\n"
+	}
+	for _, step := range steps {
+		text += step.Script + "\n"
+		text += step.Dir + "\n"
+		for _, value := range step.Env {
+			text += value + "\n"
+		}
+	}
+	return text
+}
+
+// preCheckText returns the commands, conditions, scripts, dir and env of the
+// pre-checks of a workflow, and the dir and env of the workflow they run
+// with, which can use {{variables}}
+func preCheckText(wf *workflow.YAMLWorkflow) string {
+	text := wf.Dir + "\n"
+	for _, value := range wf.Env {
+		text += value + "\n"
+	}
+	for _, check := range wf.PreChecks {
+		text += check.Command + "\n"
+		text += check.When + "\n"
+		text += check.Script + "\n"
+		text += check.Dir + "\n"
+		for _, value := range check.Env {
+			text += value + "\n"
+		}
+	}
+	return text
+}
+
+// readVariable asks for the value of variable name on the terminal. Answers
+// for variables declared with secret: true in configVariables are not echoed.
+func readVariable(name string, configVariables map[string]interface{}) string {
+	fmt.Printf("%s: ", name)
+	d, err := workflow.ParseVariableDeclaration(name, configVariables[name])
+	if err != nil || !d.Secret || !stdinIsTerminal() {
+		return readLine()
+	}
+	value, _ := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(value)
+}
+
 func readLine() string {
 	var buf [1]byte
 	var line []byte
@@ -130,6 +185,7 @@ func handleRunWorkflowV2(workflowName string, cmd *cobra.Command) {
 		workflowContent = ""
 		for _, step := range fsWf.Steps {
 			workflowContent += step.Command + "\n"
+			workflowContent += step.When + "\n"
 		}
 		for _, check := range fsWf.PreChecks {
 			workflowContent += check.Command + "\n"
@@ -137,6 +193,10 @@ func handleRunWorkflowV2(workflowName string, cmd *cobra.Command) {
 		for name, action := range fsWf.Actions {
 			workflowContent += fmt.Sprintf("%s: %s\n", name, action.Command)
 		}
+		for _, step := range fsWf.HookSteps() {
+			workflowContent += step.Command + "\n"
+		}
+		workflowContent += settingsText(fsWf)
 	}
 
 	// Process variables from flags
@@ -156,12 +216,21 @@ func handleRunWorkflowV2(workflowName string, cmd *cobra.Command) {
 		variables[parts[0]] = parts[1]
 	}
 
-	// Create variable resolver
+	opts := runOptionsFromFlags(cmd)
+	var detachedVault map[string]string
+	if opts.runID != 0 {
+		detachedVault = inheritDetachedVars(variables)
+	}
+
+	// Create variable resolver. A background run takes the vault values read
+	// by the command that started it.
 	varResolver := workflow.NewVariableResolver(storage)
+	varResolver.UseVaultValues(detachedVault)
 
 	// Determine workflow ID based on which workflow type we're using
 	var workflowID string
 	var configVariables map[string]interface{}
+	var background bool
 
 	if dbErr == nil {
 		workflowID = dbWf.ID
@@ -170,264 +239,69 @@ func handleRunWorkflowV2(workflowName string, cmd *cobra.Command) {
 		metadataBytes, _ := json.Marshal(dbWf.Metadata)
 		if err := json.Unmarshal(metadataBytes, &config); err == nil {
 			configVariables = config.Config.Variables
+			background = config.Config.Background
 		}
 	} else {
 		workflowID = workflowName
 		configVariables = fsWf.Config.Variables
+		background = fsWf.Config.Background
+	}
+
+	if opts.resume != 0 {
+		inheritResumedVars(opts.resume, workflowID, variables)
 	}
 
 	// Resolve variables based on workflow configuration
-	resolvedVars, err := varResolver.ResolveVariables(workflowID, useVault, variables, configVariables)
+	resolvedVars, sources, err := varResolver.ResolveVariablesWithSources(workflowID, useVault, variables, configVariables)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to resolve variables: %v", err))
 		os.Exit(1)
 	}
 
-	// If there are still missing variables, prompt for them if not using vault
-	if !useVault {
+	// If there are still missing variables, prompt for them if not using vault.
+	// A dry run reports them instead.
+	if !useVault && !opts.dryRun {
 		requiredVars := utils.ExtractTemplateVars(workflowContent)
 
 		for _, v := range requiredVars {
+			// Step outputs are set while the workflow runs
+			if _, _, ok := workflow.ParseOutputVariable(v); ok {
+				continue
+			}
 			if _, exists := resolvedVars[v]; !exists {
-				fmt.Printf("%s: ", v)
-				resolvedVars[v] = readLine()
+				resolvedVars[v] = readVariable(v, configVariables)
+				variables[v] = resolvedVars[v]
 			}
 		}
 	}
 
-	// Execute the workflow based on its source
-	if dbErr == nil {
-		executeDBWorkflow(dbWf, resolvedVars)
-	} else {
-		executeYAMLWorkflow(fsWf, resolvedVars)
-	}
-}
-
-func executeDBWorkflow(dbWf *sqlite.Workflow, variables map[string]string) {
-	// Display workflow header
-	ui.WorkflowHeader(dbWf.Name, "run")
-	startTime := time.Now()
-
-	// Parse metadata to get the workflow content
-	metadataBytes, err := json.Marshal(dbWf.Metadata)
-	if err != nil {
-		utils.LogError(fmt.Sprintf("Failed to marshal workflow metadata: %v", err))
-		os.Exit(1)
-	}
-
-	// Convert the metadata back to a ProjectConfig (or similar structure)
-	var config workflow.ProjectConfig
-	if err := json.Unmarshal(metadataBytes, &config); err != nil {
-		utils.LogError(fmt.Sprintf("Failed to unmarshal workflow metadata: %v", err))
+	// The resolved values and the answers to the prompts are checked together
+	if err := workflow.ValidateVariables(configVariables, resolvedVars, sources); err != nil {
+		utils.LogError(err.Error())
 		os.Exit(1)
 	}
+	opts.secrets = workflow.SecretValues(resolvedVars, sources, configVariables)
 
-	// Create variable resolver for applying variables
-	varResolver := workflow.NewVariableResolver(sqlite.GetStorageService())
-
-	// Track precheck statistics
-	precheckCount := 0
-	prechecksPassed := 0
-	prechecksFailed := 0
-	prechecksWarn := 0
-
-	// Run pre-checks section
-	ui.SectionHeader("PRECHECKS")
-
-	for i, check := range config.PreChecks {
-		precheckStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(check.Command, variables)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to pre-check %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Execute the command using the execution package
-		precheckCount++
-		err = execution.ExecuteCommand(command)
-		duration := time.Since(precheckStartTime)
-
-		if err != nil {
-			ui.PrecheckResult(*check.Description, "fail", duration, "")
-			ui.LogErrorBordered(fmt.Sprintf("Pre-check %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if check.OnFail != "" {
-				if hookErr := executeHook(check.OnFail, config.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			prechecksFailed++
-			os.Exit(1)
-		} else {
-			ui.PrecheckResult(*check.Description, "ok", duration, "")
-			prechecksPassed++
-			ui.LogInfoBordered("Pre-check completed successfully")
-
-			// Run on_success hook if present
-			if check.OnSuccess != "" {
-				if hookErr := executeHook(check.OnSuccess, config.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_success hook failed: %v", i+1, hookErr))
-					os.Exit(1)
-				}
-			}
-		}
-	}
-
-	// Run steps section
-	scriptCount := len(config.Steps)
-	ui.SectionHeader("SCRIPTS")
-
-	for i, step := range config.Steps {
-		stepStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(step.Command, variables)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to step %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Display progress with elapsed time
-		ui.ScriptProgress(i+1, scriptCount, *step.Description, time.Since(stepStartTime))
-
-		// Execute the command using the execution package
-		err = execution.ExecuteCommand(command)
-
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Step %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if step.OnFail != "" {
-				if hookErr := executeHook(step.OnFail, config.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Step %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			os.Exit(1)
-		}
-		ui.LogInfoBordered("Step completed successfully")
-
-		// Run on_success hook if present
-		if step.OnSuccess != "" {
-			if hookErr := executeHook(step.OnSuccess, config.Actions, variables, varResolver); hookErr != nil {
-				ui.LogErrorBordered(fmt.Sprintf("Step %d on_success hook failed: %v", i+1, hookErr))
-				os.Exit(1)
-			}
-		}
+	if opts.shouldDetach(background) {
+		startDetachedRun(cmd, workflowName, workflowID, variables, vaultValues(resolvedVars, sources), opts.secrets)
+		return
 	}
 
-	// Display summary
-	totalDuration := time.Since(startTime)
-	ui.Summary("SUCCESS", totalDuration, prechecksPassed, prechecksFailed, prechecksWarn, scriptCount, scriptCount, "", "")
-
-	ui.LogSuccessBordered(fmt.Sprintf("Database workflow '%s' completed successfully", dbWf.Name))
-}
-
-func executeYAMLWorkflow(yamlWf *workflow.YAMLWorkflow, variables map[string]string) {
-	// Display workflow header
-	ui.WorkflowHeader(yamlWf.Name, "run")
-	startTime := time.Now()
-
-	// Create variable resolver for applying variables
-	varResolver := workflow.NewVariableResolver(sqlite.GetStorageService())
-
-	// Track precheck statistics
-	precheckCount := 0
-	prechecksPassed := 0
-	prechecksFailed := 0
-	prechecksWarn := 0
-
-	// Run pre-checks section
-	ui.SectionHeader("PRECHECKS")
-
-	for i, check := range yamlWf.PreChecks {
-		precheckStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(check.Command, variables)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to pre-check %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Execute the command using the execution package
-		precheckCount++
-		err = execution.ExecuteCommand(command)
-		duration := time.Since(precheckStartTime)
-
-		if err != nil {
-			ui.PrecheckResult(*check.Description, "fail", duration, "")
-			ui.LogErrorBordered(fmt.Sprintf("Pre-check %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if check.OnFail != "" {
-				if hookErr := executeHook(check.OnFail, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			prechecksFailed++
+	// Execute the workflow based on its source
+	kind, wf := "YAML workflow", fsWf
+	if dbErr == nil {
+		kind = "Database workflow"
+		if wf, err = dbWorkflowToYAML(dbWf); err != nil {
+			utils.LogError(err.Error())
 			os.Exit(1)
-		} else {
-			ui.PrecheckResult(*check.Description, "ok", duration, "")
-			prechecksPassed++
-			ui.LogInfoBordered("Pre-check completed successfully")
-
-			// Run on_success hook if present
-			if check.OnSuccess != "" {
-				if hookErr := executeHook(check.OnSuccess, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_success hook failed: %v", i+1, hookErr))
-					os.Exit(1)
-				}
-			}
 		}
 	}
 
-	// For YAML workflows without specific actions, run the main steps
-	// (Note: this function doesn't currently handle specific actions like the project workflow does)
-	scriptCount := len(yamlWf.Steps)
-	ui.SectionHeader("SCRIPTS")
-
-	for i, step := range yamlWf.Steps {
-		stepStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(step.Command, variables)
-		if err != nil {
-			utils.LogError(fmt.Sprintf("Failed to apply variables to step %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Display progress with elapsed time
-		ui.ScriptProgress(i+1, scriptCount, *step.Description, time.Since(stepStartTime))
-
-		// Execute the command using the execution package
-		err = execution.ExecuteCommand(command)
-
-		if err != nil {
-			utils.LogError(fmt.Sprintf("Step %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if step.OnFail != "" {
-				if hookErr := executeHook(step.OnFail, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Step %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			os.Exit(1)
-		}
-		utils.LogInfo("Step completed successfully")
-
-		// Run on_success hook if present
-		if step.OnSuccess != "" {
-			if hookErr := executeHook(step.OnSuccess, yamlWf.Actions, variables, varResolver); hookErr != nil {
-				ui.LogErrorBordered(fmt.Sprintf("Step %d on_success hook failed: %v", i+1, hookErr))
-				os.Exit(1)
-			}
-		}
+	if opts.dryRun {
+		planWorkflow(wf, workflowID, resolvedVars, sources, opts)
+		return
 	}
-
-	// Display summary
-	totalDuration := time.Since(startTime)
-	ui.Summary("SUCCESS", totalDuration, prechecksPassed, prechecksFailed, prechecksWarn, scriptCount, scriptCount, "", "")
-
-	ui.LogSuccessBordered(fmt.Sprintf("YAML workflow '%s' completed successfully", yamlWf.Name))
+	runWorkflow(kind, wf, workflowID, resolvedVars, variables, opts)
 }
 
 func handleRunProjectWorkflow(cmd *cobra.Command) {
@@ -473,24 +347,38 @@ func handleRunProjectWorkflow(cmd *cobra.Command) {
 		variables[parts[0]] = parts[1]
 	}
 
-	// Create variable resolver
+	opts := runOptionsFromFlags(cmd)
+	var detachedVault map[string]string
+	if opts.runID != 0 {
+		detachedVault = inheritDetachedVars(variables)
+	}
+
+	// Create variable resolver. A background run takes the vault values read
+	// by the command that started it.
 	varResolver := workflow.NewVariableResolver(storage)
+	varResolver.UseVaultValues(detachedVault)
 
 	// Determine workflow ID (for project workflow, use name as ID for variable resolution)
 	workflowID := projWf.Name
 
+	if opts.resume != 0 {
+		inheritResumedVars(opts.resume, workflowID, variables)
+	}
+
 	// Resolve variables based on workflow configuration
-	resolvedVars, err := varResolver.ResolveVariables(workflowID, projWf.UseVault, variables, projWf.Config.Variables)
+	resolvedVars, sources, err := varResolver.ResolveVariablesWithSources(workflowID, projWf.UseVault, variables, projWf.Config.Variables)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to resolve variables: %v", err))
 		os.Exit(1)
 	}
 
-	// If there are still missing variables, prompt for them if not using vault
-	if !projWf.UseVault {
+	// If there are still missing variables, prompt for them if not using vault.
+	// A dry run reports them instead.
+	if !projWf.UseVault && !opts.dryRun {
 		var workflowContent string
 		for _, step := range projWf.Steps {
 			workflowContent += step.Command + "\n"
+			workflowContent += step.When + "\n"
 		}
 		for _, check := range projWf.PreChecks {
 			workflowContent += check.Command + "\n"
@@ -498,218 +386,44 @@ func handleRunProjectWorkflow(cmd *cobra.Command) {
 		for _, action := range projWf.Actions {
 			workflowContent += action.Command + "\n"
 		}
+		for _, step := range projWf.HookSteps() {
+			workflowContent += step.Command + "\n"
+		}
+		workflowContent += settingsText(projWf)
 
 		requiredVars := utils.ExtractTemplateVars(workflowContent)
 
 		for _, v := range requiredVars {
+			// Step outputs are set while the workflow runs
+			if _, _, ok := workflow.ParseOutputVariable(v); ok {
+				continue
+			}
 			if _, exists := resolvedVars[v]; !exists {
-				fmt.Printf("%s: ", v)
-				resolvedVars[v] = readLine()
+				resolvedVars[v] = readVariable(v, projWf.Config.Variables)
+				variables[v] = resolvedVars[v]
 			}
 		}
 	}
 
-	// Execute the project workflow
-	executeProjectYAMLWorkflow(projWf, resolvedVars, cmd)
-}
-
-func executeProjectYAMLWorkflow(yamlWf *workflow.YAMLWorkflow, variables map[string]string, cmd *cobra.Command) {
-	// Display workflow header
-	ui.WorkflowHeader(yamlWf.Name, "run")
-	startTime := time.Now()
-
-	// Create variable resolver for applying variables
-	varResolver := workflow.NewVariableResolver(sqlite.GetStorageService())
-
-	// Check if specific action is requested
-	actionFlags, err := cmd.Flags().GetStringArray("action")
-	if err != nil {
-		utils.LogError(fmt.Sprintf("Failed to get action flags: %v", err))
+	// The resolved values and the answers to the prompts are checked together
+	if err := workflow.ValidateVariables(projWf.Config.Variables, resolvedVars, sources); err != nil {
+		utils.LogError(err.Error())
 		os.Exit(1)
 	}
+	opts.secrets = workflow.SecretValues(resolvedVars, sources, projWf.Config.Variables)
 
-	// Track precheck statistics
-	precheckCount := 0
-	prechecksPassed := 0
-	prechecksFailed := 0
-	prechecksWarn := 0
-
-	// Run pre-checks section (always run pre-checks regardless of whether actions or main steps are being run)
-	ui.SectionHeader("PRECHECKS")
-
-	for i, check := range yamlWf.PreChecks {
-		precheckStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(check.Command, variables)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to pre-check %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Execute the command using the execution package
-		precheckCount++
-		err = execution.ExecuteCommand(command)
-		duration := time.Since(precheckStartTime)
-
-		if err != nil {
-			ui.PrecheckResult(*check.Description, "fail", duration, "")
-			ui.LogErrorBordered(fmt.Sprintf("Pre-check %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if check.OnFail != "" {
-				if hookErr := executeHook(check.OnFail, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			prechecksFailed++
-			os.Exit(1)
-		} else {
-			ui.PrecheckResult(*check.Description, "ok", duration, "")
-			prechecksPassed++
-			ui.LogInfoBordered("Pre-check completed successfully")
-
-			// Run on_success hook if present
-			if check.OnSuccess != "" {
-				if hookErr := executeHook(check.OnSuccess, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_success hook failed: %v", i+1, hookErr))
-					os.Exit(1)
-				}
-			}
-		}
-	}
-
-	// Check if specific action is requested (after running pre-checks)
-	if len(actionFlags) > 0 {
-		// Run specific action instead of main steps (but after pre-checks)
-		ui.SectionHeader("ACTIONS")
-
-		for _, actionName := range actionFlags {
-			if action, exists := yamlWf.Actions[actionName]; exists {
-				actionStartTime := time.Now()
-				command, err := varResolver.ApplyVariables(action.Command, variables)
-				if err != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to action %s: %v", actionName, err))
-					os.Exit(1)
-				}
-
-				// Display action progress with elapsed time
-				ui.ScriptProgress(1, 1, *action.Description, time.Since(actionStartTime))
-
-				// Execute the command using the execution package
-				err = execution.ExecuteCommand(command)
-
-				if err != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Action '%s' failed: %v", actionName, err))
-
-					// Run on_fail hook if present
-					if action.OnFail != "" {
-						if hookErr := executeHook(action.OnFail, yamlWf.Actions, variables, varResolver); hookErr != nil {
-							ui.LogErrorBordered(fmt.Sprintf("Action '%s' on_fail hook failed: %v", actionName, hookErr))
-						}
-					}
-
-					os.Exit(1)
-				}
-				ui.LogInfoBordered("Action completed successfully")
-
-				// Run on_success hook if present
-				if action.OnSuccess != "" {
-					if hookErr := executeHook(action.OnSuccess, yamlWf.Actions, variables, varResolver); hookErr != nil {
-						ui.LogErrorBordered(fmt.Sprintf("Action '%s' on_success hook failed: %v", actionName, hookErr))
-						os.Exit(1)
-					}
-				}
-			} else {
-				ui.LogErrorBordered(fmt.Sprintf("Action '%s' not found in workflow", actionName))
-				os.Exit(1)
-			}
-		}
-		ui.LogSuccessBordered(fmt.Sprintf("Project workflow actions completed successfully"))
+	if opts.shouldDetach(projWf.Config.Background) {
+		startDetachedRun(cmd, "", workflowID, variables, vaultValues(resolvedVars, sources), opts.secrets)
 		return
 	}
 
-	// Run steps section (only if no actions were specified)
-	scriptCount := len(yamlWf.Steps)
-	ui.SectionHeader("SCRIPTS")
-
-	for i, step := range yamlWf.Steps {
-		stepStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(step.Command, variables)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to step %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		// Display progress with elapsed time
-		ui.ScriptProgress(i+1, scriptCount, *step.Description, time.Since(stepStartTime))
-
-		// Execute the command using the execution package
-		err = execution.ExecuteCommand(command)
-
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Step %d failed: %v", i+1, err))
-
-			// Run on_fail hook if present
-			if step.OnFail != "" {
-				if hookErr := executeHook(step.OnFail, yamlWf.Actions, variables, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Step %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-
-			os.Exit(1)
-		}
-		ui.LogInfoBordered("Step completed successfully")
-
-		// Run on_success hook if present
-		if step.OnSuccess != "" {
-			if hookErr := executeHook(step.OnSuccess, yamlWf.Actions, variables, varResolver); hookErr != nil {
-				ui.LogErrorBordered(fmt.Sprintf("Step %d on_success hook failed: %v", i+1, hookErr))
-				os.Exit(1)
-			}
-		}
-	}
-
-	// Display summary
-	totalDuration := time.Since(startTime)
-	ui.Summary("SUCCESS", totalDuration, prechecksPassed, prechecksFailed, prechecksWarn, scriptCount, scriptCount, "", "")
-
-	ui.LogSuccessBordered(fmt.Sprintf("Project workflow '%s' completed successfully", yamlWf.Name))
-}
-
-func executeHook(hook string, actions map[string]workflow.YAMLStep, variables map[string]string, varResolver *workflow.VariableResolver) error {
-	if hook == "" {
-		return nil
-	}
-
-	if strings.HasPrefix(hook, "action:") {
-		actionName := strings.TrimPrefix(hook, "action:")
-		action, ok := actions[actionName]
-		if !ok {
-			return fmt.Errorf("action '%s' not found", actionName)
-		}
-
-		ui.LogInfoBordered(fmt.Sprintf("Executing hook action: %s", actionName))
-
-		command, err := varResolver.ApplyVariables(action.Command, variables)
-		if err != nil {
-			return fmt.Errorf("failed to apply variables to action %s: %v", actionName, err)
-		}
-
-		return execution.ExecuteCommand(command)
-	} else if strings.HasPrefix(hook, "run:") {
-		commandRaw := strings.TrimPrefix(hook, "run:")
-
-		ui.LogInfoBordered(fmt.Sprintf("Executing hook command: %s", commandRaw))
-
-		command, err := varResolver.ApplyVariables(commandRaw, variables)
-		if err != nil {
-			return fmt.Errorf("failed to apply variables to hook command: %v", err)
-		}
-
-		return execution.ExecuteCommand(command)
+	if opts.dryRun {
+		planWorkflow(projWf, workflowID, resolvedVars, sources, opts)
+		return
 	}
 
-	return fmt.Errorf("unknown hook format: %s (must start with 'action:' or 'run:')", hook)
+	// Execute the project workflow
+	runWorkflow("Project workflow", projWf, workflowID, resolvedVars, variables, opts)
 }
 
 func handleRunProjectPreChecks(cmd *cobra.Command) {
@@ -751,7 +465,7 @@ func handleRunProjectPreChecks(cmd *cobra.Command) {
 	varResolver := workflow.NewVariableResolver(storage)
 
 	// Resolve variables
-	resolvedVars, err := varResolver.ResolveVariables(projWf.Name, projWf.UseVault, variables, projWf.Config.Variables)
+	resolvedVars, sources, err := varResolver.ResolveVariablesWithSources(projWf.Name, projWf.UseVault, variables, projWf.Config.Variables)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to resolve variables: %v", err))
 		os.Exit(1)
@@ -759,64 +473,21 @@ func handleRunProjectPreChecks(cmd *cobra.Command) {
 
 	// If there are still missing variables, prompt for them if not using vault
 	if !projWf.UseVault {
-		workflowContent := ""
-		for _, check := range projWf.PreChecks {
-			workflowContent += check.Command + "\n"
-		}
-		requiredVars := utils.ExtractTemplateVars(workflowContent)
+		requiredVars := utils.ExtractTemplateVars(preCheckText(projWf))
 		for _, v := range requiredVars {
 			if _, exists := resolvedVars[v]; !exists {
-				fmt.Printf("%s: ", v)
-				resolvedVars[v] = readLine()
+				resolvedVars[v] = readVariable(v, projWf.Config.Variables)
 			}
 		}
 	}
 
-	// Run pre-checks
-	ui.WorkflowHeader(projWf.Name, "pre-check")
-	
-	prechecksPassed := 0
-	prechecksFailed := 0
-	
-	ui.SectionHeader("PRECHECKS")
-
-	for i, check := range projWf.PreChecks {
-		precheckStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(check.Command, resolvedVars)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to pre-check %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		err = execution.ExecuteCommand(command)
-		duration := time.Since(precheckStartTime)
-
-		if err != nil {
-			ui.PrecheckResult(*check.Description, "fail", duration, "")
-			ui.LogErrorBordered(fmt.Sprintf("Pre-check %d failed: %v", i+1, err))
-			
-			if check.OnFail != "" {
-				if hookErr := executeHook(check.OnFail, projWf.Actions, resolvedVars, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-			
-			prechecksFailed++
-			os.Exit(1)
-		} else {
-			ui.PrecheckResult(*check.Description, "ok", duration, "")
-			prechecksPassed++
-			
-			if check.OnSuccess != "" {
-				if hookErr := executeHook(check.OnSuccess, projWf.Actions, resolvedVars, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_success hook failed: %v", i+1, hookErr))
-					os.Exit(1)
-				}
-			}
-		}
+	// The resolved values and the answers to the prompts are checked together
+	if err := workflow.ValidateVariables(projWf.Config.Variables, resolvedVars, sources); err != nil {
+		utils.LogError(err.Error())
+		os.Exit(1)
 	}
 
-	ui.LogSuccessBordered("All pre-checks passed successfully")
+	runPreChecks(projWf, resolvedVars, workflow.SecretValues(resolvedVars, sources, projWf.Config.Variables))
 }
 
 func handleRunWorkflowPreChecksFromStoredDirectory(workflowName string, cmd *cobra.Command) {
@@ -832,30 +503,16 @@ func handleRunWorkflowPreChecksFromStoredDirectory(workflowName string, cmd *cob
 		os.Exit(1)
 	}
 
-	// Prefer database workflow
-	var useVault bool
-	var configVariables map[string]interface{}
-	var workflowID string
-	var preChecks []workflow.YAMLStep
-	var actions map[string]workflow.YAMLStep
-
+	// Prefer database workflow. The pre-checks run with the dir, env, shell
+	// and config of the whole workflow, as they do in a full run.
+	wf, workflowID := fsWf, workflowName
 	if dbErr == nil {
-		useVault = dbWf.UseVault
 		workflowID = dbWf.ID
-		
-		metadataBytes, _ := json.Marshal(dbWf.Metadata)
-		var config workflow.ProjectConfig
-		if err := json.Unmarshal(metadataBytes, &config); err == nil {
-			configVariables = config.Config.Variables
-			preChecks = config.PreChecks
-			actions = config.Actions
+		var err error
+		if wf, err = dbWorkflowToYAML(dbWf); err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
 		}
-	} else {
-		useVault = fsWf.UseVault
-		workflowID = workflowName
-		configVariables = fsWf.Config.Variables
-		preChecks = fsWf.PreChecks
-		actions = fsWf.Actions
 	}
 
 	// Process variables from flags
@@ -879,67 +536,29 @@ func handleRunWorkflowPreChecksFromStoredDirectory(workflowName string, cmd *cob
 	varResolver := workflow.NewVariableResolver(storage)
 
 	// Resolve variables
-	resolvedVars, err := varResolver.ResolveVariables(workflowID, useVault, variables, configVariables)
+	resolvedVars, sources, err := varResolver.ResolveVariablesWithSources(workflowID, wf.UseVault, variables, wf.Config.Variables)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to resolve variables: %v", err))
 		os.Exit(1)
 	}
 
 	// If missing variables, prompt
-	if !useVault {
-		workflowContent := ""
-		for _, check := range preChecks {
-			workflowContent += check.Command + "\n"
-		}
-		requiredVars := utils.ExtractTemplateVars(workflowContent)
+	if !wf.UseVault {
+		requiredVars := utils.ExtractTemplateVars(preCheckText(wf))
 		for _, v := range requiredVars {
 			if _, exists := resolvedVars[v]; !exists {
-				fmt.Printf("%s: ", v)
-				resolvedVars[v] = readLine()
+				resolvedVars[v] = readVariable(v, wf.Config.Variables)
 			}
 		}
 	}
 
-	// Run pre-checks
-	ui.WorkflowHeader(workflowName, "pre-check")
-	
-	ui.SectionHeader("PRECHECKS")
-
-	for i, check := range preChecks {
-		precheckStartTime := time.Now()
-		command, err := varResolver.ApplyVariables(check.Command, resolvedVars)
-		if err != nil {
-			ui.LogErrorBordered(fmt.Sprintf("Failed to apply variables to pre-check %d: %v", i+1, err))
-			os.Exit(1)
-		}
-
-		err = execution.ExecuteCommand(command)
-		duration := time.Since(precheckStartTime)
-
-		if err != nil {
-			ui.PrecheckResult(*check.Description, "fail", duration, "")
-			ui.LogErrorBordered(fmt.Sprintf("Pre-check %d failed: %v", i+1, err))
-			
-			if check.OnFail != "" {
-				if hookErr := executeHook(check.OnFail, actions, resolvedVars, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_fail hook failed: %v", i+1, hookErr))
-				}
-			}
-			
-			os.Exit(1)
-		} else {
-			ui.PrecheckResult(*check.Description, "ok", duration, "")
-			
-			if check.OnSuccess != "" {
-				if hookErr := executeHook(check.OnSuccess, actions, resolvedVars, varResolver); hookErr != nil {
-					ui.LogErrorBordered(fmt.Sprintf("Pre-check %d on_success hook failed: %v", i+1, hookErr))
-					os.Exit(1)
-				}
-			}
-		}
+	// The resolved values and the answers to the prompts are checked together
+	if err := workflow.ValidateVariables(wf.Config.Variables, resolvedVars, sources); err != nil {
+		utils.LogError(err.Error())
+		os.Exit(1)
 	}
 
-	ui.LogSuccessBordered("All pre-checks passed successfully")
+	runPreChecks(wf, resolvedVars, workflow.SecretValues(resolvedVars, sources, wf.Config.Variables))
 }
 
 func handleWorkflowInfoV2(workflowName string) {
@@ -968,6 +587,8 @@ func handleWorkflowInfoV2(workflowName string) {
 			fmt.Printf("Pre-checks: %d\n", len(config.PreChecks))
 			fmt.Printf("Steps: %d\n", len(config.Steps))
 			fmt.Printf("Actions: %d\n", len(config.Actions))
+			fmt.Printf("Hooks: %d on_success, %d on_failure, %d finally\n", len(config.OnSuccess), len(config.OnFailure), len(config.Finally))
+			printVariableDeclarations(config.Config.Variables)
 		}
 	} else {
 		fmt.Printf("Source: Local File\n")
@@ -981,5 +602,24 @@ func handleWorkflowInfoV2(workflowName string) {
 		fmt.Printf("Pre-checks: %d\n", len(fsWf.PreChecks))
 		fmt.Printf("Steps: %d\n", len(fsWf.Steps))
 		fmt.Printf("Actions: %d\n", len(fsWf.Actions))
+		fmt.Printf("Hooks: %d on_success, %d on_failure, %d finally\n", len(fsWf.OnSuccess), len(fsWf.OnFailure), len(fsWf.Finally))
+		printVariableDeclarations(fsWf.Config.Variables)
+	}
+}
+
+// printVariableDeclarations lists the config variables of a workflow with
+// their type, whether they are required and their description
+func printVariableDeclarations(configVariables map[string]interface{}) {
+	if len(configVariables) == 0 {
+		return
+	}
+	declarations, err := workflow.ParseVariableDeclarations(configVariables)
+	if err != nil {
+		fmt.Printf("Variables: %v\n", err)
+		return
+	}
+	fmt.Printf("Variables:\n")
+	for _, d := range declarations {
+		fmt.Printf("  %-20s %s\n", d.Name, d.Describe())
 	}
 }
@@ -17,8 +17,9 @@ var kvCmd = &cobra.Command{
 }
 
 var logsCmd = &cobra.Command{
-	Use:   "logs",
-	Short: "Returns recent kv store logs",
+	Use:        "logs",
+	Short:      "Returns recent kv store logs",
+	Deprecated: "it reads the legacy Badger log; use 'migraine runs' to inspect workflow runs",
 	Run: func(cmd *cobra.Command, args []string) {
 		err := displayRecentLogs(20)
 
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tesh254/migraine/internal/engine"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/ui"
+	"github.com/tesh254/migraine/internal/workflow"
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+// planWorkflow prints what running the workflow would execute, without
+// running anything, and exits with a non-zero code when a command could not
+// be resolved. sources tells where each variable came from. With
+// --output json the plan is written as a single JSON object instead.
+func planWorkflow(wf *workflow.YAMLWorkflow, workflowID string, variables, sources map[string]string, opts runOptions) {
+	runner := engine.New(engine.Options{
+		Store:    sqlite.GetStorageService().RunStore(),
+		Resolver: workflow.NewVariableResolver(sqlite.GetStorageService()),
+	})
+	plan := runner.Plan(engine.Request{
+		Workflow:   wf,
+		WorkflowID: workflowID,
+		Variables:  variables,
+		Actions:    opts.actions,
+		Selection:  opts.selection,
+		ResumeFrom: opts.resume,
+		FromStep:   opts.fromStep,
+		NoSudo:     opts.noSudo,
+		Secrets:    opts.secrets,
+	}, sources)
+
+	if opts.output == outputJSON {
+		if err := json.NewEncoder(jsonOutput).Encode(plan); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to encode plan: %v", err))
+			os.Exit(1)
+		}
+	} else {
+		printPlan(plan, opts.selection)
+	}
+
+	if !plan.Valid() {
+		os.Exit(1)
+	}
+}
+
+// printPlan prints a plan in the same layout as a run
+func printPlan(plan *engine.Plan, selection workflow.StepSelection) {
+	if selection.IsZero() {
+		ui.WorkflowHeader(plan.Workflow, "dry-run")
+	} else {
+		ui.WorkflowHeader(plan.Workflow, "dry-run", "STEPS: "+selection.String())
+	}
+
+	ui.SectionHeader("VARIABLES")
+	if len(plan.Variables) == 0 && len(plan.Missing) == 0 {
+		fmt.Println("  (none)")
+	}
+	for _, v := range plan.Variables {
+		ui.PlanVariable(v.Name, v.Value, v.Source)
+	}
+	for _, name := range plan.Missing {
+		ui.PlanVariable(name, "<missing>", "")
+	}
+
+	if len(plan.PreChecks) > 0 {
+		ui.SectionHeader("PRECHECKS")
+		printPlannedSteps(plan.PreChecks)
+	}
+	if len(plan.Actions) > 0 {
+		ui.SectionHeader("ACTIONS")
+		printPlannedSteps(plan.Actions)
+	} else if len(plan.Steps) > 0 {
+		ui.SectionHeader("SCRIPTS")
+		printPlannedSteps(plan.Steps)
+	}
+	for _, hook := range []struct {
+		title string
+		steps []engine.PlannedStep
+	}{{"ON SUCCESS", plan.OnSuccess}, {"ON FAILURE", plan.OnFailure}, {"FINALLY", plan.Finally}} {
+		if len(hook.steps) > 0 {
+			ui.SectionHeader(hook.title)
+			printPlannedSteps(hook.steps)
+		}
+	}
+
+	if plan.Error != "" {
+		fmt.Println()
+		utils.LogError(plan.Error)
+	}
+	if !plan.Valid() {
+		ui.Status("Dry run found problems that would stop the workflow; nothing was executed")
+		return
+	}
+	ui.Status("Dry run: nothing was executed")
+}
+
+func printPlannedSteps(steps []engine.PlannedStep) {
+	for _, step := range steps {
+		name := step.Name
+		if step.Sudo {
+			name += " [sudo]"
+		}
+		ui.PlanStep(step.Position, len(steps), name, step.Command)
+		if step.Skip != "" {
+			ui.PlanDetail("skipped", step.Skip)
+		}
+		if step.Error != "" {
+			ui.PlanProblem(step.Error)
+		}
+		if step.StepID != "" && step.Phase != sqlite.RunPhaseAction {
+			ui.PlanDetail("id", step.StepID)
+		}
+		if len(step.Needs) > 0 {
+			ui.PlanDetail("needs", strings.Join(step.Needs, ", "))
+		}
+		if step.When != "" {
+			ui.PlanDetail("when", step.When)
+		}
+		if step.Dir != "" {
+			ui.PlanDetail("dir", step.Dir)
+		}
+		for _, env := range step.Env {
+			ui.PlanDetail("env", env)
+		}
+		if step.Shell != "" {
+			ui.PlanDetail("shell", step.Shell)
+		}
+		if step.Timeout != "" {
+			ui.PlanDetail("timeout", step.Timeout)
+		}
+		if step.Retry != "" {
+			ui.PlanDetail("retry", step.Retry)
+		}
+		if step.AllowFailure {
+			if step.Phase == sqlite.RunPhasePrecheck {
+				ui.PlanDetail("severity", workflow.SeverityWarn)
+			} else {
+				ui.PlanDetail("allow_failure", "true")
+			}
+		}
+		names := make([]string, 0, len(step.Outputs))
+		for name := range step.Outputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ui.PlanDetail("output", fmt.Sprintf("%s <- %s", name, step.Outputs[name]))
+		}
+		for _, hook := range step.Hooks {
+			text := hook.Hook
+			if strings.HasPrefix(hook.Hook, "action:") && hook.Command != "" {
+				text = fmt.Sprintf("%s -> %s", hook.Hook, hook.Command)
+			} else if hook.Command != "" {
+				text = "run:" + hook.Command
+			}
+			ui.PlanDetail(hook.Trigger, text)
+			if hook.Error != "" {
+				ui.PlanProblem(fmt.Sprintf("%s: %s", hook.Trigger, hook.Error))
+			}
+		}
+	}
+}
@@ -20,6 +20,5 @@ var runCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(runCmd)
-	runCmd.Flags().StringArrayP("var", "v", []string{}, "Variables in KEY=VALUE format")
-	runCmd.Flags().StringArrayP("action", "a", []string{}, "Action to run")
+	addRunFlags(runCmd)
 }
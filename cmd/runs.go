@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/ui"
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+var runsCmd = &cobra.Command{
+	Use:     "runs",
+	Aliases: []string{"history"},
+	Short:   "Inspect workflow run history",
+}
+
+var runsListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List recent workflow runs",
+	Run: func(cmd *cobra.Command, args []string) {
+		workflowID, _ := cmd.Flags().GetString("workflow")
+		status, _ := cmd.Flags().GetString("status")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		runs, err := sqlite.GetStorageService().RunStore().FilterRuns(sqlite.RunFilter{
+			WorkflowID: workflowID,
+			Status:     status,
+			Limit:      limit,
+		})
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to list runs: %v", err))
+			os.Exit(1)
+		}
+
+		if len(runs) == 0 {
+			fmt.Println("No runs found.")
+			return
+		}
+
+		ui.SectionHeader("RUNS")
+		fmt.Printf("  %-6s %-24s %-9s %-19s %-9s %s\n", "ID", "WORKFLOW", "STATUS", "STARTED", "DURATION", "BY")
+		for _, run := range runs {
+			fmt.Printf("  %-6d %-24s %-9s %-19s %-9s %s\n",
+				run.ID,
+				truncate(run.WorkflowID, 24),
+				run.Status,
+				run.StartedAt.Local().Format("2006-01-02 15:04:05"),
+				runDuration(run),
+				run.TriggeredBy)
+		}
+	},
+}
+
+var runsShowCmd = &cobra.Command{
+	Use:   "show [id]",
+	Short: "Show a run with per-step timings and exit codes",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseRunID(args[0])
+		store := sqlite.GetStorageService().RunStore()
+
+		run, err := store.GetRun(id)
+		if err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
+		}
+
+		steps, err := store.ListRunSteps(id)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to load run steps: %v", err))
+			os.Exit(1)
+		}
+
+		ui.SectionHeader(fmt.Sprintf("RUN #%d", run.ID))
+		fmt.Printf("  Workflow: %s\n", run.WorkflowID)
+		fmt.Printf("  Status:   %s\n", run.Status)
+		fmt.Printf("  Started:  %s\n", run.StartedAt.Local().Format("2006-01-02 15:04:05"))
+		if run.CompletedAt != nil {
+			fmt.Printf("  Finished: %s\n", run.CompletedAt.Local().Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf("  Duration: %s\n", runDuration(*run))
+		if run.TriggeredBy != "" {
+			fmt.Printf("  By:       %s\n", run.TriggeredBy)
+		}
+		if run.ResumedFrom != 0 {
+			fmt.Printf("  Resumes:  #%d\n", run.ResumedFrom)
+		}
+
+		if len(steps) == 0 {
+			return
+		}
+
+		ui.SectionHeader("STEPS")
+		fmt.Printf("  %-10s %-4s %-32s %-4s %-9s %-5s %s\n", "PHASE", "#", "DESCRIPTION", "TRY", "STATUS", "EXIT", "DURATION")
+		for _, step := range steps {
+			exitCode := "-"
+			if step.ExitCode != nil {
+				exitCode = strconv.Itoa(*step.ExitCode)
+			}
+
+			duration := "-"
+			if step.CompletedAt != nil {
+				duration = ui.FormatDuration(step.CompletedAt.Sub(step.StartedAt))
+			}
+
+			fmt.Printf("  %-10s %-4d %-32s %-4d %-9s %-5s %s\n",
+				step.Phase,
+				step.Position,
+				truncate(step.Description, 32),
+				step.Attempt,
+				step.Status,
+				exitCode,
+				duration)
+			if step.Error != nil {
+				fmt.Printf("         -> %s\n", *step.Error)
+			}
+			if len(step.Outputs) > 0 {
+				fmt.Printf("         outputs: %s\n", outputsText(step.Outputs))
+			}
+		}
+	},
+}
+
+var runsTailCmd = &cobra.Command{
+	Use:   "tail [id]",
+	Short: "Print the stored logs of a run",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseRunID(args[0])
+		lines, _ := cmd.Flags().GetInt("lines")
+		follow, _ := cmd.Flags().GetBool("follow")
+		store := sqlite.GetStorageService().RunStore()
+
+		run, err := store.GetRun(id)
+		if err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
+		}
+
+		printed := printLogTail(run, lines, 0)
+		for follow && run.Status == sqlite.RunStatusRunning {
+			time.Sleep(time.Second)
+			if run, err = store.GetRun(id); err != nil {
+				utils.LogError(err.Error())
+				os.Exit(1)
+			}
+			printed = printLogTail(run, -1, printed)
+		}
+
+		if printed == 0 && !follow {
+			fmt.Println("No logs stored for this run. Enable 'store_logs' in the workflow config to capture output.")
+		}
+	},
+}
+
+var runsAttachCmd = &cobra.Command{
+	Use:   "attach [id]",
+	Short: "Follow the output of a background run until it finishes",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseRunID(args[0])
+		store := sqlite.GetStorageService().RunStore()
+
+		run, err := store.GetRun(id)
+		if err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
+		}
+
+		if run.LogPath == "" {
+			utils.LogError(fmt.Sprintf("Run #%d was not started in the background; use 'migraine runs tail %d' instead", id, id))
+			os.Exit(1)
+		}
+
+		logFile, err := os.Open(run.LogPath)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to open run log: %v", err))
+			os.Exit(1)
+		}
+		defer logFile.Close()
+
+		// Ctrl-C only stops following, the run itself keeps going
+		for {
+			copied, err := io.Copy(os.Stdout, logFile)
+			if err != nil {
+				utils.LogError(fmt.Sprintf("Failed to read run log: %v", err))
+				os.Exit(1)
+			}
+			if copied > 0 {
+				continue
+			}
+
+			// The command line of the process cannot always be read, in
+			// which case a live process is taken to be the run
+			if alive, _ := runProcessAlive(run); run.Status != sqlite.RunStatusRunning || !alive {
+				break
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			if run, err = store.GetRun(id); err != nil {
+				utils.LogError(err.Error())
+				os.Exit(1)
+			}
+		}
+
+		// Pick up anything written between the last read and the exit
+		io.Copy(os.Stdout, logFile)
+
+		if run.Status == sqlite.RunStatusRunning {
+			utils.LogWarning(fmt.Sprintf("Run #%d is marked as running but its process (pid %d) has exited", id, run.PID))
+			return
+		}
+		utils.LogInfo(fmt.Sprintf("Run #%d finished with status: %s", id, run.Status))
+	},
+}
+
+var runsCancelCmd = &cobra.Command{
+	Use:   "cancel [id]",
+	Short: "Stop a background run",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseRunID(args[0])
+		store := sqlite.GetStorageService().RunStore()
+
+		run, err := store.GetRun(id)
+		if err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
+		}
+
+		if run.Status != sqlite.RunStatusRunning {
+			utils.LogError(fmt.Sprintf("Run #%d is not running (status: %s)", id, run.Status))
+			os.Exit(1)
+		}
+		if run.PID == 0 {
+			utils.LogError(fmt.Sprintf("Run #%d was not started in the background and cannot be cancelled from here", id))
+			os.Exit(1)
+		}
+
+		alive, err := runProcessAlive(run)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Cannot check that pid %d still carries out run #%d: %v", run.PID, id, err))
+			os.Exit(1)
+		}
+		if alive {
+			if err := execution.TerminateProcessGroup(run.PID); err != nil {
+				utils.LogError(fmt.Sprintf("Failed to stop run #%d (pid %d): %v", id, run.PID, err))
+				os.Exit(1)
+			}
+		}
+
+		if err := store.CancelRun(id); err != nil {
+			utils.LogError(err.Error())
+			os.Exit(1)
+		}
+
+		utils.LogSuccess(fmt.Sprintf("Cancelled run #%d", id))
+	},
+}
+
+var runsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete finished runs older than a given age",
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThan, _ := cmd.Flags().GetString("older-than")
+
+		age, err := utils.ParseDuration(olderThan)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Invalid --older-than value: %v", err))
+			os.Exit(1)
+		}
+
+		deleted, logPaths, err := sqlite.GetStorageService().RunStore().DeleteRunsBefore(time.Now().Add(-age))
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to prune runs: %v", err))
+			os.Exit(1)
+		}
+
+		// Background runs leave their output in a log file
+		for _, path := range logPaths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				utils.LogWarning(fmt.Sprintf("Failed to remove run log %s: %v", path, err))
+			}
+		}
+
+		utils.LogSuccess(fmt.Sprintf("Pruned %d run(s) older than %s", deleted, olderThan))
+	},
+}
+
+// printLogTail prints the stored log lines of a run, skipping the first
+// `skip` lines. With limit >= 0 only the last `limit` lines are printed.
+// It returns the total number of log lines seen so far.
+func printLogTail(run *sqlite.Run, limit, skip int) int {
+	if run.Logs == nil || *run.Logs == "" {
+		return skip
+	}
+
+	logLines := strings.Split(strings.TrimRight(*run.Logs, "\n"), "\n")
+	if skip >= len(logLines) {
+		return len(logLines)
+	}
+
+	start := skip
+	if limit >= 0 && len(logLines)-limit > start {
+		start = len(logLines) - limit
+	}
+
+	for _, line := range logLines[start:] {
+		fmt.Println(line)
+	}
+
+	return len(logLines)
+}
+
+// runProcessAlive reports whether the process recorded for a background run
+// still carries it out. PIDs are reused once a process exits, so a live
+// process must also have been started with the --run-id of the run. err is
+// set when the command line of a live process cannot be read.
+func runProcessAlive(run *sqlite.Run) (bool, error) {
+	if !execution.ProcessAlive(run.PID) {
+		return false, nil
+	}
+	command, err := execution.ProcessCommandLine(run.PID)
+	if err != nil {
+		return true, err
+	}
+	return slices.Contains(strings.Fields(command), fmt.Sprintf("--run-id=%d", run.ID)), nil
+}
+
+func parseRunID(arg string) int64 {
+	id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Invalid run id: %s", arg))
+		os.Exit(1)
+	}
+	return id
+}
+
+func runDuration(run sqlite.Run) string {
+	if run.CompletedAt == nil {
+		return run.Status
+	}
+	return ui.FormatDuration(run.CompletedAt.Sub(run.StartedAt))
+}
+
+// truncate shortens s to length characters, cutting between runes so that
+// multi-byte characters are kept whole
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length-3]) + "..."
+}
+
+func init() {
+	runsListCmd.Flags().StringP("workflow", "w", "", "Only show runs of this workflow")
+	runsListCmd.Flags().StringP("status", "s", "", "Only show runs with this status (running, success, warning, failed, timed_out, cancelled)")
+	runsListCmd.Flags().IntP("limit", "n", 20, "Maximum number of runs to show")
+
+	runsTailCmd.Flags().IntP("lines", "n", 50, "Number of log lines to show")
+	runsTailCmd.Flags().BoolP("follow", "f", false, "Keep printing new log lines until the run finishes")
+
+	runsPruneCmd.Flags().String("older-than", "", "Delete runs started before this age, with a unit (e.g. 30d, 12h)")
+	runsPruneCmd.MarkFlagRequired("older-than")
+
+	rootCmd.AddCommand(runsCmd)
+	runsCmd.AddCommand(runsListCmd)
+	runsCmd.AddCommand(runsShowCmd)
+	runsCmd.AddCommand(runsTailCmd)
+	runsCmd.AddCommand(runsAttachCmd)
+	runsCmd.AddCommand(runsCancelCmd)
+	runsCmd.AddCommand(runsPruneCmd)
+}
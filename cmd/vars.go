@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
 	"github.com/tesh254/migraine/pkg/utils"
+	"golang.org/x/term"
 )
 
 var varsCmd = &cobra.Command{
@@ -24,16 +28,17 @@ var varsGetCmd = &cobra.Command{
 		scope, _ := cmd.Flags().GetString("scope")
 		workflowID, _ := cmd.Flags().GetString("workflow")
 
-		var workflowIDPtr *string
-		if workflowID != "" {
-			workflowIDPtr = &workflowID
+		scopeID, err := varScopeID(cmd, scope)
+		if err != nil {
+			utils.LogError(err.Error())
+			return
 		}
 
 		storage := sqlite.GetStorageService()
 
 		if scope != "" && scope != "global" {
 			// Get variable with specific scope
-			entry, err := storage.VaultStore().GetVariable(key, scope, workflowIDPtr)
+			entry, err := storage.VaultStore().GetVariable(key, scope, scopeID)
 			if err != nil {
 				utils.LogError(fmt.Sprintf("Failed to get variable: %v", err))
 				return
@@ -47,7 +52,13 @@ var varsGetCmd = &cobra.Command{
 				workflowIDStr = workflowID
 			}
 
-			entry, err := storage.VaultStore().GetVariableWithFallback(key, workflowIDStr)
+			projectID, err := varProjectID(cmd)
+			if err != nil {
+				utils.LogError(err.Error())
+				return
+			}
+
+			entry, err := storage.VaultStore().GetVariableWithFallback(key, workflowIDStr, projectID)
 			if err != nil {
 				utils.LogError(fmt.Sprintf("Failed to get variable with fallback: %v", err))
 				return
@@ -67,32 +78,38 @@ var varsSetCmd = &cobra.Command{
 		value := args[1]
 
 		scope, _ := cmd.Flags().GetString("scope")
-		workflowID, _ := cmd.Flags().GetString("workflow")
 
-		var workflowIDPtr *string
-		if workflowID != "" {
-			workflowIDPtr = &workflowID
+		scopeID, err := varScopeID(cmd, scope)
+		if err != nil {
+			utils.LogError(err.Error())
+			return
 		}
 
 		storage := sqlite.GetStorageService()
 
-		// Check if variable already exists
-		_, err := storage.VaultStore().GetVariable(key, scope, workflowIDPtr)
-		if err == nil {
+		// Check if variable already exists. Other errors, such as a vault
+		// that cannot be unlocked, must not lead to a second entry.
+		_, err = storage.VaultStore().GetVariable(key, scope, scopeID)
+		switch {
+		case err == nil:
 			// Update existing variable
-			err = storage.VaultStore().UpdateVariable(key, scope, workflowIDPtr, value)
+			err = storage.VaultStore().UpdateVariable(key, scope, scopeID, value)
 			if err != nil {
 				utils.LogError(fmt.Sprintf("Failed to update variable: %v", err))
 				return
 			}
 			utils.LogSuccess(fmt.Sprintf("Variable '%s' updated successfully", key))
-		} else {
+		case errors.Is(err, sqlite.ErrVariableNotFound):
 			// Create new variable
 			entry := sqlite.VaultEntry{
-				Key:        key,
-				Value:      value,
-				Scope:      scope,
-				WorkflowID: workflowIDPtr,
+				Key:   key,
+				Value: value,
+				Scope: scope,
+			}
+			if scope == "project" {
+				entry.ProjectID = scopeID
+			} else {
+				entry.WorkflowID = scopeID
 			}
 
 			err = storage.VaultStore().CreateVariable(entry)
@@ -101,6 +118,8 @@ var varsSetCmd = &cobra.Command{
 				return
 			}
 			utils.LogSuccess(fmt.Sprintf("Variable '%s' created successfully", key))
+		default:
+			utils.LogError(fmt.Sprintf("Failed to read variable: %v", err))
 		}
 	},
 }
@@ -110,16 +129,17 @@ var varsListCmd = &cobra.Command{
 	Short: "List all variables",
 	Run: func(cmd *cobra.Command, args []string) {
 		scope, _ := cmd.Flags().GetString("scope")
-		workflowID, _ := cmd.Flags().GetString("workflow")
 
-		var workflowIDPtr *string
-		if workflowID != "" {
-			workflowIDPtr = &workflowID
+		scopeID, err := varScopeID(cmd, scope)
+		if err != nil {
+			utils.LogError(err.Error())
+			return
 		}
 
 		storage := sqlite.GetStorageService()
 
-		variables, err := storage.VaultStore().ListVariables(scope, workflowIDPtr)
+		// Only the keys are shown, so the vault is not unlocked
+		variables, err := storage.VaultStore().ListVariableKeys(scope, scopeID)
 		if err != nil {
 			utils.LogError(fmt.Sprintf("Failed to list variables: %v", err))
 			return
@@ -135,6 +155,8 @@ var varsListCmd = &cobra.Command{
 			scopeInfo := variable.Scope
 			if variable.WorkflowID != nil {
 				scopeInfo = fmt.Sprintf("%s:%s", variable.Scope, *variable.WorkflowID)
+			} else if variable.ProjectID != nil {
+				scopeInfo = fmt.Sprintf("%s:%s", variable.Scope, *variable.ProjectID)
 			}
 
 			fmt.Printf("  %s (%s)\n", variable.Key, scopeInfo)
@@ -150,16 +172,16 @@ var varsDeleteCmd = &cobra.Command{
 		key := args[0]
 
 		scope, _ := cmd.Flags().GetString("scope")
-		workflowID, _ := cmd.Flags().GetString("workflow")
 
-		var workflowIDPtr *string
-		if workflowID != "" {
-			workflowIDPtr = &workflowID
+		scopeID, err := varScopeID(cmd, scope)
+		if err != nil {
+			utils.LogError(err.Error())
+			return
 		}
 
 		storage := sqlite.GetStorageService()
 
-		err := storage.VaultStore().DeleteVariable(key, scope, workflowIDPtr)
+		err = storage.VaultStore().DeleteVariable(key, scope, scopeID)
 		if err != nil {
 			utils.LogError(fmt.Sprintf("Failed to delete variable: %v", err))
 			return
@@ -169,6 +191,115 @@ var varsDeleteCmd = &cobra.Command{
 	},
 }
 
+var varsRekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypt the vault with a new key",
+	Long: `Re-encrypt every vault value with a new data key.
+
+The data key is protected by the current master key, or by the one selected
+with --passphrase, --key-file or --keyring.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase, _ := cmd.Flags().GetBool("passphrase")
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		keyring, _ := cmd.Flags().GetBool("keyring")
+
+		var target *sqlite.MasterKey
+		switch {
+		case passphrase:
+			value, err := newPassphrase()
+			if err != nil {
+				utils.LogError(err.Error())
+				os.Exit(1)
+			}
+			target = &sqlite.MasterKey{Source: sqlite.KeySourcePassphrase, Passphrase: value}
+		case keyFile != "":
+			target = &sqlite.MasterKey{Source: sqlite.KeySourceFile, KeyFile: keyFile}
+		case keyring:
+			target = &sqlite.MasterKey{Source: sqlite.KeySourceKeyring}
+		}
+
+		vault := sqlite.GetStorageService().VaultStore()
+		count, err := vault.Rekey(target)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to rekey the vault: %v", err))
+			os.Exit(1)
+		}
+
+		source, path, _ := vault.KeySource()
+		if path != "" {
+			source = fmt.Sprintf("%s %s", source, path)
+		}
+		utils.LogSuccess(fmt.Sprintf("Re-encrypted %d variables with a new data key, protected by the %s", count, source))
+	},
+}
+
+// varScopeID returns the workflow or project identifying variables of scope:
+// the project of the current directory for the project scope, unless
+// --project names another, and the --workflow flag otherwise
+func varScopeID(cmd *cobra.Command, scope string) (*string, error) {
+	if scope == "project" {
+		projectID, err := varProjectID(cmd)
+		if err != nil {
+			return nil, err
+		}
+		// --project "" selects the project variables set by earlier
+		// versions, which have no project
+		if projectID == "" {
+			return nil, nil
+		}
+		return &projectID, nil
+	}
+
+	workflowID, _ := cmd.Flags().GetString("workflow")
+	if workflowID == "" {
+		return nil, nil
+	}
+	return &workflowID, nil
+}
+
+// varProjectID returns the --project flag, or the project of the current
+// directory when it is not given
+func varProjectID(cmd *cobra.Command) (string, error) {
+	if cmd.Flags().Changed("project") {
+		return cmd.Flags().GetString("project")
+	}
+	return workflow.ProjectID(".")
+}
+
+// promptPassphrase asks for the vault passphrase without echoing it
+func promptPassphrase(prompt string) (string, error) {
+	if !stdinIsTerminal() {
+		return "", fmt.Errorf("cannot ask for the vault passphrase without a terminal (set %s to unlock the vault)", sqlite.PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the passphrase: %v", err)
+	}
+	return string(passphrase), nil
+}
+
+// newPassphrase asks for a new vault passphrase twice
+func newPassphrase() (string, error) {
+	passphrase, err := promptPassphrase("New vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the vault passphrase must not be empty")
+	}
+	confirmation, err := promptPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirmation != passphrase {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
 func init() {
 	// Add flags to all commands
 	scopeFlag := "global"
@@ -176,15 +307,26 @@ func init() {
 
 	varsGetCmd.Flags().StringVarP(&scopeFlag, "scope", "s", "global", "Variable scope (global, project, workflow)")
 	varsGetCmd.Flags().StringVarP(&workflowFlag, "workflow", "w", "", "Workflow ID (for workflow scope)")
+	varsGetCmd.Flags().String("project", "", "Project ID (for project scope, default: the project of the current directory)")
 
 	varsSetCmd.Flags().StringVarP(&scopeFlag, "scope", "s", "global", "Variable scope (global, project, workflow)")
 	varsSetCmd.Flags().StringVarP(&workflowFlag, "workflow", "w", "", "Workflow ID (for workflow scope)")
+	varsSetCmd.Flags().String("project", "", "Project ID (for project scope, default: the project of the current directory)")
 
 	varsListCmd.Flags().StringVarP(&scopeFlag, "scope", "s", "", "Variable scope (global, project, workflow)")
 	varsListCmd.Flags().StringVarP(&workflowFlag, "workflow", "w", "", "Workflow ID (for workflow scope)")
+	varsListCmd.Flags().String("project", "", "Project ID (for project scope, default: the project of the current directory)")
 
 	varsDeleteCmd.Flags().StringVarP(&scopeFlag, "scope", "s", "global", "Variable scope (global, project, workflow)")
 	varsDeleteCmd.Flags().StringVarP(&workflowFlag, "workflow", "w", "", "Workflow ID (for workflow scope)")
+	varsDeleteCmd.Flags().String("project", "", "Project ID (for project scope, default: the project of the current directory)")
+
+	varsRekeyCmd.Flags().Bool("passphrase", false, "Protect the vault with a new passphrase")
+	varsRekeyCmd.Flags().String("key-file", "", "Protect the vault with this key file, created when missing")
+	varsRekeyCmd.Flags().Bool("keyring", false, "Protect the vault with a new key in the OS keyring")
+	varsRekeyCmd.MarkFlagsMutuallyExclusive("passphrase", "key-file", "keyring")
+
+	sqlite.SetPassphrasePrompt(promptPassphrase)
 
 	// Add commands to root
 	rootCmd.AddCommand(varsCmd)
@@ -192,4 +334,5 @@ func init() {
 	varsCmd.AddCommand(varsSetCmd)
 	varsCmd.AddCommand(varsListCmd)
 	varsCmd.AddCommand(varsDeleteCmd)
+	varsCmd.AddCommand(varsRekeyCmd)
 }
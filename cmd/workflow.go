@@ -80,17 +80,21 @@ var workflowValidateCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		path := args[0]
-		workflow, err := workflow.LoadYAMLWorkflow(path)
+		yamlWf, err := workflow.LoadYAMLWorkflow(path)
 		if err != nil {
 			return fmt.Errorf("failed to load workflow: %v", err)
 		}
 
 		// Basic validation
-		if workflow.Name == "" {
+		if yamlWf.Name == "" {
 			return fmt.Errorf("workflow name is required")
 		}
 
-		fmt.Printf("✓ Workflow '%s' is valid\n", workflow.Name)
+		if err := workflow.ValidateYAMLWorkflow(yamlWf); err != nil {
+			return err
+		}
+
+		fmt.Printf("✓ Workflow '%s' is valid\n", yamlWf.Name)
 		return nil
 	},
 }
@@ -234,8 +238,7 @@ func init() {
 	initCmd.Flags().StringP("editor", "e", "", "Configure editor LSP (vscode, neovim, vim, helix, or 'auto' to detect)")
 
 	// Add flags to workflow run command
-	workflowRunCmd.Flags().StringArrayP("var", "v", []string{}, "Variables in KEY=VALUE format")
-	workflowRunCmd.Flags().StringArrayP("action", "a", []string{}, "Action to run")
+	addRunFlags(workflowRunCmd)
 
 	// Add commands
 	rootCmd.AddCommand(initCmd)
@@ -32,11 +32,13 @@ workflow {
         {
             cmd = `docker build -t {{app_name}}:{{env}} .`
             desc = "Build the Docker image"
+            timeout = "{{build_timeout}}"
             on_fail = "action:notify_failure"
         },
         {
             cmd = `docker push {{app_name}}:{{env}}`
             desc = "Push image to registry"
+            timeout = "10m"
             on_fail = "action:notify_failure"
         },
         {
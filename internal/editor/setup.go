@@ -135,9 +135,10 @@ return M
 	syntaxContent := strings.Join([]string{
 		`" Migraine syntax (auto-generated by 'migraine init --editor neovim')`,
 		`syn keyword migraineBlock metadata variables workflow config`,
-		`syn keyword migraineSection pre_checks steps actions`,
-		`syn keyword migraineProperty cmd desc description name on_fail on_success`,
-		`syn keyword migraineProperty store_variables store_logs background global`,
+		`syn keyword migraineSection pre_checks steps actions on_failure finally`,
+		`syn keyword migraineProperty cmd desc description name on_fail on_success timeout retries retry_delay backoff jitter id needs when tags allow_failure severity dir env outputs script shell sudo`,
+		`syn keyword migraineProperty store_variables store_logs background global export_variables`,
+		`syn keyword migraineProperty type default required pattern secret values`,
 		`syn keyword migraineBool true false`,
 		``,
 		`syn match migraineComment "#.*$"`,
@@ -190,9 +191,10 @@ func setupVim(migrainePath string) error {
 	syntaxContent := strings.Join([]string{
 		`" Migraine syntax (auto-generated by 'migraine init --editor vim')`,
 		`syn keyword migraineBlock metadata variables workflow config`,
-		`syn keyword migraineSection pre_checks steps actions`,
-		`syn keyword migraineProperty cmd desc description name on_fail on_success`,
-		`syn keyword migraineProperty store_variables store_logs background global`,
+		`syn keyword migraineSection pre_checks steps actions on_failure finally`,
+		`syn keyword migraineProperty cmd desc description name on_fail on_success timeout retries retry_delay backoff jitter id needs when tags allow_failure severity dir env outputs script shell sudo`,
+		`syn keyword migraineProperty store_variables store_logs background global export_variables`,
+		`syn keyword migraineProperty type default required pattern secret values`,
 		`syn keyword migraineBool true false`,
 		``,
 		`syn match migraineComment "#.*$"`,
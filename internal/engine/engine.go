@@ -0,0 +1,479 @@
+// Package engine runs workflows: their pre-checks, then either the steps or
+// the requested actions, with hooks, retries, timeouts, `when` conditions,
+// step dependencies and run history. It reports progress through events and
+// returns a Result, leaving output and exit codes to its caller.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// Options configures a Runner
+type Options struct {
+	// Store records runs in the run history. Nil disables recording.
+	Store *sqlite.RunStore
+	// Resolver applies variables to commands. Defaults to a resolver without storage.
+	Resolver *workflow.VariableResolver
+	// Jobs is the maximum number of steps with `needs` running at once. Defaults to 1.
+	Jobs int
+	// OnEvent is called for every event of a run. Calls never overlap, even
+	// when steps run in parallel. May be nil.
+	OnEvent func(Event)
+	Stdout  io.Writer // Command output, defaults to os.Stdout
+	Stderr  io.Writer // Command errors, defaults to os.Stderr
+	// OutputEvents sends command output as step_output events, one per
+	// line, instead of writing it to Stdout and Stderr
+	OutputEvents bool
+	// PromptSudo lets sudo ask for the password on the terminal before a run
+	// with steps that use sudo. Without it such runs fail when sudo needs a
+	// password.
+	PromptSudo bool
+}
+
+// Runner executes workflows. A Runner may run several workflows, one after
+// the other or at the same time.
+type Runner struct {
+	opts    Options
+	eventMu sync.Mutex
+	// outputMu keeps the lines of steps running in parallel from interleaving
+	outputMu sync.Mutex
+}
+
+// New creates a Runner
+func New(opts Options) *Runner {
+	if opts.Resolver == nil {
+		opts.Resolver = workflow.NewVariableResolver(nil)
+	}
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	return &Runner{opts: opts}
+}
+
+// Request describes one execution of a workflow
+type Request struct {
+	Workflow *workflow.YAMLWorkflow
+	// WorkflowID identifies the workflow in the run history
+	WorkflowID string
+	// Variables are applied to commands, hooks, timeouts and conditions
+	Variables map[string]string
+	// Actions run after the pre-checks instead of the steps
+	Actions []string
+	// Selection picks the steps to run; the others are skipped. It cannot
+	// be combined with Actions.
+	Selection workflow.StepSelection
+	// PreChecksOnly stops after the pre-checks. Such runs are not recorded.
+	PreChecksOnly bool
+	// RunID continues an existing run record instead of creating one (background runs)
+	RunID int64
+	// TriggeredBy is recorded as who started the run, e.g. user@host
+	TriggeredBy string
+	// Inputs are the variables given on the command line or at prompts. They
+	// are recorded with the run so that it can be resumed with the same values,
+	// except for the secrets, which are masked and asked for again.
+	Inputs map[string]string
+	// ResumeFrom is a previous run of the workflow. The pre-checks, steps and
+	// actions that succeeded in it, or in the runs it resumed, are skipped,
+	// and the new run is recorded as its continuation.
+	ResumeFrom int64
+	// FromStep skips the steps before this 1-based position. When resuming,
+	// the steps from this position on run even if they succeeded before.
+	FromStep int
+	// NoSudo refuses to run pre-checks, steps and actions with sudo. The run
+	// fails before anything runs when it would execute one.
+	NoSudo bool
+	// Secrets are values replaced by *** in command output, events, errors
+	// and stored logs, such as the variables read from the vault
+	Secrets []string
+}
+
+// Result is the outcome of a run
+type Result struct {
+	RunID    int64  // Zero when the run was not recorded
+	Status   string // One of the sqlite.RunStatus values
+	Err      error  // Why the run did not succeed, a *StepError when a step failed
+	Duration time.Duration
+
+	PreChecksPassed int
+	PreChecksFailed int
+	PreChecksWarned int
+
+	StepsTotal     int
+	StepsCompleted int
+	StepsSkipped   int
+	StepsWarned    int // Steps with allow_failure that failed
+}
+
+// ExitCodeWarnings is the exit code of runs that completed with warnings
+const ExitCodeWarnings = 5
+
+// Succeeded reports whether the run completed, possibly with warnings
+func (r *Result) Succeeded() bool {
+	return r.Status == sqlite.RunStatusSuccess || r.Status == sqlite.RunStatusWarning
+}
+
+// ExitCode returns the process exit code for the result: 0 on success,
+// ExitCodeWarnings when it completed with warnings, 130 when the run was
+// cancelled and 1 otherwise
+func (r *Result) ExitCode() int {
+	switch r.Status {
+	case sqlite.RunStatusSuccess:
+		return 0
+	case sqlite.RunStatusWarning:
+		return ExitCodeWarnings
+	case sqlite.RunStatusCancelled:
+		return 130
+	default:
+		return 1
+	}
+}
+
+// StepError reports the pre-check, step or action that failed a run
+type StepError struct {
+	Phase    string // One of the sqlite.RunPhase values
+	Position int
+	StepID   string // Step id, or the action name for actions
+	Err      error
+
+	// tolerated is set when the run goes on despite the failure
+	tolerated bool
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s %d failed: %v", e.Phase, e.Position, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// run holds the state of a single execution
+type run struct {
+	*Runner
+	ctx       context.Context
+	req       Request
+	rec       *recorder
+	selected  []bool // Steps kept by Request.Selection, nil when all are
+	resume    *resumeState
+	result    *Result
+	startTime time.Time
+
+	outputsMu sync.Mutex
+	// outputs holds the outputs of finished steps as
+	// steps.<id>.outputs.<name> variables
+	outputs map[string]string
+
+	// stopSudo stops refreshing the sudo credentials, nil when the run has
+	// no steps with sudo
+	stopSudo context.CancelFunc
+
+	// redact removes Request.Secrets from everything the run reports, nil
+	// when there are none
+	redact *execution.Redactor
+}
+
+// Run executes the workflow described by req until it completes, fails or
+// ctx is cancelled. Cancelling ctx stops the running commands and reports
+// the run as cancelled.
+func (r *Runner) Run(ctx context.Context, req Request) *Result {
+	rn := &run{
+		Runner:    r,
+		ctx:       ctx,
+		req:       req,
+		result:    &Result{StepsTotal: len(req.Workflow.Steps)},
+		startTime: time.Now(),
+		redact:    execution.NewRedactor(req.Secrets),
+	}
+
+	if r.opts.Store != nil && !req.PreChecksOnly {
+		rn.rec = startRecorder(r.opts.Store, sqlite.Run{
+			WorkflowID:  req.WorkflowID,
+			TriggeredBy: req.TriggeredBy,
+			ResumedFrom: req.ResumeFrom,
+			Variables:   rn.redact.Map(req.Inputs),
+		}, req.Workflow.Config.StoreLogs, req.RunID, rn.redact, rn.warn)
+	}
+	rn.result.RunID = rn.rec.runID()
+
+	rn.emit(Event{Type: EventRunStarted})
+
+	err := rn.runPhases()
+	if !req.PreChecksOnly {
+		err = rn.runWorkflowHooks(err)
+	}
+	if rn.stopSudo != nil {
+		rn.stopSudo()
+	}
+	switch {
+	case err != nil:
+		rn.result.Status = FailureStatus(err)
+	case rn.result.PreChecksWarned > 0 || rn.result.StepsWarned > 0:
+		rn.result.Status = sqlite.RunStatusWarning
+	default:
+		rn.result.Status = sqlite.RunStatusSuccess
+	}
+	rn.result.Err = rn.redact.Error(err)
+	rn.result.Duration = time.Since(rn.startTime)
+
+	rn.rec.finish(rn.result.Status)
+	rn.emit(Event{Type: EventRunFinished, Result: rn.result})
+
+	return rn.result
+}
+
+// runPhases runs the pre-checks, then the requested actions or the steps
+func (rn *run) runPhases() error {
+	wf := rn.req.Workflow
+
+	// Reject invalid step dependencies before running anything
+	graph, err := workflow.NewStepGraph(wf.Steps)
+	if err != nil && !rn.req.PreChecksOnly && len(rn.req.Actions) == 0 {
+		return fmt.Errorf("invalid step dependencies: %w", err)
+	}
+
+	if rn.selected, err = rn.selectSteps(); err != nil {
+		return err
+	}
+	if rn.resume, err = rn.loadResume(); err != nil {
+		return err
+	}
+	if err := rn.prepareSudo(); err != nil {
+		return err
+	}
+
+	if err := rn.runPreChecks(); err != nil || rn.req.PreChecksOnly {
+		return err
+	}
+
+	if len(rn.req.Actions) > 0 {
+		return rn.runActions()
+	}
+
+	return rn.runSteps(graph)
+}
+
+// runWorkflowHooks runs the on_success or on_failure block of the workflow,
+// depending on err, then its finally block. Cancelled runs, including a
+// command stopped by Ctrl-C in the terminal foreground, only run finally,
+// which is no longer bound to the cancelled context so that it can clean up.
+// A failed hook fails a run that succeeded; the error of a failed run is
+// kept.
+func (rn *run) runWorkflowHooks(err error) error {
+	wf := rn.req.Workflow
+
+	switch {
+	case rn.ctx.Err() != nil, errors.Is(err, execution.ErrInterrupted):
+	case err == nil:
+		err = rn.runHookSteps(sqlite.RunPhaseOnSuccess, wf.OnSuccess)
+	default:
+		rn.runHookSteps(sqlite.RunPhaseOnFailure, wf.OnFailure)
+	}
+
+	if rn.ctx.Err() != nil {
+		rn.ctx = context.WithoutCancel(rn.ctx)
+	}
+	if finallyErr := rn.runHookSteps(sqlite.RunPhaseFinally, wf.Finally); err == nil {
+		err = finallyErr
+	}
+	return err
+}
+
+// runHookSteps runs the steps of a workflow hook in order, stopping at the
+// first failure
+func (rn *run) runHookSteps(phase string, steps []workflow.YAMLStep) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	rn.emit(Event{Type: EventPhaseStarted, Phase: phase, Total: len(steps)})
+
+	for i, step := range steps {
+		err := rn.runStep(stepExecution{
+			phase:    phase,
+			position: i + 1,
+			total:    len(steps),
+			id:       step.ID,
+			step:     step,
+			label:    fmt.Sprintf("%s %d", phase, i+1),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runPreChecks runs the pre-checks in order, stopping at the first failure
+func (rn *run) runPreChecks() error {
+	checks := rn.req.Workflow.PreChecks
+	rn.emit(Event{Type: EventPhaseStarted, Phase: sqlite.RunPhasePrecheck, Total: len(checks)})
+
+	for i, check := range checks {
+		err := rn.runStep(stepExecution{
+			phase:    sqlite.RunPhasePrecheck,
+			position: i + 1,
+			total:    len(checks),
+			step:     check,
+			label:    fmt.Sprintf("precheck %d", i+1),
+		})
+		switch {
+		case tolerated(err):
+			rn.result.PreChecksWarned++
+		case err != nil:
+			rn.result.PreChecksFailed++
+			return err
+		default:
+			rn.result.PreChecksPassed++
+		}
+	}
+
+	return nil
+}
+
+// runActions runs the requested actions in order, stopping at the first failure
+func (rn *run) runActions() error {
+	actions := rn.req.Actions
+	rn.emit(Event{Type: EventPhaseStarted, Phase: sqlite.RunPhaseAction, Total: len(actions)})
+
+	for i, name := range actions {
+		action, ok := rn.req.Workflow.Actions[name]
+		if !ok {
+			return fmt.Errorf("action '%s' not found in workflow", name)
+		}
+
+		err := rn.runStep(stepExecution{
+			phase:    sqlite.RunPhaseAction,
+			position: i + 1,
+			total:    len(actions),
+			id:       name,
+			step:     action,
+			label:    fmt.Sprintf("action %s", name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selectSteps applies Request.Selection to the workflow steps
+func (rn *run) selectSteps() ([]bool, error) {
+	selection := rn.req.Selection
+	if selection.IsZero() {
+		return nil, nil
+	}
+	if len(rn.req.Actions) > 0 {
+		return nil, fmt.Errorf("steps cannot be selected when running actions")
+	}
+
+	selected, err := selection.Select(rn.req.Workflow.Steps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid step selection: %w", err)
+	}
+	return selected, nil
+}
+
+// skipReason explains why a pre-check, step or action is skipped without
+// running, or returns "" when it runs
+func (rn *run) skipReason(se stepExecution) string {
+	switch se.phase {
+	case sqlite.RunPhaseOnSuccess, sqlite.RunPhaseOnFailure, sqlite.RunPhaseFinally:
+		// Workflow hooks run after every run, resumed or not
+		return ""
+	}
+	if se.phase == sqlite.RunPhaseStep && rn.selected != nil && !rn.selected[se.position-1] {
+		return "not selected"
+	}
+	return rn.resume.skipReason(se)
+}
+
+// emit stamps an event with the run details, redacts the secrets from it
+// and hands it to OnEvent
+func (rn *run) emit(e Event) {
+	if rn.opts.OnEvent == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Workflow = rn.req.Workflow.Name
+	e.RunID = rn.result.RunID
+	if rn.redact != nil {
+		e = redactEvent(e, rn.redact)
+	}
+
+	rn.eventMu.Lock()
+	defer rn.eventMu.Unlock()
+	rn.opts.OnEvent(e)
+}
+
+func (rn *run) warn(message string) {
+	rn.emit(Event{Type: EventWarning, Message: message})
+}
+
+// tolerated reports whether err is the failure of a pre-check with
+// severity: warn or a step with allow_failure, which does not stop the run
+func tolerated(err error) bool {
+	var stepErr *StepError
+	return errors.As(err, &stepErr) && stepErr.tolerated
+}
+
+// FailureStatus returns the run status matching a command error
+func FailureStatus(err error) string {
+	switch {
+	case errors.Is(err, execution.ErrTimeout):
+		return sqlite.RunStatusTimedOut
+	case errors.Is(err, execution.ErrInterrupted):
+		return sqlite.RunStatusCancelled
+	default:
+		return sqlite.RunStatusFailed
+	}
+}
+
+// exitCode returns the exit code of a failed command, 0 when err is nil and
+// -1 when the command did not exit on its own
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// StepDescription returns the step description, falling back to its name,
+// then its command or the first line of its script
+func StepDescription(step workflow.YAMLStep) string {
+	if step.Description != nil && *step.Description != "" {
+		return *step.Description
+	}
+	if step.Name != "" {
+		return step.Name
+	}
+	if step.Script != "" {
+		first, _, _ := strings.Cut(strings.TrimSpace(step.Script), "\n")
+		return first
+	}
+	return step.Command
+}
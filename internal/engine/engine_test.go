@@ -0,0 +1,799 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// runWorkflow runs wf without run history and returns its result, the
+// command output and the events it produced
+func runWorkflow(t *testing.T, ctx context.Context, req Request) (*Result, string, []Event) {
+	t.Helper()
+
+	var out bytes.Buffer
+	var events []Event
+	runner := New(Options{
+		Stdout:  &out,
+		Stderr:  &out,
+		OnEvent: func(e Event) { events = append(events, e) },
+	})
+
+	result := runner.Run(ctx, req)
+	return result, out.String(), events
+}
+
+func eventTypes(events []Event) []EventType {
+	types := make([]EventType, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func TestRun_Success(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:      "build",
+		PreChecks: []workflow.YAMLStep{{Command: "true"}},
+		Steps: []workflow.YAMLStep{
+			{Command: "echo {{greeting}}"},
+			{Command: "echo skipped", When: "{{greeting}} == 'bye'"},
+			{Command: "echo done", OnSuccess: "run:echo hook"},
+		},
+	}
+
+	result, out, events := runWorkflow(t, context.Background(), Request{
+		Workflow:  wf,
+		Variables: map[string]string{"greeting": "hello"},
+	})
+
+	if !result.Succeeded() || result.Err != nil || result.ExitCode() != 0 {
+		t.Fatalf("expected success, got %s: %v", result.Status, result.Err)
+	}
+	if result.RunID != 0 {
+		t.Errorf("expected an unrecorded run, got run %d", result.RunID)
+	}
+	if result.PreChecksPassed != 1 || result.StepsTotal != 3 || result.StepsCompleted != 2 || result.StepsSkipped != 1 {
+		t.Errorf("unexpected counts: %+v", result)
+	}
+	if out != "hello\ndone\nhook\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	want := []EventType{
+		EventRunStarted,
+		EventPhaseStarted, EventStepStarted, EventStepFinished,
+		EventPhaseStarted,
+		EventStepStarted, EventStepFinished,
+		EventStepSkipped,
+		EventStepStarted, EventStepFinished, EventHookFired, EventHookFinished,
+		EventRunFinished,
+	}
+	if got := eventTypes(events); !slices.Equal(got, want) {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+	if last := events[len(events)-1]; last.Result != result || last.Workflow != "build" {
+		t.Errorf("run_finished should carry the result and workflow, got %+v", last)
+	}
+}
+
+func TestRun_StepFailure(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "deploy",
+		Steps: []workflow.YAMLStep{
+			{Command: "echo one"},
+			{Command: "exit 3", OnFail: "action:rollback"},
+			{Command: "echo never"},
+		},
+		Actions: map[string]workflow.YAMLStep{
+			"rollback": {Command: "echo rolling back"},
+		},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf})
+
+	if result.Status != sqlite.RunStatusFailed || result.ExitCode() != 1 {
+		t.Fatalf("expected a failed run, got %s", result.Status)
+	}
+
+	var stepErr *StepError
+	if !errors.As(result.Err, &stepErr) || stepErr.Phase != sqlite.RunPhaseStep || stepErr.Position != 2 {
+		t.Fatalf("expected step 2 to fail, got %v", result.Err)
+	}
+	if result.StepsCompleted != 1 {
+		t.Errorf("expected 1 completed step, got %d", result.StepsCompleted)
+	}
+	if out != "one\nrolling back\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestRun_Retries(t *testing.T) {
+	marker := t.TempDir() + "/attempted"
+	wf := &workflow.YAMLWorkflow{
+		Name: "flaky",
+		Steps: []workflow.YAMLStep{
+			// Fails on the first attempt only
+			{Command: "test -e " + marker + " || { touch " + marker + "; exit 1; }", Retries: 2, RetryDelay: "10ms"},
+		},
+	}
+
+	result, _, events := runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if !result.Succeeded() {
+		t.Fatalf("expected the retry to succeed, got %v", result.Err)
+	}
+
+	var attempts, retries int
+	for _, e := range events {
+		switch e.Type {
+		case EventStepStarted:
+			attempts++
+			if e.Attempts != 3 {
+				t.Errorf("expected 3 allowed attempts, got %d", e.Attempts)
+			}
+		case EventStepRetrying:
+			retries++
+			if e.Err == nil || e.Delay != 10*time.Millisecond {
+				t.Errorf("unexpected retry event %+v", e)
+			}
+		}
+	}
+	if attempts != 2 || retries != 1 {
+		t.Errorf("expected 2 attempts and 1 retry, got %d and %d", attempts, retries)
+	}
+}
+
+func TestRun_Actions(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "release",
+		Steps: []workflow.YAMLStep{{Command: "echo step"}},
+		Actions: map[string]workflow.YAMLStep{
+			"tag": {Command: "echo tagging {{version}}"},
+		},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{
+		Workflow:  wf,
+		Actions:   []string{"tag"},
+		Variables: map[string]string{"version": "1.2.0"},
+	})
+	if !result.Succeeded() || out != "tagging 1.2.0\n" {
+		t.Fatalf("expected only the action to run, got %s with output %q", result.Status, out)
+	}
+
+	result, _, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, Actions: []string{"publish"}})
+	if result.Succeeded() || result.Err == nil || !strings.Contains(result.Err.Error(), "action 'publish' not found") {
+		t.Errorf("expected an unknown action error, got %v", result.Err)
+	}
+}
+
+func TestRun_PreChecksOnly(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:      "checks",
+		PreChecks: []workflow.YAMLStep{{Command: "echo check"}, {Command: "exit 1"}},
+		Steps:     []workflow.YAMLStep{{Command: "echo step"}},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf, PreChecksOnly: true})
+	if result.Status != sqlite.RunStatusFailed || result.PreChecksPassed != 1 || result.PreChecksFailed != 1 {
+		t.Errorf("expected the second pre-check to fail, got %+v", result)
+	}
+	if out != "check\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestRun_InvalidDependencies(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "cycle",
+		Steps: []workflow.YAMLStep{{ID: "a", Needs: []string{"a"}, Command: "echo a"}},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Succeeded() || out != "" || !strings.Contains(result.Err.Error(), "invalid step dependencies") {
+		t.Errorf("expected the run to be rejected, got %v with output %q", result.Err, out)
+	}
+}
+
+func TestRun_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	wf := &workflow.YAMLWorkflow{
+		Name:  "slow",
+		Steps: []workflow.YAMLStep{{Command: "sleep 30", OnFail: "run:echo hook"}, {Command: "echo never"}},
+	}
+
+	start := time.Now()
+	result, out, _ := runWorkflow(t, ctx, Request{Workflow: wf})
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("cancelling the run took %s", time.Since(start))
+	}
+	if result.Status != sqlite.RunStatusCancelled || result.ExitCode() != 130 || !errors.Is(result.Err, execution.ErrInterrupted) {
+		t.Errorf("expected a cancelled run, got %s: %v", result.Status, result.Err)
+	}
+	if out != "" {
+		t.Errorf("hooks and later steps should not run, got output %q", out)
+	}
+}
+
+func TestRun_OutputEvents(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "build",
+		Steps: []workflow.YAMLStep{{ID: "greet", Command: "echo one; printf 'two' >&2"}},
+	}
+
+	var out bytes.Buffer
+	var lines []Event
+	runner := New(Options{
+		Stdout:       &out,
+		Stderr:       &out,
+		OutputEvents: true,
+		OnEvent: func(e Event) {
+			if e.Type == EventStepOutput {
+				lines = append(lines, e)
+			}
+		},
+	})
+
+	if result := runner.Run(context.Background(), Request{Workflow: wf}); !result.Succeeded() {
+		t.Fatalf("expected success, got %v", result.Err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("output should only be sent as events, got %q", out.String())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 output events, got %d", len(lines))
+	}
+	if lines[0].Stream != "stdout" || lines[0].Text != "one" || lines[1].Stream != "stderr" || lines[1].Text != "two" {
+		t.Errorf("unexpected output events %+v", lines)
+	}
+	if lines[0].StepID != "greet" || lines[0].Position != 1 {
+		t.Errorf("output events should name their step, got %+v", lines[0])
+	}
+}
+
+func TestEvent_MarshalJSON(t *testing.T) {
+	e := Event{
+		Type:     EventStepFinished,
+		Time:     time.Date(2025, 1, 8, 12, 0, 0, 0, time.UTC),
+		Workflow: "deploy",
+		Phase:    sqlite.RunPhaseStep,
+		Position: 2,
+		Total:    3,
+		Name:     "Run tests",
+		Status:   sqlite.RunStatusFailed,
+		ExitCode: 2,
+		Duration: 1500 * time.Millisecond,
+		Err:      errors.New("command failed: exit status 2"),
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"type":"step_finished","time":"2025-01-08T12:00:00Z","workflow":"deploy","phase":"step","position":2,"total":3,"name":"Run tests","duration_ms":1500,"status":"failed","exit_code":2,"error":"command failed: exit status 2"}`
+	if string(data) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, data)
+	}
+
+	data, err = json.Marshal(Event{Type: EventRunFinished, Time: e.Time, Result: &Result{Status: sqlite.RunStatusSuccess, StepsTotal: 1, StepsCompleted: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"result":{"status":"success","duration_ms":0,"prechecks":{"passed":0,"failed":0,"warned":0},"steps":{"total":1,"completed":1,"skipped":0,"warned":0}}`) {
+		t.Errorf("unexpected run_finished encoding %s", data)
+	}
+}
+
+func TestRun_Resume(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db, err := sqlite.NewDBService("migraine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := sqlite.NewRunStore(db)
+
+	marker := t.TempDir() + "/fixed"
+	wf := &workflow.YAMLWorkflow{
+		Name:      "deploy",
+		PreChecks: []workflow.YAMLStep{{Command: "true"}},
+		Steps: []workflow.YAMLStep{
+			{Command: "echo one"},
+			{Command: "test -e " + marker + " && echo two"},
+			{Command: "echo three"},
+		},
+	}
+	run := func(req Request) (*Result, string) {
+		var out bytes.Buffer
+		req.Workflow, req.WorkflowID = wf, "deploy"
+		result := New(Options{Store: store, Stdout: &out, Stderr: &out}).Run(context.Background(), req)
+		return result, out.String()
+	}
+
+	first, _ := run(Request{Inputs: map[string]string{"env": "prod"}})
+	if first.Succeeded() {
+		t.Fatal("expected the first run to fail")
+	}
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	second, out := run(Request{ResumeFrom: first.RunID})
+	if !second.Succeeded() || out != "two\nthree\n" {
+		t.Fatalf("expected the resumed run to start at step 2, got %s with output %q", second.Status, out)
+	}
+	if second.StepsCompleted != 2 || second.StepsSkipped != 1 {
+		t.Errorf("unexpected counts: %+v", second)
+	}
+
+	recorded, err := store.GetRun(second.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.ResumedFrom != first.RunID {
+		t.Errorf("expected run %d to resume run %d, got %d", second.RunID, first.RunID, recorded.ResumedFrom)
+	}
+	if original, _ := store.GetRun(first.RunID); original.Variables["env"] != "prod" {
+		t.Errorf("expected the inputs to be recorded, got %v", original.Variables)
+	}
+
+	// Resuming the resumed run skips what succeeded in either run
+	if _, out := run(Request{ResumeFrom: second.RunID}); out != "" {
+		t.Errorf("expected every step to be skipped, got output %q", out)
+	}
+	if _, out := run(Request{ResumeFrom: second.RunID, FromStep: 3}); out != "three\n" {
+		t.Errorf("expected --from-step to rerun step 3, got output %q", out)
+	}
+
+	if result, _ := run(Request{ResumeFrom: 999}); result.Succeeded() || !strings.Contains(result.Err.Error(), "cannot resume run 999") {
+		t.Errorf("expected an unknown run error, got %v", result.Err)
+	}
+}
+
+func TestRun_Selection(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "ci",
+		Steps: []workflow.YAMLStep{
+			{Name: "lint", Command: "echo lint", Tags: []string{"fast"}},
+			{ID: "build", Command: "echo build"},
+			{Name: "test", Command: "echo test", Needs: []string{"build"}, Tags: []string{"fast"}},
+		},
+	}
+
+	// Unselected steps satisfy the needs of selected ones
+	result, out, events := runWorkflow(t, context.Background(), Request{
+		Workflow:  wf,
+		Selection: workflow.StepSelection{Tags: []string{"fast"}, Skip: []string{"lint"}},
+	})
+	if !result.Succeeded() || out != "[test] test\n" {
+		t.Fatalf("expected only the test step to run, got %s with output %q", result.Status, out)
+	}
+	if result.StepsCompleted != 1 || result.StepsSkipped != 2 {
+		t.Errorf("unexpected counts: %+v", result)
+	}
+	for _, e := range events {
+		if e.Type == EventStepSkipped && e.Reason != "not selected" {
+			t.Errorf("unexpected skip reason %q", e.Reason)
+		}
+	}
+
+	result, _, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, Selection: workflow.StepSelection{Only: []string{"deploy"}}})
+	if result.Succeeded() || !strings.Contains(result.Err.Error(), `no step is named "deploy"`) {
+		t.Errorf("expected an invalid selection, got %v", result.Err)
+	}
+}
+
+func TestRun_AllowedFailures(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:      "ci",
+		PreChecks: []workflow.YAMLStep{{Command: "exit 2", Severity: workflow.SeverityWarn}, {Command: "true"}},
+		Steps: []workflow.YAMLStep{
+			{Command: "exit 3", AllowFailure: true, OnFail: "run:echo cleanup"},
+			{Command: "echo after", When: "previous.failed"},
+		},
+	}
+
+	result, out, events := runWorkflow(t, context.Background(), Request{Workflow: wf})
+
+	if result.Status != sqlite.RunStatusWarning || !result.Succeeded() || result.ExitCode() != ExitCodeWarnings {
+		t.Fatalf("expected a run with warnings, got %s (%v)", result.Status, result.Err)
+	}
+	if result.PreChecksWarned != 1 || result.PreChecksPassed != 1 || result.StepsWarned != 1 || result.StepsCompleted != 1 {
+		t.Errorf("unexpected counts: %+v", result)
+	}
+	if out != "cleanup\nafter\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	allowed := 0
+	for _, e := range events {
+		if e.Type == EventStepFinished && e.AllowedFailure {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected 2 allowed failures, got %d", allowed)
+	}
+
+	// Pre-checks do not honor allow_failure
+	wf.PreChecks = []workflow.YAMLStep{{Command: "exit 2", AllowFailure: true}}
+	result, _, _ = runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusFailed {
+		t.Errorf("expected a failed run, got %s", result.Status)
+	}
+}
+
+func TestRun_WorkflowHooks(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:      "deploy",
+		Steps:     []workflow.YAMLStep{{Command: "echo {{step}}"}},
+		OnSuccess: []workflow.YAMLStep{{Command: "echo notify ok"}},
+		OnFailure: []workflow.YAMLStep{{Command: "echo notify failed"}},
+		Finally:   []workflow.YAMLStep{{Command: "echo cleanup"}},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: map[string]string{"step": "build"}})
+	if result.Status != sqlite.RunStatusSuccess || out != "build\nnotify ok\ncleanup\n" {
+		t.Errorf("expected on_success and finally to run, got %s with output %q", result.Status, out)
+	}
+
+	wf.Steps[0].Command = "exit 3"
+	result, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf})
+	var stepErr *StepError
+	if !errors.As(result.Err, &stepErr) || stepErr.Phase != sqlite.RunPhaseStep {
+		t.Errorf("expected the step error to be kept, got %v", result.Err)
+	}
+	if out != "notify failed\ncleanup\n" {
+		t.Errorf("expected on_failure and finally to run, got %q", out)
+	}
+
+	// A failed hook fails a run that succeeded
+	wf.Steps[0].Command = "true"
+	wf.Finally = []workflow.YAMLStep{{Command: "exit 4"}, {Command: "echo never"}}
+	result, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusFailed || !errors.As(result.Err, &stepErr) || stepErr.Phase != sqlite.RunPhaseFinally {
+		t.Errorf("expected the finally hook to fail the run, got %s: %v", result.Status, result.Err)
+	}
+	if out != "notify ok\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestRun_FinallyAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	wf := &workflow.YAMLWorkflow{
+		Name:      "slow",
+		Steps:     []workflow.YAMLStep{{Command: "sleep 30"}},
+		OnFailure: []workflow.YAMLStep{{Command: "echo notify"}},
+		Finally:   []workflow.YAMLStep{{Command: "echo cleanup"}},
+	}
+
+	result, out, _ := runWorkflow(t, ctx, Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusCancelled {
+		t.Errorf("expected a cancelled run, got %s: %v", result.Status, result.Err)
+	}
+	if out != "cleanup\n" {
+		t.Errorf("expected only finally to run, got %q", out)
+	}
+}
+
+func TestRun_FinallyAfterInterrupt(t *testing.T) {
+	// In the terminal foreground Ctrl-C reaches the command, not the context
+	wf := &workflow.YAMLWorkflow{
+		Name:      "interrupted",
+		Steps:     []workflow.YAMLStep{{Command: "kill -INT $$"}},
+		OnFailure: []workflow.YAMLStep{{Command: "echo notify"}},
+		Finally:   []workflow.YAMLStep{{Command: "echo cleanup"}},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusCancelled {
+		t.Errorf("expected a cancelled run, got %s: %v", result.Status, result.Err)
+	}
+	if out != "cleanup\n" {
+		t.Errorf("expected only finally to run, got %q", out)
+	}
+}
+
+func TestRun_DirAndEnv(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "services", "api"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, _ = filepath.EvalSymlinks(root)
+	if err := os.WriteFile(filepath.Join(root, "services", "api", "go.mod"), []byte("module api\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Conditions check paths in the dir of their step
+	wf := &workflow.YAMLWorkflow{
+		Name: "monorepo",
+		Dir:  "{{root}}",
+		Env:  map[string]string{"STAGE": "{{stage}}", "GOFLAGS": "-mod=vendor"},
+		Steps: []workflow.YAMLStep{
+			{Command: `echo "$(pwd) $STAGE $GOFLAGS"`},
+			{Command: `echo "$(pwd) $STAGE $GOFLAGS"`, Dir: "services/{{service}}", Env: map[string]string{"GOFLAGS": "-mod=mod"}, OnSuccess: "run:pwd"},
+			{Command: "echo go", Dir: "services/api", When: "exists('go.mod')"},
+			{Command: "echo never", When: "exists('go.mod')"},
+		},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{
+		Workflow:  wf,
+		Variables: map[string]string{"root": root, "stage": "prod", "service": "api"},
+	})
+	if !result.Succeeded() {
+		t.Fatalf("expected the run to succeed, got %v", result.Err)
+	}
+
+	api := filepath.Join(root, "services", "api")
+	want := root + " prod -mod=vendor\n" + api + " prod -mod=mod\n" + api + "\ngo\n"
+	if out != want {
+		t.Errorf("expected output %q, got %q", want, out)
+	}
+}
+
+func TestRun_ExportVariables(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "export",
+		Env:   map[string]string{"REGION": "eu-{{region}}"},
+		Steps: []workflow.YAMLStep{{Command: `echo "$APP_NAME $REGION $TOKEN"`}},
+	}
+	variables := map[string]string{"APP_NAME": "it's \"quoted\"", "region": "west", "REGION": "us", "TOKEN": "secret"}
+
+	_, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: variables})
+	if out != " eu-west \n" {
+		t.Errorf("variables should not be exported by default, got %q", out)
+	}
+
+	// Explicit env takes precedence over exported variables
+	wf.Config.ExportVariables = workflow.VariableExports{Names: []string{"APP_NAME", "REGION"}}
+	_, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: variables})
+	if out != "it's \"quoted\" eu-west \n" {
+		t.Errorf("expected APP_NAME to be exported, got %q", out)
+	}
+
+	wf.Config.ExportVariables = workflow.VariableExports{All: true}
+	_, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: variables})
+	if out != "it's \"quoted\" eu-west secret\n" {
+		t.Errorf("expected every variable to be exported, got %q", out)
+	}
+}
+
+func TestRun_StepOutputs(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "outputs",
+		Steps: []workflow.YAMLStep{
+			{
+				ID:      "build",
+				Command: `echo building >&2; echo '{"image": {"tag": "v1"}}'; echo url=https://example.com >> "$MIGRAINE_OUTPUT"`,
+				Outputs: map[string]workflow.StepOutput{
+					"tag": {From: workflow.OutputFromLastLine, JSON: ".image.tag"},
+					"url": {From: workflow.OutputFromFile},
+				},
+			},
+			{
+				Command: `echo "push {{steps.build.outputs.tag}} to $URL"`,
+				When:    "{{steps.build.outputs.tag}} == 'v1'",
+				Env:     map[string]string{"URL": "{{steps.build.outputs.url}}"},
+			},
+		},
+		Finally: []workflow.YAMLStep{{Command: "echo done {{steps.build.outputs.tag}}"}},
+	}
+
+	result, out, events := runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusSuccess {
+		t.Fatalf("expected success, got %s: %v", result.Status, result.Err)
+	}
+	if !strings.HasSuffix(out, "push v1 to https://example.com\ndone v1\n") {
+		t.Errorf("expected later steps to read the outputs, got %q", out)
+	}
+	for _, e := range events {
+		if e.Type == EventStepFinished && e.StepID == "build" && (e.Outputs["tag"] != "v1" || e.Outputs["url"] != "https://example.com") {
+			t.Errorf("expected the outputs in the step_finished event, got %v", e.Outputs)
+		}
+	}
+
+	// A step whose outputs cannot be captured fails
+	wf.Steps[0].Outputs["port"] = workflow.StepOutput{Regex: `port=(\d+)`}
+	result, _, _ = runWorkflow(t, context.Background(), Request{Workflow: wf})
+	if result.Status != sqlite.RunStatusFailed || !strings.Contains(result.Err.Error(), "output port: regex") {
+		t.Errorf("expected the missing output to fail the step, got %s: %v", result.Status, result.Err)
+	}
+}
+
+func TestRun_NoSudo(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "install",
+		Steps: []workflow.YAMLStep{
+			{Name: "build", Command: "echo build"},
+			{Name: "install", Command: "echo install", Sudo: true},
+		},
+		Actions: map[string]workflow.YAMLStep{"uninstall": {Command: "echo uninstall", Sudo: true}},
+	}
+
+	// Nothing runs when a step would need sudo
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf, NoSudo: true})
+	if result.Status != sqlite.RunStatusFailed || !errors.Is(result.Err, errSudoDisabled) || !strings.Contains(result.Err.Error(), "install need sudo") {
+		t.Fatalf("expected the run to be refused, got %s: %v", result.Status, result.Err)
+	}
+	if out != "" {
+		t.Errorf("expected nothing to run, got %q", out)
+	}
+
+	// Steps with sudo that do not run are not refused, unless a hook runs them
+	result, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, NoSudo: true, Selection: workflow.StepSelection{Only: []string{"build"}}})
+	if result.Status != sqlite.RunStatusSuccess || out != "build\n" {
+		t.Errorf("expected the build step to run, got %s %q: %v", result.Status, out, result.Err)
+	}
+
+	wf.Steps[0].OnSuccess = "action:uninstall"
+	result, _, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, NoSudo: true, Selection: workflow.StepSelection{Only: []string{"build"}}})
+	if result.Status != sqlite.RunStatusFailed || result.Err == nil || !strings.Contains(result.Err.Error(), "action uninstall need sudo") {
+		t.Errorf("expected the hook action to be refused, got %s: %v", result.Status, result.Err)
+	}
+}
+
+func TestRun_ShellAndScript(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "shell",
+		Shell: "bash -eo pipefail",
+		Steps: []workflow.YAMLStep{
+			{Script: "greeting={{greeting}}\nfor name in a b; do\n  echo \"$greeting $name\"\ndone\n"},
+			{Command: "false | true; echo unreachable"},
+		},
+	}
+
+	result, out, _ := runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: map[string]string{"greeting": "hi"}})
+	if result.Status != sqlite.RunStatusFailed {
+		t.Fatalf("expected the workflow shell to fail the pipeline, got %s", result.Status)
+	}
+	if out != "hi a\nhi b\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	// A step shell takes precedence over the workflow shell
+	wf.Steps[1].Shell = "sh"
+	result, out, _ = runWorkflow(t, context.Background(), Request{Workflow: wf, Variables: map[string]string{"greeting": "hi"}})
+	if result.Status != sqlite.RunStatusSuccess {
+		t.Fatalf("expected success, got %s: %v", result.Status, result.Err)
+	}
+	if !strings.HasSuffix(out, "unreachable\n") {
+		t.Errorf("expected the step to run with sh, got %q", out)
+	}
+}
+
+func TestRun_ResumeKeepsOutputs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db, err := sqlite.NewDBService("migraine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := sqlite.NewRunStore(db)
+
+	marker := t.TempDir() + "/fixed"
+	wf := &workflow.YAMLWorkflow{
+		Name: "deploy",
+		Steps: []workflow.YAMLStep{
+			{ID: "build", Command: "echo v2", Outputs: map[string]workflow.StepOutput{"tag": {}}},
+			{Command: "test -e " + marker + " && echo deploy {{steps.build.outputs.tag}}"},
+		},
+	}
+	run := func(req Request) (*Result, string) {
+		var out bytes.Buffer
+		req.Workflow, req.WorkflowID = wf, "deploy"
+		result := New(Options{Store: store, Stdout: &out, Stderr: &out}).Run(context.Background(), req)
+		return result, out.String()
+	}
+
+	first, _ := run(Request{})
+	if first.Succeeded() {
+		t.Fatal("expected the first run to fail")
+	}
+	steps, err := store.ListRunSteps(first.RunID)
+	if err != nil || len(steps) != 2 || steps[0].Outputs["tag"] != "v2" {
+		t.Fatalf("expected the outputs to be recorded, got %+v (%v)", steps, err)
+	}
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if second, out := run(Request{ResumeFrom: first.RunID}); !second.Succeeded() || out != "deploy v2\n" {
+		t.Errorf("expected the resumed run to reuse the recorded outputs, got %s with output %q", second.Status, out)
+	}
+}
+
+func TestRun_RedactsSecrets(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db, err := sqlite.NewDBService("migraine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := sqlite.NewRunStore(db)
+
+	wf := &workflow.YAMLWorkflow{
+		Name:   "deploy",
+		Config: workflow.YAMLConfig{StoreLogs: true},
+		Steps: []workflow.YAMLStep{
+			{ID: "login", Command: "echo token={{token}}; printf 'hunt' >&2; echo 'er2' >&2", Outputs: map[string]workflow.StepOutput{"token": {Regex: `token=(\S+)`}}},
+			{Command: "true", Dir: "/nonexistent/{{token}}"},
+		},
+	}
+	req := Request{Workflow: wf, WorkflowID: "deploy", Variables: map[string]string{"token": "hunter2"}, Inputs: map[string]string{"token": "hunter2", "env": "prod"}, Secrets: []string{"hunter2"}}
+
+	var out bytes.Buffer
+	var events []Event
+	result := New(Options{Store: store, Stdout: &out, Stderr: &out, OnEvent: func(e Event) { events = append(events, e) }}).Run(context.Background(), req)
+	if result.Succeeded() {
+		t.Fatal("expected the second step to fail")
+	}
+	// stdout and stderr are read at the same time, so their order varies
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"***", "token=***"}) {
+		t.Errorf("expected the output to be redacted, got %q", out.String())
+	}
+	if strings.Contains(result.Err.Error(), "hunter2") || !strings.Contains(result.Err.Error(), "/nonexistent/***") {
+		t.Errorf("expected the error to be redacted, got %v", result.Err)
+	}
+	for _, e := range events {
+		if data, _ := json.Marshal(e); strings.Contains(string(data), "hunter2") {
+			t.Errorf("expected events to be redacted, got %s", data)
+		}
+	}
+
+	run, err := store.GetRun(result.RunID)
+	if err != nil || run.Logs == nil || strings.Contains(*run.Logs, "hunter2") || !strings.Contains(*run.Logs, "token=***") {
+		t.Errorf("expected the stored logs to be redacted, got %+v (%v)", run, err)
+	}
+	if run.Variables["token"] != "***" || run.Variables["env"] != "prod" {
+		t.Errorf("expected the recorded secret input to be masked, got %v", run.Variables)
+	}
+	steps, err := store.ListRunSteps(result.RunID)
+	if err != nil || len(steps) != 2 || steps[1].Error == nil || strings.Contains(*steps[1].Error, "hunter2") {
+		t.Errorf("expected the stored step error to be redacted, got %+v (%v)", steps, err)
+	}
+	if steps[0].Outputs["token"] != "***" {
+		t.Errorf("expected the recorded output to be redacted, got %v", steps[0].Outputs)
+	}
+
+	// A resumed run cannot reuse a redacted output, so the step runs again
+	out.Reset()
+	wf.Steps[1].Dir = ""
+	resumed := New(Options{Store: store, Stdout: &out, Stderr: &out}).Run(context.Background(), Request{Workflow: wf, WorkflowID: "deploy", Variables: req.Variables, Secrets: req.Secrets, ResumeFrom: result.RunID})
+	if !resumed.Succeeded() || !strings.Contains(out.String(), "token=***") {
+		t.Errorf("expected the step with a redacted output to run again, got %s with output %q", resumed.Status, out.String())
+	}
+
+	// Output sent as events is redacted too
+	events = nil
+	New(Options{OutputEvents: true, OnEvent: func(e Event) { events = append(events, e) }}).Run(context.Background(), Request{Workflow: wf, Variables: req.Variables, Secrets: req.Secrets})
+	lines = nil
+	for _, e := range events {
+		if e.Type == EventStepOutput {
+			lines = append(lines, e.Text)
+		}
+	}
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"***", "token=***"}) {
+		t.Errorf("expected redacted output events, got %q", lines)
+	}
+}
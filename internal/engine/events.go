@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"encoding/json"
+	"time"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+)
+
+// EventType identifies what happened during a run
+type EventType string
+
+const (
+	// EventRunStarted is sent once before anything runs
+	EventRunStarted EventType = "run_started"
+	// EventPhaseStarted is sent before the pre-checks, steps or actions run
+	EventPhaseStarted EventType = "phase_started"
+	// EventStepStarted is sent before every attempt of a pre-check, step or action
+	EventStepStarted EventType = "step_started"
+	// EventStepRetrying is sent when a failed attempt is about to be retried
+	EventStepRetrying EventType = "step_retrying"
+	// EventStepSkipped is sent for a step whose `when` condition is false or
+	// that was not selected, and for the pre-checks, steps and actions
+	// skipped by a resumed run
+	EventStepSkipped EventType = "step_skipped"
+	// EventStepOutput carries a line of command output when the runner
+	// sends output as events
+	EventStepOutput EventType = "step_output"
+	// EventStepFinished is sent when a pre-check, step or action is done
+	EventStepFinished EventType = "step_finished"
+	// EventHookFired is sent before an on_fail or on_success hook runs
+	EventHookFired EventType = "hook_fired"
+	// EventHookFinished is sent after an on_fail or on_success hook ran
+	EventHookFinished EventType = "hook_finished"
+	// EventWarning reports a problem that does not fail the run, such as
+	// run history that could not be recorded
+	EventWarning EventType = "warning"
+	// EventRunFinished is sent once with the result of the run
+	EventRunFinished EventType = "run_finished"
+)
+
+// Event describes progress of a run. Only the fields relevant to its type are set.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Workflow string
+	RunID    int64 // Zero when the run is not recorded
+
+	// Phase is one of the sqlite.RunPhase values, set for phase, step and hook events
+	Phase    string
+	Position int    // 1-based position of the step within its phase
+	Total    int    // Number of pre-checks, steps or requested actions in the phase
+	StepID   string // Step id, or the action name for actions
+	Name     string // Step description, falling back to its command
+
+	Attempt   int           // Current attempt, starting at 1
+	Attempts  int           // Attempts allowed by the retry policy
+	Delay     time.Duration // Wait before the next attempt (step_retrying)
+	Duration  time.Duration // Time since the step started
+	Condition string        // The false `when` condition (step_skipped)
+	Reason    string        // Why the step was skipped, when not by its condition (step_skipped)
+	Status    string        // One of the sqlite.RunStatus values (step_finished)
+	ExitCode  int           // Exit code of the command, -1 when it did not exit on its own
+	// AllowedFailure is set when a failed pre-check or step does not stop the
+	// run, because of severity: warn or allow_failure (step_finished)
+	AllowedFailure bool
+	// Outputs captured from a successful step (step_finished)
+	Outputs map[string]string
+
+	Stream string // "stdout" or "stderr" (step_output)
+	Text   string // Line of output without its newline (step_output)
+
+	Hook    string // The hook as written, e.g. "action:notify" or "run:echo done"
+	Trigger string // "on_fail" or "on_success"
+
+	Err     error
+	Message string  // Warning text
+	Result  *Result // Outcome of the run (run_finished)
+}
+
+// redactEvent replaces the secret values of r in the text of e. The result
+// of run_finished events is redacted by the run itself.
+func redactEvent(e Event, r *execution.Redactor) Event {
+	e.Name = r.String(e.Name)
+	e.Condition = r.String(e.Condition)
+	e.Reason = r.String(e.Reason)
+	e.Text = r.String(e.Text)
+	e.Hook = r.String(e.Hook)
+	e.Message = r.String(e.Message)
+	e.Err = r.Error(e.Err)
+	if len(e.Outputs) > 0 {
+		outputs := make(map[string]string, len(e.Outputs))
+		for name, value := range e.Outputs {
+			outputs[name] = r.String(value)
+		}
+		e.Outputs = outputs
+	}
+	return e
+}
+
+// eventJSON is the wire format of an Event, with durations in milliseconds
+type eventJSON struct {
+	Type       EventType         `json:"type"`
+	Time       time.Time         `json:"time"`
+	Workflow   string            `json:"workflow,omitempty"`
+	RunID      int64             `json:"run_id,omitempty"`
+	Phase      string            `json:"phase,omitempty"`
+	Position   int               `json:"position,omitempty"`
+	Total      int               `json:"total,omitempty"`
+	StepID     string            `json:"step_id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Attempt    int               `json:"attempt,omitempty"`
+	Attempts   int               `json:"attempts,omitempty"`
+	DelayMS    *int64            `json:"delay_ms,omitempty"`
+	DurationMS *int64            `json:"duration_ms,omitempty"`
+	Condition  string            `json:"condition,omitempty"`
+	Reason     string            `json:"reason,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	Allowed    bool              `json:"allowed_failure,omitempty"`
+	Outputs    map[string]string `json:"outputs,omitempty"`
+	Stream     string            `json:"stream,omitempty"`
+	Text       *string           `json:"text,omitempty"`
+	Hook       string            `json:"hook,omitempty"`
+	Trigger    string            `json:"trigger,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Result     *Result           `json:"result,omitempty"`
+}
+
+// MarshalJSON encodes the event with snake_case fields, leaving out the
+// fields that do not apply to its type
+func (e Event) MarshalJSON() ([]byte, error) {
+	out := eventJSON{
+		Type:      e.Type,
+		Time:      e.Time,
+		Workflow:  e.Workflow,
+		RunID:     e.RunID,
+		Phase:     e.Phase,
+		Position:  e.Position,
+		Total:     e.Total,
+		StepID:    e.StepID,
+		Name:      e.Name,
+		Attempt:   e.Attempt,
+		Attempts:  e.Attempts,
+		Condition: e.Condition,
+		Reason:    e.Reason,
+		Status:    e.Status,
+		Allowed:   e.AllowedFailure,
+		Outputs:   e.Outputs,
+		Stream:    e.Stream,
+		Hook:      e.Hook,
+		Trigger:   e.Trigger,
+		Message:   e.Message,
+		Result:    e.Result,
+	}
+
+	switch e.Type {
+	case EventStepRetrying:
+		out.DelayMS = milliseconds(e.Delay)
+	case EventStepOutput:
+		out.Text = &e.Text
+	case EventStepFinished, EventHookFinished:
+		out.DurationMS = milliseconds(e.Duration)
+		out.ExitCode = &e.ExitCode
+	}
+	if e.Err != nil {
+		out.Error = e.Err.Error()
+	}
+
+	return json.Marshal(out)
+}
+
+// MarshalJSON encodes the result with snake_case fields and its duration in milliseconds
+func (r *Result) MarshalJSON() ([]byte, error) {
+	out := struct {
+		RunID      int64  `json:"run_id,omitempty"`
+		Status     string `json:"status"`
+		Error      string `json:"error,omitempty"`
+		DurationMS int64  `json:"duration_ms"`
+		PreChecks  struct {
+			Passed int `json:"passed"`
+			Failed int `json:"failed"`
+			Warned int `json:"warned"`
+		} `json:"prechecks"`
+		Steps struct {
+			Total     int `json:"total"`
+			Completed int `json:"completed"`
+			Skipped   int `json:"skipped"`
+			Warned    int `json:"warned"`
+		} `json:"steps"`
+	}{
+		RunID:      r.RunID,
+		Status:     r.Status,
+		DurationMS: r.Duration.Milliseconds(),
+	}
+	if r.Err != nil {
+		out.Error = r.Err.Error()
+	}
+	out.PreChecks.Passed, out.PreChecks.Failed, out.PreChecks.Warned = r.PreChecksPassed, r.PreChecksFailed, r.PreChecksWarned
+	out.Steps.Total, out.Steps.Completed, out.Steps.Skipped, out.Steps.Warned = r.StepsTotal, r.StepsCompleted, r.StepsSkipped, r.StepsWarned
+
+	return json.Marshal(out)
+}
+
+func milliseconds(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
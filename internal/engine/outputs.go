@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// variables returns the request variables along with the outputs of the
+// steps finished so far
+func (rn *run) variables() map[string]string {
+	rn.outputsMu.Lock()
+	defer rn.outputsMu.Unlock()
+
+	if len(rn.outputs) == 0 {
+		return rn.req.Variables
+	}
+	variables := make(map[string]string, len(rn.req.Variables)+len(rn.outputs))
+	for name, value := range rn.req.Variables {
+		variables[name] = value
+	}
+	for name, value := range rn.outputs {
+		variables[name] = value
+	}
+	return variables
+}
+
+// setOutputs makes the outputs of a step available to the steps after it.
+// Only steps with an id have outputs.
+func (rn *run) setOutputs(se stepExecution, outputs map[string]string) {
+	if se.phase != sqlite.RunPhaseStep || se.id == "" || len(outputs) == 0 {
+		return
+	}
+
+	rn.outputsMu.Lock()
+	defer rn.outputsMu.Unlock()
+	if rn.outputs == nil {
+		rn.outputs = make(map[string]string)
+	}
+	for name, value := range outputs {
+		rn.outputs[workflow.OutputVariable(se.id, name)] = value
+	}
+}
+
+// outputCapture collects what an attempt of a step with outputs writes to
+// stdout and to the $MIGRAINE_OUTPUT file. A nil outputCapture captures
+// nothing, for steps without outputs.
+type outputCapture struct {
+	stdout bytes.Buffer
+	file   string
+}
+
+// newOutputCapture creates the $MIGRAINE_OUTPUT file of a step with outputs
+func newOutputCapture(step workflow.YAMLStep) (*outputCapture, error) {
+	if len(step.Outputs) == 0 {
+		return nil, nil
+	}
+
+	file, err := os.CreateTemp("", "migraine-output-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the output file: %w", err)
+	}
+	file.Close()
+	return &outputCapture{file: file.Name()}, nil
+}
+
+// env adds $MIGRAINE_OUTPUT to the environment of the command
+func (c *outputCapture) env(env []string) []string {
+	if c == nil {
+		return env
+	}
+	return append(env[:len(env):len(env)], workflow.OutputFileEnv+"="+c.file)
+}
+
+// wrap copies the standard output of the command into the capture
+func (c *outputCapture) wrap(out stepOutput) stepOutput {
+	if c == nil {
+		return out
+	}
+	out.stdout = io.MultiWriter(out.stdout, &c.stdout)
+	return out
+}
+
+// values extracts the outputs of step from what the command wrote
+func (c *outputCapture) values(step workflow.YAMLStep) (map[string]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(c.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the output file: %w", err)
+	}
+	file := workflow.ParseOutputFile(string(content))
+
+	names := make([]string, 0, len(step.Outputs))
+	for name := range step.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := step.Outputs[name].Extract(name, c.stdout.String(), file)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// close removes the $MIGRAINE_OUTPUT file
+func (c *outputCapture) close() {
+	if c != nil {
+		os.Remove(c.file)
+	}
+}
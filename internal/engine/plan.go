@@ -0,0 +1,333 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+// Plan is what a run would execute, with variables applied, built without
+// running anything
+type Plan struct {
+	Workflow  string            `json:"workflow"`
+	Variables []PlannedVariable `json:"variables"`
+	// Missing lists the variables used by the workflow that have no value
+	Missing   []string      `json:"missing,omitempty"`
+	PreChecks []PlannedStep `json:"pre_checks"`
+	Steps     []PlannedStep `json:"steps,omitempty"`
+	Actions   []PlannedStep `json:"actions,omitempty"`
+	// OnSuccess, OnFailure and Finally are the workflow hooks
+	OnSuccess []PlannedStep `json:"on_success,omitempty"`
+	OnFailure []PlannedStep `json:"on_failure,omitempty"`
+	Finally   []PlannedStep `json:"finally,omitempty"`
+	// Error reports a problem with the whole workflow, such as a dependency cycle
+	Error string `json:"error,omitempty"`
+}
+
+// PlannedVariable is a resolved variable and where its value came from
+type PlannedVariable struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+}
+
+// PlannedStep is a pre-check, step or action of a Plan
+type PlannedStep struct {
+	Phase    string        `json:"phase"`
+	Position int           `json:"position"`
+	StepID   string        `json:"step_id,omitempty"` // Step id, or the action name for actions
+	Name     string        `json:"name"`
+	Command  string        `json:"command,omitempty"`
+	Timeout  string        `json:"timeout,omitempty"`
+	Retry    string        `json:"retry,omitempty"` // e.g. "2 retries, exponential backoff from 5s"
+	Needs    []string      `json:"needs,omitempty"`
+	When     string        `json:"when,omitempty"`
+	Dir      string        `json:"dir,omitempty"`
+	Env      []string      `json:"env,omitempty"` // KEY=value pairs added to the environment
+	Shell    string        `json:"shell,omitempty"`
+	Script   bool          `json:"script,omitempty"` // Command is a script run from a file
+	Sudo     bool          `json:"sudo,omitempty"`   // Command runs as root through sudo
+	Hooks    []PlannedHook `json:"hooks,omitempty"`
+	// Outputs maps the outputs of the step to where they are captured from,
+	// e.g. "last_line"
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// AllowFailure is set when a failure would not stop the run: steps with
+	// allow_failure and pre-checks with severity: warn
+	AllowFailure bool `json:"allow_failure,omitempty"`
+	// Skip explains why the step would be skipped, e.g. "not selected"
+	Skip string `json:"skip,omitempty"`
+	// Error explains why the step could not be resolved, e.g. missing variables
+	Error string `json:"error,omitempty"`
+}
+
+// PlannedHook is an on_fail or on_success hook of a planned step
+type PlannedHook struct {
+	Trigger string `json:"trigger"` // "on_fail" or "on_success"
+	Hook    string `json:"hook"`    // The hook as written
+	Command string `json:"command,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Valid reports whether every planned command could be resolved
+func (p *Plan) Valid() bool {
+	if p.Error != "" || len(p.Missing) > 0 {
+		return false
+	}
+	for _, steps := range [][]PlannedStep{p.PreChecks, p.Steps, p.Actions, p.OnSuccess, p.OnFailure, p.Finally} {
+		for _, step := range steps {
+			if step.Error != "" {
+				return false
+			}
+			for _, hook := range step.Hooks {
+				if hook.Error != "" {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Plan resolves what running req would execute: the commands of the
+// pre-checks, of the steps or requested actions and of the workflow hooks,
+// their step hooks, timeouts and retry policies, with variables applied.
+// sources maps variable names to where their value came from, as reported
+// by workflow.VariableResolver.ResolveVariablesWithSources; it may be nil.
+// The values of req.Secrets are redacted.
+func (r *Runner) Plan(req Request, sources map[string]string) *Plan {
+	rn := &run{Runner: r, req: req, redact: execution.NewRedactor(req.Secrets)}
+	wf := req.Workflow
+
+	// Step outputs are only known once steps ran, so commands show them as
+	// placeholders
+	for _, step := range wf.Steps {
+		placeholders := make(map[string]string, len(step.Outputs))
+		for name := range step.Outputs {
+			placeholders[name] = "{{" + workflow.OutputVariable(step.ID, name) + "}}"
+		}
+		rn.setOutputs(stepExecution{phase: sqlite.RunPhaseStep, id: step.ID}, placeholders)
+	}
+
+	plan := &Plan{Workflow: wf.Name}
+	for name, value := range req.Variables {
+		plan.Variables = append(plan.Variables, PlannedVariable{Name: name, Value: rn.redact.String(value), Source: sources[name]})
+	}
+	sort.Slice(plan.Variables, func(i, j int) bool { return plan.Variables[i].Name < plan.Variables[j].Name })
+
+	var err error
+	if rn.selected, err = rn.selectSteps(); err != nil {
+		plan.Error = err.Error()
+	}
+	if rn.resume, err = rn.loadResume(); err != nil && plan.Error == "" {
+		plan.Error = err.Error()
+	}
+
+	used := make(map[string]bool)
+	for i, check := range wf.PreChecks {
+		plan.PreChecks = append(plan.PreChecks, rn.planStep(sqlite.RunPhasePrecheck, i+1, "", check, used))
+	}
+
+	if len(req.Actions) > 0 {
+		for i, name := range req.Actions {
+			action, ok := wf.Actions[name]
+			if !ok {
+				plan.Actions = append(plan.Actions, PlannedStep{
+					Phase:    sqlite.RunPhaseAction,
+					Position: i + 1,
+					StepID:   name,
+					Name:     name,
+					Error:    fmt.Sprintf("action '%s' not found in workflow", name),
+				})
+				continue
+			}
+			plan.Actions = append(plan.Actions, rn.planStep(sqlite.RunPhaseAction, i+1, name, action, used))
+		}
+	} else {
+		if _, err := workflow.NewStepGraph(wf.Steps); err != nil && plan.Error == "" {
+			plan.Error = fmt.Sprintf("invalid step dependencies: %v", err)
+		}
+		for i, step := range wf.Steps {
+			plan.Steps = append(plan.Steps, rn.planStep(sqlite.RunPhaseStep, i+1, step.ID, step, used))
+		}
+	}
+
+	plan.OnSuccess = rn.planSteps(sqlite.RunPhaseOnSuccess, wf.OnSuccess, used)
+	plan.OnFailure = rn.planSteps(sqlite.RunPhaseOnFailure, wf.OnFailure, used)
+	plan.Finally = rn.planSteps(sqlite.RunPhaseFinally, wf.Finally, used)
+
+	variables := rn.variables()
+	for name := range used {
+		if _, ok := variables[name]; !ok {
+			plan.Missing = append(plan.Missing, name)
+		}
+	}
+	sort.Strings(plan.Missing)
+
+	return plan
+}
+
+// planSteps resolves the steps of a workflow hook
+func (rn *run) planSteps(phase string, steps []workflow.YAMLStep, used map[string]bool) []PlannedStep {
+	var planned []PlannedStep
+	for i, step := range steps {
+		planned = append(planned, rn.planStep(phase, i+1, step.ID, step, used))
+	}
+	return planned
+}
+
+// planStep resolves a single step, adding the variables it uses to used
+func (rn *run) planStep(phase string, position int, id string, step workflow.YAMLStep, used map[string]bool) PlannedStep {
+	planned := PlannedStep{
+		Phase:    phase,
+		Position: position,
+		StepID:   id,
+		Name:     StepDescription(step),
+		Needs:    step.Needs,
+		When:     step.When,
+		Shell:    rn.stepShell(step),
+		Script:   step.Script != "",
+		Sudo:     step.Sudo,
+	}
+	for name, output := range step.Outputs {
+		if planned.Outputs == nil {
+			planned.Outputs = make(map[string]string)
+		}
+		planned.Outputs[name] = output.String()
+	}
+	se := stepExecution{phase: phase, position: position, step: step}
+	planned.Skip = rn.skipReason(se)
+	planned.AllowFailure = se.toleratesFailure()
+	if planned.Skip != "" {
+		// Skipped steps do not run, so their variables and settings do not matter
+		planned.Command, _ = rn.planCommand(step.Code())
+		return planned
+	}
+	markUsed(used, step.Code(), string(step.Timeout), string(step.RetryDelay), step.When, step.Dir, rn.req.Workflow.Dir)
+	for _, env := range []map[string]string{rn.req.Workflow.Env, step.Env} {
+		for _, value := range env {
+			markUsed(used, value)
+		}
+	}
+
+	var problems []string
+	if step.Sudo && rn.req.NoSudo {
+		problems = append(problems, errSudoDisabled.Error())
+	}
+	command, err := rn.planCommand(step.Code())
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	planned.Command = command
+
+	if timeout, err := rn.stepTimeout(step); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid timeout: %v", err))
+	} else if timeout > 0 {
+		planned.Timeout = timeout.String()
+	}
+
+	if retry, err := rn.stepRetryPolicy(step); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid retry settings: %v", err))
+	} else if retry.Retries > 0 {
+		planned.Retry = describeRetry(retry)
+	}
+
+	if step.When != "" {
+		if _, err := workflow.ParseCondition(step.When); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid when: %v", err))
+		}
+	}
+
+	if dir, env, err := rn.stepEnvironment(step); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		planned.Dir = rn.redact.String(dir)
+		for _, pair := range env {
+			planned.Env = append(planned.Env, rn.redact.String(pair))
+		}
+	}
+	planned.Error = rn.redact.String(strings.Join(problems, "; "))
+
+	for _, hook := range []struct{ trigger, hook string }{{"on_fail", step.OnFail}, {"on_success", step.OnSuccess}} {
+		if hook.hook != "" {
+			planned.Hooks = append(planned.Hooks, rn.planHook(hook.trigger, hook.hook, used))
+		}
+	}
+
+	return planned
+}
+
+// planHook resolves the command an on_fail or on_success hook would run
+func (rn *run) planHook(trigger, hook string, used map[string]bool) PlannedHook {
+	planned := PlannedHook{Trigger: trigger, Hook: hook}
+
+	var raw string
+	if actionName, ok := strings.CutPrefix(hook, "action:"); ok {
+		action, ok := rn.req.Workflow.Actions[actionName]
+		if !ok {
+			planned.Error = fmt.Sprintf("action '%s' not found", actionName)
+			return planned
+		}
+		raw = action.Code()
+	} else if command, ok := strings.CutPrefix(hook, "run:"); ok {
+		raw = command
+	} else {
+		planned.Error = fmt.Sprintf("unknown hook format: %s (must start with 'action:' or 'run:')", hook)
+		return planned
+	}
+
+	markUsed(used, raw)
+	command, err := rn.planCommand(raw)
+	if err != nil {
+		planned.Error = err.Error()
+	}
+	planned.Command = command
+	return planned
+}
+
+// planCommand applies variables to a command, with the secrets redacted.
+// When some are missing it returns the error along with the command with
+// the known variables applied.
+func (rn *run) planCommand(command string) (string, error) {
+	applied, err := rn.opts.Resolver.ApplyVariables(command, rn.variables())
+	if err == nil {
+		return rn.redact.String(applied), nil
+	}
+
+	for k, v := range rn.variables() {
+		command = strings.ReplaceAll(command, fmt.Sprintf("{{%s}}", k), v)
+	}
+	return rn.redact.String(command), rn.redact.Error(err)
+}
+
+// markUsed adds the {{variables}} referenced by texts to used
+func markUsed(used map[string]bool, texts ...string) {
+	for _, text := range texts {
+		for _, name := range utils.ExtractTemplateVars(text) {
+			used[name] = true
+		}
+	}
+}
+
+// describeRetry summarizes a retry policy, e.g. "2 retries, exponential backoff from 5s"
+func describeRetry(retry workflow.RetryPolicy) string {
+	text := fmt.Sprintf("%d retries", retry.Retries)
+	if retry.Retries == 1 {
+		text = "1 retry"
+	}
+	if retry.Delay > 0 {
+		if retry.Backoff == workflow.BackoffExponential {
+			text += fmt.Sprintf(", exponential backoff from %s", retry.Delay)
+		} else {
+			text += fmt.Sprintf(" every %s", retry.Delay)
+		}
+	}
+	if retry.Jitter {
+		text += " with jitter"
+	}
+	return text
+}
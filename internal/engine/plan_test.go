@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+func TestPlan_ResolvesCommandsAndHooks(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:      "deploy",
+		PreChecks: []workflow.YAMLStep{{Command: "test -n {{env}}"}},
+		Steps: []workflow.YAMLStep{
+			{ID: "build", Command: "make {{target}}", Timeout: "5m", Retries: 2, RetryDelay: "5s", Backoff: "exponential"},
+			{ID: "ship", Needs: []string{"build"}, When: "{{env}} == 'prod'", Command: "ship --env {{env}}", OnFail: "action:rollback", OnSuccess: "run:echo shipped {{target}}"},
+		},
+		Actions: map[string]workflow.YAMLStep{
+			"rollback": {Command: "rollback --env {{env}}"},
+		},
+	}
+
+	plan := New(Options{}).Plan(Request{
+		Workflow:  wf,
+		Variables: map[string]string{"target": "all", "env": "prod"},
+	}, map[string]string{"target": workflow.SourceFlag, "env": "env:DEPLOY_ENV"})
+
+	if !plan.Valid() {
+		t.Fatalf("expected a valid plan, got %+v", plan)
+	}
+	want := []PlannedVariable{{"env", "prod", "env:DEPLOY_ENV"}, {"target", "all", workflow.SourceFlag}}
+	if !slices.Equal(plan.Variables, want) {
+		t.Errorf("expected variables %v, got %v", want, plan.Variables)
+	}
+	if len(plan.PreChecks) != 1 || plan.PreChecks[0].Command != "test -n prod" {
+		t.Errorf("unexpected pre-checks %+v", plan.PreChecks)
+	}
+	if len(plan.Steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(plan.Steps))
+	}
+
+	build := plan.Steps[0]
+	if build.Command != "make all" || build.Timeout != "5m0s" || build.Retry != "2 retries, exponential backoff from 5s" {
+		t.Errorf("unexpected build step %+v", build)
+	}
+
+	ship := plan.Steps[1]
+	if ship.Command != "ship --env prod" || ship.When != "{{env}} == 'prod'" || !slices.Equal(ship.Needs, []string{"build"}) {
+		t.Errorf("unexpected ship step %+v", ship)
+	}
+	wantHooks := []PlannedHook{
+		{Trigger: "on_fail", Hook: "action:rollback", Command: "rollback --env prod"},
+		{Trigger: "on_success", Hook: "run:echo shipped {{target}}", Command: "echo shipped all"},
+	}
+	if !slices.Equal(ship.Hooks, wantHooks) {
+		t.Errorf("expected hooks %+v, got %+v", wantHooks, ship.Hooks)
+	}
+}
+
+func TestPlan_ReportsProblems(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "broken",
+		Steps: []workflow.YAMLStep{
+			{Command: "echo {{known}} {{missing}}", OnFail: "action:nope"},
+			{Command: "echo ok", Timeout: "soon"},
+		},
+	}
+
+	plan := New(Options{}).Plan(Request{Workflow: wf, Variables: map[string]string{"known": "yes"}}, nil)
+	if plan.Valid() {
+		t.Fatal("expected an invalid plan")
+	}
+	if !slices.Equal(plan.Missing, []string{"missing"}) {
+		t.Errorf("expected missing variables [missing], got %v", plan.Missing)
+	}
+
+	first := plan.Steps[0]
+	if first.Command != "echo yes {{missing}}" || first.Error == "" {
+		t.Errorf("expected a partially resolved command with an error, got %+v", first)
+	}
+	if len(first.Hooks) != 1 || !strings.Contains(first.Hooks[0].Error, "action 'nope' not found") {
+		t.Errorf("expected an unknown hook action, got %+v", first.Hooks)
+	}
+	if !strings.Contains(plan.Steps[1].Error, "invalid timeout") {
+		t.Errorf("expected an invalid timeout, got %q", plan.Steps[1].Error)
+	}
+}
+
+func TestPlan_Actions(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:    "release",
+		Steps:   []workflow.YAMLStep{{Command: "echo step"}},
+		Actions: map[string]workflow.YAMLStep{"tag": {Command: "git tag {{version}}"}},
+	}
+
+	plan := New(Options{}).Plan(Request{
+		Workflow:  wf,
+		Actions:   []string{"tag", "publish"},
+		Variables: map[string]string{"version": "v1"},
+	}, nil)
+
+	if len(plan.Steps) != 0 || len(plan.Actions) != 2 {
+		t.Fatalf("expected only the actions to be planned, got %+v", plan)
+	}
+	if plan.Actions[0].Command != "git tag v1" || plan.Actions[0].Error != "" {
+		t.Errorf("unexpected action %+v", plan.Actions[0])
+	}
+	if !strings.Contains(plan.Actions[1].Error, "action 'publish' not found") || plan.Valid() {
+		t.Errorf("expected an unknown action error, got %+v", plan.Actions[1])
+	}
+}
+
+func TestPlan_StepOutputs(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name: "deploy",
+		Steps: []workflow.YAMLStep{
+			{ID: "build", Command: "make image", Outputs: map[string]workflow.StepOutput{"tag": {From: workflow.OutputFromLastLine}}},
+			{Command: "docker push app:{{steps.build.outputs.tag}}"},
+			{Command: "echo {{steps.build.outputs.digest}}"},
+		},
+	}
+
+	plan := New(Options{}).Plan(Request{Workflow: wf}, nil)
+	if got := plan.Steps[0].Outputs["tag"]; got != "last_line" {
+		t.Errorf("expected the build output to be planned, got %q", got)
+	}
+	if plan.Steps[1].Command != "docker push app:{{steps.build.outputs.tag}}" || plan.Steps[1].Error != "" {
+		t.Errorf("expected the output to stay a placeholder, got %+v", plan.Steps[1])
+	}
+	if !slices.Equal(plan.Missing, []string{"steps.build.outputs.digest"}) {
+		t.Errorf("expected only the undeclared output to be missing, got %v", plan.Missing)
+	}
+}
+
+func TestPlan_Sudo(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "install",
+		Steps: []workflow.YAMLStep{{Command: "make"}, {Command: "make install", Sudo: true}},
+	}
+
+	plan := New(Options{}).Plan(Request{Workflow: wf}, nil)
+	if plan.Steps[0].Sudo || !plan.Steps[1].Sudo || !plan.Valid() {
+		t.Errorf("expected only the second step to be marked sudo, got %+v", plan.Steps)
+	}
+
+	plan = New(Options{}).Plan(Request{Workflow: wf, NoSudo: true}, nil)
+	if plan.Valid() || plan.Steps[1].Error != "sudo is disabled for this run" {
+		t.Errorf("expected the sudo step to be refused, got %+v", plan.Steps[1])
+	}
+}
+
+func TestPlan_RedactsSecrets(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:  "deploy",
+		Steps: []workflow.YAMLStep{{Command: "login --token {{token}} --user {{user}}"}, {Command: "echo {{token}} {{missing}}"}},
+	}
+
+	plan := New(Options{}).Plan(Request{
+		Workflow:  wf,
+		Variables: map[string]string{"token": "hunter2", "user": "ci"},
+		Secrets:   []string{"hunter2"},
+	}, nil)
+
+	if plan.Variables[0].Value != "***" || plan.Variables[1].Value != "ci" {
+		t.Errorf("expected the secret value to be redacted, got %v", plan.Variables)
+	}
+	if plan.Steps[0].Command != "login --token *** --user ci" || plan.Steps[1].Command != "echo *** {{missing}}" {
+		t.Errorf("expected redacted commands, got %q and %q", plan.Steps[0].Command, plan.Steps[1].Command)
+	}
+}
+
+func TestPlan_RedactsSecretsInDirAndEnv(t *testing.T) {
+	wf := &workflow.YAMLWorkflow{
+		Name:   "deploy",
+		Config: workflow.YAMLConfig{ExportVariables: workflow.VariableExports{All: true}},
+		Steps: []workflow.YAMLStep{{
+			Command: "deploy",
+			Dir:     "/tmp/{{token}}",
+			Env:     map[string]string{"TOKEN": "{{token}}"},
+		}},
+	}
+
+	plan := New(Options{}).Plan(Request{
+		Workflow:  wf,
+		Variables: map[string]string{"token": "hunter2"},
+		Secrets:   []string{"hunter2"},
+	}, nil)
+
+	step := plan.Steps[0]
+	if step.Dir != "/tmp/***" {
+		t.Errorf("expected the dir to be redacted, got %q", step.Dir)
+	}
+	if !slices.Contains(step.Env, "TOKEN=***") || !slices.Contains(step.Env, "token=***") {
+		t.Errorf("expected the env to be redacted, got %q", step.Env)
+	}
+	if data, _ := json.Marshal(plan); strings.Contains(string(data), "hunter2") {
+		t.Errorf("expected no secret in the JSON plan, got %s", data)
+	}
+}
@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// recorder persists a workflow execution to the runs table.
+// Recording is best effort: a storage error is reported once and
+// disables further recording, it never aborts the workflow itself.
+// It is safe for steps running in parallel. A nil recorder records nothing.
+type recorder struct {
+	mu       sync.Mutex
+	store    *sqlite.RunStore
+	run      sqlite.Run
+	disabled bool
+	warn     func(message string)
+	// redact removes secret values from the stored logs and errors
+	redact *execution.Redactor
+
+	// Output capture, only set when the workflow enables store_logs
+	logs *execution.OutputLog
+}
+
+// startRecorder records a new run with the workflow, invoker, origin and
+// variables of run, or continues the existing run record runID when it is
+// non-zero (background runs)
+func startRecorder(store *sqlite.RunStore, run sqlite.Run, storeLogs bool, runID int64, redact *execution.Redactor, warn func(string)) *recorder {
+	run.Status = sqlite.RunStatusRunning
+	run.StartedAt = time.Now().UTC()
+	rec := &recorder{
+		store:  store,
+		warn:   warn,
+		run:    run,
+		redact: redact,
+	}
+
+	if runID != 0 {
+		run, err := rec.store.GetRun(runID)
+		if err != nil {
+			rec.disable(err)
+			return rec
+		}
+		rec.run = *run
+	} else {
+		id, err := rec.store.CreateRun(rec.run)
+		if err != nil {
+			rec.disable(err)
+			return rec
+		}
+		rec.run.ID = id
+	}
+
+	if storeLogs {
+		rec.logs = execution.NewOutputLog()
+	}
+
+	return rec
+}
+
+// runID returns the ID of the recorded run, or 0 when nothing is recorded
+func (r *recorder) runID() int64 {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return 0
+	}
+	return r.run.ID
+}
+
+// execute runs a command with opts, writing its output to out
+// and tee-ing it into the run logs when they are captured
+func (r *recorder) execute(ctx context.Context, label, command string, opts execution.Options, out stepOutput) error {
+	opts.Stdout, opts.Stderr, opts.Background = out.stdout, out.stderr, out.background
+	if r == nil || r.logs == nil || r.isDisabled() {
+		return execution.Execute(ctx, command, opts)
+	}
+
+	stdout := r.logs.Writer(label, "stdout")
+	stderr := r.logs.Writer(label, "stderr")
+
+	if opts.Stdout == nil {
+		opts.Stdout = os.Stdout
+	}
+	if opts.Stderr == nil {
+		opts.Stderr = os.Stderr
+	}
+	opts.Stdout = io.MultiWriter(opts.Stdout, stdout)
+	opts.Stderr = io.MultiWriter(opts.Stderr, stderr)
+	err := execution.Execute(ctx, command, opts)
+	stdout.Flush()
+	stderr.Flush()
+	r.flushLogs()
+
+	return err
+}
+
+func (r *recorder) isDisabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.disabled
+}
+
+// flushLogs persists the output captured so far so it can be followed with `runs tail`
+func (r *recorder) flushLogs() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.disabled || r.logs == nil {
+		return
+	}
+
+	logs := r.redact.String(r.logs.String())
+	r.run.Logs = &logs
+	if err := r.store.UpdateRun(r.run); err != nil {
+		r.disable(err)
+	}
+}
+
+// beginStep records the start of a pre-check, step or action attempt and returns its step ID
+func (r *recorder) beginStep(phase string, position, attempt int, step workflow.YAMLStep) int64 {
+	if r == nil || phase == "" {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return 0
+	}
+
+	id, err := r.store.CreateRunStep(sqlite.RunStep{
+		RunID:       r.run.ID,
+		Phase:       phase,
+		Position:    position,
+		Attempt:     attempt,
+		Description: StepDescription(step),
+		Command:     step.Code(),
+		Status:      sqlite.RunStatusRunning,
+		StartedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		r.disable(err)
+		return 0
+	}
+
+	return id
+}
+
+// skipStep records a step that did not run because its condition was false
+func (r *recorder) skipStep(phase string, position int, step workflow.YAMLStep) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return
+	}
+
+	now := time.Now().UTC()
+	if _, err := r.store.CreateRunStep(sqlite.RunStep{
+		RunID:       r.run.ID,
+		Phase:       phase,
+		Position:    position,
+		Description: StepDescription(step),
+		Command:     step.Code(),
+		Status:      sqlite.RunStatusSkipped,
+		StartedAt:   now,
+		CompletedAt: &now,
+	}); err != nil {
+		r.disable(err)
+	}
+}
+
+// endStep records the outcome of a step previously opened with beginStep
+// and the outputs captured from it, with the secrets redacted
+func (r *recorder) endStep(stepID int64, stepErr error, outputs map[string]string) {
+	if r == nil || stepID == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return
+	}
+
+	completedAt := time.Now().UTC()
+	step := sqlite.RunStep{
+		ID:          stepID,
+		Status:      sqlite.RunStatusSuccess,
+		CompletedAt: &completedAt,
+	}
+	for name, value := range outputs {
+		if step.Outputs == nil {
+			step.Outputs = make(map[string]string, len(outputs))
+		}
+		step.Outputs[name] = r.redact.String(value)
+	}
+
+	if stepErr != nil {
+		step.Status = FailureStatus(stepErr)
+		msg := r.redact.String(stepErr.Error())
+		step.Error = &msg
+	}
+	code := exitCode(stepErr)
+	step.ExitCode = &code
+
+	if err := r.store.UpdateRunStep(step); err != nil {
+		r.disable(err)
+	}
+}
+
+// finish finalizes the run with the given status and completion time
+func (r *recorder) finish(status string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return
+	}
+
+	completedAt := time.Now().UTC()
+	r.run.Status = status
+	r.run.CompletedAt = &completedAt
+	if r.logs != nil {
+		logs := r.redact.String(r.logs.String())
+		r.run.Logs = &logs
+	}
+
+	if err := r.store.UpdateRun(r.run); err != nil {
+		r.disable(err)
+	}
+}
+
+// disable turns off recording after a storage error. Callers hold r.mu once
+// the run has started.
+func (r *recorder) disable(err error) {
+	r.disabled = true
+	r.warn(fmt.Sprintf("Run history will not be recorded: %v", err))
+}
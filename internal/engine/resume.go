@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+)
+
+// resumeState tells which pre-checks, steps and actions a run skips because
+// of Request.ResumeFrom and Request.FromStep
+type resumeState struct {
+	fromStep int
+	// outcomes holds the latest recorded outcome of every pre-check, step and
+	// action of the resumed runs
+	outcomes map[stepKey]stepOutcome
+}
+
+type stepKey struct {
+	phase    string
+	position int
+}
+
+type stepOutcome struct {
+	runID   int64
+	status  string
+	command string // Command template, to notice steps changed since
+	outputs map[string]string
+}
+
+// loadResume reads the outcomes of the run being resumed and of the runs it
+// resumed in turn. It returns nil when the run neither resumes nor starts
+// from a later step.
+func (rn *run) loadResume() (*resumeState, error) {
+	if rn.req.ResumeFrom == 0 && rn.req.FromStep <= 1 {
+		return nil, nil
+	}
+
+	state := &resumeState{fromStep: rn.req.FromStep}
+	if rn.req.FromStep > len(rn.req.Workflow.Steps) && len(rn.req.Actions) == 0 {
+		return nil, fmt.Errorf("cannot start from step %d, the workflow has %d steps", rn.req.FromStep, len(rn.req.Workflow.Steps))
+	}
+	if rn.req.ResumeFrom == 0 {
+		return state, nil
+	}
+	if rn.opts.Store == nil {
+		return nil, fmt.Errorf("cannot resume run %d without run history", rn.req.ResumeFrom)
+	}
+
+	state.outcomes = make(map[stepKey]stepOutcome)
+	seen := make(map[int64]bool)
+	for id := rn.req.ResumeFrom; id != 0 && !seen[id]; {
+		seen[id] = true
+
+		previous, err := rn.opts.Store.GetRun(id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume run %d: %w", rn.req.ResumeFrom, err)
+		}
+		if id == rn.req.ResumeFrom {
+			if rn.req.WorkflowID != "" && previous.WorkflowID != rn.req.WorkflowID {
+				return nil, fmt.Errorf("cannot resume run %d: it ran workflow '%s', not '%s'", id, previous.WorkflowID, rn.req.WorkflowID)
+			}
+			if previous.Status == sqlite.RunStatusRunning {
+				return nil, fmt.Errorf("cannot resume run %d: it is still running", id)
+			}
+		}
+
+		steps, err := rn.opts.Store.ListRunSteps(id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resume run %d: %w", rn.req.ResumeFrom, err)
+		}
+
+		// Later attempts and later runs take precedence. Skipped steps did
+		// not run, so they leave the outcome of earlier runs in place.
+		for i := len(steps) - 1; i >= 0; i-- {
+			step := steps[i]
+			key := stepKey{step.Phase, step.Position}
+			if _, known := state.outcomes[key]; known || step.Status == sqlite.RunStatusSkipped {
+				continue
+			}
+			state.outcomes[key] = stepOutcome{runID: id, status: step.Status, command: step.Command, outputs: step.Outputs}
+		}
+
+		id = previous.ResumedFrom
+	}
+
+	return state, nil
+}
+
+// skipReason explains why a pre-check, step or action is skipped, or returns
+// "" when it runs. A nil resumeState skips nothing.
+func (s *resumeState) skipReason(se stepExecution) string {
+	if s == nil {
+		return ""
+	}
+
+	if se.phase == sqlite.RunPhaseStep && s.fromStep > 1 {
+		if se.position < s.fromStep {
+			return fmt.Sprintf("before step %d", s.fromStep)
+		}
+		return ""
+	}
+
+	outcome, ok := s.outcomes[stepKey{se.phase, se.position}]
+	if !ok || outcome.status != sqlite.RunStatusSuccess || outcome.command != se.step.Code() || outcome.redacted() {
+		return ""
+	}
+	return fmt.Sprintf("succeeded in run #%d", outcome.runID)
+}
+
+// redacted reports whether a recorded output had secrets redacted. The
+// step runs again, since later steps need the actual value.
+func (o stepOutcome) redacted() bool {
+	for _, value := range o.outputs {
+		if strings.Contains(value, execution.RedactedValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// outputs returns the outputs a skipped step had when it succeeded in a
+// resumed run, or nil. A nil resumeState has none.
+func (s *resumeState) outputs(se stepExecution) map[string]string {
+	if s == nil {
+		return nil
+	}
+
+	outcome, ok := s.outcomes[stepKey{se.phase, se.position}]
+	if !ok || outcome.status != sqlite.RunStatusSuccess || outcome.command != se.step.Code() || outcome.redacted() {
+		return nil
+	}
+	return outcome.outputs
+}
@@ -0,0 +1,554 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// stepOutput is where a step and its hooks write their output
+type stepOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	// background is set for steps running alongside others, which get no
+	// terminal input
+	background bool
+}
+
+// stepExecution describes a pre-check, step or action to run
+type stepExecution struct {
+	phase    string
+	position int
+	total    int
+	id       string // Step id, or the action name for actions
+	step     workflow.YAMLStep
+	label    string // Names the step in logs, e.g. "step 2"
+	// parallel is set for steps running alongside others, whose output is
+	// prefixed by the step name
+	parallel bool
+	// results evaluates the `when` condition of steps and collects their
+	// outcome; nil for pre-checks and actions
+	results *stepResults
+}
+
+// event returns an event of type t describing the step
+func (se stepExecution) event(t EventType) Event {
+	return Event{
+		Type:     t,
+		Phase:    se.phase,
+		Position: se.position,
+		Total:    se.total,
+		StepID:   se.id,
+		Name:     StepDescription(se.step),
+	}
+}
+
+// runStep runs a pre-check, step or action with its hooks, reporting its
+// progress as events. It returns a *StepError when the step fails.
+func (rn *run) runStep(se stepExecution) error {
+	if reason := rn.skipReason(se); reason != "" {
+		skipped := se.event(EventStepSkipped)
+		skipped.Reason = reason
+		rn.emit(skipped)
+		rn.rec.skipStep(se.phase, se.position, se.step)
+		// Steps that were not selected, or succeeded before the run was
+		// resumed, satisfy the needs and conditions of later steps. The
+		// latter keep the outputs they had.
+		rn.setOutputs(se, rn.resume.outputs(se))
+		se.results.record(se.step, workflow.StepSucceeded)
+		se.results.countSkipped()
+		return nil
+	}
+
+	if se.results != nil && se.step.When != "" {
+		dir, err := rn.stepDir(se.step)
+		if err != nil {
+			return rn.stepFailed(se, 0, err)
+		}
+		ok, err := se.results.shouldRun(se.step, rn.variables(), dir)
+		if err != nil {
+			return rn.stepFailed(se, 0, fmt.Errorf("invalid condition: %w", err))
+		}
+		if !ok {
+			skipped := se.event(EventStepSkipped)
+			skipped.Condition = se.step.When
+			rn.emit(skipped)
+			rn.rec.skipStep(se.phase, se.position, se.step)
+			se.results.record(se.step, workflow.StepSkipped)
+			return nil
+		}
+	}
+
+	out, closeOutput := rn.openOutput(se)
+	defer closeOutput()
+
+	started := time.Now()
+	outputs, err := rn.execute(se.phase, se.position, se.step, se.label, out, func(e Event) {
+		attempt := se.event(e.Type)
+		attempt.Attempt, attempt.Attempts = e.Attempt, e.Attempts
+		attempt.Delay, attempt.Err = e.Delay, e.Err
+		attempt.Duration = time.Since(started)
+		rn.emit(attempt)
+	})
+	closeOutput()
+	if err != nil {
+		stepErr := rn.stepFailed(se, time.Since(started), err)
+
+		// Interrupted runs stop right away, without running any hooks
+		if se.step.OnFail != "" && !errors.Is(err, execution.ErrInterrupted) {
+			rn.runHook(se, "on_fail", se.step.OnFail, out)
+		}
+		return stepErr
+	}
+
+	rn.setOutputs(se, outputs)
+	finished := se.event(EventStepFinished)
+	finished.Status = sqlite.RunStatusSuccess
+	finished.Duration = time.Since(started)
+	finished.Outputs = outputs
+	rn.emit(finished)
+
+	if se.step.OnSuccess != "" {
+		if err := rn.runHook(se, "on_success", se.step.OnSuccess, out); err != nil {
+			se.results.record(se.step, workflow.StepFailed)
+			return &StepError{Phase: se.phase, Position: se.position, StepID: se.id, Err: fmt.Errorf("on_success hook failed: %w", err), tolerated: se.toleratesFailure()}
+		}
+	}
+
+	se.results.record(se.step, workflow.StepSucceeded)
+	return nil
+}
+
+// stepFailed reports a failed step and returns the matching *StepError.
+// Interrupted steps never let the run go on.
+func (rn *run) stepFailed(se stepExecution, duration time.Duration, err error) error {
+	tolerated := se.toleratesFailure() && !errors.Is(err, execution.ErrInterrupted)
+
+	finished := se.event(EventStepFinished)
+	finished.Status = FailureStatus(err)
+	finished.ExitCode = exitCode(err)
+	finished.Duration = duration
+	finished.Err = err
+	finished.AllowedFailure = tolerated
+	rn.emit(finished)
+
+	se.results.record(se.step, workflow.StepFailed)
+	return &StepError{Phase: se.phase, Position: se.position, StepID: se.id, Err: err, tolerated: tolerated}
+}
+
+// toleratesFailure reports whether the run goes on when the step fails:
+// pre-checks with severity: warn and steps with allow_failure
+func (se stepExecution) toleratesFailure() bool {
+	switch se.phase {
+	case sqlite.RunPhasePrecheck:
+		return se.step.Severity == workflow.SeverityWarn
+	case sqlite.RunPhaseStep:
+		return se.step.AllowFailure
+	}
+	return false
+}
+
+// execute applies variables to a step and runs its command, retrying it as
+// its retry policy allows. Every attempt is recorded as its own run step
+// under phase; hooks pass no phase and are not recorded. Interrupted
+// attempts are not retried. notify, when set, receives the step_started
+// event of every attempt and the step_retrying event before each retry.
+// It returns the outputs captured from the successful attempt; an attempt
+// whose outputs cannot be captured fails.
+func (rn *run) execute(phase string, position int, step workflow.YAMLStep, label string, out stepOutput, notify func(Event)) (map[string]string, error) {
+	command, err := rn.opts.Resolver.ApplyVariables(step.Code(), rn.variables())
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply variables: %w", err)
+	}
+	timeout, err := rn.stepTimeout(step)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %w", err)
+	}
+	retry, err := rn.stepRetryPolicy(step)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry settings: %w", err)
+	}
+	dir, env, err := rn.stepEnvironment(step)
+	if err != nil {
+		return nil, err
+	}
+	if step.Sudo && rn.req.NoSudo {
+		return nil, errSudoDisabled
+	}
+
+	for attempt := 1; attempt <= retry.Attempts(); attempt++ {
+		if attempt > 1 {
+			delay := retry.DelayBefore(attempt)
+			if notify != nil {
+				notify(Event{Type: EventStepRetrying, Attempt: attempt - 1, Attempts: retry.Attempts(), Delay: delay, Err: err})
+			}
+
+			select {
+			case <-rn.ctx.Done():
+				return nil, execution.ErrInterrupted
+			case <-time.After(delay):
+			}
+		}
+
+		if notify != nil {
+			notify(Event{Type: EventStepStarted, Attempt: attempt, Attempts: retry.Attempts()})
+		}
+
+		var capture *outputCapture
+		var outputs map[string]string
+		stepID := rn.rec.beginStep(phase, position, attempt, step)
+		if capture, err = newOutputCapture(step); err == nil {
+			opts := execution.Options{Timeout: timeout, Dir: dir, Env: capture.env(env), Shell: rn.stepShell(step), Script: step.Script != "", Sudo: step.Sudo}
+			err = rn.rec.execute(rn.ctx, label, command, opts, capture.wrap(out))
+			if err == nil {
+				outputs, err = capture.values(step)
+			}
+			capture.close()
+		}
+		rn.rec.endStep(stepID, err, outputs)
+
+		if err == nil || errors.Is(err, execution.ErrInterrupted) {
+			return outputs, err
+		}
+	}
+	return nil, err
+}
+
+// runHook runs an on_fail or on_success hook of a step, writing its output
+// with the step output
+func (rn *run) runHook(se stepExecution, trigger, hook string, out stepOutput) error {
+	fired := se.event(EventHookFired)
+	fired.Hook = hook
+	fired.Trigger = trigger
+	rn.emit(fired)
+
+	started := time.Now()
+	err := rn.executeHook(se.step, hook, out)
+
+	finished := se.event(EventHookFinished)
+	finished.Hook = hook
+	finished.Trigger = trigger
+	finished.ExitCode = exitCode(err)
+	finished.Duration = time.Since(started)
+	finished.Err = err
+	rn.emit(finished)
+
+	return err
+}
+
+// executeHook runs a hook of step. Actions run with their own dir, env and
+// shell, run: commands with the dir and env of the step and the workflow
+// shell, since the step shell may be an interpreter such as python3.
+func (rn *run) executeHook(step workflow.YAMLStep, hook string, out stepOutput) error {
+	if actionName, ok := strings.CutPrefix(hook, "action:"); ok {
+		action, ok := rn.req.Workflow.Actions[actionName]
+		if !ok {
+			return fmt.Errorf("action '%s' not found", actionName)
+		}
+
+		_, err := rn.execute("", 0, action, fmt.Sprintf("hook %s", actionName), out, nil)
+		return err
+	} else if commandRaw, ok := strings.CutPrefix(hook, "run:"); ok {
+		command, err := rn.opts.Resolver.ApplyVariables(commandRaw, rn.variables())
+		if err != nil {
+			return fmt.Errorf("failed to apply variables to hook command: %v", err)
+		}
+		dir, env, err := rn.stepEnvironment(step)
+		if err != nil {
+			return err
+		}
+
+		return rn.rec.execute(rn.ctx, "hook", command, execution.Options{Dir: dir, Env: env, Shell: rn.req.Workflow.Shell}, out)
+	}
+
+	return fmt.Errorf("unknown hook format: %s (must start with 'action:' or 'run:')", hook)
+}
+
+// runSteps runs the workflow steps, one after the other or, when they
+// declare `needs`, up to Jobs at a time with their output prefixed by the
+// step id. Steps whose `when` condition is false are skipped, which satisfies
+// the needs of later steps. It returns the first step error.
+func (rn *run) runSteps(graph *workflow.StepGraph) error {
+	steps := rn.req.Workflow.Steps
+	rn.emit(Event{Type: EventPhaseStarted, Phase: sqlite.RunPhaseStep, Total: len(steps)})
+
+	results := &stepResults{byID: make(map[string]string)}
+	succeeded, err := graph.Run(rn.opts.Jobs, func(i int) error {
+		err := rn.runStep(stepExecution{
+			phase:    sqlite.RunPhaseStep,
+			position: i + 1,
+			total:    len(steps),
+			id:       steps[i].ID,
+			step:     steps[i],
+			label:    fmt.Sprintf("step %d", i+1),
+			parallel: graph.Parallel(),
+			results:  results,
+		})
+		if tolerated(err) {
+			results.countWarned()
+			return nil
+		}
+		return err
+	})
+
+	rn.result.StepsCompleted = succeeded - results.skipped - results.warned
+	rn.result.StepsSkipped = results.skipped
+	rn.result.StepsWarned = results.warned
+	return err
+}
+
+// openOutput returns where a step and its hooks write their output: the
+// runner output, the runner output prefixed by the step name for steps
+// running in parallel, or step_output events, with the secrets redacted. The
+// returned function flushes any partial last line and may be called more
+// than once.
+func (rn *run) openOutput(se stepExecution) (stepOutput, func()) {
+	// step_output events are redacted when they are emitted
+	if rn.opts.OutputEvents {
+		stdout := &eventWriter{rn: rn, se: se, stream: "stdout"}
+		stderr := &eventWriter{rn: rn, se: se, stream: "stderr"}
+		return stepOutput{stdout: stdout, stderr: stderr, background: se.parallel}, func() {
+			stdout.Flush()
+			stderr.Flush()
+		}
+	}
+
+	if !se.parallel {
+		stdout, stderr := rn.redact.Writer(rn.opts.Stdout, &rn.outputMu), rn.redact.Writer(rn.opts.Stderr, &rn.outputMu)
+		return stepOutput{stdout: stdout, stderr: stderr}, func() {
+			stdout.Flush()
+			stderr.Flush()
+		}
+	}
+
+	prefix := fmt.Sprintf("[%s] ", workflow.StepName(se.position-1, se.step))
+	stdout := execution.NewPrefixWriter(rn.opts.Stdout, prefix, &rn.outputMu)
+	stderr := execution.NewPrefixWriter(rn.opts.Stderr, prefix, &rn.outputMu)
+	// The prefix writers take outputMu themselves
+	var lock sync.Mutex
+	redactedStdout, redactedStderr := rn.redact.Writer(stdout, &lock), rn.redact.Writer(stderr, &lock)
+	return stepOutput{stdout: redactedStdout, stderr: redactedStderr, background: true}, func() {
+		redactedStdout.Flush()
+		redactedStderr.Flush()
+		stdout.Flush()
+		stderr.Flush()
+	}
+}
+
+// eventWriter sends each line of command output as a step_output event. A
+// trailing partial line is held back until the next newline or Flush.
+type eventWriter struct {
+	rn      *run
+	se      stepExecution
+	stream  string
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush sends the partial last line, if any
+func (w *eventWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.send(string(w.partial))
+		w.partial = nil
+	}
+}
+
+func (w *eventWriter) send(line string) {
+	e := w.se.event(EventStepOutput)
+	e.Stream = w.stream
+	e.Text = strings.TrimSuffix(line, "\r")
+	w.rn.emit(e)
+}
+
+// stepTimeout returns the time limit of a step after applying variables, or 0 when it has none
+func (rn *run) stepTimeout(step workflow.YAMLStep) (time.Duration, error) {
+	if step.Timeout == "" {
+		return 0, nil
+	}
+
+	value, err := rn.opts.Resolver.ApplyVariables(string(step.Timeout), rn.variables())
+	if err != nil {
+		return 0, err
+	}
+
+	return workflow.ParseDuration(value)
+}
+
+// stepEnvironment returns the working directory and the environment
+// variables of a step after applying variables, see stepDir. The step env
+// takes precedence over the workflow env, which takes precedence over the
+// variables exported by config.export_variables.
+func (rn *run) stepEnvironment(step workflow.YAMLStep) (string, []string, error) {
+	wf := rn.req.Workflow
+	variables := rn.variables()
+	dir, err := rn.stepDir(step)
+	if err != nil {
+		return "", nil, err
+	}
+
+	values := make(map[string]string, len(wf.Env)+len(step.Env))
+	exports := wf.Config.ExportVariables
+	for name, value := range rn.req.Variables {
+		if exports.Exports(name) && workflow.ValidEnvName(name) {
+			values[name] = value
+		}
+	}
+	for _, env := range []map[string]string{wf.Env, step.Env} {
+		for name, value := range env {
+			applied, err := rn.opts.Resolver.ApplyVariables(value, variables)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid env %s: %w", name, err)
+			}
+			values[name] = applied
+		}
+	}
+	env := make([]string, 0, len(values))
+	for name, value := range values {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return dir, env, nil
+}
+
+// stepShell returns the shell running a step: its own, the workflow shell,
+// or "" for the default shell
+func (rn *run) stepShell(step workflow.YAMLStep) string {
+	if step.Shell != "" {
+		return step.Shell
+	}
+	return rn.req.Workflow.Shell
+}
+
+// stepRetryPolicy returns the retry policy of a step after applying variables
+func (rn *run) stepRetryPolicy(step workflow.YAMLStep) (workflow.RetryPolicy, error) {
+	var delay time.Duration
+	if step.RetryDelay != "" {
+		value, err := rn.opts.Resolver.ApplyVariables(string(step.RetryDelay), rn.variables())
+		if err != nil {
+			return workflow.RetryPolicy{}, err
+		}
+		if delay, err = workflow.ParseDuration(value); err != nil {
+			return workflow.RetryPolicy{}, err
+		}
+	}
+
+	return workflow.NewRetryPolicy(step.Retries, delay, step.Backoff, step.Jitter)
+}
+
+// stepDir returns the working directory of a step after applying variables,
+// empty for the current directory. The step dir is relative to the workflow
+// dir.
+func (rn *run) stepDir(step workflow.YAMLStep) (string, error) {
+	variables := rn.variables()
+	dir, err := rn.opts.Resolver.ApplyVariables(rn.req.Workflow.Dir, variables)
+	if err != nil {
+		return "", fmt.Errorf("invalid dir: %w", err)
+	}
+	if step.Dir != "" {
+		stepDir, err := rn.opts.Resolver.ApplyVariables(step.Dir, variables)
+		if err != nil {
+			return "", fmt.Errorf("invalid dir: %w", err)
+		}
+		if dir == "" || filepath.IsAbs(stepDir) {
+			dir = stepDir
+		} else {
+			dir = filepath.Join(dir, stepDir)
+		}
+	}
+	return dir, nil
+}
+
+// stepResults tracks the outcome of finished steps for `when` conditions
+type stepResults struct {
+	mu       sync.Mutex
+	previous string
+	byID     map[string]string
+	skipped  int
+	warned   int // Steps with allow_failure that failed
+}
+
+// shouldRun evaluates the condition of a step against variables and the
+// steps finished so far. Paths in exists() are relative to dir, the working
+// directory of the step.
+func (r *stepResults) shouldRun(step workflow.YAMLStep, variables map[string]string, dir string) (bool, error) {
+	r.mu.Lock()
+	ctx := workflow.ConditionContext{
+		Dir:       dir,
+		Variables: variables,
+		Previous:  r.previous,
+		Steps:     make(map[string]string, len(r.byID)),
+	}
+	for id, status := range r.byID {
+		ctx.Steps[id] = status
+	}
+	r.mu.Unlock()
+
+	return workflow.EvaluateCondition(step.When, ctx)
+}
+
+// record stores the outcome of a step. A nil stepResults records nothing.
+func (r *stepResults) record(step workflow.YAMLStep, status string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.previous = status
+	if step.ID != "" {
+		r.byID[step.ID] = status
+	}
+	if status == workflow.StepSkipped {
+		r.skipped++
+	}
+}
+
+// countWarned counts a step with allow_failure that failed
+func (r *stepResults) countWarned() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warned++
+}
+
+// countSkipped counts a step that did not run although it is recorded as
+// succeeded. A nil stepResults counts nothing.
+func (r *stepResults) countSkipped() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped++
+}
@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	execution "github.com/tesh254/migraine/internal/execution"
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+	"github.com/tesh254/migraine/internal/workflow"
+)
+
+// errSudoDisabled is returned for steps with sudo when Request.NoSudo is set
+var errSudoDisabled = errors.New("sudo is disabled for this run")
+
+// sudoSteps names the pre-checks, steps, actions and workflow hook steps
+// with sudo that the run may execute, including the actions run by the
+// on_fail and on_success hooks of those steps
+func (rn *run) sudoSteps() []string {
+	wf := rn.req.Workflow
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string, step workflow.YAMLStep) {
+		if step.Sudo && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	visit := func(se stepExecution, name string) {
+		if rn.skipReason(se) != "" {
+			return
+		}
+		add(name, se.step)
+		for _, hook := range []string{se.step.OnFail, se.step.OnSuccess} {
+			if actionName, ok := strings.CutPrefix(hook, "action:"); ok {
+				add("action "+actionName, wf.Actions[actionName])
+			}
+		}
+	}
+
+	for i, check := range wf.PreChecks {
+		visit(stepExecution{phase: sqlite.RunPhasePrecheck, position: i + 1, step: check}, fmt.Sprintf("pre-check %d", i+1))
+	}
+	if rn.req.PreChecksOnly {
+		return names
+	}
+
+	if len(rn.req.Actions) > 0 {
+		for i, name := range rn.req.Actions {
+			visit(stepExecution{phase: sqlite.RunPhaseAction, position: i + 1, id: name, step: wf.Actions[name]}, "action "+name)
+		}
+	} else {
+		for i, step := range wf.Steps {
+			visit(stepExecution{phase: sqlite.RunPhaseStep, position: i + 1, id: step.ID, step: step}, workflow.StepName(i, step))
+		}
+	}
+
+	for _, block := range []struct {
+		phase string
+		steps []workflow.YAMLStep
+	}{{sqlite.RunPhaseOnSuccess, wf.OnSuccess}, {sqlite.RunPhaseOnFailure, wf.OnFailure}, {sqlite.RunPhaseFinally, wf.Finally}} {
+		for i, step := range block.steps {
+			visit(stepExecution{phase: block.phase, position: i + 1, step: step}, fmt.Sprintf("%s %d", block.phase, i+1))
+		}
+	}
+	return names
+}
+
+// prepareSudo runs before anything else when the run has steps with sudo.
+// With Request.NoSudo it refuses to run them; otherwise it acquires the sudo
+// credentials once, prompting for the password when Options.PromptSudo is
+// set, and keeps them fresh until the run ends.
+func (rn *run) prepareSudo() error {
+	steps := rn.sudoSteps()
+	if len(steps) == 0 {
+		return nil
+	}
+	if rn.req.NoSudo {
+		return fmt.Errorf("%w: %s need sudo", errSudoDisabled, strings.Join(steps, ", "))
+	}
+
+	reason := fmt.Sprintf("Workflow '%s' runs %s with sudo.", rn.req.Workflow.Name, strings.Join(steps, ", "))
+	if err := execution.AcquireSudo(rn.ctx, rn.opts.PromptSudo, reason); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rn.stopSudo = cancel
+	go execution.KeepSudoAlive(ctx)
+	return nil
+}
@@ -0,0 +1,37 @@
+package execution
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// StartDetached starts a program in its own session so it outlives the
+// calling process and is not tied to its terminal. Standard output and
+// error are appended to logPath; standard input is closed. It returns the
+// PID of the started process, which also identifies its process group.
+func StartDetached(path string, args []string, env []string, logPath string) (int, error) {
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = env
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start background process: %w", err)
+	}
+
+	pid := cmd.Process.Pid
+	// The child is supervised through its PID from now on, not through this handle
+	if err := cmd.Process.Release(); err != nil {
+		return pid, fmt.Errorf("failed to release background process: %w", err)
+	}
+
+	return pid, nil
+}
@@ -0,0 +1,158 @@
+package execution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// DefaultGracePeriod is how long a stopped command gets to exit after
+// SIGTERM before its process group is killed
+const DefaultGracePeriod = 5 * time.Second
+
+var (
+	// ErrTimeout is returned when a command runs longer than its timeout
+	ErrTimeout = errors.New("command timed out")
+	// ErrInterrupted is returned when a command is stopped because the
+	// context was cancelled, e.g. on Ctrl-C or SIGTERM
+	ErrInterrupted = errors.New("command interrupted")
+)
+
+// Options configures how Execute runs a command
+type Options struct {
+	Stdout io.Writer // Defaults to os.Stdout
+	Stderr io.Writer // Defaults to os.Stderr
+	// Timeout limits how long the command may run. Zero means no limit.
+	Timeout time.Duration
+	// GracePeriod is the time between SIGTERM and SIGKILL when the command
+	// is stopped. Zero means DefaultGracePeriod.
+	GracePeriod time.Duration
+	// Background runs the command without stdin and outside the terminal
+	// foreground, for commands running alongside others
+	Background bool
+	// Dir is the working directory of the command. Empty means the current
+	// directory.
+	Dir string
+	// Env holds KEY=value pairs added to the environment of migraine, taking
+	// precedence over it
+	Env []string
+	// Shell runs the command instead of the default shell, e.g. "bash -euo
+	// pipefail" or "python3"
+	Shell string
+	// Script runs the command from a temporary file given to the shell
+	// instead of passing it inline, for multi-line scripts
+	Script bool
+	// Sudo runs the command as root through sudo, which must not need a
+	// password; see AcquireSudo
+	Sudo bool
+}
+
+// Execute runs command in the default shell, or opts.Shell, inside its own
+// process group. When ctx is cancelled or the timeout expires the whole
+// group is stopped, so commands started by the shell are not left running,
+// and ErrInterrupted or ErrTimeout is returned.
+func Execute(ctx context.Context, command string, opts Options) error {
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+
+	stdout, stderr := opts.Stdout, opts.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	grace := opts.GracePeriod
+	if grace <= 0 {
+		grace = DefaultGracePeriod
+	}
+
+	runCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	// exec reports a missing directory as a missing shell
+	if opts.Dir != "" {
+		if info, err := os.Stat(opts.Dir); err != nil {
+			return fmt.Errorf("command failed: working directory %s does not exist", opts.Dir)
+		} else if !info.IsDir() {
+			return fmt.Errorf("command failed: working directory %s is not a directory", opts.Dir)
+		}
+	}
+
+	if opts.Script {
+		script, err := writeScript(opts.Shell, command)
+		if err != nil {
+			return fmt.Errorf("command failed: %w", err)
+		}
+		defer os.Remove(script)
+		command = script
+	}
+
+	name, args := shellCommand(opts.Shell, command, opts.Script)
+	if opts.Sudo {
+		name, args = sudoCommand(name, args, opts.Env)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = opts.Dir
+	cmd.Env = append(os.Environ(), opts.Env...)
+	if !opts.Background {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	foreground := setupProcessGroup(cmd, !opts.Background)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	if foreground {
+		defer restoreForeground()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			return nil
+		}
+		// In the terminal foreground the command receives Ctrl-C itself
+		if interruptedBySignal(err) {
+			return ErrInterrupted
+		}
+		return fmt.Errorf("command failed: %w", err)
+
+	case <-runCtx.Done():
+		stopProcessGroup(cmd, grace, done)
+		if ctx.Err() != nil {
+			return ErrInterrupted
+		}
+		return fmt.Errorf("%w after %s", ErrTimeout, opts.Timeout)
+	}
+}
+
+// stopProcessGroup terminates the command's process group and kills it if
+// it has not exited after the grace period
+func stopProcessGroup(cmd *exec.Cmd, grace time.Duration, done <-chan error) {
+	signalProcessGroup(cmd, false)
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		signalProcessGroup(cmd, true)
+		<-done
+	}
+}
@@ -0,0 +1,159 @@
+package execution
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecute_Success(t *testing.T) {
+	err := Execute(context.Background(), "true", Options{Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+}
+
+func TestExecute_ExitCode(t *testing.T) {
+	err := Execute(context.Background(), "exit 3", Options{Stdout: io.Discard, Stderr: io.Discard})
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected an exit error, got %v", err)
+	}
+	if exitErr.ExitCode() != 3 {
+		t.Errorf("expected exit code 3, got %d", exitErr.ExitCode())
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrInterrupted) {
+		t.Errorf("a failing command should not be reported as timed out or interrupted: %v", err)
+	}
+}
+
+func TestExecute_Timeout(t *testing.T) {
+	start := time.Now()
+	// The background sleep shares the process group and must be stopped too,
+	// otherwise `wait` keeps the shell alive
+	err := Execute(context.Background(), "sleep 30 & wait", Options{
+		Stdout:      io.Discard,
+		Stderr:      io.Discard,
+		Timeout:     200 * time.Millisecond,
+		GracePeriod: time.Second,
+	})
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command was not stopped promptly, took %s", elapsed)
+	}
+}
+
+func TestExecute_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	err := Execute(ctx, "sleep 30", Options{Stdout: io.Discard, Stderr: io.Discard, GracePeriod: time.Second})
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+
+	// A cancelled context must not start new commands
+	if err := Execute(ctx, "true", Options{}); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("expected ErrInterrupted for an already cancelled context, got %v", err)
+	}
+}
+
+func TestExecute_DirAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	err := Execute(context.Background(), `echo "$(pwd) $MIGRAINE_TEST_VAR"`, Options{
+		Stdout: &out,
+		Stderr: io.Discard,
+		Dir:    dir,
+		Env:    []string{"MIGRAINE_TEST_VAR=first", "MIGRAINE_TEST_VAR=second"},
+	})
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+
+	resolved, _ := filepath.EvalSymlinks(dir)
+	if got := strings.TrimSpace(out.String()); got != resolved+" second" && got != dir+" second" {
+		t.Errorf("expected the command to run in %s with the last env value, got %q", dir, got)
+	}
+}
+
+func TestExecute_MissingDir(t *testing.T) {
+	err := Execute(context.Background(), "true", Options{Dir: filepath.Join(t.TempDir(), "missing")})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected a missing directory error, got %v", err)
+	}
+}
+
+func TestExecute_ShellAndScript(t *testing.T) {
+	var out bytes.Buffer
+	err := Execute(context.Background(), "false | true", Options{Stdout: &out, Stderr: io.Discard, Shell: "bash -o pipefail"})
+	if err == nil {
+		t.Error("expected the pipeline to fail with pipefail")
+	}
+
+	script := "greeting=hello\nfor name in a b; do\n  echo \"$greeting $name\"\ndone\n"
+	if err := Execute(context.Background(), script, Options{Stdout: &out, Stderr: io.Discard, Shell: "sh", Script: true}); err != nil {
+		t.Fatalf("expected the script to succeed, got %v", err)
+	}
+	if got := out.String(); got != "hello a\nhello b\n" {
+		t.Errorf("unexpected script output %q", got)
+	}
+
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	out.Reset()
+	if err := Execute(context.Background(), "answer = 6 * 7\nprint(answer)", Options{Stdout: &out, Stderr: io.Discard, Shell: "python3", Script: true}); err != nil {
+		t.Fatalf("expected the python script to succeed, got %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "42" {
+		t.Errorf("unexpected python output %q", got)
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	tests := []struct {
+		shell  string
+		script bool
+		want   string
+	}{
+		{"bash -euo pipefail", false, "bash -euo pipefail -c run"},
+		{"node", false, "node -e run"},
+		{"/usr/bin/pwsh -NoProfile", false, "/usr/bin/pwsh -NoProfile -Command run"},
+		{"python3", true, "python3 run"},
+	}
+	for _, tt := range tests {
+		name, args := shellCommand(tt.shell, "run", tt.script)
+		if got := strings.Join(append([]string{name}, args...), " "); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.shell, tt.want, got)
+		}
+	}
+
+	if name, _ := shellCommand("", "run", false); name != getDefaultShell() {
+		t.Errorf("expected the default shell, got %s", name)
+	}
+}
+
+func TestProcessCommandLine(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 10", "migraine-run", "--run-id=42")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	command, err := ProcessCommandLine(cmd.Process.Pid)
+	if err != nil || !strings.Contains(command, "--run-id=42") {
+		t.Errorf("expected the command line of the process, got %q (%v)", command, err)
+	}
+}
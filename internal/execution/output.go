@@ -0,0 +1,130 @@
+package execution
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputLog collects command output as timestamped lines labelled with
+// the step and stream they came from. It is safe for concurrent use.
+type OutputLog struct {
+	mu    sync.Mutex
+	lines strings.Builder
+}
+
+// NewOutputLog creates an empty output log
+func NewOutputLog() *OutputLog {
+	return &OutputLog{}
+}
+
+// Writer returns a writer appending each line written to it to the log,
+// tagged with the given label (e.g. "step 2") and stream name.
+func (l *OutputLog) Writer(label, stream string) *LineWriter {
+	return &LineWriter{log: l, label: label, stream: stream}
+}
+
+// String returns the log content collected so far
+func (l *OutputLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lines.String()
+}
+
+func (l *OutputLog) append(label, stream, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.lines, "%s [%s] %s: %s\n", time.Now().UTC().Format(time.RFC3339), label, stream, text)
+}
+
+// LineWriter splits written output into lines for an OutputLog. A trailing
+// partial line is held back until the next newline or Flush.
+type LineWriter struct {
+	log     *OutputLog
+	label   string
+	stream  string
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.append(w.label, w.stream, strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any pending partial line to the log
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.log.append(w.label, w.stream, strings.TrimRight(string(w.partial), "\r"))
+		w.partial = nil
+	}
+}
+
+// PrefixWriter writes every line of output prefixed with a label such as
+// "[lint] ", so the output of commands running at the same time can be told
+// apart. Writers sharing the same lock never interleave within a line.
+type PrefixWriter struct {
+	w       io.Writer
+	prefix  string
+	lock    *sync.Mutex
+	mu      sync.Mutex
+	partial []byte
+}
+
+// NewPrefixWriter creates a writer prefixing lines written to w. lock
+// serializes writes to w with other writers sharing it.
+func NewPrefixWriter(w io.Writer, prefix string, lock *sync.Mutex) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: prefix, lock: lock}
+}
+
+func (w *PrefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any pending partial line, ending it with a newline
+func (w *PrefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) > 0 {
+		w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *PrefixWriter) writeLine(line []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.w.Write(append([]byte(w.prefix), line...))
+}
@@ -0,0 +1,26 @@
+package execution
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+	lint := NewPrefixWriter(&out, "[lint] ", &lock)
+	test := NewPrefixWriter(&out, "[test] ", &lock)
+
+	lint.Write([]byte("checking"))
+	test.Write([]byte("ok 1\nok "))
+	lint.Write([]byte(" files\n"))
+	test.Write([]byte("2"))
+	test.Flush()
+	lint.Flush()
+
+	want := "[test] ok 1\n[lint] checking files\n[test] ok 2\n"
+	if out.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, out.String())
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+
+package execution
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// setupProcessGroup starts the command in a new process group. When
+// terminal is set and migraine owns the terminal, the group is also moved to
+// the foreground so interactive commands can read input and receive Ctrl-C
+// directly. It reports whether the terminal has to be taken back with
+// restoreForeground.
+func setupProcessGroup(cmd *exec.Cmd, terminal bool) bool {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+
+	stdin := int(os.Stdin.Fd())
+	pgrp, err := unix.IoctlGetInt(stdin, unix.TIOCGPGRP)
+	foreground := terminal && err == nil && pgrp == unix.Getpgrp()
+	if foreground {
+		attr.Foreground = true
+		attr.Ctty = stdin
+	}
+
+	cmd.SysProcAttr = attr
+	return foreground
+}
+
+// restoreForeground moves migraine's process group back to the terminal
+// foreground after a command started by setupProcessGroup has exited
+func restoreForeground() {
+	// Changing the foreground group from the background raises SIGTTOU
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	unix.IoctlSetPointerInt(int(os.Stdin.Fd()), unix.TIOCSPGRP, unix.Getpgrp())
+}
+
+// signalProcessGroup sends SIGTERM, or SIGKILL when kill is set, to the
+// process group of a command started by setupProcessGroup
+func signalProcessGroup(cmd *exec.Cmd, kill bool) {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// interruptedBySignal reports whether the command was ended by Ctrl-C
+func interruptedBySignal(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGINT
+}
+
+// TerminateProcessGroup asks every process in the group led by pid to stop
+func TerminateProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// ProcessAlive reports whether a process with the given PID is still running
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// ProcessCommandLine returns the command line of a running process, read
+// from /proc where there is one and from ps(1) otherwise
+func ProcessCommandLine(pid int) (string, error) {
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")), nil
+	}
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the command line of pid %d: %w", pid, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,68 @@
+//go:build windows
+
+package execution
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// setupProcessGroup is a no-op on Windows, which has no process groups that
+// can be signalled; commands stay attached to the console
+func setupProcessGroup(cmd *exec.Cmd, terminal bool) bool {
+	return false
+}
+
+func restoreForeground() {}
+
+// signalProcessGroup stops the command's process. Without process groups,
+// processes it started may keep running.
+func signalProcessGroup(cmd *exec.Cmd, kill bool) {
+	cmd.Process.Kill()
+}
+
+// interruptedBySignal always reports false; Ctrl-C reaches migraine itself
+func interruptedBySignal(err error) bool {
+	return false
+}
+
+// TerminateProcessGroup stops the process with the given PID. Windows has no
+// process group signals, so child processes may outlive it.
+func TerminateProcessGroup(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// ProcessAlive reports whether a process with the given PID is still running
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// ProcessCommandLine returns the command line of a running process, read
+// through PowerShell
+func ProcessCommandLine(pid int) (string, error) {
+	query := fmt.Sprintf("(Get-CimInstance Win32_Process -Filter 'ProcessId=%d').CommandLine", pid)
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", query).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the command line of pid %d: %w", pid, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
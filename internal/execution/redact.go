@@ -0,0 +1,170 @@
+package execution
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue replaces secret values in output
+const RedactedValue = "***"
+
+// Redactor replaces secret values with RedactedValue. A nil Redactor leaves
+// text as it is.
+type Redactor struct {
+	secrets  [][]byte // Longest first
+	replacer *strings.Replacer
+}
+
+// NewRedactor creates a redactor for values. Each line of a multi-line value
+// is redacted on its own, since output is handled line by line. It returns
+// nil when there is nothing to redact.
+func NewRedactor(values []string) *Redactor {
+	seen := make(map[string]bool)
+	var secrets []string
+	for _, value := range values {
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" || seen[line] {
+				continue
+			}
+			seen[line] = true
+			secrets = append(secrets, line)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	// Longer values first, so that a value containing another is redacted whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	r := &Redactor{}
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		r.secrets = append(r.secrets, []byte(secret))
+		pairs = append(pairs, secret, RedactedValue)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r
+}
+
+// String returns s with the secret values replaced
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Map returns a copy of m with the secret values replaced in its values
+func (r *Redactor) Map(m map[string]string) map[string]string {
+	if r == nil || m == nil {
+		return m
+	}
+	redacted := make(map[string]string, len(m))
+	for k, v := range m {
+		redacted[k] = r.String(v)
+	}
+	return redacted
+}
+
+// Error returns err with the secret values replaced in its message. The
+// returned error still wraps err for errors.Is and errors.As.
+func (r *Redactor) Error(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	message := r.String(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, message: message}
+}
+
+// Writer returns a writer redacting what is written to w. Output that may be
+// the start of a secret value is held back until more is written or Flush
+// is called. lock serializes writes to w with other writers sharing it, such
+// as the writers of the stdout and stderr of a command.
+func (r *Redactor) Writer(w io.Writer, lock *sync.Mutex) *RedactWriter {
+	return &RedactWriter{r: r, w: w, lock: lock}
+}
+
+// pendingSuffix returns the length of the longest end of p that a secret
+// value starts with, without being all of it
+func (r *Redactor) pendingSuffix(p []byte) int {
+	longest := 0
+	for _, secret := range r.secrets {
+		for n := min(len(secret)-1, len(p)); n > longest; n-- {
+			if bytes.HasSuffix(p, secret[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// redactedError carries the redacted message of an error
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// RedactWriter redacts secret values from output, see Redactor.Writer
+type RedactWriter struct {
+	r       *Redactor
+	w       io.Writer
+	lock    *sync.Mutex
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (w *RedactWriter) Write(p []byte) (int, error) {
+	if w.r == nil {
+		return w.write(p)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, p...)
+	held := w.r.pendingSuffix(w.pending)
+	ready := len(w.pending) - held
+	if ready == 0 {
+		return len(p), nil
+	}
+
+	_, err := w.write([]byte(w.r.String(string(w.pending[:ready]))))
+	w.pending = append(w.pending[:0], w.pending[ready:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the output held back
+func (w *RedactWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 {
+		w.write([]byte(w.r.String(string(w.pending))))
+		w.pending = nil
+	}
+}
+
+func (w *RedactWriter) write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
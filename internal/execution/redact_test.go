@@ -0,0 +1,73 @@
+package execution
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor([]string{"hunter2", "", "  ", "s3cr3t-token", "s3cr3t", "-----BEGIN KEY-----\nMIIBOg\n-----END KEY-----"})
+
+	for in, want := range map[string]string{
+		"password=hunter2":                 "password=***",
+		"token s3cr3t-token and s3cr3t":    "token *** and ***",
+		"key:\nMIIBOg\n":                   "key:\n***\n",
+		"nothing to hide, spaces kept  ":   "nothing to hide, spaces kept  ",
+		"hunter2hunter2":                   "******",
+		"curl -H 'Authorization: hunter2'": "curl -H 'Authorization: ***'",
+	} {
+		if got := r.String(in); got != want {
+			t.Errorf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+
+	if NewRedactor([]string{"", "\n"}) != nil {
+		t.Error("expected no redactor without values")
+	}
+	var none *Redactor
+	if none.String("hunter2") != "hunter2" {
+		t.Error("expected a nil redactor to leave text as it is")
+	}
+
+	plain := fmt.Errorf("login failed: %w", ErrTimeout)
+	if r.Error(plain) != plain {
+		t.Error("expected an error without secrets to be returned as it is")
+	}
+	err := r.Error(fmt.Errorf("login with hunter2 failed: %w", ErrTimeout))
+	if err.Error() != "login with *** failed: "+ErrTimeout.Error() || !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a redacted error wrapping ErrTimeout, got %v", err)
+	}
+
+	inputs := map[string]string{"password": "hunter2", "user": "admin"}
+	if got := r.Map(inputs); got["password"] != "***" || got["user"] != "admin" || inputs["password"] != "hunter2" {
+		t.Errorf("expected a redacted copy of the map, got %v (original %v)", got, inputs)
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+	w := NewRedactor([]string{"hunter2"}).Writer(&out, &lock)
+
+	// A value split across writes is still redacted
+	for _, chunk := range []string{"Password: hun", "ter2\nPrompt> ", "hunt", "ing\nhunt"} {
+		w.Write([]byte(chunk))
+	}
+	if want := "Password: ***\nPrompt> hunting\n"; out.String() != want {
+		t.Errorf("expected output up to the possible secret, got %q", out.String())
+	}
+	w.Flush()
+	if want := "Password: ***\nPrompt> hunting\nhunt"; out.String() != want {
+		t.Errorf("expected the held back output after Flush, got %q", out.String())
+	}
+
+	out.Reset()
+	w = (*Redactor)(nil).Writer(&out, &lock)
+	w.Write([]byte("hunter2"))
+	if out.String() != "hunter2" {
+		t.Errorf("expected output to pass through without secrets, got %q", out.String())
+	}
+}
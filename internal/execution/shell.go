@@ -2,10 +2,12 @@ package execution
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strings"
 )
 
@@ -33,17 +35,69 @@ func getDefaultShell() string {
 	return "/bin/sh"
 }
 
-func ExecuteCommand(command string) error {
-	shell := getDefaultShell()
+// shellCommand returns the program and arguments running command with
+// shell, or with the default shell when shell is empty. Inline commands are
+// passed with the flag the interpreter expects; scripts are passed as a file.
+func shellCommand(shell, command string, script bool) (string, []string) {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		fields = []string{getDefaultShell()}
+	}
 
-	cmd := exec.Command(shell, "-c", command)
-	cmd.Env = os.Environ()
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	args := fields[1:]
+	if !script {
+		args = append(args, inlineFlag(fields[0]))
+	}
+	return fields[0], append(args, command)
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("command failed: %w", err)
+// inlineFlag returns the flag of program that runs code given as an argument
+func inlineFlag(program string) string {
+	switch strings.TrimSuffix(filepath.Base(program), ".exe") {
+	case "node", "ruby", "perl":
+		return "-e"
+	case "pwsh", "powershell":
+		return "-Command"
+	default:
+		return "-c"
 	}
-	return nil
+}
+
+// writeScript writes a script to a temporary file run by shell and returns
+// its path. The caller removes it.
+func writeScript(shell, content string) (string, error) {
+	ext := ""
+	if fields := strings.Fields(shell); len(fields) > 0 {
+		switch strings.TrimSuffix(filepath.Base(fields[0]), ".exe") {
+		case "pwsh", "powershell":
+			ext = ".ps1"
+		}
+	}
+
+	file, err := os.CreateTemp("", "migraine-script-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("failed to create script file: %w", err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write script file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write script file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// ExecuteCommand runs command in the default shell without a timeout.
+// Use Execute to run it with a context or time limit.
+func ExecuteCommand(command string) error {
+	return ExecuteCommandWithOutput(command, os.Stdout, os.Stderr)
+}
+
+// ExecuteCommandWithOutput runs command in the default shell, sending its
+// stdout and stderr to the given writers instead of the terminal.
+func ExecuteCommandWithOutput(command string, stdout, stderr io.Writer) error {
+	return Execute(context.Background(), command, Options{Stdout: stdout, Stderr: stderr})
 }
@@ -63,4 +63,24 @@ func TestGetDefaultShell_Fallback(t *testing.T) {
 	if !strings.HasPrefix(shell, "/") {
 		t.Errorf("expected absolute path, got %s", shell)
 	}
-}
\ No newline at end of file
+}
+
+func TestExecuteCommandWithOutput_CapturesStreams(t *testing.T) {
+	log := NewOutputLog()
+	stdout := log.Writer("step 1", "stdout")
+	stderr := log.Writer("step 1", "stderr")
+
+	err := ExecuteCommandWithOutput("echo out; echo err >&2; printf partial", stdout, stderr)
+	if err != nil {
+		t.Fatalf("ExecuteCommandWithOutput failed: %v", err)
+	}
+	stdout.Flush()
+	stderr.Flush()
+
+	content := log.String()
+	for _, want := range []string{"[step 1] stdout: out", "[step 1] stderr: err", "[step 1] stdout: partial"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected log to contain %q, got:\n%s", want, content)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package execution
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sudoKeepAlive is how often KeepSudoAlive refreshes the sudo credentials,
+// well within the default sudo timeout of 5 minutes
+const sudoKeepAlive = time.Minute
+
+// runsAsRoot reports whether migraine already runs as root, in which case
+// commands are not wrapped in sudo
+var runsAsRoot = func() bool {
+	return os.Geteuid() == 0
+}
+
+// AcquireSudo makes sure commands can be run through sudo for the rest of
+// the run. With prompt, sudo asks for the password on the terminal once,
+// showing reason; otherwise it fails when a password is needed.
+func AcquireSudo(ctx context.Context, prompt bool, reason string) error {
+	if runsAsRoot() {
+		return nil
+	}
+	if _, err := exec.LookPath("sudo"); err != nil {
+		return fmt.Errorf("sudo is not installed")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sudo", "-n", "-v")
+	cmd.Stderr = &stderr
+	if prompt {
+		cmd = exec.CommandContext(ctx, "sudo", "-v", "-p", reason+"\n[sudo] password for %u: ")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	}
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ErrInterrupted
+		}
+		if !prompt {
+			message := strings.TrimSpace(stderr.String())
+			if message == "" {
+				message = err.Error()
+			}
+			return fmt.Errorf("sudo cannot run without a password in a non-interactive run (%s)", message)
+		}
+		return fmt.Errorf("sudo authentication failed: %w", err)
+	}
+	return nil
+}
+
+// KeepSudoAlive refreshes the sudo credentials acquired by AcquireSudo
+// until ctx is done, so that long runs do not ask for the password again
+func KeepSudoAlive(ctx context.Context) {
+	if runsAsRoot() {
+		return
+	}
+
+	ticker := time.NewTicker(sudoKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			exec.CommandContext(ctx, "sudo", "-n", "-v").Run()
+		}
+	}
+}
+
+// sudoCommand wraps a program and its arguments in sudo. sudo does not
+// keep the environment of migraine, so it is asked to preserve the variables
+// of env, which the command is started with. Only their names are passed, so
+// the values do not show up in the process list. sudo never prompts here:
+// the credentials were acquired before the run.
+func sudoCommand(name string, args, env []string) (string, []string) {
+	if runsAsRoot() {
+		return name, args
+	}
+
+	sudoArgs := []string{"-n"}
+	if len(env) > 0 {
+		names := make([]string, 0, len(env))
+		for _, kv := range env {
+			k, _, _ := strings.Cut(kv, "=")
+			names = append(names, k)
+		}
+		sudoArgs = append(sudoArgs, "--preserve-env="+strings.Join(names, ","))
+	}
+	return "sudo", append(append(sudoArgs, "--", name), args...)
+}
@@ -0,0 +1,31 @@
+package execution
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSudoCommand(t *testing.T) {
+	defer func(orig func() bool) { runsAsRoot = orig }(runsAsRoot)
+	runsAsRoot = func() bool { return false }
+
+	name, args := sudoCommand("bash", []string{"-c", "make install"}, []string{"PREFIX=/usr/local", "API_TOKEN=hunter2"})
+	got := strings.Join(append([]string{name}, args...), " ")
+	if got != "sudo -n --preserve-env=PREFIX,API_TOKEN -- bash -c make install" {
+		t.Errorf("unexpected sudo command %q", got)
+	}
+	// Values are passed in the environment, where other users cannot see them
+	if strings.Contains(got, "/usr/local") || strings.Contains(got, "hunter2") {
+		t.Errorf("expected no variable values in the arguments, got %q", got)
+	}
+
+	name, args = sudoCommand("sh", []string{"-c", "id -u"}, nil)
+	if got := strings.Join(append([]string{name}, args...), " "); got != "sudo -n -- sh -c id -u" {
+		t.Errorf("unexpected sudo command %q", got)
+	}
+
+	runsAsRoot = func() bool { return true }
+	if name, args := sudoCommand("sh", []string{"-c", "id -u"}, nil); name != "sh" || len(args) != 2 {
+		t.Errorf("expected root to run the command directly, got %s %v", name, args)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -246,7 +247,10 @@ func validateDocument(text string) []DiagnosticItem {
 		}
 	}
 
-	_, err = parser.Parse()
+	wf, err := parser.Parse()
+	if err == nil {
+		_, err = workflow.ParseVariableDeclarations(wf.Config.Variables)
+	}
 	if err != nil {
 		line := 0
 		char := 0
@@ -298,13 +302,43 @@ func (s *Server) handleCompletion(params json.RawMessage) (interface{}, error) {
 		{Label: "steps", Kind: 6, Documentation: "Ordered list of execution steps"},
 		{Label: "pre_checks", Kind: 6, Documentation: "Pre-flight checks before running steps"},
 		{Label: "actions", Kind: 6, Documentation: "Named reusable actions that can be triggered by hooks"},
+		{Label: "on_failure", Kind: 6, Documentation: "Steps run once after the workflow failed"},
+		{Label: "finally", Kind: 6, Documentation: "Steps run once after every run, e.g. cleanup"},
 	}
 
 	atomKeywords := []CompletionItem{
 		{Label: "cmd", Kind: 6, Documentation: "Command to execute"},
 		{Label: "desc", Kind: 6, Documentation: "Human-readable description"},
 		{Label: "on_fail", Kind: 6, Documentation: "Action or command to run on failure (e.g. 'action:name' or 'run:cmd')"},
-		{Label: "on_success", Kind: 6, Documentation: "Action or command to run on success (e.g. 'action:name' or 'run:cmd')"},
+		{Label: "on_success", Kind: 6, Documentation: "Action or command to run on success (e.g. 'action:name' or 'run:cmd'), or in the workflow block, steps run once after the workflow succeeded"},
+		{Label: "timeout", Kind: 6, Documentation: "Stop the command after this long (seconds or a duration like \"5m\")"},
+		{Label: "retries", Kind: 6, Documentation: "Number of times to retry the command after it fails"},
+		{Label: "retry_delay", Kind: 6, Documentation: "Wait before retrying (seconds or a duration like \"10s\", default 1s)"},
+		{Label: "backoff", Kind: 6, Documentation: "Retry delay strategy: 'constant' (default) or 'exponential'"},
+		{Label: "jitter", Kind: 6, Documentation: "Randomize retry delays to avoid retrying in lockstep"},
+		{Label: "id", Kind: 6, Documentation: "Step identifier referenced by other steps in needs"},
+		{Label: "needs", Kind: 6, Documentation: "Ids of the steps that must succeed before this one runs (e.g. [\"lint\", \"test\"])"},
+		{Label: "when", Kind: 6, Documentation: "Condition under which the step runs (e.g. \"{{env}} == 'prod'\")"},
+		{Label: "if", Kind: 6, Documentation: "Another name for when"},
+		{Label: "tags", Kind: 6, Documentation: "Step tags, selected with --tags (e.g. [\"fast\", \"unit\"])"},
+		{Label: "allow_failure", Kind: 6, Documentation: "Keep running the workflow when this step fails"},
+		{Label: "severity", Kind: 6, Documentation: "Pre-check severity: 'error' (default) or 'warn' to only warn when it fails"},
+		{Label: "dir", Kind: 6, Documentation: "Working directory of the command (e.g. \"services/api\")"},
+		{Label: "env", Kind: 6, Documentation: "Environment variables of the command (e.g. { GOFLAGS = \"-mod=mod\" })"},
+		{Label: "script", Kind: 6, Documentation: "Multi-line script run from a temporary file, instead of cmd"},
+		{Label: "shell", Kind: 6, Documentation: "Shell or interpreter running the command (e.g. \"bash -euo pipefail\", \"python3\")"},
+		{Label: "outputs", Kind: 6, Documentation: "Values captured from the step, read by later steps as {{steps.<id>.outputs.<name>}}"},
+		{Label: "sudo", Kind: 6, Documentation: "Run the command as root through sudo"},
+	}
+
+	declarationKeywords := []CompletionItem{
+		{Label: "type", Kind: 6, Documentation: "Type of the variable: string (default), int, bool, enum, path or url"},
+		{Label: "default", Kind: 6, Documentation: "Value used when none is given, or an args:, env: or vault: reference"},
+		{Label: "required", Kind: 6, Documentation: "Fail the run before any step when the variable has no value"},
+		{Label: "pattern", Kind: 6, Documentation: "Regular expression the whole value must match (e.g. \"v[0-9]+\")"},
+		{Label: "description", Kind: 6, Documentation: "What the variable is for, shown by workflow info"},
+		{Label: "secret", Kind: 6, Documentation: "Redact the value as *** from run output"},
+		{Label: "values", Kind: 6, Documentation: "Allowed values of an enum variable (e.g. [\"staging\", \"prod\"])"},
 	}
 
 	configKeywords := []CompletionItem{
@@ -312,10 +346,11 @@ func (s *Server) handleCompletion(params json.RawMessage) (interface{}, error) {
 		{Label: "store_logs", Kind: 6, Documentation: "Store execution logs"},
 		{Label: "background", Kind: 6, Documentation: "Run workflow in the background"},
 		{Label: "global", Kind: 6, Documentation: "Make workflow available globally"},
+		{Label: "export_variables", Kind: 6, Documentation: "Add resolved variables to the environment of commands: true, or a list of names"},
 	}
 
 	metadataKeywords := []CompletionItem{
-		{Label: "name", Kind: 6, Documentation: "Workflow name"},
+		{Label: "name", Kind: 6, Documentation: "Workflow name, or step name selected with --only and --skip"},
 		{Label: "desc", Kind: 6, Documentation: "Workflow description"},
 	}
 
@@ -327,15 +362,30 @@ func (s *Server) handleCompletion(params json.RawMessage) (interface{}, error) {
 		{Label: "vault:", Kind: 15, Documentation: "Resolve from migraine vault (e.g. vault:SECRET_KEY)"},
 		{Label: "action:", Kind: 15, Documentation: "Reference a named action in on_fail/on_success (e.g. action:notify)"},
 		{Label: "run:", Kind: 15, Documentation: "Run a command in on_fail/on_success (e.g. 'run:echo done')"},
+		{Label: "string", Kind: 12, Documentation: "Variable type: any text"},
+		{Label: "int", Kind: 12, Documentation: "Variable type: a whole number"},
+		{Label: "bool", Kind: 12, Documentation: "Variable type: true or false"},
+		{Label: "enum", Kind: 12, Documentation: "Variable type: one of the declared values"},
+		{Label: "path", Kind: 12, Documentation: "Variable type: a file system path, with ~/ expanded"},
+		{Label: "url", Kind: 12, Documentation: "Variable type: an absolute URL such as https://example.com"},
 	}
 
 	items = append(items, blockKeywords...)
 	items = append(items, workflowKeywords...)
 	items = append(items, atomKeywords...)
+	items = append(items, declarationKeywords...)
 	items = append(items, configKeywords...)
 	items = append(items, metadataKeywords...)
 	items = append(items, valueHints...)
 
+	// Variables declared in the document, for {{name}}
+	s.mu.Lock()
+	text := s.docs[p.TextDocument.URI]
+	s.mu.Unlock()
+	for _, d := range documentVariables(text) {
+		items = append(items, CompletionItem{Label: d.Name, Kind: 6, Documentation: d.Describe()})
+	}
+
 	return CompletionResult{Items: items}, nil
 }
 
@@ -356,20 +406,49 @@ type MarkupContent struct {
 
 var hoverDocs = map[string]string{
 	"metadata":      "## metadata block\nDefines workflow metadata: `name` and `desc` (description).",
-	"variables":     "## variables block\nDefine variables resolved at runtime.\n\nPrefixes:\n- `args:VAR` — from CLI flags\n- `env:VAR` — from environment\n- `vault:VAR` — from migraine vault",
-	"workflow":      "## workflow block\nContains `pre_checks`, `steps`, and `actions`.",
-	"config":        "## config block\nConfiguration options:\n- `store_variables` (bool)\n- `store_logs` (bool)\n- `background` (bool)\n- `global` (bool)",
+	"variables":     "## variables block\nDefine variables resolved at runtime.\n\nPrefixes:\n- `args:VAR` — from CLI flags\n- `env:VAR` — from environment\n- `vault:VAR` — from migraine vault\n\nDeclare a variable to check its value before any step runs, e.g. `port = { type = \"int\", default = 8080, required = true }`. Fields: `type`, `default`, `required`, `pattern`, `description`, `secret`, `values`.",
+	"workflow":      "## workflow block\nContains `pre_checks`, `steps`, `actions` and the workflow hooks `on_success`, `on_failure` and `finally`.",
+	"config":        "## config block\nConfiguration options:\n- `store_variables` (bool)\n- `store_logs` (bool)\n- `background` (bool)\n- `global` (bool)\n- `export_variables` (bool or list)",
 	"pre_checks":    "## pre_checks\nPre-flight checks that run before steps. Each check is an atom with `cmd`, optional `desc`, `on_fail`, `on_success`.",
 	"steps":         "## steps\nOrdered execution steps. Each step is an atom with `cmd`, optional `desc`, `on_fail`, `on_success`.",
 	"actions":       "## actions\nNamed reusable actions triggered by `on_fail` or `on_success` hooks.\n\nReference with `action:name` in hook fields.",
 	"cmd":           "## cmd\nThe shell command to execute. Supports template variables: `{{var_name}}`.",
 	"desc":          "## desc\nHuman-readable description displayed during execution.",
 	"on_fail":       "## on_fail\nHook executed when the step/check fails. Use `action:name` to reference an action, or `run:command` for inline.",
-	"on_success":    "## on_success\nHook executed when the step/check succeeds. Use `action:name` to reference an action, or `run:command` for inline.",
+	"on_success":    "## on_success\nHook executed when the step/check succeeds. Use `action:name` to reference an action, or `run:command` for inline.\n\nIn the `workflow` block, `on_success [ ... ]` lists steps run once after the whole workflow succeeded.",
+	"on_failure":    "## on_failure\nSteps run once after the workflow failed, e.g. a single notification instead of one per step. Not run when the run is cancelled.",
+	"finally":       "## finally\nSteps run once after every run, after `on_success` or `on_failure`, also when the run failed or was cancelled. Use it to clean up.",
+	"timeout":       "## timeout\nMaximum run time of the step/check, as seconds (`300`) or a duration string (`\"5m\"`, `\"1h30m\"`). Supports template variables, e.g. `\"{{build_timeout}}\"`. The command and everything it started are stopped when it expires.",
+	"retries":       "## retries\nNumber of times to retry the step/check after it fails. Every attempt is recorded in the run history. Interrupted commands are not retried.",
+	"retry_delay":   "## retry_delay\nTime to wait before each retry, as seconds (`5`) or a duration string (`\"10s\"`). Defaults to `1s`.",
+	"backoff":       "## backoff\nHow the retry delay grows: `constant` (default) waits `retry_delay` every time, `exponential` doubles it after each attempt, up to 5 minutes.",
+	"jitter":        "## jitter\nWhen `true`, each retry delay is randomized between half and the full delay.",
+	"id":            "## id\nIdentifier of the step, used by other steps in `needs` and to prefix its output when steps run in parallel.",
+	"when":          "## when\nCondition under which the step runs; the step is skipped when it is false.\n\n- `{{env}} == 'prod'`, `!=`, `&&`, `||`, `!` and parentheses\n- `previous.failed`, `previous.succeeded`, `previous.skipped`, `previous.status` (not with `needs`)\n- `steps.<id>.succeeded` (also `failed`, `skipped`, `status`)\n- `exists('go.mod')` for files, directories and globs, relative to the step `dir`",
+	"if":            "## if\nAnother name for `when`. A step sets one of them, not both.",
+	"name":          "## name\nName of the workflow in `metadata`, or of a step. `migraine run --only build,test` and `--skip lint` select steps by name or `id`.",
+	"tags":          "## tags\nLabels of the step, e.g. `[\"fast\", \"unit\"]`. `migraine run --tags fast` runs only the steps with any of the given tags.",
+	"allow_failure": "## allow_failure\nWhen `true`, a failure of the step is reported but the workflow goes on, and the run finishes as `PASSED WITH WARNINGS` (exit code 5).",
+	"severity":      "## severity\nSeverity of a pre-check: `error` (default) stops the workflow when the check fails, `warn` reports it as a warning and goes on.",
+	"dir":           "## dir\nWorking directory of the command, e.g. `\"services/api\"`. Set in the `workflow` block for every command; a relative step `dir` is then relative to it. Supports `{{variables}}`.",
+	"env":           "## env\nEnvironment variables added to the command, e.g. `{ GOFLAGS = \"-mod=mod\" }`. Set in the `workflow` block for every command; step values take precedence. Values support `{{variables}}`.",
+	"script":        "## script\nMulti-line script written to a temporary file and run by the `shell`, instead of `cmd`. Use a backtick string for several lines. Supports `{{variables}}`.",
+	"shell":         "## shell\nShell or interpreter running the command or script, e.g. `\"bash -euo pipefail\"`, `\"sh\"`, `\"python3\"` or `\"node\"`. Set in the `workflow` block for every command; defaults to `$SHELL`.",
+	"sudo":          "## sudo\nRuns the command as root through `sudo`. migraine asks for the sudo password once before the run, or fails when a password is needed and it cannot ask. `--no-sudo` refuses to run such steps.",
+	"outputs":       "## outputs\nValues captured from the step, which later steps read as `{{steps.<id>.outputs.<name>}}`; the step needs an `id`.\n\n- `version = \"last_line\"`: `stdout` (default), `last_line` or `file` for `name=value` lines written to `$MIGRAINE_OUTPUT`\n- `tag = { json = \".image.tag\" }` or `{ regex = \"port=(\\d+)\" }` to pick a part of it",
+	"needs":         "## needs\nList of step ids that must succeed before this step starts, e.g. `[\"lint\", \"test\"]`. Once any step declares `needs`, independent steps run in parallel (limited by `--jobs`).",
+	"type":          "## type\nType of a declared variable, checked before any step runs:\n\n- `string` (default)\n- `int`\n- `bool`, normalized to `true` or `false`\n- `enum`, one of `values`\n- `path`, with `~/` expanded\n- `url`, absolute with a scheme and a host",
+	"default":       "## default\nValue of a declared variable when none is given by a flag, the vault or a `.env` file. Accepts `args:`, `env:` and `vault:` references.",
+	"required":      "## required\nWhen `true`, the run fails before any step when the variable has no value.",
+	"pattern":       "## pattern\nRegular expression the whole value of the variable must match, e.g. `\"[a-z][a-z0-9-]*\"`.",
+	"description":   "## description\nDescription of the workflow in `metadata`, same as `desc`, or what a declared variable is for, shown by `migraine workflow info` and when a required variable is missing.",
+	"secret":        "## secret\nWhen `true`, the value of the variable is redacted as `***` from run output, logs and events, like values from the vault.",
+	"values":        "## values\nAllowed values of an `enum` variable, e.g. `[\"staging\", \"prod\"]`.",
 	"store_variables": "`store_variables` (bool): Persist resolved variables between runs.",
 	"store_logs":      "`store_logs` (bool): Store execution logs for later review.",
 	"background":      "`background` (bool): Run the workflow in the background.",
 	"global":           "`global` (bool): Make the workflow available across all projects.",
+	"export_variables": "`export_variables` (bool or list): Add the resolved variables, or only the listed ones (e.g. `[\"APP_NAME\"]`), to the environment of every command so scripts can read `$APP_NAME`.",
 }
 
 func (s *Server) handleHover(params json.RawMessage) (interface{}, error) {
@@ -400,9 +479,46 @@ func (s *Server) handleHover(params json.RawMessage) (interface{}, error) {
 		}, nil
 	}
 
+	for _, d := range documentVariables(text) {
+		if d.Name == word {
+			return HoverResult{
+				Contents: MarkupContent{
+					Kind:  "markdown",
+					Value: fmt.Sprintf("## {{%s}}\nVariable: %s", d.Name, d.Describe()),
+				},
+			}, nil
+		}
+	}
+
 	return nil, nil
 }
 
+// documentVariables returns the valid variable declarations of a document,
+// sorted by name
+func documentVariables(text string) []workflow.VariableDeclaration {
+	parser, err := workflow.NewMigraineParserFromReader(strings.NewReader(text))
+	if err != nil {
+		return nil
+	}
+	wf, err := parser.Parse()
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(wf.Config.Variables))
+	for name := range wf.Config.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var declarations []workflow.VariableDeclaration
+	for _, name := range names {
+		if d, err := workflow.ParseVariableDeclaration(name, wf.Config.Variables[name]); err == nil {
+			declarations = append(declarations, d)
+		}
+	}
+	return declarations
+}
+
 type DocumentSymbolParams struct {
 	TextDocument TextDocumentIdentifier `json:"textDocument"`
 }
@@ -573,12 +689,18 @@ var blockNames = map[string]bool{
 
 var sectionNames = map[string]bool{
 	"pre_checks": true, "steps": true, "actions": true,
+	"on_failure": true, "finally": true,
 }
 
 var propertyNames = map[string]bool{
 	"cmd": true, "desc": true, "description": true,
-	"on_fail": true, "on_success": true,
-	"store_variables": true, "store_logs": true,
+	"on_fail": true, "on_success": true, "timeout": true,
+	"retries": true, "retry_delay": true, "backoff": true, "jitter": true,
+	"id": true, "needs": true, "when": true, "if": true, "tags": true,
+	"allow_failure": true, "severity": true, "dir": true, "env": true, "outputs": true,
+	"script": true, "shell": true, "sudo": true,
+	"type": true, "default": true, "required": true, "pattern": true, "secret": true, "values": true,
+	"store_variables": true, "store_logs": true, "export_variables": true,
 	"background": true, "global": true,
 	"name": true,
 }
@@ -641,7 +763,7 @@ func symbolKind(name string) int {
 		return 7 // Module
 	case "workflow":
 		return 6 // Class
-	case "steps", "pre_checks", "actions":
+	case "steps", "pre_checks", "actions", "on_failure", "finally":
 		return 12 // Function
 	default:
 		return 12
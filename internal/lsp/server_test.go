@@ -82,9 +82,13 @@ func TestCompletion_ReturnsItems(t *testing.T) {
 	}
 
 	expected := []string{"metadata", "variables", "workflow", "config",
-		"steps", "pre_checks", "actions",
-		"cmd", "desc", "on_fail", "on_success",
-		"store_variables", "store_logs", "background", "global",
+		"steps", "pre_checks", "actions", "on_failure", "finally",
+		"cmd", "desc", "on_fail", "on_success", "timeout",
+		"retries", "retry_delay", "backoff", "jitter", "id", "needs", "when", "if", "name", "tags",
+		"allow_failure", "severity", "dir", "env", "outputs", "script", "shell", "sudo",
+		"type", "default", "required", "pattern", "description", "secret", "values",
+		"string", "int", "bool", "enum", "path", "url",
+		"store_variables", "store_logs", "background", "global", "export_variables",
 		"true", "false", "args:", "env:", "vault:", "action:", "run:"}
 
 	for _, e := range expected {
@@ -115,6 +119,49 @@ func TestHover_KnownKeyword(t *testing.T) {
 	}
 }
 
+func TestHover_DeclaredVariable(t *testing.T) {
+	s := NewServer()
+	s.docs["file:///test.mg"] = `variables {
+    port = { type = "int", default = 8080, description = "Port of the API" }
+}
+workflow {
+    steps [
+        { cmd = "serve --port {{port}}" }
+    ]
+}
+`
+
+	params, _ := json.Marshal(HoverParams{
+		TextDocument: TextDocumentIdentifier{URI: "file:///test.mg"},
+		Position:     Position{Line: 5, Character: 33},
+	})
+	result, err := s.handleHover(params)
+	if err != nil || result == nil {
+		t.Fatalf("Expected hover result for 'port', got %v (%v)", result, err)
+	}
+	if value := result.(HoverResult).Contents.Value; !strings.Contains(value, "int, default 8080 - Port of the API") {
+		t.Errorf("Hover content should describe the variable, got: %s", value)
+	}
+
+	completion, _ := json.Marshal(CompletionParams{TextDocument: TextDocumentIdentifier{URI: "file:///test.mg"}})
+	items, _ := s.handleCompletion(completion)
+	found := false
+	for _, item := range items.(CompletionResult).Items {
+		found = found || (item.Label == "port" && strings.Contains(item.Documentation, "Port of the API"))
+	}
+	if !found {
+		t.Error("Expected a completion item for the declared variable")
+	}
+
+	diags := validateDocument(`variables {
+    port = { type = "integer" }
+}
+`)
+	if len(diags) == 0 || !strings.Contains(diags[0].Message, `unknown type "integer"`) {
+		t.Errorf("Expected a diagnostic for the invalid declaration, got %+v", diags)
+	}
+}
+
 func TestHover_UnknownWord(t *testing.T) {
 	s := NewServer()
 	s.docs["file:///test.mg"] = "xyzzy {\n}\n"
@@ -29,7 +29,9 @@ func NewDBService(appName string) (*DBService, error) {
 	// Full path to the SQLite file
 	dbFilePath := filepath.Join(dbPath, "migraine.db")
 
-	db, err := sql.Open("sqlite", dbFilePath)
+	// Background runs write to the database from a separate process, so wait
+	// for locks instead of failing immediately with SQLITE_BUSY
+	db, err := sql.Open("sqlite", dbFilePath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +54,11 @@ func (s *DBService) DB() *sql.DB {
 	return s.db
 }
 
+// DataDir returns the directory holding the database and other migraine data
+func (s *DBService) DataDir() string {
+	return filepath.Dir(s.path)
+}
+
 func (s *DBService) Close() error {
 	if s.db != nil {
 		return s.db.Close()
@@ -101,6 +108,27 @@ func (s *DBService) migrate() error {
 		return fmt.Errorf("failed to create vault index: %v", err)
 	}
 
+	// Project of project-scoped variables, NULL for those set before projects
+	if err := s.ensureColumn("vault", "project_id", "TEXT"); err != nil {
+		return err
+	}
+
+	// The data key encrypting vault values, sealed with the master key
+	vaultKeysTableSQL := `
+	CREATE TABLE IF NOT EXISTS vault_keys (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		source TEXT NOT NULL,
+		kdf TEXT,
+		key_ref TEXT,
+		wrapped_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := s.db.Exec(vaultKeysTableSQL); err != nil {
+		return fmt.Errorf("failed to create vault_keys table: %v", err)
+	}
+
 	// Create runs table
 	runsTableSQL := `
 	CREATE TABLE IF NOT EXISTS runs (
@@ -117,5 +145,96 @@ func (s *DBService) migrate() error {
 		return fmt.Errorf("failed to create runs table: %v", err)
 	}
 
+	// Columns added to runs after the initial release
+	if err := s.ensureColumn("runs", "triggered_by", "TEXT"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("runs", "pid", "INTEGER"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("runs", "log_path", "TEXT"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("runs", "resumed_from", "INTEGER"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("runs", "variables", "TEXT"); err != nil {
+		return err
+	}
+
+	// Create run steps table
+	runStepsTableSQL := `
+	CREATE TABLE IF NOT EXISTS run_steps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id INTEGER NOT NULL,
+		phase TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		description TEXT,
+		command TEXT,
+		status TEXT NOT NULL,
+		exit_code INTEGER,
+		error TEXT,
+		started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		completed_at DATETIME,
+		FOREIGN KEY (run_id) REFERENCES runs (id) ON DELETE CASCADE
+	);`
+
+	if _, err := s.db.Exec(runStepsTableSQL); err != nil {
+		return fmt.Errorf("failed to create run_steps table: %v", err)
+	}
+
+	runStepsIndexSQL := `
+	CREATE INDEX IF NOT EXISTS idx_run_steps_run_id ON run_steps(run_id);`
+
+	if _, err := s.db.Exec(runStepsIndexSQL); err != nil {
+		return fmt.Errorf("failed to create run_steps index: %v", err)
+	}
+
+	if err := s.ensureColumn("run_steps", "attempt", "INTEGER DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := s.ensureColumn("run_steps", "outputs", "TEXT"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ensureColumn adds a column to an existing table if it is not present yet.
+// CREATE TABLE IF NOT EXISTS never alters tables created by older versions.
+func (s *DBService) ensureColumn(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+
+	found := false
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to inspect %s table: %v", table, err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+
+	if found {
+		return nil
+	}
+
+	if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %v", table, column, err)
+	}
+
 	return nil
 }
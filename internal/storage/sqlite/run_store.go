@@ -2,6 +2,7 @@ package sqlite
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -14,10 +15,51 @@ func NewRunStore(dbService *DBService) *RunStore {
 	return &RunStore{dbService: dbService}
 }
 
-func (rs *RunStore) CreateRun(run Run) error {
+const runColumns = `id, workflow_id, status, started_at, completed_at, logs, COALESCE(triggered_by, ''), COALESCE(pid, 0), COALESCE(log_path, ''), COALESCE(resumed_from, 0), variables`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRun(row rowScanner) (*Run, error) {
+	var run Run
+	var completedAt *time.Time
+	var logs *string
+	var variables *string
+
+	err := row.Scan(
+		&run.ID,
+		&run.WorkflowID,
+		&run.Status,
+		&run.StartedAt,
+		&completedAt,
+		&logs,
+		&run.TriggeredBy,
+		&run.PID,
+		&run.LogPath,
+		&run.ResumedFrom,
+		&variables,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	run.CompletedAt = completedAt
+	run.Logs = logs
+	if variables != nil {
+		if err := json.Unmarshal([]byte(*variables), &run.Variables); err != nil {
+			return nil, fmt.Errorf("failed to decode variables of run %d: %v", run.ID, err)
+		}
+	}
+
+	return &run, nil
+}
+
+// CreateRun inserts a new run and returns its generated ID
+func (rs *RunStore) CreateRun(run Run) (int64, error) {
 	query := `
-		INSERT INTO runs (workflow_id, status, started_at, completed_at, logs)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO runs (workflow_id, status, started_at, completed_at, logs, triggered_by, resumed_from, variables)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	var completedAt *time.Time
@@ -30,36 +72,48 @@ func (rs *RunStore) CreateRun(run Run) error {
 		logs = run.Logs
 	}
 
-	_, err := rs.dbService.db.Exec(
+	var resumedFrom *int64
+	if run.ResumedFrom != 0 {
+		resumedFrom = &run.ResumedFrom
+	}
+
+	var variables *string
+	if len(run.Variables) > 0 {
+		encoded, err := json.Marshal(run.Variables)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode run variables: %v", err)
+		}
+		value := string(encoded)
+		variables = &value
+	}
+
+	result, err := rs.dbService.db.Exec(
 		query,
 		run.WorkflowID,
 		run.Status,
 		run.StartedAt,
 		completedAt,
 		logs,
+		run.TriggeredBy,
+		resumedFrom,
+		variables,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create run: %v", err)
+		return 0, fmt.Errorf("failed to create run: %v", err)
 	}
 
-	return nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get run id: %v", err)
+	}
+
+	return id, nil
 }
 
 func (rs *RunStore) GetRun(id int64) (*Run, error) {
-	query := `SELECT id, workflow_id, status, started_at, completed_at, logs FROM runs WHERE id = ?`
+	query := `SELECT ` + runColumns + ` FROM runs WHERE id = ?`
 
-	var run Run
-	var completedAt *time.Time
-	var logs *string
-
-	err := rs.dbService.db.QueryRow(query, id).Scan(
-		&run.ID,
-		&run.WorkflowID,
-		&run.Status,
-		&run.StartedAt,
-		&completedAt,
-		&logs,
-	)
+	run, err := scanRun(rs.dbService.db.QueryRow(query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("run with id %d not found", id)
@@ -67,15 +121,12 @@ func (rs *RunStore) GetRun(id int64) (*Run, error) {
 		return nil, fmt.Errorf("failed to get run: %v", err)
 	}
 
-	run.CompletedAt = completedAt
-	run.Logs = logs
-
-	return &run, nil
+	return run, nil
 }
 
 func (rs *RunStore) UpdateRun(run Run) error {
 	query := `
-		UPDATE runs 
+		UPDATE runs
 		SET status = ?, completed_at = ?, logs = ?
 		WHERE id = ?
 	`
@@ -105,7 +156,7 @@ func (rs *RunStore) UpdateRun(run Run) error {
 }
 
 func (rs *RunStore) ListRuns(workflowID string) ([]Run, error) {
-	query := `SELECT id, workflow_id, status, started_at, completed_at, logs FROM runs WHERE workflow_id = ? ORDER BY started_at DESC`
+	query := `SELECT ` + runColumns + ` FROM runs WHERE workflow_id = ? ORDER BY started_at DESC`
 
 	rows, err := rs.dbService.db.Query(query, workflowID)
 	if err != nil {
@@ -115,32 +166,18 @@ func (rs *RunStore) ListRuns(workflowID string) ([]Run, error) {
 
 	var runs []Run
 	for rows.Next() {
-		var run Run
-		var completedAt *time.Time
-		var logs *string
-
-		err := rows.Scan(
-			&run.ID,
-			&run.WorkflowID,
-			&run.Status,
-			&run.StartedAt,
-			&completedAt,
-			&logs,
-		)
+		run, err := scanRun(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan run: %v", err)
 		}
-
-		run.CompletedAt = completedAt
-		run.Logs = logs
-		runs = append(runs, run)
+		runs = append(runs, *run)
 	}
 
 	return runs, nil
 }
 
 func (rs *RunStore) ListRecentRuns(limit int) ([]Run, error) {
-	query := `SELECT id, workflow_id, status, started_at, completed_at, logs FROM runs ORDER BY started_at DESC LIMIT ?`
+	query := `SELECT ` + runColumns + ` FROM runs ORDER BY started_at DESC LIMIT ?`
 
 	rows, err := rs.dbService.db.Query(query, limit)
 	if err != nil {
@@ -150,31 +187,149 @@ func (rs *RunStore) ListRecentRuns(limit int) ([]Run, error) {
 
 	var runs []Run
 	for rows.Next() {
-		var run Run
-		var completedAt *time.Time
-		var logs *string
-
-		err := rows.Scan(
-			&run.ID,
-			&run.WorkflowID,
-			&run.Status,
-			&run.StartedAt,
-			&completedAt,
-			&logs,
-		)
+		run, err := scanRun(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan run: %v", err)
 		}
+		runs = append(runs, *run)
+	}
+
+	return runs, nil
+}
 
-		run.CompletedAt = completedAt
-		run.Logs = logs
-		runs = append(runs, run)
+// SetRunProcess records the process and log file of a background run
+func (rs *RunStore) SetRunProcess(id int64, pid int, logPath string) error {
+	_, err := rs.dbService.db.Exec(`UPDATE runs SET pid = ?, log_path = ? WHERE id = ?`, pid, logPath, id)
+	if err != nil {
+		return fmt.Errorf("failed to update run process: %v", err)
+	}
+	return nil
+}
+
+// CancelRun marks a run and its unfinished steps as cancelled
+func (rs *RunStore) CancelRun(id int64) error {
+	now := time.Now().UTC()
+
+	if _, err := rs.dbService.db.Exec(
+		`UPDATE run_steps SET status = ?, completed_at = ? WHERE run_id = ? AND status = ?`,
+		RunStatusCancelled, now, id, RunStatusRunning,
+	); err != nil {
+		return fmt.Errorf("failed to cancel run steps: %v", err)
+	}
+
+	if _, err := rs.dbService.db.Exec(
+		`UPDATE runs SET status = ?, completed_at = ? WHERE id = ?`,
+		RunStatusCancelled, now, id,
+	); err != nil {
+		return fmt.Errorf("failed to cancel run: %v", err)
+	}
+
+	return nil
+}
+
+// RunFilter narrows the runs returned by FilterRuns. Zero values match everything.
+type RunFilter struct {
+	WorkflowID string
+	Status     string
+	Limit      int
+}
+
+// FilterRuns returns the most recent runs matching the filter
+func (rs *RunStore) FilterRuns(filter RunFilter) ([]Run, error) {
+	query := `SELECT ` + runColumns + ` FROM runs WHERE 1 = 1`
+	var args []interface{}
+
+	if filter.WorkflowID != "" {
+		query += ` AND workflow_id = ?`
+		args = append(args, filter.WorkflowID)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+
+	query += ` ORDER BY started_at DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := rs.dbService.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run: %v", err)
+		}
+		runs = append(runs, *run)
 	}
 
 	return runs, nil
 }
 
+// DeleteRunsBefore removes finished runs started before the cutoff, along with
+// their steps, and returns how many runs were deleted and the log files of the
+// background ones, which the caller removes. Runs still in progress are kept.
+func (rs *RunStore) DeleteRunsBefore(cutoff time.Time) (int64, []string, error) {
+	tx, err := rs.dbService.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT log_path FROM runs WHERE started_at < ? AND status != ? AND COALESCE(log_path, '') != ''`, cutoff.UTC(), RunStatusRunning)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list run logs: %v", err)
+	}
+	var logPaths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, nil, fmt.Errorf("failed to scan run log: %v", err)
+		}
+		logPaths = append(logPaths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("failed to list run logs: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM run_steps WHERE run_id IN (
+			SELECT id FROM runs WHERE started_at < ? AND status != ?
+		)`, cutoff.UTC(), RunStatusRunning)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to delete run steps: %v", err)
+	}
+
+	result, err := tx.Exec(`DELETE FROM runs WHERE started_at < ? AND status != ?`, cutoff.UTC(), RunStatusRunning)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to delete runs: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("failed to commit prune: %v", err)
+	}
+
+	return deleted, logPaths, nil
+}
+
 func (rs *RunStore) DeleteRun(id int64) error {
+	if _, err := rs.dbService.db.Exec(`DELETE FROM run_steps WHERE run_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete run steps: %v", err)
+	}
+
 	query := `DELETE FROM runs WHERE id = ?`
 
 	result, err := rs.dbService.db.Exec(query, id)
@@ -193,3 +348,129 @@ func (rs *RunStore) DeleteRun(id int64) error {
 
 	return nil
 }
+
+// CreateRunStep inserts a step record for a run and returns its generated ID
+func (rs *RunStore) CreateRunStep(step RunStep) (int64, error) {
+	query := `
+		INSERT INTO run_steps (run_id, phase, position, attempt, description, command, status, exit_code, error, started_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	attempt := step.Attempt
+	if attempt == 0 {
+		attempt = 1
+	}
+
+	result, err := rs.dbService.db.Exec(
+		query,
+		step.RunID,
+		step.Phase,
+		step.Position,
+		attempt,
+		step.Description,
+		step.Command,
+		step.Status,
+		step.ExitCode,
+		step.Error,
+		step.StartedAt,
+		step.CompletedAt,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create run step: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get run step id: %v", err)
+	}
+
+	return id, nil
+}
+
+// UpdateRunStep records the outcome of a run step
+func (rs *RunStore) UpdateRunStep(step RunStep) error {
+	query := `
+		UPDATE run_steps
+		SET status = ?, exit_code = ?, error = ?, completed_at = ?, outputs = ?
+		WHERE id = ?
+	`
+
+	var outputs *string
+	if len(step.Outputs) > 0 {
+		encoded, err := json.Marshal(step.Outputs)
+		if err != nil {
+			return fmt.Errorf("failed to encode run step outputs: %v", err)
+		}
+		value := string(encoded)
+		outputs = &value
+	}
+
+	_, err := rs.dbService.db.Exec(
+		query,
+		step.Status,
+		step.ExitCode,
+		step.Error,
+		step.CompletedAt,
+		outputs,
+		step.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update run step: %v", err)
+	}
+
+	return nil
+}
+
+// ListRunSteps returns the steps of a run in execution order
+func (rs *RunStore) ListRunSteps(runID int64) ([]RunStep, error) {
+	query := `
+		SELECT id, run_id, phase, position, COALESCE(attempt, 1), COALESCE(description, ''), COALESCE(command, ''), status, exit_code, error, started_at, completed_at, outputs
+		FROM run_steps WHERE run_id = ? ORDER BY id
+	`
+
+	rows, err := rs.dbService.db.Query(query, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list run steps: %v", err)
+	}
+	defer rows.Close()
+
+	var steps []RunStep
+	for rows.Next() {
+		var step RunStep
+		var exitCode *int
+		var errMsg *string
+		var completedAt *time.Time
+		var outputs *string
+
+		err := rows.Scan(
+			&step.ID,
+			&step.RunID,
+			&step.Phase,
+			&step.Position,
+			&step.Attempt,
+			&step.Description,
+			&step.Command,
+			&step.Status,
+			&exitCode,
+			&errMsg,
+			&step.StartedAt,
+			&completedAt,
+			&outputs,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan run step: %v", err)
+		}
+		if outputs != nil {
+			if err := json.Unmarshal([]byte(*outputs), &step.Outputs); err != nil {
+				return nil, fmt.Errorf("failed to decode outputs of run step %d: %v", step.ID, err)
+			}
+		}
+
+		step.ExitCode = exitCode
+		step.Error = errMsg
+		step.CompletedAt = completedAt
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,189 @@
+package sqlite
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestRunStore opens a database in a temporary home directory
+func newTestRunStore(t *testing.T) *RunStore {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	db, err := NewDBService("migraine")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewRunStore(db)
+}
+
+// createRun records a run started age ago
+func createRun(t *testing.T, store *RunStore, workflowID, status string, age time.Duration) int64 {
+	t.Helper()
+	id, err := store.CreateRun(Run{WorkflowID: workflowID, Status: status, StartedAt: time.Now().UTC().Add(-age)})
+	if err != nil {
+		t.Fatalf("failed to create run: %v", err)
+	}
+	return id
+}
+
+// createRunStep records a step of run with the given status
+func createRunStep(t *testing.T, store *RunStore, runID int64, position int, status string) {
+	t.Helper()
+	if _, err := store.CreateRunStep(RunStep{RunID: runID, Phase: RunPhaseStep, Position: position, Status: status, StartedAt: time.Now().UTC()}); err != nil {
+		t.Fatalf("failed to create run step: %v", err)
+	}
+}
+
+func runIDs(runs []Run) []int64 {
+	ids := make([]int64, len(runs))
+	for i, run := range runs {
+		ids[i] = run.ID
+	}
+	return ids
+}
+
+func TestRunStore_RecordRun(t *testing.T) {
+	store := newTestRunStore(t)
+	id, err := store.CreateRun(Run{WorkflowID: "deploy", Status: RunStatusRunning, StartedAt: time.Now().UTC(), TriggeredBy: "cli"})
+	if err != nil {
+		t.Fatalf("failed to create run: %v", err)
+	}
+	stepID, err := store.CreateRunStep(RunStep{RunID: id, Phase: RunPhaseStep, Position: 1, Description: "Build", Command: "make {{target}}", Status: RunStatusRunning, StartedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("failed to create run step: %v", err)
+	}
+
+	exitCode := 2
+	message := "exit status 2"
+	completed := time.Now().UTC()
+	if err := store.UpdateRunStep(RunStep{ID: stepID, Status: RunStatusFailed, ExitCode: &exitCode, Error: &message, CompletedAt: &completed}); err != nil {
+		t.Fatalf("failed to update run step: %v", err)
+	}
+	if err := store.UpdateRun(Run{ID: id, Status: RunStatusFailed, CompletedAt: &completed}); err != nil {
+		t.Fatalf("failed to update run: %v", err)
+	}
+
+	run, err := store.GetRun(id)
+	if err != nil || run.WorkflowID != "deploy" || run.Status != RunStatusFailed || run.TriggeredBy != "cli" || run.CompletedAt == nil {
+		t.Errorf("expected a completed, failed run triggered by the cli, got %+v (%v)", run, err)
+	}
+	steps, err := store.ListRunSteps(id)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("expected 1 step, got %v (%v)", steps, err)
+	}
+	step := steps[0]
+	if step.Command != "make {{target}}" || step.Status != RunStatusFailed || step.ExitCode == nil || *step.ExitCode != 2 || step.Error == nil || *step.Error != message || step.CompletedAt == nil {
+		t.Errorf("expected the outcome of the step to be recorded, got %+v", step)
+	}
+
+	if _, err := store.GetRun(id + 1); err == nil {
+		t.Error("expected an unknown run to fail")
+	}
+}
+
+func TestRunStore_FilterRuns(t *testing.T) {
+	store := newTestRunStore(t)
+	oldest := createRun(t, store, "deploy", RunStatusSuccess, 3*time.Hour)
+	failed := createRun(t, store, "deploy", RunStatusFailed, 2*time.Hour)
+	other := createRun(t, store, "backup", RunStatusFailed, time.Hour)
+	newest := createRun(t, store, "deploy", RunStatusRunning, time.Minute)
+
+	for name, tc := range map[string]struct {
+		filter RunFilter
+		want   []int64
+	}{
+		"all, newest first": {RunFilter{}, []int64{newest, other, failed, oldest}},
+		"workflow":          {RunFilter{WorkflowID: "deploy"}, []int64{newest, failed, oldest}},
+		"status":            {RunFilter{Status: RunStatusFailed}, []int64{other, failed}},
+		"workflow, status":  {RunFilter{WorkflowID: "deploy", Status: RunStatusRunning}, []int64{newest}},
+		"limit":             {RunFilter{WorkflowID: "deploy", Limit: 2}, []int64{newest, failed}},
+		"no match":          {RunFilter{WorkflowID: "release"}, []int64{}},
+	} {
+		runs, err := store.FilterRuns(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: failed to filter runs: %v", name, err)
+		}
+		if got := runIDs(runs); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected runs %v, got %v", name, tc.want, got)
+		}
+	}
+}
+
+func TestRunStore_DeleteRunsBefore(t *testing.T) {
+	store := newTestRunStore(t)
+	old := createRun(t, store, "deploy", RunStatusSuccess, 48*time.Hour)
+	createRunStep(t, store, old, 1, RunStatusSuccess)
+	background := createRun(t, store, "deploy", RunStatusFailed, 48*time.Hour)
+	if err := store.SetRunProcess(background, 4242, "/tmp/runs/2.log"); err != nil {
+		t.Fatalf("failed to set run process: %v", err)
+	}
+	running := createRun(t, store, "deploy", RunStatusRunning, 48*time.Hour)
+	recent := createRun(t, store, "deploy", RunStatusSuccess, time.Hour)
+
+	deleted, logPaths, err := store.DeleteRunsBefore(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("failed to prune runs: %v", err)
+	}
+	if deleted != 2 || len(logPaths) != 1 || logPaths[0] != "/tmp/runs/2.log" {
+		t.Errorf("expected 2 runs and the background log to be pruned, got %d and %v", deleted, logPaths)
+	}
+
+	for _, id := range []int64{old, background} {
+		if _, err := store.GetRun(id); err == nil {
+			t.Errorf("expected run %d to be deleted", id)
+		}
+	}
+	if steps, err := store.ListRunSteps(old); err != nil || len(steps) != 0 {
+		t.Errorf("expected the steps of the run to be deleted, got %v (%v)", steps, err)
+	}
+	for _, id := range []int64{running, recent} {
+		if _, err := store.GetRun(id); err != nil {
+			t.Errorf("expected run %d to be kept, got %v", id, err)
+		}
+	}
+}
+
+func TestRunStore_CancelRun(t *testing.T) {
+	store := newTestRunStore(t)
+	id := createRun(t, store, "deploy", RunStatusRunning, time.Minute)
+	createRunStep(t, store, id, 1, RunStatusSuccess)
+	createRunStep(t, store, id, 2, RunStatusRunning)
+
+	if err := store.CancelRun(id); err != nil {
+		t.Fatalf("failed to cancel run: %v", err)
+	}
+
+	run, err := store.GetRun(id)
+	if err != nil || run.Status != RunStatusCancelled || run.CompletedAt == nil {
+		t.Errorf("expected a completed, cancelled run, got %+v (%v)", run, err)
+	}
+	steps, err := store.ListRunSteps(id)
+	if err != nil || len(steps) != 2 {
+		t.Fatalf("expected 2 steps, got %v (%v)", steps, err)
+	}
+	if steps[0].Status != RunStatusSuccess || steps[0].CompletedAt != nil {
+		t.Errorf("expected the finished step to be kept, got %+v", steps[0])
+	}
+	if steps[1].Status != RunStatusCancelled || steps[1].CompletedAt == nil {
+		t.Errorf("expected the running step to be cancelled, got %+v", steps[1])
+	}
+}
+
+func TestRunStore_SetRunProcess(t *testing.T) {
+	store := newTestRunStore(t)
+	id := createRun(t, store, "deploy", RunStatusRunning, 0)
+
+	if run, err := store.GetRun(id); err != nil || run.PID != 0 || run.LogPath != "" {
+		t.Fatalf("expected no process before it is set, got %+v (%v)", run, err)
+	}
+	if err := store.SetRunProcess(id, 4242, "/tmp/runs/1.log"); err != nil {
+		t.Fatalf("failed to set run process: %v", err)
+	}
+	run, err := store.GetRun(id)
+	if err != nil || run.PID != 4242 || run.LogPath != "/tmp/runs/1.log" || run.Status != RunStatusRunning {
+		t.Errorf("expected the process and log file to be recorded, got %+v (%v)", run, err)
+	}
+}
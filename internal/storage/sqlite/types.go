@@ -22,10 +22,35 @@ type VaultEntry struct {
 	Value      string    `json:"value" db:"value"`
 	Scope      string    `json:"scope" db:"scope"` // global, project, workflow
 	WorkflowID *string   `json:"workflow_id" db:"workflow_id"`
+	ProjectID  *string   `json:"project_id" db:"project_id"` // For the project scope
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// Run and run step statuses
+const (
+	RunStatusRunning   = "running"
+	RunStatusSuccess   = "success"
+	RunStatusFailed    = "failed"
+	RunStatusTimedOut  = "timed_out"
+	RunStatusCancelled = "cancelled"
+	RunStatusSkipped   = "skipped" // Steps whose `when` condition was false
+	// RunStatusWarning is the status of runs that completed although
+	// pre-checks with severity: warn or steps with allow_failure failed
+	RunStatusWarning = "warning"
+)
+
+// Run phases recorded for each run step
+const (
+	RunPhasePrecheck = "precheck"
+	RunPhaseStep     = "step"
+	RunPhaseAction   = "action"
+	// Workflow hooks, run once after the pre-checks and steps
+	RunPhaseOnSuccess = "on_success"
+	RunPhaseOnFailure = "on_failure"
+	RunPhaseFinally   = "finally"
+)
+
 // Run represents an execution run of a workflow
 type Run struct {
 	ID          int64      `json:"id" db:"id"`
@@ -34,4 +59,28 @@ type Run struct {
 	StartedAt   time.Time  `json:"started_at" db:"started_at"`
 	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
 	Logs        *string    `json:"logs" db:"logs"`
+	TriggeredBy string     `json:"triggered_by" db:"triggered_by"`
+	PID         int        `json:"pid,omitempty" db:"pid"`                   // Set for background runs
+	LogPath     string     `json:"log_path,omitempty" db:"log_path"`         // Set for background runs
+	ResumedFrom int64      `json:"resumed_from,omitempty" db:"resumed_from"` // Run continued by this one, set by --resume
+	// Variables given on the command line or at prompts, reused by --resume
+	Variables map[string]string `json:"variables,omitempty" db:"variables"`
+}
+
+// RunStep represents the execution of a single pre-check, step or action within a run
+type RunStep struct {
+	ID          int64      `json:"id" db:"id"`
+	RunID       int64      `json:"run_id" db:"run_id"`
+	Phase       string     `json:"phase" db:"phase"`
+	Position    int        `json:"position" db:"position"`
+	Attempt     int        `json:"attempt" db:"attempt"` // 1 for the first run of a step, higher for retries
+	Description string     `json:"description" db:"description"`
+	Command     string     `json:"command" db:"command"` // Command template, before variable substitution
+	Status      string     `json:"status" db:"status"`
+	ExitCode    *int       `json:"exit_code" db:"exit_code"`
+	Error       *string    `json:"error" db:"error"`
+	StartedAt   time.Time  `json:"started_at" db:"started_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+	// Outputs captured from the step, read by later steps
+	Outputs map[string]string `json:"outputs,omitempty" db:"outputs"`
 }
@@ -0,0 +1,100 @@
+package sqlite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix marks vault values encrypted with the data key. Values
+// without it were written by versions of migraine without encryption.
+const encryptedPrefix = "enc:v1:"
+
+// keySize is the size of data and key encryption keys (AES-256)
+const keySize = 32
+
+// vaultCipher encrypts vault values with AES-GCM
+type vaultCipher struct {
+	aead cipher.AEAD
+}
+
+func newVaultCipher(key []byte) (*vaultCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultCipher{aead: aead}, nil
+}
+
+// seal encrypts data, binding it to ad, and returns the nonce followed by
+// the ciphertext
+func (c *vaultCipher) seal(data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, ad), nil
+}
+
+// open decrypts what seal returned
+func (c *vaultCipher) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// encryptValue encrypts the value of a vault entry. The entry key, scope and
+// workflow or project are authenticated with it, so values cannot be swapped
+// between rows.
+func (c *vaultCipher) encryptValue(value, key, scope string, scopeID *string) (string, error) {
+	sealed, err := c.seal([]byte(value), entryAD(key, scope, scopeID))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt variable '%s': %v", key, err)
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue returns the plain value of a vault entry. Values stored
+// before encryption are returned as they are.
+func (c *vaultCipher) decryptValue(value, key, scope string, scopeID *string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt variable '%s': %v", key, err)
+	}
+	plain, err := c.open(sealed, entryAD(key, scope, scopeID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt variable '%s': %v", key, err)
+	}
+	return string(plain), nil
+}
+
+// entryAD identifies a vault entry in the additional data of its value
+func entryAD(key, scope string, scopeID *string) []byte {
+	id := ""
+	if scopeID != nil {
+		id = *scopeID
+	}
+	return []byte(scope + "\x00" + id + "\x00" + key)
+}
+
+// newKey returns a random AES-256 key
+func newKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,281 @@
+package sqlite
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/argon2"
+)
+
+// Sources of the master key, which encrypts the data key of the vault
+const (
+	KeySourcePassphrase = "passphrase" // Derived from a passphrase with Argon2id
+	KeySourceFile       = "file"       // Read from a key file
+	KeySourceKeyring    = "keyring"    // Stored in the OS keyring
+)
+
+// Environment variables selecting the master key
+const (
+	// PassphraseEnv holds the vault passphrase, so it is not asked for
+	PassphraseEnv = "MIGRAINE_VAULT_PASSPHRASE"
+	// KeyFileEnv holds the path of the key file, overriding the recorded one
+	KeyFileEnv = "MIGRAINE_VAULT_KEY_FILE"
+)
+
+// keyringService is the service of the master keys in the OS keyring
+const keyringService = "migraine"
+
+// Argon2id parameters of passphrases
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+)
+
+// wrapAD is authenticated with the data key when it is sealed
+var wrapAD = []byte("migraine vault data key")
+
+// MasterKey selects where the master key of the vault comes from
+type MasterKey struct {
+	Source     string // One of the KeySource values
+	Passphrase string // For KeySourcePassphrase
+	KeyFile    string // For KeySourceFile; created when missing
+}
+
+// vaultKeyRecord is the row of the vault_keys table. It holds the data key
+// sealed with the master key and how to get the master key back.
+type vaultKeyRecord struct {
+	Source     string
+	KDF        string // For passphrases: argon2id$t=3,m=65536,p=4$<salt>
+	KeyRef     string // Path of the key file or keyring account
+	WrappedKey string
+}
+
+// passphrasePrompt asks for the vault passphrase when PassphraseEnv is not
+// set. It is nil when migraine cannot ask.
+var passphrasePrompt func(prompt string) (string, error)
+
+// SetPassphrasePrompt sets how the vault passphrase is asked for
+func SetPassphrasePrompt(prompt func(prompt string) (string, error)) {
+	passphrasePrompt = prompt
+}
+
+// vaultPassphrase returns the passphrase from PassphraseEnv or the prompt
+func vaultPassphrase() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if passphrasePrompt == nil {
+		return "", fmt.Errorf("the vault is protected by a passphrase: set %s to unlock it without a terminal", PassphraseEnv)
+	}
+	return passphrasePrompt("Vault passphrase: ")
+}
+
+// defaultMasterKey picks the master key of a new vault: a passphrase or key
+// file given in the environment, otherwise the OS keyring
+func defaultMasterKey() MasterKey {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return MasterKey{Source: KeySourcePassphrase, Passphrase: passphrase}
+	}
+	if path := os.Getenv(KeyFileEnv); path != "" {
+		return MasterKey{Source: KeySourceFile, KeyFile: path}
+	}
+	return MasterKey{Source: KeySourceKeyring}
+}
+
+// keyringFallback protects a new vault with a passphrase when the OS
+// keyring failed with keyringErr. The passphrase is asked for twice, after
+// saying why; without a terminal the vault is not set up, and a key file or
+// passphrase has to be chosen in the environment instead.
+func keyringFallback(keyringErr error) ([]byte, vaultKeyRecord, error) {
+	unavailable := fmt.Errorf("%v; set %s to keep the vault key in a file or %s to protect the vault with a passphrase", keyringErr, KeyFileEnv, PassphraseEnv)
+	if passphrasePrompt == nil {
+		return nil, vaultKeyRecord{}, unavailable
+	}
+
+	passphrase, err := passphrasePrompt(fmt.Sprintf("WARNING: the OS keyring is not available (%v).\nChoose a passphrase to protect the vault: ", keyringErr))
+	if err != nil {
+		return nil, vaultKeyRecord{}, unavailable
+	}
+	confirmation, err := passphrasePrompt("Repeat the passphrase: ")
+	if err != nil {
+		return nil, vaultKeyRecord{}, err
+	}
+	if confirmation != passphrase {
+		return nil, vaultKeyRecord{}, fmt.Errorf("the passphrases do not match")
+	}
+	return newMasterKey(MasterKey{Source: KeySourcePassphrase, Passphrase: passphrase})
+}
+
+// newMasterKey creates the master key described by m: it derives it from
+// the passphrase with a new salt, reads the key file or generates it when
+// missing, or stores a new key in the OS keyring. The returned record has
+// no wrapped data key yet.
+func newMasterKey(m MasterKey) ([]byte, vaultKeyRecord, error) {
+	record := vaultKeyRecord{Source: m.Source}
+
+	switch m.Source {
+	case KeySourcePassphrase:
+		if m.Passphrase == "" {
+			return nil, record, fmt.Errorf("the vault passphrase must not be empty")
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, record, fmt.Errorf("failed to generate salt: %v", err)
+		}
+		record.KDF = fmt.Sprintf("argon2id$t=%d,m=%d,p=%d$%s", argonTime, argonMemory, argonThreads, base64.RawStdEncoding.EncodeToString(salt))
+		key, err := deriveKey(m.Passphrase, record.KDF)
+		return key, record, err
+
+	case KeySourceFile:
+		path, err := filepath.Abs(m.KeyFile)
+		if err != nil {
+			return nil, record, fmt.Errorf("invalid key file %s: %v", m.KeyFile, err)
+		}
+		record.KeyRef = path
+		if _, err := os.Stat(path); err == nil {
+			key, err := readKeyFile(path)
+			return key, record, err
+		}
+		key, err := newKey()
+		if err != nil {
+			return nil, record, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, record, fmt.Errorf("failed to create key file: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, record, fmt.Errorf("failed to create key file: %v", err)
+		}
+		return key, record, nil
+
+	case KeySourceKeyring:
+		key, err := newKey()
+		if err != nil {
+			return nil, record, err
+		}
+		// Every key gets its own account, so that the previous one is only
+		// removed once the vault no longer needs it
+		record.KeyRef = fmt.Sprintf("vault-key-%d", time.Now().UnixNano())
+		if err := keyring.Set(keyringService, record.KeyRef, base64.StdEncoding.EncodeToString(key)); err != nil {
+			return nil, record, fmt.Errorf("failed to store the vault key in the OS keyring: %v", err)
+		}
+		return key, record, nil
+	}
+
+	return nil, record, fmt.Errorf("unknown vault key source %q", m.Source)
+}
+
+// loadMasterKey reads or derives the master key of an existing record
+func loadMasterKey(record vaultKeyRecord) ([]byte, error) {
+	switch record.Source {
+	case KeySourcePassphrase:
+		passphrase, err := vaultPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		return deriveKey(passphrase, record.KDF)
+
+	case KeySourceFile:
+		path := record.KeyRef
+		if override := os.Getenv(KeyFileEnv); override != "" {
+			path = override
+		}
+		return readKeyFile(path)
+
+	case KeySourceKeyring:
+		encoded, err := keyring.Get(keyringService, record.KeyRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the vault key from the OS keyring: %v", err)
+		}
+		return decodeKey(encoded)
+	}
+
+	return nil, fmt.Errorf("unknown vault key source %q", record.Source)
+}
+
+// forgetMasterKey removes a master key from the OS keyring once the vault
+// no longer uses it. Passphrases and key files are left to the user.
+func forgetMasterKey(record vaultKeyRecord) {
+	if record.Source == KeySourceKeyring {
+		keyring.Delete(keyringService, record.KeyRef)
+	}
+}
+
+// deriveKey derives a master key from a passphrase with the parameters and
+// salt of kdf
+func deriveKey(passphrase, kdf string) ([]byte, error) {
+	var iterations, memory uint32
+	var threads uint8
+	parts := strings.Split(kdf, "$")
+	if len(parts) != 3 || parts[0] != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation %q", kdf)
+	}
+	if _, err := fmt.Sscanf(parts[1], "t=%d,m=%d,p=%d", &iterations, &memory, &threads); err != nil {
+		return nil, fmt.Errorf("invalid key derivation parameters %q", parts[1])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key derivation salt: %v", err)
+	}
+	return argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, keySize), nil
+}
+
+// readKeyFile reads a base64-encoded key from path
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the vault key file: %v", err)
+	}
+	key, err := decodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault key file %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// decodeKey decodes a base64-encoded AES-256 key
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != keySize {
+		return nil, errors.New("expected a base64-encoded 32-byte key")
+	}
+	return key, nil
+}
+
+// wrapKey seals the data key with the master key
+func wrapKey(master, dataKey []byte) (string, error) {
+	c, err := newVaultCipher(master)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := c.seal(dataKey, wrapAD)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt the data key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrapKey opens the data key sealed by wrapKey
+func unwrapKey(master []byte, wrapped string) ([]byte, error) {
+	c, err := newVaultCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %v", err)
+	}
+	dataKey, err := c.open(sealed, wrapAD)
+	if err != nil {
+		return nil, errors.New("failed to unlock the vault: wrong passphrase or master key")
+	}
+	return dataKey, nil
+}
@@ -2,12 +2,26 @@ package sqlite
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 )
 
+// ErrVariableNotFound is returned for variables missing from the vault
+var ErrVariableNotFound = errors.New("not found")
+
+// VaultStore stores variables with their values encrypted by a data key,
+// which is itself sealed with a master key (see MasterKey). The vault is
+// unlocked when a value is first read or written.
 type VaultStore struct {
 	dbService *DBService
+
+	mu        sync.Mutex
+	cipher    *vaultCipher // Nil until the vault is unlocked
+	masterKey []byte
+	keyRecord vaultKeyRecord
 }
 
 func NewVaultStore(dbService *DBService) *VaultStore {
@@ -15,9 +29,18 @@ func NewVaultStore(dbService *DBService) *VaultStore {
 }
 
 func (vs *VaultStore) CreateVariable(entry VaultEntry) error {
+	c, err := vs.unlock()
+	if err != nil {
+		return err
+	}
+	value, err := c.encryptValue(entry.Value, entry.Key, entry.Scope, entry.scopeID())
+	if err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO vault (key, value, scope, workflow_id, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO vault (key, value, scope, workflow_id, project_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 
 	var workflowID *string
@@ -25,12 +48,13 @@ func (vs *VaultStore) CreateVariable(entry VaultEntry) error {
 		workflowID = entry.WorkflowID
 	}
 
-	_, err := vs.dbService.db.Exec(
+	_, err = vs.dbService.db.Exec(
 		query,
 		entry.Key,
-		entry.Value,
+		value,
 		entry.Scope,
 		workflowID,
+		entry.ProjectID,
 		entry.CreatedAt,
 		entry.UpdatedAt,
 	)
@@ -41,16 +65,23 @@ func (vs *VaultStore) CreateVariable(entry VaultEntry) error {
 	return nil
 }
 
-func (vs *VaultStore) GetVariable(key, scope string, workflowID *string) (*VaultEntry, error) {
+// GetVariable returns the variable key of scope. scopeID is the workflow of
+// the workflow scope or the project of the project scope (see scopeColumn).
+func (vs *VaultStore) GetVariable(key, scope string, scopeID *string) (*VaultEntry, error) {
+	// Unlocking may write to the database, so it happens before the query
+	c, err := vs.unlock()
+	if err != nil {
+		return nil, err
+	}
+
 	var query string
 	var rows *sql.Rows
-	var err error
 
-	if workflowID != nil {
-		query = `SELECT id, key, value, scope, workflow_id, created_at, updated_at FROM vault WHERE key = ? AND scope = ? AND workflow_id = ?`
-		rows, err = vs.dbService.db.Query(query, key, scope, *workflowID)
+	if scopeID != nil {
+		query = `SELECT id, key, value, scope, workflow_id, project_id, created_at, updated_at FROM vault WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` = ?`
+		rows, err = vs.dbService.db.Query(query, key, scope, *scopeID)
 	} else {
-		query = `SELECT id, key, value, scope, workflow_id, created_at, updated_at FROM vault WHERE key = ? AND scope = ? AND workflow_id IS NULL`
+		query = `SELECT id, key, value, scope, workflow_id, project_id, created_at, updated_at FROM vault WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` IS NULL`
 		rows, err = vs.dbService.db.Query(query, key, scope)
 	}
 
@@ -69,6 +100,7 @@ func (vs *VaultStore) GetVariable(key, scope string, workflowID *string) (*Vault
 			&entry.Value,
 			&entry.Scope,
 			&workflowIdPtr,
+			&entry.ProjectID,
 			&entry.CreatedAt,
 			&entry.UpdatedAt,
 		)
@@ -77,37 +109,65 @@ func (vs *VaultStore) GetVariable(key, scope string, workflowID *string) (*Vault
 		}
 
 		entry.WorkflowID = workflowIdPtr
+		if entry.Value, err = c.decryptValue(entry.Value, entry.Key, entry.Scope, entry.scopeID()); err != nil {
+			return nil, err
+		}
 		return &entry, nil
 	}
 
-	return nil, fmt.Errorf("variable with key '%s' and scope '%s' not found", key, scope)
+	return nil, fmt.Errorf("variable with key '%s' and scope '%s' %w", key, scope, ErrVariableNotFound)
 }
 
-// GetVariableWithFallback implements the fallback logic: workflow -> project -> global
-func (vs *VaultStore) GetVariableWithFallback(key, workflowID string) (*VaultEntry, error) {
+// GetVariableWithFallback implements the fallback logic: workflow -> project -> global.
+// The project scope holds the variables of projectID first, then those set
+// without a project by earlier versions. Only missing variables fall back;
+// other errors, such as a locked vault, are returned as they are.
+func (vs *VaultStore) GetVariableWithFallback(key, workflowID, projectID string) (*VaultEntry, error) {
 	// Try workflow scope first
 	entry, err := vs.GetVariable(key, "workflow", &workflowID)
-	if err == nil {
-		return entry, nil
+	if !errors.Is(err, ErrVariableNotFound) {
+		return entry, err
 	}
 
 	// Try project scope
+	if projectID != "" {
+		entry, err = vs.GetVariable(key, "project", &projectID)
+		if !errors.Is(err, ErrVariableNotFound) {
+			return entry, err
+		}
+	}
 	entry, err = vs.GetVariable(key, "project", nil)
-	if err == nil {
-		return entry, nil
+	if !errors.Is(err, ErrVariableNotFound) {
+		return entry, err
 	}
 
 	// Try global scope
-	return vs.GetVariable(key, "global", nil)
+	entry, err = vs.GetVariable(key, "global", nil)
+	if errors.Is(err, ErrVariableNotFound) {
+		scopes := fmt.Sprintf("project '%s' or global scope", projectID)
+		if workflowID != "" {
+			scopes = fmt.Sprintf("workflow '%s', %s", workflowID, scopes)
+		}
+		return nil, fmt.Errorf("variable '%s' %w in %s", key, ErrVariableNotFound, scopes)
+	}
+	return entry, err
 }
 
-func (vs *VaultStore) UpdateVariable(key, scope string, workflowID *string, value string) error {
+func (vs *VaultStore) UpdateVariable(key, scope string, scopeID *string, value string) error {
+	c, err := vs.unlock()
+	if err != nil {
+		return err
+	}
+	if value, err = c.encryptValue(value, key, scope, scopeID); err != nil {
+		return err
+	}
+
 	var query string
 
-	if workflowID != nil {
-		query = `UPDATE vault SET value = ?, updated_at = ? WHERE key = ? AND scope = ? AND workflow_id = ?`
+	if scopeID != nil {
+		query = `UPDATE vault SET value = ?, updated_at = ? WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` = ?`
 	} else {
-		query = `UPDATE vault SET value = ?, updated_at = ? WHERE key = ? AND scope = ? AND workflow_id IS NULL`
+		query = `UPDATE vault SET value = ?, updated_at = ? WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` IS NULL`
 	}
 
 	result, err := vs.dbService.db.Exec(
@@ -116,7 +176,7 @@ func (vs *VaultStore) UpdateVariable(key, scope string, workflowID *string, valu
 		time.Now(),
 		key,
 		scope,
-		workflowID,
+		scopeID,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update vault entry: %v", err)
@@ -128,22 +188,22 @@ func (vs *VaultStore) UpdateVariable(key, scope string, workflowID *string, valu
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("variable with key '%s' and scope '%s' not found", key, scope)
+		return fmt.Errorf("variable with key '%s' and scope '%s' %w", key, scope, ErrVariableNotFound)
 	}
 
 	return nil
 }
 
-func (vs *VaultStore) DeleteVariable(key, scope string, workflowID *string) error {
+func (vs *VaultStore) DeleteVariable(key, scope string, scopeID *string) error {
 	var query string
 
-	if workflowID != nil {
-		query = `DELETE FROM vault WHERE key = ? AND scope = ? AND workflow_id = ?`
+	if scopeID != nil {
+		query = `DELETE FROM vault WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` = ?`
 	} else {
-		query = `DELETE FROM vault WHERE key = ? AND scope = ? AND workflow_id IS NULL`
+		query = `DELETE FROM vault WHERE key = ? AND scope = ? AND ` + scopeColumn(scope) + ` IS NULL`
 	}
 
-	result, err := vs.dbService.db.Exec(query, key, scope, workflowID)
+	result, err := vs.dbService.db.Exec(query, key, scope, scopeID)
 	if err != nil {
 		return fmt.Errorf("failed to delete vault entry: %v", err)
 	}
@@ -154,28 +214,66 @@ func (vs *VaultStore) DeleteVariable(key, scope string, workflowID *string) erro
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("variable with key '%s' and scope '%s' not found", key, scope)
+		return fmt.Errorf("variable with key '%s' and scope '%s' %w", key, scope, ErrVariableNotFound)
 	}
 
 	return nil
 }
 
-func (vs *VaultStore) ListVariables(scope string, workflowID *string) ([]VaultEntry, error) {
+// ListVariables returns the variables of scope and scopeID, like
+// GetVariable, or every variable when scope is empty
+func (vs *VaultStore) ListVariables(scope string, scopeID *string) ([]VaultEntry, error) {
+	c, err := vs.unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := vs.listEntries(scope, scopeID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Value, err = c.decryptValue(entry.Value, entry.Key, entry.Scope, entry.scopeID()); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// ListVariableKeys returns the variables like ListVariables, without their
+// values. It does not unlock the vault, so listing the keys never asks for
+// the vault passphrase.
+func (vs *VaultStore) ListVariableKeys(scope string, scopeID *string) ([]VaultEntry, error) {
+	entries, err := vs.listEntries(scope, scopeID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Value = ""
+	}
+	return entries, nil
+}
+
+// listEntries returns the vault entries of scope and scopeID, or every entry
+// when scope is empty, with their values as stored
+func (vs *VaultStore) listEntries(scope string, scopeID *string) ([]VaultEntry, error) {
 	var query string
 
-	if workflowID != nil {
-		query = `SELECT id, key, value, scope, workflow_id, created_at, updated_at FROM vault WHERE scope = ? AND workflow_id = ? ORDER BY key`
+	if scopeID != nil {
+		query = `SELECT id, key, value, scope, workflow_id, project_id, created_at, updated_at FROM vault WHERE scope = ? AND ` + scopeColumn(scope) + ` = ? ORDER BY key`
 	} else if scope != "" {
-		query = `SELECT id, key, value, scope, workflow_id, created_at, updated_at FROM vault WHERE scope = ? AND workflow_id IS NULL ORDER BY key`
+		query = `SELECT id, key, value, scope, workflow_id, project_id, created_at, updated_at FROM vault WHERE scope = ? AND ` + scopeColumn(scope) + ` IS NULL ORDER BY key`
 	} else {
-		query = `SELECT id, key, value, scope, workflow_id, created_at, updated_at FROM vault ORDER BY scope, key`
+		query = `SELECT id, key, value, scope, workflow_id, project_id, created_at, updated_at FROM vault ORDER BY scope, project_id, key`
 	}
 
 	var rows *sql.Rows
 	var err error
 
-	if workflowID != nil {
-		rows, err = vs.dbService.db.Query(query, scope, *workflowID)
+	if scopeID != nil {
+		rows, err = vs.dbService.db.Query(query, scope, *scopeID)
 	} else if scope != "" {
 		rows, err = vs.dbService.db.Query(query, scope)
 	} else {
@@ -198,6 +296,7 @@ func (vs *VaultStore) ListVariables(scope string, workflowID *string) ([]VaultEn
 			&entry.Value,
 			&entry.Scope,
 			&workflowIdPtr,
+			&entry.ProjectID,
 			&entry.CreatedAt,
 			&entry.UpdatedAt,
 		)
@@ -213,8 +312,10 @@ func (vs *VaultStore) ListVariables(scope string, workflowID *string) ([]VaultEn
 }
 
 // GetAllVariablesForWorkflow returns all variables that apply to a specific workflow
-// including workflow-specific, project, and global variables
-func (vs *VaultStore) GetAllVariablesForWorkflow(workflowID string) (map[string]string, error) {
+// including workflow-specific, project, and global variables. Project
+// variables are those of projectID, then those set without a project by
+// earlier versions.
+func (vs *VaultStore) GetAllVariablesForWorkflow(workflowID, projectID string) (map[string]string, error) {
 	variables := make(map[string]string)
 
 	// Get workflow-specific variables
@@ -228,10 +329,17 @@ func (vs *VaultStore) GetAllVariablesForWorkflow(workflowID string) (map[string]
 	}
 
 	// Get project variables
-	projectVars, err := vs.ListVariables("project", nil)
+	var projectVars []VaultEntry
+	if projectID != "" {
+		if projectVars, err = vs.ListVariables("project", &projectID); err != nil {
+			return nil, fmt.Errorf("failed to get project variables: %v", err)
+		}
+	}
+	legacyVars, err := vs.ListVariables("project", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get project variables: %v", err)
 	}
+	projectVars = append(projectVars, legacyVars...)
 
 	for _, entry := range projectVars {
 		// Only add if key doesn't already exist (workflow variables have priority)
@@ -255,3 +363,272 @@ func (vs *VaultStore) GetAllVariablesForWorkflow(workflowID string) (map[string]
 
 	return variables, nil
 }
+
+// unlock returns the cipher of the data key. On first use it sets up
+// encryption with the default master key; every time it encrypts the values
+// stored in plaintext by earlier versions.
+func (vs *VaultStore) unlock() (*vaultCipher, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if vs.cipher != nil {
+		return vs.cipher, nil
+	}
+
+	record, found, err := vs.loadKeyRecord()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if err := vs.setupEncryption(); err != nil {
+			return nil, err
+		}
+		if record, _, err = vs.loadKeyRecord(); err != nil {
+			return nil, err
+		}
+	}
+
+	master := vs.masterKey
+	if master == nil || record != vs.keyRecord {
+		if master, err = loadMasterKey(record); err != nil {
+			return nil, err
+		}
+	}
+	dataKey, err := unwrapKey(master, record.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newVaultCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := vs.encryptPlaintext(c); err != nil {
+		return nil, err
+	}
+
+	vs.cipher, vs.masterKey, vs.keyRecord = c, master, record
+	return c, nil
+}
+
+// setupEncryption creates the data key of a new vault and seals it with
+// the default master key, falling back to a passphrase when the OS keyring
+// is not available
+func (vs *VaultStore) setupEncryption() error {
+	master, record, err := newMasterKey(defaultMasterKey())
+	if err != nil && record.Source == KeySourceKeyring {
+		master, record, err = keyringFallback(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := newKey()
+	if err != nil {
+		return err
+	}
+	if record.WrappedKey, err = wrapKey(master, dataKey); err != nil {
+		return err
+	}
+
+	// Another process may have set up encryption in the meantime, in which
+	// case its key is kept
+	result, err := vs.dbService.db.Exec(
+		`INSERT OR IGNORE INTO vault_keys (id, source, kdf, key_ref, wrapped_key, created_at, updated_at) VALUES (1, ?, ?, ?, ?, ?, ?)`,
+		record.Source, record.KDF, record.KeyRef, record.WrappedKey, time.Now(), time.Now(),
+	)
+	if err != nil {
+		forgetMasterKey(record)
+		return fmt.Errorf("failed to store the vault key: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		forgetMasterKey(record)
+		return nil
+	}
+
+	vs.masterKey, vs.keyRecord = master, record
+	return nil
+}
+
+// loadKeyRecord reads the vault_keys row. found is false before encryption
+// is set up.
+func (vs *VaultStore) loadKeyRecord() (record vaultKeyRecord, found bool, err error) {
+	var kdf, keyRef sql.NullString
+	err = vs.dbService.db.QueryRow(`SELECT source, kdf, key_ref, wrapped_key FROM vault_keys WHERE id = 1`).
+		Scan(&record.Source, &kdf, &keyRef, &record.WrappedKey)
+	if err == sql.ErrNoRows {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, fmt.Errorf("failed to read the vault key: %v", err)
+	}
+	record.KDF, record.KeyRef = kdf.String, keyRef.String
+	return record, true, nil
+}
+
+// encryptPlaintext encrypts the values stored without encryption
+func (vs *VaultStore) encryptPlaintext(c *vaultCipher) error {
+	tx, err := vs.dbService.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to encrypt vault entries: %v", err)
+	}
+	defer tx.Rollback()
+
+	entries, err := scanVaultRows(tx, `SELECT id, key, value, scope, workflow_id, project_id FROM vault WHERE value NOT LIKE ?`, encryptedPrefix+"%")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		value, err := c.encryptValue(entry.Value, entry.Key, entry.Scope, entry.scopeID())
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE vault SET value = ? WHERE id = ?`, value, entry.ID); err != nil {
+			return fmt.Errorf("failed to encrypt vault entry: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to encrypt vault entries: %v", err)
+	}
+	return nil
+}
+
+// Rekey re-encrypts every vault value with a new data key. The data key is
+// sealed with the master key described by target, or with the current
+// master key when target is nil. It returns how many values were
+// re-encrypted.
+func (vs *VaultStore) Rekey(target *MasterKey) (int, error) {
+	old, err := vs.unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	master, record := vs.masterKey, vs.keyRecord
+	if target != nil {
+		if master, record, err = newMasterKey(*target); err != nil {
+			return 0, err
+		}
+	}
+	// Until the new key is stored, a new keyring entry is not needed
+	committed := false
+	defer func() {
+		if !committed && record.KeyRef != vs.keyRecord.KeyRef {
+			forgetMasterKey(record)
+		}
+	}()
+
+	dataKey, err := newKey()
+	if err != nil {
+		return 0, err
+	}
+	c, err := newVaultCipher(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	if record.WrappedKey, err = wrapKey(master, dataKey); err != nil {
+		return 0, err
+	}
+
+	tx, err := vs.dbService.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to rekey the vault: %v", err)
+	}
+	defer tx.Rollback()
+
+	entries, err := scanVaultRows(tx, `SELECT id, key, value, scope, workflow_id, project_id FROM vault`)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		plain, err := old.decryptValue(entry.Value, entry.Key, entry.Scope, entry.scopeID())
+		if err != nil {
+			return 0, err
+		}
+		value, err := c.encryptValue(plain, entry.Key, entry.Scope, entry.scopeID())
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE vault SET value = ? WHERE id = ?`, value, entry.ID); err != nil {
+			return 0, fmt.Errorf("failed to rekey vault entry: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE vault_keys SET source = ?, kdf = ?, key_ref = ?, wrapped_key = ?, updated_at = ? WHERE id = 1`,
+		record.Source, record.KDF, record.KeyRef, record.WrappedKey, time.Now(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store the vault key: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to rekey the vault: %v", err)
+	}
+	committed = true
+
+	if record.KeyRef != vs.keyRecord.KeyRef {
+		forgetMasterKey(vs.keyRecord)
+	}
+	vs.cipher, vs.masterKey, vs.keyRecord = c, master, record
+	return len(entries), nil
+}
+
+// KeySource returns where the master key of the vault comes from, and the
+// path of the key file for KeySourceFile. It is empty before the vault is
+// first used.
+func (vs *VaultStore) KeySource() (source, keyFile string, err error) {
+	record, _, err := vs.loadKeyRecord()
+	if err != nil {
+		return "", "", err
+	}
+	if record.Source == KeySourceFile {
+		keyFile = record.KeyRef
+		if override := os.Getenv(KeyFileEnv); override != "" {
+			keyFile = override
+		}
+	}
+	return record.Source, keyFile, nil
+}
+
+// scanVaultRows reads the id, key, value, scope, workflow_id and project_id
+// of vault rows without decrypting them
+func scanVaultRows(tx *sql.Tx, query string, args ...interface{}) ([]VaultEntry, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault entries: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []VaultEntry
+	for rows.Next() {
+		var entry VaultEntry
+		if err := rows.Scan(&entry.ID, &entry.Key, &entry.Value, &entry.Scope, &entry.WorkflowID, &entry.ProjectID); err != nil {
+			return nil, fmt.Errorf("failed to scan vault entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// scopeColumn is the column identifying the variables of scope: project_id
+// for the project scope, workflow_id otherwise
+func scopeColumn(scope string) string {
+	if scope == "project" {
+		return "project_id"
+	}
+	return "workflow_id"
+}
+
+// scopeID returns the workflow or project of the entry, see scopeColumn
+func (e VaultEntry) scopeID() *string {
+	if e.Scope == "project" {
+		return e.ProjectID
+	}
+	return e.WorkflowID
+}
@@ -0,0 +1,262 @@
+package sqlite
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+// newTestVault opens a database in a temporary home directory. The vault
+// key is kept in a key file there, never in the OS keyring.
+func newTestVault(t *testing.T) (*VaultStore, *DBService) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyFileEnv, filepath.Join(home, "vault.key"))
+
+	db, err := NewDBService("migraine")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewVaultStore(db), db
+}
+
+// storedValue returns the value of a vault entry as stored in the database
+func storedValue(t *testing.T, db *DBService, key string) string {
+	t.Helper()
+	var value string
+	if err := db.DB().QueryRow(`SELECT value FROM vault WHERE key = ?`, key).Scan(&value); err != nil {
+		t.Fatalf("failed to read %s: %v", key, err)
+	}
+	return value
+}
+
+func TestVaultStore_EncryptsValues(t *testing.T) {
+	vault, db := newTestVault(t)
+
+	if err := vault.CreateVariable(VaultEntry{Key: "API_TOKEN", Value: "s3cret", Scope: "global"}); err != nil {
+		t.Fatalf("failed to create variable: %v", err)
+	}
+	if stored := storedValue(t, db, "API_TOKEN"); !strings.HasPrefix(stored, encryptedPrefix) || strings.Contains(stored, "s3cret") {
+		t.Errorf("expected the value to be encrypted, got %q", stored)
+	}
+
+	if err := vault.UpdateVariable("API_TOKEN", "global", nil, "rotated"); err != nil {
+		t.Fatalf("failed to update variable: %v", err)
+	}
+
+	// A new store unlocks the vault with the key file
+	entry, err := NewVaultStore(db).GetVariable("API_TOKEN", "global", nil)
+	if err != nil || entry.Value != "rotated" {
+		t.Fatalf("expected the decrypted value, got %+v: %v", entry, err)
+	}
+
+	// Values are bound to their row
+	if _, err := db.DB().Exec(`INSERT INTO vault (key, value, scope) VALUES ('COPY', ?, 'global')`, storedValue(t, db, "API_TOKEN")); err != nil {
+		t.Fatalf("failed to copy the value: %v", err)
+	}
+	if _, err := vault.GetVariable("COPY", "global", nil); err == nil {
+		t.Error("expected a value copied from another row to be rejected")
+	}
+}
+
+func TestVaultStore_EncryptsPlaintextRows(t *testing.T) {
+	vault, db := newTestVault(t)
+
+	workflowID := "deploy"
+	if _, err := db.DB().Exec(`INSERT INTO workflows (id, name) VALUES (?, ?)`, workflowID, workflowID); err != nil {
+		t.Fatalf("failed to create workflow: %v", err)
+	}
+	for _, row := range [][]interface{}{{"REGION", "eu-west-1", "project", nil}, {"DB_PASSWORD", "hunter2", "workflow", workflowID}} {
+		if _, err := db.DB().Exec(`INSERT INTO vault (key, value, scope, workflow_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`, append(row, time.Now(), time.Now())...); err != nil {
+			t.Fatalf("failed to insert plaintext row: %v", err)
+		}
+	}
+
+	variables, err := vault.GetAllVariablesForWorkflow(workflowID, "")
+	if err != nil {
+		t.Fatalf("failed to read variables: %v", err)
+	}
+	if variables["REGION"] != "eu-west-1" || variables["DB_PASSWORD"] != "hunter2" {
+		t.Errorf("unexpected variables %v", variables)
+	}
+	for _, key := range []string{"REGION", "DB_PASSWORD"} {
+		if stored := storedValue(t, db, key); !strings.HasPrefix(stored, encryptedPrefix) {
+			t.Errorf("expected %s to be encrypted by the migration, got %q", key, stored)
+		}
+	}
+}
+
+func TestVaultStore_ProjectScope(t *testing.T) {
+	vault, db := newTestVault(t)
+
+	api, web := "/src/api", "acme-web"
+	for _, entry := range []VaultEntry{
+		{Key: "DB_HOST", Value: "api-db", Scope: "project", ProjectID: &api},
+		{Key: "DB_HOST", Value: "web-db", Scope: "project", ProjectID: &web},
+		{Key: "REGION", Value: "eu-west-1", Scope: "project"}, // Set before projects
+		{Key: "DB_HOST", Value: "global-db", Scope: "global"},
+	} {
+		if err := vault.CreateVariable(entry); err != nil {
+			t.Fatalf("failed to create %s: %v", entry.Key, err)
+		}
+	}
+
+	for projectID, want := range map[string]string{api: "api-db", web: "web-db", "/src/other": "global-db"} {
+		entry, err := vault.GetVariableWithFallback("DB_HOST", "deploy", projectID)
+		if err != nil || entry.Value != want {
+			t.Errorf("%s: expected %q, got %+v (%v)", projectID, want, entry, err)
+		}
+		variables, err := vault.GetAllVariablesForWorkflow("deploy", projectID)
+		if err != nil || variables["DB_HOST"] != want || variables["REGION"] != "eu-west-1" {
+			t.Errorf("%s: unexpected variables %v (%v)", projectID, variables, err)
+		}
+	}
+
+	if err := vault.UpdateVariable("DB_HOST", "project", &web, "web-db-2"); err != nil {
+		t.Fatalf("failed to update variable: %v", err)
+	}
+	if entry, _ := vault.GetVariable("DB_HOST", "project", &api); entry == nil || entry.Value != "api-db" {
+		t.Errorf("expected the other project to keep its value, got %+v", entry)
+	}
+	if entries, err := vault.ListVariables("project", &web); err != nil || len(entries) != 1 || entries[0].Value != "web-db-2" {
+		t.Errorf("expected the variable of the project, got %+v (%v)", entries, err)
+	}
+
+	// Values are bound to their project
+	moved := "/src/moved"
+	if _, err := db.DB().Exec(`UPDATE vault SET project_id = ? WHERE project_id = ?`, moved, api); err != nil {
+		t.Fatalf("failed to move the value: %v", err)
+	}
+	if _, err := vault.GetVariable("DB_HOST", "project", &moved); err == nil {
+		t.Error("expected a value moved to another project to be rejected")
+	}
+
+	if err := vault.DeleteVariable("DB_HOST", "project", &web); err != nil {
+		t.Fatalf("failed to delete variable: %v", err)
+	}
+	_, err := vault.GetVariableWithFallback("MISSING", "deploy", web)
+	if !errors.Is(err, ErrVariableNotFound) || !strings.Contains(err.Error(), "project 'acme-web'") {
+		t.Errorf("expected a not found error naming the project, got %v", err)
+	}
+}
+
+func TestVaultStore_Rekey(t *testing.T) {
+	vault, db := newTestVault(t)
+	if err := vault.CreateVariable(VaultEntry{Key: "API_TOKEN", Value: "s3cret", Scope: "global"}); err != nil {
+		t.Fatalf("failed to create variable: %v", err)
+	}
+	before := storedValue(t, db, "API_TOKEN")
+
+	count, err := vault.Rekey(&MasterKey{Source: KeySourcePassphrase, Passphrase: "correct horse"})
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 value to be re-encrypted, got %d: %v", count, err)
+	}
+	if storedValue(t, db, "API_TOKEN") == before {
+		t.Error("expected the value to be encrypted with the new data key")
+	}
+	if source, _, _ := vault.KeySource(); source != KeySourcePassphrase {
+		t.Errorf("expected the passphrase source, got %q", source)
+	}
+
+	t.Setenv(PassphraseEnv, "wrong")
+	if _, err := NewVaultStore(db).GetVariable("API_TOKEN", "global", nil); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("expected a wrong passphrase to be rejected, got %v", err)
+	}
+	t.Setenv(PassphraseEnv, "correct horse")
+	if entry, err := NewVaultStore(db).GetVariable("API_TOKEN", "global", nil); err != nil || entry.Value != "s3cret" {
+		t.Fatalf("expected the passphrase to unlock the vault, got %+v: %v", entry, err)
+	}
+
+	// Back to a new key file, keeping the values
+	keyFile := filepath.Join(t.TempDir(), "keys", "migraine.key")
+	if _, err := vault.Rekey(&MasterKey{Source: KeySourceFile, KeyFile: keyFile}); err != nil {
+		t.Fatalf("failed to rekey: %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a private key file, got %v", err)
+	}
+	t.Setenv(PassphraseEnv, "")
+	t.Setenv(KeyFileEnv, "")
+	if entry, err := NewVaultStore(db).GetVariable("API_TOKEN", "global", nil); err != nil || entry.Value != "s3cret" {
+		t.Errorf("expected the key file to unlock the vault, got %+v: %v", entry, err)
+	}
+}
+
+func TestVaultStore_KeyringUnavailable(t *testing.T) {
+	vault, db := newTestVault(t)
+	t.Setenv(KeyFileEnv, "")
+	keyring.MockInitWithError(errors.New("no secret service"))
+	defer func(orig func(string) (string, error)) { passphrasePrompt = orig }(passphrasePrompt)
+
+	// Without a terminal, a key file or a passphrase has to be chosen
+	passphrasePrompt = nil
+	err := vault.CreateVariable(VaultEntry{Key: "API_TOKEN", Value: "s3cret", Scope: "global"})
+	if err == nil || !strings.Contains(err.Error(), "no secret service") || !strings.Contains(err.Error(), KeyFileEnv) {
+		t.Errorf("expected the vault to need a key source, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(db.DataDir(), "vault.key")); !os.IsNotExist(err) {
+		t.Errorf("expected no key file to be written, got %v", err)
+	}
+
+	// Otherwise a passphrase is asked for, twice
+	var prompts []string
+	passphrasePrompt = func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		return "correct horse", nil
+	}
+	if err := vault.CreateVariable(VaultEntry{Key: "API_TOKEN", Value: "s3cret", Scope: "global"}); err != nil {
+		t.Fatalf("failed to create variable: %v", err)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[0], "keyring is not available") {
+		t.Errorf("expected a warning and two prompts, got %q", prompts)
+	}
+	if source, _, _ := vault.KeySource(); source != KeySourcePassphrase {
+		t.Errorf("expected the passphrase source, got %q", source)
+	}
+}
+
+func TestVaultStore_ListVariableKeys(t *testing.T) {
+	_, db := newTestVault(t)
+	t.Setenv(KeyFileEnv, "")
+	t.Setenv(PassphraseEnv, "correct horse")
+	vault := NewVaultStore(db)
+	workflowID := "deploy"
+	for _, entry := range []VaultEntry{
+		{Key: "API_TOKEN", Value: "s3cret", Scope: "global"},
+		{Key: "DB_PASSWORD", Value: "hunter2", Scope: "workflow", WorkflowID: &workflowID},
+	} {
+		if err := vault.CreateVariable(entry); err != nil {
+			t.Fatalf("failed to create %s: %v", entry.Key, err)
+		}
+	}
+
+	// Listing the keys does not need the passphrase
+	t.Setenv(PassphraseEnv, "")
+	defer func(orig func(string) (string, error)) { passphrasePrompt = orig }(passphrasePrompt)
+	passphrasePrompt = nil
+	vault = NewVaultStore(db)
+
+	entries, err := vault.ListVariableKeys("", nil)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 keys, got %+v (%v)", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.Value != "" {
+			t.Errorf("expected no value for %s, got %q", entry.Key, entry.Value)
+		}
+	}
+	if entries, err := vault.ListVariableKeys("workflow", &workflowID); err != nil || len(entries) != 1 || entries[0].Key != "DB_PASSWORD" {
+		t.Errorf("expected the key of the workflow, got %+v (%v)", entries, err)
+	}
+	if _, err := vault.ListVariables("", nil); err == nil {
+		t.Error("expected the values to need the passphrase")
+	}
+}
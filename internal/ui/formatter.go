@@ -6,8 +6,20 @@ import (
 	"time"
 )
 
-// WorkflowHeader displays the workflow header
-func WorkflowHeader(workflowName, action string) {
+// redact replaces secret values in bordered messages, see SetRedaction
+var redact = func(message string) string { return message }
+
+// SetRedaction sets how secret values are replaced in bordered messages
+func SetRedaction(fn func(string) string) {
+	if fn == nil {
+		fn = func(message string) string { return message }
+	}
+	redact = fn
+}
+
+// WorkflowHeader displays the workflow header, with a line for each detail
+// such as the selected steps
+func WorkflowHeader(workflowName, action string, details ...string) {
 	timestamp := time.Now().Format("2006-01-02 15:04")
 	actionText := fmt.Sprintf("ACTION: %s", action)
 	startedText := fmt.Sprintf("STARTED: %s", timestamp)
@@ -18,12 +30,15 @@ func WorkflowHeader(workflowName, action string) {
 	workflowText := fmt.Sprintf("WORKFLOW: %s", workflowName)
 
 	headerLine := strings.Repeat("-", totalWidth-2) // -2 for the "+"
-	header := fmt.Sprintf("+%s+\n| %s | %s | %s |\n+%s+",
+	header := fmt.Sprintf("+%s+\n| %s | %s | %s |",
 		headerLine,
 		padRight(workflowText, 30),
 		padRight(actionText, 15),
-		startedText,
-		headerLine)
+		startedText)
+	for _, detail := range details {
+		header += fmt.Sprintf("\n| %s |", padRight(detail, totalWidth-4))
+	}
+	header += fmt.Sprintf("\n+%s+", headerLine)
 	fmt.Println(header)
 }
 
@@ -37,10 +52,20 @@ func PrecheckResult(name, status string, duration time.Duration, message string)
 	} else if status == "fail" {
 		statusIcon = "✗"
 		statusText = "fail"
+	} else if status == "timeout" {
+		statusIcon = "✗"
+		statusText = "timed out"
+	} else if status == "skip" {
+		statusIcon = "-"
+		statusText = "skip"
 	}
 
-	durationStr := formatDuration(duration)
-	fmt.Printf("  %s %s %s (%s)\n", statusIcon, padRight(name, 30), padRight(statusText, 4), durationStr)
+	if status == "skip" {
+		fmt.Printf("  %s %s %s\n", statusIcon, padRight(name, 30), statusText)
+	} else {
+		durationStr := formatDuration(duration)
+		fmt.Printf("  %s %s %s (%s)\n", statusIcon, padRight(name, 30), padRight(statusText, 4), durationStr)
+	}
 
 	if message != "" {
 		fmt.Printf("         -> %s\n", message)
@@ -53,6 +78,38 @@ func ScriptProgress(current, total int, name string, duration time.Duration) {
 	fmt.Printf("  (%d/%d) %s %s\n", current, total, padRight(name, 20), durationStr)
 }
 
+// ScriptSkipped displays a script that did not run and why, e.g. "when: {{env}} == 'prod'"
+func ScriptSkipped(current, total int, name, reason string) {
+	fmt.Printf("  (%d/%d) %s skipped (%s)\n", current, total, padRight(name, 20), reason)
+}
+
+// PlanVariable displays a resolved variable of a dry run and where it came from
+func PlanVariable(name, value, source string) {
+	if source != "" {
+		fmt.Printf("  %s = %s (%s)\n", padRight(name, 20), value, source)
+	} else {
+		fmt.Printf("  %s = %s\n", padRight(name, 20), value)
+	}
+}
+
+// PlanStep displays a step of a dry run and the command it would execute
+func PlanStep(current, total int, name, command string) {
+	fmt.Printf("  (%d/%d) %s\n", current, total, name)
+	for _, line := range strings.Split(strings.TrimRight(command, "\n"), "\n") {
+		fmt.Printf("         $ %s\n", line)
+	}
+}
+
+// PlanDetail displays a setting of a dry run step, such as its timeout or hooks
+func PlanDetail(label, text string) {
+	fmt.Printf("         %s %s\n", padRight(label+":", 11), text)
+}
+
+// PlanProblem displays why a dry run step could not be resolved
+func PlanProblem(message string) {
+	fmt.Printf("         ✗ %s\n", message)
+}
+
 // ScriptOutput displays script output
 func ScriptOutput(output string) {
 	if output != "" {
@@ -61,12 +118,19 @@ func ScriptOutput(output string) {
 }
 
 // Summary displays the workflow summary
-func Summary(status string, duration time.Duration, prechecksPassed, prechecksFailed, prechecksWarn int, scriptsTotal, scriptsCompleted int, artifacts, endpoint string) {
+func Summary(status string, duration time.Duration, prechecksPassed, prechecksFailed, prechecksWarn int, scriptsTotal, scriptsCompleted, scriptsSkipped, scriptsWarned int, artifacts, endpoint string) {
 	fmt.Println("\n[ SUMMARY ]")
 	fmt.Printf("  Status: %s\n", status)
 	fmt.Printf("  Duration: %s\n", formatDuration(duration))
 	fmt.Printf("  Prechecks: %d passed, %d failed, %d warn\n", prechecksPassed, prechecksFailed, prechecksWarn)
-	fmt.Printf("  Scripts: %d/%d completed\n", scriptsCompleted, scriptsTotal)
+	scripts := fmt.Sprintf("%d/%d completed", scriptsCompleted, scriptsTotal)
+	if scriptsSkipped > 0 {
+		scripts += fmt.Sprintf(", %d skipped", scriptsSkipped)
+	}
+	if scriptsWarned > 0 {
+		scripts += fmt.Sprintf(", %d failed (allowed)", scriptsWarned)
+	}
+	fmt.Printf("  Scripts: %s\n", scripts)
 	if artifacts != "" {
 		fmt.Printf("  Artifacts: %s\n", artifacts)
 	}
@@ -128,6 +192,11 @@ func padRight(str string, length int) string {
 	return str + strings.Repeat(" ", length-len(str))
 }
 
+// FormatDuration formats a duration the same way run output does
+func FormatDuration(d time.Duration) string {
+	return formatDuration(d)
+}
+
 // formatDuration formats a duration nicely
 func formatDuration(d time.Duration) string {
 	if d < time.Millisecond {
@@ -150,7 +219,7 @@ func LogInfoBordered(message string) {
 	borderLine := strings.Repeat("─", contentWidth)
 
 	fmt.Printf("  ┌%s┐\n", borderLine)
-	fmt.Printf("  │ %-74s │\n", "ℹ "+message)
+	fmt.Printf("  │ %-74s │\n", "ℹ "+redact(message))
 	fmt.Printf("  └%s┘\n", borderLine)
 }
 
@@ -160,7 +229,7 @@ func LogSuccessBordered(message string) {
 	borderLine := strings.Repeat("─", contentWidth)
 
 	fmt.Printf("  ┌%s┐\n", borderLine)
-	fmt.Printf("  │ %-74s │\n", "✓ "+message)
+	fmt.Printf("  │ %-74s │\n", "✓ "+redact(message))
 	fmt.Printf("  └%s┘\n", borderLine)
 }
 
@@ -170,7 +239,7 @@ func LogWarningBordered(message string) {
 	borderLine := strings.Repeat("─", contentWidth)
 
 	fmt.Printf("  ┌%s┐\n", borderLine)
-	fmt.Printf("  │ %-74s │\n", "⚠ "+message)
+	fmt.Printf("  │ %-74s │\n", "⚠ "+redact(message))
 	fmt.Printf("  └%s┘\n", borderLine)
 }
 
@@ -180,6 +249,6 @@ func LogErrorBordered(message string) {
 	borderLine := strings.Repeat("─", contentWidth)
 
 	fmt.Printf("  ┌%s┐\n", borderLine)
-	fmt.Printf("  │ %-74s │\n", "✗ "+message)
+	fmt.Printf("  │ %-74s │\n", "✗ "+redact(message))
 	fmt.Printf("  └%s┘\n", borderLine)
 }
@@ -0,0 +1,522 @@
+package workflow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+// Step statuses a condition can test, matching the statuses of the run history
+const (
+	StepSucceeded = "success"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+// ConditionContext holds the values a `when` condition can refer to
+type ConditionContext struct {
+	// Dir is the directory relative paths in exists() are resolved against,
+	// the current directory when empty
+	Dir       string
+	Variables map[string]string
+	// Previous is the status of the step that finished last, empty before the
+	// first step. Workflows using needs have no previous step, see NewStepGraph.
+	Previous string
+	// Steps holds the status of finished steps by id
+	Steps map[string]string
+}
+
+// Condition is a parsed `when` expression. Conditions support:
+//
+//	{{var}} == 'value'     comparisons with == and !=, variables also apply inside quotes
+//	a && b, a || b, !a     boolean operators and parentheses
+//	previous.failed        status of the step that finished last (also succeeded, skipped, status);
+//	                       not available in workflows using needs
+//	steps.build.succeeded  status of the step with id "build"
+//	exists('go.mod')       whether a file, directory or glob match exists, relative to the step dir
+type Condition struct {
+	source string
+	root   conditionNode
+}
+
+// ParseCondition parses a `when` expression
+func ParseCondition(expr string) (*Condition, error) {
+	tokens, err := lexCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != condEOF {
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+
+	return &Condition{source: expr, root: root}, nil
+}
+
+// EvaluateCondition parses and evaluates a `when` expression
+func EvaluateCondition(expr string, ctx ConditionContext) (bool, error) {
+	cond, err := ParseCondition(expr)
+	if err != nil {
+		return false, err
+	}
+	return cond.Eval(ctx)
+}
+
+// Eval evaluates the condition against the context
+func (c *Condition) Eval(ctx ConditionContext) (bool, error) {
+	v, err := c.root.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+func (c *Condition) String() string {
+	return c.source
+}
+
+// UsesPrevious reports whether the condition reads previous.<field>
+func (c *Condition) UsesPrevious() bool {
+	return usesPrevious(c.root)
+}
+
+func usesPrevious(node conditionNode) bool {
+	switch n := node.(type) {
+	case stepFieldNode:
+		return n.stepID == ""
+	case compareNode:
+		return usesPrevious(n.left) || usesPrevious(n.right)
+	case logicalNode:
+		return usesPrevious(n.left) || usesPrevious(n.right)
+	case notNode:
+		return usesPrevious(n.operand)
+	case existsNode:
+		return usesPrevious(n.path)
+	}
+	return false
+}
+
+// truthy interprets a value as a boolean: empty strings, "false", "0", "no"
+// and "off" are false, everything else is true
+func truthy(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "false", "0", "no", "off":
+		return false
+	}
+	return true
+}
+
+func boolValue(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+type conditionTokenKind int
+
+const (
+	condEOF conditionTokenKind = iota
+	condString
+	condVariable
+	condIdent
+	condEq
+	condNotEq
+	condAnd
+	condOr
+	condNot
+	condLParen
+	condRParen
+	condComma
+)
+
+type conditionToken struct {
+	kind conditionTokenKind
+	text string
+}
+
+func lexCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	rs := []rune(expr)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != r {
+				end++
+			}
+			if end == len(rs) {
+				return nil, fmt.Errorf("unterminated string starting at %d", i+1)
+			}
+			tokens = append(tokens, conditionToken{condString, string(rs[i+1 : end])})
+			i = end + 1
+		case r == '{' && i+1 < len(rs) && rs[i+1] == '{':
+			end := i + 2
+			for end+1 < len(rs) && !(rs[end] == '}' && rs[end+1] == '}') {
+				end++
+			}
+			if end+1 >= len(rs) {
+				return nil, fmt.Errorf("unterminated variable starting at %d", i+1)
+			}
+			name := strings.TrimSpace(string(rs[i+2 : end]))
+			if name == "" {
+				return nil, fmt.Errorf("empty variable at %d", i+1)
+			}
+			tokens = append(tokens, conditionToken{condVariable, name})
+			i = end + 2
+		case isConditionIdentRune(r):
+			end := i
+			for end < len(rs) && isConditionIdentRune(rs[end]) {
+				end++
+			}
+			tokens = append(tokens, conditionToken{condIdent, string(rs[i:end])})
+			i = end
+		default:
+			two := ""
+			if i+1 < len(rs) {
+				two = string(rs[i : i+2])
+			}
+			switch {
+			case two == "==":
+				tokens = append(tokens, conditionToken{condEq, two})
+				i += 2
+			case two == "!=":
+				tokens = append(tokens, conditionToken{condNotEq, two})
+				i += 2
+			case two == "&&":
+				tokens = append(tokens, conditionToken{condAnd, two})
+				i += 2
+			case two == "||":
+				tokens = append(tokens, conditionToken{condOr, two})
+				i += 2
+			case r == '!':
+				tokens = append(tokens, conditionToken{condNot, "!"})
+				i++
+			case r == '(':
+				tokens = append(tokens, conditionToken{condLParen, "("})
+				i++
+			case r == ')':
+				tokens = append(tokens, conditionToken{condRParen, ")"})
+				i++
+			case r == ',':
+				tokens = append(tokens, conditionToken{condComma, ","})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q at %d", r, i+1)
+			}
+		}
+	}
+
+	return append(tokens, conditionToken{kind: condEOF}), nil
+}
+
+func isConditionIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != condEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == condOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == condAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.peek().kind == condNot {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch p.peek().kind {
+	case condEq, condNotEq:
+		negate := p.next().kind == condNotEq
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{negate: negate, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parsePrimary() (conditionNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case condString:
+		if strings.Contains(tok.text, "{{") {
+			return templateNode(tok.text), nil
+		}
+		return literalNode(tok.text), nil
+	case condVariable:
+		return variableNode(tok.text), nil
+	case condLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != condRParen {
+			return nil, fmt.Errorf("expected )")
+		}
+		return node, nil
+	case condIdent:
+		if p.peek().kind == condLParen {
+			return p.parseCall(tok.text)
+		}
+		return identNode(tok.text)
+	case condEOF:
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+func (p *conditionParser) parseCall(name string) (conditionNode, error) {
+	if name != "exists" {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+
+	p.next() // consume (
+	var args []conditionNode
+	for p.peek().kind != condRParen {
+		if len(args) > 0 {
+			if p.next().kind != condComma {
+				return nil, fmt.Errorf("expected , or ) in arguments of %s", name)
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next() // consume )
+
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects 1 argument, got %d", name, len(args))
+	}
+	return existsNode{path: args[0]}, nil
+}
+
+type conditionNode interface {
+	eval(ctx ConditionContext) (string, error)
+}
+
+type literalNode string
+
+func (n literalNode) eval(ConditionContext) (string, error) {
+	return string(n), nil
+}
+
+// templateNode is a quoted string containing {{variables}}
+type templateNode string
+
+func (n templateNode) eval(ctx ConditionContext) (string, error) {
+	result := string(n)
+	for _, name := range utils.ExtractTemplateVars(result) {
+		v, ok := ctx.Variables[name]
+		if !ok {
+			return "", fmt.Errorf("missing required variables: %s", name)
+		}
+		result = strings.ReplaceAll(result, "{{"+name+"}}", v)
+	}
+	return result, nil
+}
+
+type variableNode string
+
+func (n variableNode) eval(ctx ConditionContext) (string, error) {
+	v, ok := ctx.Variables[string(n)]
+	if !ok {
+		return "", fmt.Errorf("missing required variables: %s", string(n))
+	}
+	return v, nil
+}
+
+// stepFieldNode reads a field of a step result: previous.<field> or steps.<id>.<field>
+type stepFieldNode struct {
+	stepID string // Empty for previous
+	field  string
+}
+
+func identNode(name string) (conditionNode, error) {
+	switch name {
+	case "true", "false":
+		return literalNode(name), nil
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return literalNode(name), nil
+	}
+
+	parts := strings.Split(name, ".")
+	var node stepFieldNode
+	switch {
+	case len(parts) == 2 && parts[0] == "previous":
+		node.field = parts[1]
+	case len(parts) == 3 && parts[0] == "steps" && parts[1] != "":
+		node.stepID, node.field = parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("unknown name %q (use {{var}} for variables, previous.<field> or steps.<id>.<field>)", name)
+	}
+
+	switch node.field {
+	case "status", "succeeded", "failed", "skipped":
+		return node, nil
+	}
+	return nil, fmt.Errorf("unknown field %q in %s (expected status, succeeded, failed or skipped)", node.field, name)
+}
+
+func (n stepFieldNode) eval(ctx ConditionContext) (string, error) {
+	status := ctx.Previous
+	if n.stepID != "" {
+		status = ctx.Steps[n.stepID]
+	}
+
+	switch n.field {
+	case "succeeded":
+		return boolValue(status == StepSucceeded), nil
+	case "failed":
+		return boolValue(status == StepFailed), nil
+	case "skipped":
+		return boolValue(status == StepSkipped), nil
+	}
+	return status, nil
+}
+
+type compareNode struct {
+	negate      bool
+	left, right conditionNode
+}
+
+func (n compareNode) eval(ctx ConditionContext) (string, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	return boolValue((l == r) != n.negate), nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right conditionNode
+}
+
+func (n logicalNode) eval(ctx ConditionContext) (string, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	if truthy(l) == n.or {
+		return boolValue(n.or), nil
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	return boolValue(truthy(r)), nil
+}
+
+type notNode struct {
+	operand conditionNode
+}
+
+func (n notNode) eval(ctx ConditionContext) (string, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	return boolValue(!truthy(v)), nil
+}
+
+type existsNode struct {
+	path conditionNode
+}
+
+func (n existsNode) eval(ctx ConditionContext) (string, error) {
+	path, err := n.path.eval(ctx)
+	if err != nil {
+		return "", err
+	}
+	if ctx.Dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Dir, path)
+	}
+
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return "", fmt.Errorf("invalid pattern in exists(%q): %v", path, err)
+		}
+		return boolValue(len(matches) > 0), nil
+	}
+
+	_, err = os.Stat(path)
+	return boolValue(err == nil), nil
+}
@@ -0,0 +1,110 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := ConditionContext{
+		Variables: map[string]string{"env": "prod", "region": "eu-west-1", "deploy": "false", "dir": dir},
+		Previous:  StepFailed,
+		Steps:     map[string]string{"build": StepSucceeded, "lint": StepSkipped},
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"{{env}} == 'prod'", true},
+		{"{{env}} != \"prod\"", false},
+		{"{{ env }} == 'prod' && {{region}} == 'us-east-1'", false},
+		{"{{env}} == 'staging' || {{region}} == 'eu-west-1'", true},
+		{"!({{env}} == 'prod')", false},
+		{"{{deploy}}", false},
+		{"!{{deploy}}", true},
+		{"true", true},
+		{"previous.failed", true},
+		{"previous.succeeded", false},
+		{"previous.status == 'failed'", true},
+		{"steps.build.succeeded", true},
+		{"steps.lint.skipped && !steps.build.failed", true},
+		{"steps.deploy.status == ''", true},
+		{"exists('{{dir}}/go.mod')", true},
+		{"exists({{dir}})", true},
+		{"'{{env}}-{{region}}' == 'prod-eu-west-1'", true},
+		{"exists('" + dir + "/go.mod')", true},
+		{"exists('" + dir + "/*.mod')", true},
+		{"exists('" + dir + "/package.json')", false},
+	}
+
+	for _, tt := range tests {
+		got, err := EvaluateCondition(tt.expr, ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestEvaluateCondition_Dir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := ConditionContext{Dir: dir}
+
+	for expr, want := range map[string]bool{
+		"exists('go.mod')":                               true,
+		"exists('*.mod')":                                true,
+		"exists('package.json')":                         false,
+		"exists('" + filepath.Join(dir, "go.mod") + "')": true,
+	} {
+		got, err := EvaluateCondition(expr, ctx)
+		if err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v (%v)", expr, want, got, err)
+		}
+	}
+}
+
+func TestParseCondition_Errors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end of condition"},
+		{"{{env}} ==", "unexpected end of condition"},
+		{"'prod", "unterminated string"},
+		{"{{env == 'prod'", "unterminated variable"},
+		{"env == 'prod'", `unknown name "env"`},
+		{"previous.broken", `unknown field "broken"`},
+		{"matches('x')", `unknown function "matches"`},
+		{"exists('a', 'b')", "exists expects 1 argument"},
+		{"({{env}} == 'prod'", "expected )"},
+		{"{{env}} = 'prod'", "unexpected character"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCondition(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.expr, tt.want, err)
+		}
+	}
+}
+
+func TestEvaluateCondition_MissingVariable(t *testing.T) {
+	_, err := EvaluateCondition("{{env}} == 'prod'", ConditionContext{})
+	if err == nil || !strings.Contains(err.Error(), "missing required variables: env") {
+		t.Errorf("expected missing variable error, got %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package workflow
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of declared variables
+const (
+	VariableString = "string"
+	VariableInt    = "int"
+	VariableBool   = "bool"
+	VariableEnum   = "enum" // One of the values of the declaration
+	VariablePath   = "path" // A file system path, with ~/ expanded
+	VariableURL    = "url"  // An absolute URL with a scheme and a host
+)
+
+// variableTypes lists the types a declaration accepts
+var variableTypes = []string{VariableString, VariableInt, VariableBool, VariableEnum, VariablePath, VariableURL}
+
+// declarationFields lists the fields of a declaration
+var declarationFields = []string{"type", "default", "required", "pattern", "description", "secret", "values"}
+
+// VariableDeclaration describes a config variable. A variable is declared
+// with a map such as {type: int, default: 8080, required: true}, with a list
+// of settings such as ["required"], or with a plain value, which is its
+// default.
+type VariableDeclaration struct {
+	Name        string
+	Type        string      // One of the Variable types, VariableString when not set
+	Default     interface{} // A value, or an args:, env: or vault: reference; nil for none
+	Required    bool        // The run fails when no value is found
+	Pattern     string      // Regular expression matching the whole value
+	Description string
+	Secret      bool     // The value is redacted from the output of runs
+	Values      []string // Allowed values of enum variables
+
+	pattern *regexp.Regexp
+}
+
+// ParseVariableDeclaration reads the declaration of the config variable
+// called name. Settings of the list form other than "required" and "secret"
+// are ignored, as earlier versions did.
+func ParseVariableDeclaration(name string, val interface{}) (VariableDeclaration, error) {
+	d := VariableDeclaration{Name: name, Type: VariableString}
+
+	if settings, ok := stringList(val); ok {
+		for _, setting := range settings {
+			switch setting {
+			case "required":
+				d.Required = true
+			case "secret":
+				d.Secret = true
+			}
+		}
+		return d, nil
+	}
+
+	fields, ok := variableDeclaration(val)
+	if !ok {
+		d.Default = val
+		return d, nil
+	}
+
+	var err error
+	for field, value := range fields {
+		switch field {
+		case "type":
+			d.Type, err = stringField(field, value)
+			if err == nil && !slices.Contains(variableTypes, d.Type) {
+				err = fmt.Errorf("unknown type %q (must be one of %s)", d.Type, strings.Join(variableTypes, ", "))
+			}
+		case "default":
+			d.Default = value
+		case "required":
+			d.Required, err = boolField(field, value)
+		case "secret":
+			d.Secret, err = boolField(field, value)
+		case "pattern":
+			d.Pattern, err = stringField(field, value)
+		case "description":
+			d.Description, err = stringField(field, value)
+		case "values":
+			var valid bool
+			if d.Values, valid = stringList(value); !valid {
+				err = fmt.Errorf("values must be a list")
+			}
+		default:
+			err = fmt.Errorf("unknown field %q (must be one of %s)", field, strings.Join(declarationFields, ", "))
+		}
+		if err != nil {
+			return d, err
+		}
+	}
+
+	switch {
+	case d.Type == VariableEnum && len(d.Values) == 0:
+		return d, fmt.Errorf("enum variables need a list of values")
+	case d.Type != VariableEnum && len(d.Values) > 0:
+		return d, fmt.Errorf("values are only used by enum variables")
+	}
+	if d.Pattern != "" {
+		if d.pattern, err = regexp.Compile("^(?:" + d.Pattern + ")$"); err != nil {
+			return d, fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	if value, ok := d.staticDefault(); ok {
+		if _, err := d.Validate(value); err != nil {
+			return d, fmt.Errorf("invalid default: %v", err)
+		}
+	}
+	return d, nil
+}
+
+// ParseVariableDeclarations reads the declarations of the config variables
+// of a workflow, sorted by name
+func ParseVariableDeclarations(configVariables map[string]interface{}) ([]VariableDeclaration, error) {
+	names := make([]string, 0, len(configVariables))
+	for name := range configVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	declarations := make([]VariableDeclaration, 0, len(names))
+	for _, name := range names {
+		d, err := ParseVariableDeclaration(name, configVariables[name])
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %v", name, err)
+		}
+		declarations = append(declarations, d)
+	}
+	return declarations, nil
+}
+
+// staticDefault returns the default as a string, unless it is missing or
+// refers to a flag, an environment variable or the vault
+func (d VariableDeclaration) staticDefault() (string, bool) {
+	if d.Default == nil {
+		return "", false
+	}
+	s := fmt.Sprint(d.Default)
+	if _, ok := d.Default.(string); ok && (strings.HasPrefix(s, "args:") || strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "vault:")) {
+		return "", false
+	}
+	return s, true
+}
+
+// Validate checks value against the type and pattern of the declaration and
+// returns it normalized: booleans as true or false, paths with ~/ expanded.
+// Errors do not show the values of secret variables.
+func (d VariableDeclaration) Validate(value string) (string, error) {
+	got := fmt.Sprintf(", got %q", value)
+	if d.Secret {
+		got = ""
+	}
+
+	switch d.Type {
+	case VariableInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "", fmt.Errorf("expected an int%s", got)
+		}
+	case VariableBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected true or false%s", got)
+		}
+		value = strconv.FormatBool(b)
+	case VariableEnum:
+		if !slices.Contains(d.Values, value) {
+			return "", fmt.Errorf("expected one of %s%s", strings.Join(d.Values, ", "), got)
+		}
+	case VariablePath:
+		if value == "" {
+			return "", fmt.Errorf("expected a path")
+		}
+		if value == "~" || strings.HasPrefix(value, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("cannot expand ~: %v", err)
+			}
+			value = filepath.Join(home, value[1:])
+		}
+	case VariableURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return "", fmt.Errorf("expected an absolute URL such as https://example.com%s", got)
+		}
+	}
+
+	if d.pattern != nil && !d.pattern.MatchString(value) {
+		return "", fmt.Errorf("expected a value matching %s%s", d.Pattern, got)
+	}
+	return value, nil
+}
+
+// Describe returns a one-line description of the declaration, such as
+// "int, required, default 8080 - Port of the API". Defaults of secret
+// variables are left out.
+func (d VariableDeclaration) Describe() string {
+	parts := []string{d.Type}
+	if d.Type == VariableEnum {
+		parts[0] = "one of " + strings.Join(d.Values, ", ")
+	}
+	if d.Required {
+		parts = append(parts, "required")
+	}
+	if d.Secret {
+		parts = append(parts, "secret")
+	}
+	if d.Pattern != "" {
+		parts = append(parts, "pattern "+d.Pattern)
+	}
+	if d.Default != nil && !d.Secret {
+		parts = append(parts, fmt.Sprintf("default %v", d.Default))
+	}
+
+	description := strings.Join(parts, ", ")
+	if d.Description != "" {
+		description += " - " + d.Description
+	}
+	return description
+}
+
+// checkVariables checks the resolved variables against their declarations
+// and normalizes their values. Values from the vault are treated as secrets
+// in errors.
+func checkVariables(declarations []VariableDeclaration, variables, sources map[string]string) error {
+	var problems []string
+	for _, d := range declarations {
+		value, ok := variables[d.Name]
+		if !ok || (d.Required && value == "") {
+			if d.Required {
+				problem := fmt.Sprintf("%s is required, set it with --var %s=...", d.Name, d.Name)
+				if d.Description != "" {
+					problem += " (" + d.Description + ")"
+				}
+				problems = append(problems, problem)
+			}
+			continue
+		}
+
+		if sources[d.Name] == SourceVault {
+			d.Secret = true
+		}
+		normalized, err := d.Validate(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", d.Name, err))
+			continue
+		}
+		variables[d.Name] = normalized
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid variables:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ValidateVariables checks variables against the declarations in
+// configVariables, like ResolveVariables does, and normalizes their values.
+// Use it once the values resolved by ResolveVariablesWithSources, with their
+// sources, are completed, such as with answers to prompts.
+func ValidateVariables(configVariables map[string]interface{}, variables, sources map[string]string) error {
+	declarations, err := ParseVariableDeclarations(configVariables)
+	if err != nil {
+		return err
+	}
+	return checkVariables(declarations, variables, sources)
+}
+
+// SecretValues returns the values to redact from the output of a run: those
+// that came from the vault and those of the variables declared with
+// secret: true in configVariables
+func SecretValues(variables, sources map[string]string, configVariables map[string]interface{}) []string {
+	var secrets []string
+	for name, value := range variables {
+		if sources[name] == SourceVault {
+			secrets = append(secrets, value)
+		}
+	}
+	for name, val := range configVariables {
+		d, err := ParseVariableDeclaration(name, val)
+		if err != nil || !d.Secret {
+			continue
+		}
+		if value, ok := variables[name]; ok {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// variableDeclaration returns the fields of a config variable declared as a
+// map, as read from YAML, JSON or .mg files
+func variableDeclaration(val interface{}) (map[string]interface{}, bool) {
+	switch m := val.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[string]string:
+		declaration := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			declaration[k] = v
+		}
+		return declaration, true
+	}
+	return nil, false
+}
+
+// stringList returns the items of a list read from YAML, JSON or .mg files
+func stringList(val interface{}) ([]string, bool) {
+	switch list := val.(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+func stringField(field string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %v", field, value)
+	}
+	return s, nil
+}
+
+// boolField accepts booleans and strings such as "true"
+func boolField(field string, value interface{}) (bool, error) {
+	b, err := strconv.ParseBool(fmt.Sprint(value))
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %v", field, value)
+	}
+	return b, nil
+}
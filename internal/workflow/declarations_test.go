@@ -0,0 +1,95 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseVariableDeclaration(t *testing.T) {
+	d, err := ParseVariableDeclaration("env", map[string]interface{}{
+		"type":        "enum",
+		"values":      []interface{}{"staging", "prod"},
+		"default":     "staging",
+		"required":    true,
+		"description": "Environment to deploy to",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse declaration: %v", err)
+	}
+	if d.Type != VariableEnum || !slices.Equal(d.Values, []string{"staging", "prod"}) || d.Default != "staging" || !d.Required {
+		t.Errorf("unexpected declaration %+v", d)
+	}
+	if want := "one of staging, prod, required, default staging - Environment to deploy to"; d.Describe() != want {
+		t.Errorf("expected %q, got %q", want, d.Describe())
+	}
+
+	// The list form and plain values
+	if d, err := ParseVariableDeclaration("APP_NAME", []interface{}{"required", "slugify"}); err != nil || !d.Required || d.Default != nil {
+		t.Errorf("expected a required variable without a default, got %+v (%v)", d, err)
+	}
+	if d, err := ParseVariableDeclaration("region", "eu-west-1"); err != nil || d.Type != VariableString || d.Default != "eu-west-1" {
+		t.Errorf("expected a string with a default, got %+v (%v)", d, err)
+	}
+
+	for want, fields := range map[string]map[string]interface{}{
+		`unknown type "number"`:            {"type": "number"},
+		`unknown field "requried"`:         {"requried": true},
+		"need a list of values":            {"type": "enum"},
+		"only used by enum variables":      {"values": []interface{}{"a"}},
+		"invalid pattern":                  {"pattern": "[a-"},
+		"invalid default: expected an int": {"type": "int", "default": "eighty"},
+		"required must be true or false":   {"required": "yes please"},
+	} {
+		if _, err := ParseVariableDeclaration("v", fields); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%v: expected an error containing %q, got %v", fields, want, err)
+		}
+	}
+
+	// References are only checked once resolved
+	if _, err := ParseVariableDeclaration("port", map[string]interface{}{"type": "int", "default": "env:PORT"}); err != nil {
+		t.Errorf("expected a reference to be accepted as default, got %v", err)
+	}
+}
+
+func TestVariableDeclaration_Validate(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+
+	for _, tc := range []struct {
+		declaration map[string]interface{}
+		value       string
+		want        string // Normalized value, empty when invalid
+	}{
+		{map[string]interface{}{"type": "int"}, "8080", "8080"},
+		{map[string]interface{}{"type": "int"}, "80.5", ""},
+		{map[string]interface{}{"type": "bool"}, "1", "true"},
+		{map[string]interface{}{"type": "bool"}, "maybe", ""},
+		{map[string]interface{}{"type": "enum", "values": []string{"a", "b"}}, "b", "b"},
+		{map[string]interface{}{"type": "enum", "values": []string{"a", "b"}}, "c", ""},
+		{map[string]interface{}{"type": "path"}, "~/src", filepath.Join(home, "src")},
+		{map[string]interface{}{"type": "path"}, "", ""},
+		{map[string]interface{}{"type": "url"}, "https://example.com/hook", "https://example.com/hook"},
+		{map[string]interface{}{"type": "url"}, "example.com", ""},
+		{map[string]interface{}{"pattern": "v[0-9]+"}, "v12", "v12"},
+		{map[string]interface{}{"pattern": "v[0-9]+"}, "release-v12", ""},
+	} {
+		d, err := ParseVariableDeclaration("v", tc.declaration)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.declaration, err)
+		}
+		got, err := d.Validate(tc.value)
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%v: expected %q for %q, got %q (%v)", tc.declaration, tc.want, tc.value, got, err)
+		}
+	}
+
+	d, _ := ParseVariableDeclaration("token", map[string]interface{}{"pattern": "ghp_.+", "secret": true})
+	if _, err := d.Validate("hunter2"); err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("expected an error without the secret value, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tesh254/migraine/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time span in a workflow definition, such as a step timeout.
+// It is written as a number of seconds (300), a duration string ("5m",
+// "1h30m") or a {{variable}} resolving to either, so it is kept as text
+// until variables have been applied.
+type Duration string
+
+// UnmarshalJSON accepts both numbers and strings
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err == nil {
+		*d = Duration(n.String())
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a number of seconds or a string, got %s", data)
+	}
+	*d = Duration(s)
+	return nil
+}
+
+// UnmarshalYAML accepts any scalar, keeping its literal text
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: duration must be a number of seconds or a string", node.Line)
+	}
+	*d = Duration(node.Value)
+	return nil
+}
+
+// ParseDuration converts a duration whose variables have been applied, see
+// utils.ParseDuration. A bare number is read as seconds; an empty value means
+// no duration.
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		value += "s"
+	}
+	return utils.ParseDuration(value)
+}
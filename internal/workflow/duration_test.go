@@ -0,0 +1,55 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats are tested with utils.ParseDuration
+func TestParseDuration(t *testing.T) {
+	if d, err := ParseDuration(" "); err != nil || d != 0 {
+		t.Errorf("expected no duration for an empty value, got %s (%v)", d, err)
+	}
+	if d, err := ParseDuration("300"); err != nil || d != 300*time.Second {
+		t.Errorf("expected 300 seconds, got %s (%v)", d, err)
+	}
+	if _, err := ParseDuration("-5"); err == nil {
+		t.Error("expected a negative number of seconds to fail")
+	}
+	if _, err := ParseDuration("{{build_timeout}}"); err == nil {
+		t.Error("expected a duration with a variable left to fail")
+	}
+}
+
+func TestDuration_Unmarshal(t *testing.T) {
+	var fromYAML struct {
+		Seconds  Duration `yaml:"seconds"`
+		Text     Duration `yaml:"text"`
+		Variable Duration `yaml:"variable"`
+	}
+	data := "seconds: 300\ntext: 5m\nvariable: \"{{build_timeout}}\"\n"
+	if err := yaml.Unmarshal([]byte(data), &fromYAML); err != nil {
+		t.Fatalf("yaml unmarshal failed: %v", err)
+	}
+	if fromYAML.Seconds != "300" || fromYAML.Text != "5m" || fromYAML.Variable != "{{build_timeout}}" {
+		t.Errorf("unexpected yaml values: %+v", fromYAML)
+	}
+
+	var fromJSON struct {
+		Seconds Duration `json:"seconds"`
+		Text    Duration `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(`{"seconds": 300, "text": "5m"}`), &fromJSON); err != nil {
+		t.Fatalf("json unmarshal failed: %v", err)
+	}
+	if fromJSON.Seconds != "300" || fromJSON.Text != "5m" {
+		t.Errorf("unexpected json values: %+v", fromJSON)
+	}
+
+	if err := json.Unmarshal([]byte(`{"seconds": [1]}`), &fromJSON); err == nil {
+		t.Error("expected an error for a non-scalar duration")
+	}
+}
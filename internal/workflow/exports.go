@@ -0,0 +1,79 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VariableExports selects the resolved variables that are added to the
+// environment of commands. It is written as `export_variables: true` for
+// every variable or as a list of variable names.
+type VariableExports struct {
+	All   bool
+	Names []string
+}
+
+// IsZero reports whether no variable is exported
+func (e VariableExports) IsZero() bool {
+	return !e.All && len(e.Names) == 0
+}
+
+// Exports reports whether the variable called name is exported
+func (e VariableExports) Exports(name string) bool {
+	return e.All || slices.Contains(e.Names, name)
+}
+
+// UnmarshalJSON accepts a boolean or a list of names
+func (e *VariableExports) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.All); err == nil {
+		e.Names = nil
+		return nil
+	}
+	e.All = false
+	if err := json.Unmarshal(data, &e.Names); err != nil {
+		return fmt.Errorf("export_variables must be true, false or a list of variable names, got %s", data)
+	}
+	return nil
+}
+
+// MarshalJSON writes the list of names, or a boolean when there is none
+func (e VariableExports) MarshalJSON() ([]byte, error) {
+	if e.All || len(e.Names) == 0 {
+		return json.Marshal(e.All)
+	}
+	return json.Marshal(e.Names)
+}
+
+// UnmarshalYAML accepts a boolean or a list of names
+func (e *VariableExports) UnmarshalYAML(node *yaml.Node) error {
+	*e = VariableExports{}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if err := node.Decode(&e.All); err == nil {
+			return nil
+		}
+	case yaml.SequenceNode:
+		if err := node.Decode(&e.Names); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("line %d: export_variables must be true, false or a list of variable names", node.Line)
+}
+
+// MarshalYAML writes the list of names, or a boolean when there is none
+func (e VariableExports) MarshalYAML() (interface{}, error) {
+	if e.All || len(e.Names) == 0 {
+		return e.All, nil
+	}
+	return e.Names, nil
+}
+
+// ValidEnvName reports whether name can be used as the name of an
+// environment variable
+func ValidEnvName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "= \t\n")
+}
@@ -0,0 +1,54 @@
+package workflow
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestVariableExports_Unmarshal(t *testing.T) {
+	var config YAMLConfig
+	if err := yaml.Unmarshal([]byte("export_variables: true"), &config); err != nil || !config.ExportVariables.All {
+		t.Errorf("expected every variable to be exported, got %+v (%v)", config.ExportVariables, err)
+	}
+
+	config = YAMLConfig{}
+	if err := yaml.Unmarshal([]byte("export_variables: [APP_NAME, REGION]"), &config); err != nil {
+		t.Fatalf("failed to unmarshal a list: %v", err)
+	}
+	exports := config.ExportVariables
+	if exports.All || !exports.Exports("REGION") || exports.Exports("TOKEN") {
+		t.Errorf("expected only the listed variables to be exported, got %+v", exports)
+	}
+
+	if err := yaml.Unmarshal([]byte("export_variables: {APP_NAME: true}"), &config); err == nil {
+		t.Error("expected a map to be rejected")
+	}
+
+	var project ProjectConfig
+	if err := json.Unmarshal([]byte(`{"config": {"export_variables": ["APP_NAME"]}}`), &project); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+	if !slices.Equal(project.Config.ExportVariables.Names, []string{"APP_NAME"}) {
+		t.Errorf("expected [APP_NAME], got %+v", project.Config.ExportVariables)
+	}
+}
+
+func TestVariableExports_RoundTrip(t *testing.T) {
+	for _, exports := range []VariableExports{{}, {All: true}, {Names: []string{"APP_NAME"}}} {
+		data, err := json.Marshal(YAMLConfig{ExportVariables: exports})
+		if err != nil {
+			t.Fatalf("failed to marshal %+v: %v", exports, err)
+		}
+
+		var config YAMLConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatalf("failed to unmarshal %s: %v", data, err)
+		}
+		if config.ExportVariables.All != exports.All || !slices.Equal(config.ExportVariables.Names, exports.Names) {
+			t.Errorf("expected %+v after a round trip, got %+v", exports, config.ExportVariables)
+		}
+	}
+}
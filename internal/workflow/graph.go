@@ -0,0 +1,250 @@
+package workflow
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// StepGraph orders workflow steps by the `needs` they declare. Workflows
+// without any `needs` keep running their steps one after the other.
+type StepGraph struct {
+	steps      []YAMLStep
+	needs      [][]int // Indexes of the steps each step waits for
+	dependents [][]int // Indexes of the steps waiting for each step
+	parallel   bool
+}
+
+// NewStepGraph builds the dependency graph of steps, rejecting duplicate
+// ids, unknown or self references and dependency cycles. Steps with `needs`
+// finish in any order, so their workflows cannot use previous.<field> in
+// conditions; steps.<id>.<field> names the step to test instead.
+func NewStepGraph(steps []YAMLStep) (*StepGraph, error) {
+	g := &StepGraph{
+		steps:      steps,
+		needs:      make([][]int, len(steps)),
+		dependents: make([][]int, len(steps)),
+	}
+
+	ids := make(map[string]int)
+	for i, step := range steps {
+		if step.ID == "" {
+			continue
+		}
+		if prev, exists := ids[step.ID]; exists {
+			return nil, fmt.Errorf("step %d: id %q is already used by step %d", i+1, step.ID, prev+1)
+		}
+		ids[step.ID] = i
+	}
+
+	for i, step := range steps {
+		for _, need := range step.Needs {
+			j, exists := ids[need]
+			if !exists {
+				return nil, fmt.Errorf("step %d: needs unknown step %q", i+1, need)
+			}
+			if j == i {
+				return nil, fmt.Errorf("step %d: cannot need itself", i+1)
+			}
+			g.needs[i] = append(g.needs[i], j)
+			g.dependents[j] = append(g.dependents[j], i)
+			g.parallel = true
+		}
+	}
+
+	if g.parallel {
+		for i, step := range steps {
+			// Syntax errors are reported when the condition is evaluated
+			if cond, err := ParseCondition(step.When); step.When != "" && err == nil && cond.UsesPrevious() {
+				return nil, fmt.Errorf("step %d: previous is not available when steps use needs, use steps.<id>.<field> instead", i+1)
+			}
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		names := make([]string, len(cycle))
+		for k, i := range cycle {
+			names[k] = StepName(i, steps[i])
+		}
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+	}
+
+	return g, nil
+}
+
+// ValidateStepGraph checks that the `needs` of steps form a valid dependency graph
+func ValidateStepGraph(steps []YAMLStep) error {
+	_, err := NewStepGraph(steps)
+	return err
+}
+
+// Parallel reports whether any step declares `needs`, in which case steps
+// run as soon as the steps they need have succeeded
+func (g *StepGraph) Parallel() bool {
+	return g.parallel
+}
+
+// RunsBefore reports whether step j always finishes before step i starts:
+// j comes first in a sequential graph, or i needs j, directly or not
+func (g *StepGraph) RunsBefore(j, i int) bool {
+	if !g.parallel {
+		return j < i
+	}
+
+	seen := make([]bool, len(g.steps))
+	queue := append([]int{}, g.needs[i]...)
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		if k == j {
+			return true
+		}
+		if !seen[k] {
+			seen[k] = true
+			queue = append(queue, g.needs[k]...)
+		}
+	}
+	return false
+}
+
+// Run calls run for every step and returns how many steps succeeded. In a
+// parallel graph up to jobs steps run at once; otherwise steps run in order.
+// Once a step fails no new steps are started, the running ones are waited
+// for and the first error is returned.
+func (g *StepGraph) Run(jobs int, run func(i int) error) (int, error) {
+	if !g.parallel {
+		for i := range g.steps {
+			if err := run(i); err != nil {
+				return i, err
+			}
+		}
+		return len(g.steps), nil
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type result struct {
+		index int
+		err   error
+	}
+
+	pending := make([]int, len(g.steps))
+	var ready []int
+	for i := range g.steps {
+		pending[i] = len(g.needs[i])
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	results := make(chan result)
+	var wg sync.WaitGroup
+	running, completed := 0, 0
+	var firstErr error
+
+	for {
+		for firstErr == nil && running < jobs && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- result{index: i, err: run(i)}
+			}()
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := <-results
+		running--
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		completed++
+		for _, d := range g.dependents[res.index] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = insertSorted(ready, d)
+			}
+		}
+	}
+
+	wg.Wait()
+	return completed, firstErr
+}
+
+// findCycle returns the step indexes of a dependency cycle, or nil
+func (g *StepGraph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(g.steps))
+	var path []int
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range g.needs[i] {
+			switch state[j] {
+			case visiting:
+				for k, p := range path {
+					if p == j {
+						return append(append([]int{}, path[k:]...), j)
+					}
+				}
+			case unvisited:
+				if cycle := visit(j); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range g.steps {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// insertSorted keeps ready steps in declaration order
+func insertSorted(list []int, v int) []int {
+	k := len(list)
+	for k > 0 && list[k-1] > v {
+		k--
+	}
+	list = append(list, 0)
+	copy(list[k+1:], list[k:])
+	list[k] = v
+	return list
+}
+
+// StepName names a step in output and messages by its id, then its name, or
+// "step N" without either
+func StepName(i int, step YAMLStep) string {
+	if step.ID != "" {
+		return step.ID
+	}
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("step %d", i+1)
+}
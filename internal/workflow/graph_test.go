@@ -0,0 +1,190 @@
+package workflow
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewStepGraph_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []YAMLStep
+		want  string
+	}{
+		{
+			name:  "duplicate id",
+			steps: []YAMLStep{{ID: "lint"}, {ID: "lint"}},
+			want:  `step 2: id "lint" is already used by step 1`,
+		},
+		{
+			name:  "unknown need",
+			steps: []YAMLStep{{ID: "test", Needs: []string{"build"}}},
+			want:  `step 1: needs unknown step "build"`,
+		},
+		{
+			name:  "self need",
+			steps: []YAMLStep{{ID: "test", Needs: []string{"test"}}},
+			want:  "step 1: cannot need itself",
+		},
+		{
+			name: "cycle",
+			steps: []YAMLStep{
+				{ID: "a", Needs: []string{"c"}},
+				{ID: "b", Needs: []string{"a"}},
+				{ID: "c", Needs: []string{"b"}},
+			},
+			want: "dependency cycle: a -> c -> b -> a",
+		},
+		{
+			name: "previous with needs",
+			steps: []YAMLStep{
+				{ID: "build"},
+				{ID: "lint"},
+				{ID: "deploy", Needs: []string{"build", "lint"}, When: "!previous.failed && exists('dist')"},
+			},
+			want: "step 3: previous is not available when steps use needs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewStepGraph(tt.steps)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestStepGraph_SequentialWithoutNeeds(t *testing.T) {
+	g, err := NewStepGraph([]YAMLStep{{ID: "a"}, {}, {When: "previous.succeeded"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Parallel() {
+		t.Error("expected a workflow without needs to run sequentially")
+	}
+
+	var order []int
+	completed, err := g.Run(4, func(i int) error {
+		order = append(order, i)
+		if i == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if err == nil || completed != 1 {
+		t.Errorf("expected failure after 1 completed step, got %d, %v", completed, err)
+	}
+	if len(order) != 2 {
+		t.Errorf("expected steps after a failure not to run, ran %v", order)
+	}
+}
+
+func TestStepGraph_RunsDependenciesFirst(t *testing.T) {
+	steps := []YAMLStep{
+		{ID: "lint"},
+		{ID: "test"},
+		{ID: "build", Needs: []string{"lint", "test"}},
+		{ID: "push", Needs: []string{"build"}},
+	}
+	g, err := NewStepGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	finished := map[string]bool{}
+	concurrent, maxConcurrent := 0, 0
+
+	completed, err := g.Run(4, func(i int) error {
+		mu.Lock()
+		for _, need := range steps[i].Needs {
+			if !finished[need] {
+				t.Errorf("%s started before %s finished", steps[i].ID, need)
+			}
+		}
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		concurrent--
+		finished[steps[i].ID] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil || completed != len(steps) {
+		t.Fatalf("expected all steps to complete, got %d, %v", completed, err)
+	}
+	if maxConcurrent != 2 {
+		t.Errorf("expected lint and test to run concurrently, max concurrency was %d", maxConcurrent)
+	}
+}
+
+func TestStepGraph_JobsLimit(t *testing.T) {
+	steps := []YAMLStep{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d", Needs: []string{"a"}}}
+	g, err := NewStepGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	concurrent, maxConcurrent := 0, 0
+	_, err = g.Run(1, func(i int) error {
+		mu.Lock()
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		concurrent--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxConcurrent != 1 {
+		t.Errorf("expected at most 1 step at a time, got %d", maxConcurrent)
+	}
+}
+
+func TestStepGraph_StopsSchedulingAfterFailure(t *testing.T) {
+	steps := []YAMLStep{
+		{ID: "a"},
+		{ID: "b", Needs: []string{"a"}},
+		{ID: "c"},
+	}
+	g, err := NewStepGraph(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	ran := map[string]bool{}
+	completed, err := g.Run(1, func(i int) error {
+		mu.Lock()
+		ran[steps[i].ID] = true
+		mu.Unlock()
+		if steps[i].ID == "a" {
+			return errors.New("a failed")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "a failed" {
+		t.Errorf("expected the failure of a, got %v", err)
+	}
+	if completed != 0 || ran["b"] || ran["c"] {
+		t.Errorf("expected no steps to start after the failure, ran %v", ran)
+	}
+}
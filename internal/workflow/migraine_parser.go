@@ -141,6 +141,32 @@ func (p *MigraineParser) parseMetadata(wf *Workflow) error {
 
 func (p *MigraineParser) parseVariables(wf *Workflow) error {
 	for p.curToken.Type != TokenRBrace && p.curToken.Type != TokenEOF {
+		// A variable is a value or a declaration such as
+		// db_password = { default = "vault:DB_PASSWORD", secret = true }
+		if p.curToken.Type == TokenIdent && p.peekToken.Type == TokenAssign {
+			key := p.curToken.Literal
+			p.nextToken()
+			p.nextToken()
+			if p.curToken.Type == TokenLBrace {
+				declaration, err := p.parseValueMap()
+				if err != nil {
+					return fmt.Errorf("invalid declaration for variable %s: %v", key, err)
+				}
+				p.nextToken()
+				if p.curToken.Type == TokenComma {
+					p.nextToken()
+				}
+				wf.Config.Variables[key] = declaration
+				continue
+			}
+			val, err := p.parseValue(key)
+			if err != nil {
+				return err
+			}
+			wf.Config.Variables[key] = val
+			continue
+		}
+
 		key, val, err := p.parseKeyValue()
 		if err != nil {
 			return err
@@ -160,6 +186,24 @@ func (p *MigraineParser) parseWorkflow(wf *Workflow) error {
 			return fmt.Errorf("expected identifier in workflow block, got %v", p.curToken)
 		}
 		
+		// Settings that apply to every command of the workflow
+		if lit := p.curToken.Literal; lit == "dir" || lit == "env" || lit == "shell" {
+			key, val, err := p.parseKeyValue()
+			if err != nil {
+				return err
+			}
+			if s, ok := val.(string); ok && key == "dir" {
+				wf.Dir = s
+			} else if s, ok := val.(string); ok && key == "shell" {
+				wf.Shell = s
+			} else if m, ok := val.(map[string]string); ok && key == "env" {
+				wf.Env = m
+			} else {
+				return fmt.Errorf("invalid value for %s in workflow block", key)
+			}
+			continue
+		}
+
 		section := p.curToken.Literal
 		p.nextToken()
 
@@ -176,7 +220,7 @@ func (p *MigraineParser) parseWorkflow(wf *Workflow) error {
 			continue
 		}
 
-		// pre_checks or steps
+		// pre_checks, steps, on_success, on_failure or finally
 		if p.curToken.Type != TokenLBracket {
 			// Maybe it's not a list?
 			// The example shows: pre_checks [ ... ]
@@ -194,6 +238,12 @@ func (p *MigraineParser) parseWorkflow(wf *Workflow) error {
 			wf.PreChecks = atoms
 		case "steps":
 			wf.Steps = atoms
+		case "on_success":
+			wf.OnSuccess = atoms
+		case "on_failure":
+			wf.OnFailure = atoms
+		case "finally":
+			wf.Finally = atoms
 		default:
 			return fmt.Errorf("unknown workflow section: %s", section)
 		}
@@ -269,6 +319,13 @@ func (p *MigraineParser) parseConfig(wf *Workflow) error {
 			if b, ok := val.(bool); ok {
 				wf.Config.Global = b
 			}
+		case "export_variables":
+			switch v := val.(type) {
+			case bool:
+				wf.Config.ExportVariables = VariableExports{All: v}
+			case []string:
+				wf.Config.ExportVariables = VariableExports{Names: v}
+			}
 		}
 	}
 	if p.curToken.Type != TokenRBrace {
@@ -290,6 +347,15 @@ func (p *MigraineParser) parseKeyValue() (string, interface{}, error) {
 	}
 	p.nextToken()
 
+	val, err := p.parseValue(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, val, nil
+}
+
+// parseValue parses the value of key and an optional comma after it
+func (p *MigraineParser) parseValue(key string) (interface{}, error) {
 	var val interface{}
 	switch p.curToken.Type {
 	case TokenString:
@@ -301,8 +367,20 @@ func (p *MigraineParser) parseKeyValue() (string, interface{}, error) {
 		// Not used in example but good to have
 		f, _ := strconv.ParseFloat(p.curToken.Literal, 64)
 		val = f
+	case TokenLBracket:
+		list, err := p.parseStringList()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list for key %s: %v", key, err)
+		}
+		val = list
+	case TokenLBrace:
+		m, err := p.parseStringMap()
+		if err != nil {
+			return nil, fmt.Errorf("invalid map for key %s: %v", key, err)
+		}
+		val = m
 	default:
-		return "", nil, fmt.Errorf("expected value for key %s, got %v", key, p.curToken)
+		return nil, fmt.Errorf("expected value for key %s, got %v", key, p.curToken)
 	}
 	p.nextToken()
 
@@ -311,7 +389,94 @@ func (p *MigraineParser) parseKeyValue() (string, interface{}, error) {
 		p.nextToken()
 	}
 
-	return key, val, nil
+	return val, nil
+}
+
+// parseStringList parses a list of strings such as ["lint", "test"], leaving
+// the closing ] as the current token
+func (p *MigraineParser) parseStringList() ([]string, error) {
+	list := []string{}
+	p.nextToken() // consume [
+	for p.curToken.Type != TokenRBracket {
+		switch p.curToken.Type {
+		case TokenString:
+			list = append(list, p.curToken.Literal)
+		case TokenComma:
+		default:
+			return nil, fmt.Errorf("expected string or ], got %v", p.curToken)
+		}
+		p.nextToken()
+	}
+	return list, nil
+}
+
+// parseStringMap parses a map of strings such as { GOFLAGS = "-mod=mod" },
+// leaving the closing } as the current token
+func (p *MigraineParser) parseStringMap() (map[string]string, error) {
+	m := map[string]string{}
+	p.nextToken() // consume {
+	for p.curToken.Type != TokenRBrace {
+		if p.curToken.Type == TokenComma {
+			p.nextToken()
+			continue
+		}
+		if p.curToken.Type != TokenIdent && p.curToken.Type != TokenString {
+			return nil, fmt.Errorf("expected key or }, got %v", p.curToken)
+		}
+		key := p.curToken.Literal
+		p.nextToken()
+		if p.curToken.Type != TokenAssign {
+			return nil, fmt.Errorf("expected = after key %s, got %v", key, p.curToken)
+		}
+		p.nextToken()
+		if p.curToken.Type != TokenString {
+			return nil, fmt.Errorf("expected string value for key %s, got %v", key, p.curToken)
+		}
+		m[key] = p.curToken.Literal
+		p.nextToken()
+	}
+	return m, nil
+}
+
+// parseValueMap parses a map of strings, booleans, numbers and lists of
+// strings such as { type = "enum", values = ["staging", "prod"] }, leaving
+// the closing } as the current token
+func (p *MigraineParser) parseValueMap() (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	p.nextToken() // consume {
+	for p.curToken.Type != TokenRBrace {
+		if p.curToken.Type == TokenComma {
+			p.nextToken()
+			continue
+		}
+		if p.curToken.Type != TokenIdent && p.curToken.Type != TokenString {
+			return nil, fmt.Errorf("expected key or }, got %v", p.curToken)
+		}
+		key := p.curToken.Literal
+		p.nextToken()
+		if p.curToken.Type != TokenAssign {
+			return nil, fmt.Errorf("expected = after key %s, got %v", key, p.curToken)
+		}
+		p.nextToken()
+		switch p.curToken.Type {
+		case TokenString:
+			m[key] = p.curToken.Literal
+		case TokenBool:
+			m[key], _ = strconv.ParseBool(p.curToken.Literal)
+		case TokenNumber:
+			m[key], _ = strconv.ParseFloat(p.curToken.Literal, 64)
+		case TokenLBracket:
+			list, err := p.parseStringList()
+			if err != nil {
+				return nil, fmt.Errorf("invalid list for key %s: %v", key, err)
+			}
+			m[key] = list
+		default:
+			return nil, fmt.Errorf("expected value for key %s, got %v", key, p.curToken)
+		}
+		p.nextToken()
+	}
+	return m, nil
 }
 
 func (p *MigraineParser) parseAtomList() ([]Atom, error) {
@@ -353,17 +518,55 @@ func (p *MigraineParser) parseAtomList() ([]Atom, error) {
 
 func (p *MigraineParser) parseAtom() (Atom, error) {
 	var atom Atom
+	var when, ifCondition string
 	for p.curToken.Type != TokenRBrace && p.curToken.Type != TokenEOF {
+		if p.curToken.Type == TokenIdent && p.curToken.Literal == "outputs" {
+			outputs, err := p.parseOutputs()
+			if err != nil {
+				return atom, err
+			}
+			atom.Outputs = outputs
+			continue
+		}
+
 		key, val, err := p.parseKeyValue()
 		if err != nil {
 			return atom, err
 		}
 		
 		switch key {
+		case "id":
+			if s, ok := val.(string); ok {
+				atom.ID = s
+			}
+		case "needs":
+			if list, ok := val.([]string); ok {
+				atom.Needs = list
+			}
+		case "name":
+			if s, ok := val.(string); ok {
+				atom.Name = s
+			}
+		case "tags":
+			if list, ok := val.([]string); ok {
+				atom.Tags = list
+			}
 		case "cmd":
 			if s, ok := val.(string); ok {
 				atom.Command = s
 			}
+		case "script":
+			if s, ok := val.(string); ok {
+				atom.Script = s
+			}
+		case "shell":
+			if s, ok := val.(string); ok {
+				atom.Shell = s
+			}
+		case "sudo":
+			if b, ok := val.(bool); ok {
+				atom.Sudo = b
+			}
 		case "desc":
 			if s, ok := val.(string); ok {
 				atom.Description = &s
@@ -376,7 +579,127 @@ func (p *MigraineParser) parseAtom() (Atom, error) {
 			if s, ok := val.(string); ok {
 				atom.OnSuccess = s
 			}
+		case "timeout":
+			atom.Timeout = durationValue(val)
+		case "retries":
+			if f, ok := val.(float64); ok {
+				atom.Retries = int(f)
+			}
+		case "retry_delay":
+			atom.RetryDelay = durationValue(val)
+		case "backoff":
+			if s, ok := val.(string); ok {
+				atom.Backoff = s
+			}
+		case "jitter":
+			if b, ok := val.(bool); ok {
+				atom.Jitter = b
+			}
+		case "when":
+			if s, ok := val.(string); ok {
+				when = s
+			}
+		case "if":
+			if s, ok := val.(string); ok {
+				ifCondition = s
+			}
+		case "allow_failure":
+			if b, ok := val.(bool); ok {
+				atom.AllowFailure = b
+			}
+		case "severity":
+			if s, ok := val.(string); ok {
+				atom.Severity = s
+			}
+		case "dir":
+			if s, ok := val.(string); ok {
+				atom.Dir = s
+			}
+		case "env":
+			if m, ok := val.(map[string]string); ok {
+				atom.Env = m
+			}
 		}
 	}
-	return atom, nil
+
+	var err error
+	atom.When, err = whenOrIf(when, ifCondition)
+	return atom, err
+}
+
+// parseOutputs parses the outputs of a step such as
+// outputs = { version = "last_line", tag = { json = ".image.tag" } }
+func (p *MigraineParser) parseOutputs() (map[string]StepOutput, error) {
+	p.nextToken() // consume outputs
+	if p.curToken.Type != TokenAssign {
+		return nil, fmt.Errorf("expected = after key outputs, got %v", p.curToken)
+	}
+	p.nextToken()
+	if p.curToken.Type != TokenLBrace {
+		return nil, fmt.Errorf("expected { for outputs, got %v", p.curToken)
+	}
+	p.nextToken() // consume {
+
+	outputs := map[string]StepOutput{}
+	for p.curToken.Type != TokenRBrace {
+		if p.curToken.Type == TokenComma {
+			p.nextToken()
+			continue
+		}
+		if p.curToken.Type != TokenIdent && p.curToken.Type != TokenString {
+			return nil, fmt.Errorf("expected output name or }, got %v", p.curToken)
+		}
+		name := p.curToken.Literal
+		p.nextToken()
+		if p.curToken.Type != TokenAssign {
+			return nil, fmt.Errorf("expected = after output %s, got %v", name, p.curToken)
+		}
+		p.nextToken()
+
+		switch p.curToken.Type {
+		case TokenString:
+			outputs[name] = StepOutput{From: p.curToken.Literal}
+		case TokenLBrace:
+			fields, err := p.parseStringMap()
+			if err != nil {
+				return nil, fmt.Errorf("invalid output %s: %v", name, err)
+			}
+			var output StepOutput
+			for field, value := range fields {
+				switch field {
+				case "from":
+					output.From = value
+				case "json":
+					output.JSON = value
+				case "regex":
+					output.Regex = value
+				default:
+					return nil, fmt.Errorf("invalid output %s: unknown field %s", name, field)
+				}
+			}
+			outputs[name] = output
+		default:
+			return nil, fmt.Errorf("expected string or { for output %s, got %v", name, p.curToken)
+		}
+		p.nextToken()
+	}
+	p.nextToken() // consume }
+
+	// Optional comma
+	if p.curToken.Type == TokenComma {
+		p.nextToken()
+	}
+
+	return outputs, nil
+}
+
+// durationValue converts a number of seconds or a duration string to a Duration
+func durationValue(val interface{}) Duration {
+	switch v := val.(type) {
+	case string:
+		return Duration(v)
+	case float64:
+		return Duration(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return ""
 }
@@ -2,6 +2,8 @@ package workflow
 
 import (
 	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -196,6 +198,12 @@ func TestMigraineParser_SampleFile(t *testing.T) {
 	if wf.Steps[2].OnFail != "action:rollback" {
 		t.Errorf("Expected step 3 on_fail 'action:rollback', got '%s'", wf.Steps[2].OnFail)
 	}
+	if wf.Steps[0].Timeout != "{{build_timeout}}" {
+		t.Errorf("Expected step 1 timeout '{{build_timeout}}', got '%s'", wf.Steps[0].Timeout)
+	}
+	if wf.Steps[1].Timeout != "10m" {
+		t.Errorf("Expected step 2 timeout '10m', got '%s'", wf.Steps[1].Timeout)
+	}
 
 	if len(wf.Actions) != 4 {
 		t.Fatalf("Expected 4 actions, got %d", len(wf.Actions))
@@ -221,6 +229,167 @@ func TestMigraineParser_SampleFile(t *testing.T) {
 	}
 }
 
+func TestMigraineParser_NumericTimeout(t *testing.T) {
+	script := `
+metadata {
+    name = "timeout-test"
+}
+workflow {
+    steps [
+        {
+            cmd = "sleep 1"
+            timeout = 90
+        }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(wf.Steps) != 1 || wf.Steps[0].Timeout != "90" {
+		t.Fatalf("Expected step timeout '90', got %+v", wf.Steps)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if yamlWf.Steps[0].Timeout != "90" {
+		t.Errorf("YAMLWorkflow: Expected step timeout '90', got '%s'", yamlWf.Steps[0].Timeout)
+	}
+}
+
+func TestMigraineParser_RetryFields(t *testing.T) {
+	script := `
+metadata {
+    name = "retry-test"
+}
+workflow {
+    steps [
+        {
+            cmd = "curl -fsS localhost:8080/health"
+            retries = 3
+            retry_delay = "2s"
+            backoff = "exponential"
+            jitter = true
+        }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(wf.Steps) != 1 {
+		t.Fatalf("Expected 1 step, got %d", len(wf.Steps))
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	step := yamlWf.Steps[0]
+	if step.Retries != 3 {
+		t.Errorf("Expected retries 3, got %d", step.Retries)
+	}
+	if step.RetryDelay != "2s" {
+		t.Errorf("Expected retry_delay '2s', got '%s'", step.RetryDelay)
+	}
+	if step.Backoff != BackoffExponential {
+		t.Errorf("Expected backoff 'exponential', got '%s'", step.Backoff)
+	}
+	if !step.Jitter {
+		t.Error("Expected jitter to be enabled")
+	}
+}
+
+func TestMigraineParser_StepNeeds(t *testing.T) {
+	script := `
+metadata {
+    name = "needs-test"
+}
+workflow {
+    pre_checks [
+        { cmd = "docker info", severity = "warn" }
+    ]
+    steps [
+        { id = "lint", cmd = "make lint", allow_failure = true },
+        { id = "test", name = "unit tests", tags = ["fast", "unit"], cmd = "make test" },
+        {
+            id = "build"
+            needs = ["lint", "test"]
+            cmd = "docker build ."
+            when = "exists('Dockerfile')"
+        },
+        { id = "push", needs = ["build"], cmd = "docker push", if = "{{push}}" }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if len(yamlWf.Steps) != 4 {
+		t.Fatalf("Expected 4 steps, got %d", len(yamlWf.Steps))
+	}
+
+	if !yamlWf.Steps[0].AllowFailure || len(yamlWf.PreChecks) != 1 || yamlWf.PreChecks[0].Severity != SeverityWarn {
+		t.Errorf("Expected allow_failure and severity to be parsed, got %+v %+v", yamlWf.Steps[0], yamlWf.PreChecks)
+	}
+
+	if test := yamlWf.Steps[1]; test.Name != "unit tests" || len(test.Tags) != 2 || test.Tags[1] != "unit" {
+		t.Errorf("Expected the test step name and tags to be parsed, got %q %v", test.Name, test.Tags)
+	}
+
+	build := yamlWf.Steps[2]
+	if build.ID != "build" || len(build.Needs) != 2 || build.Needs[0] != "lint" || build.Needs[1] != "test" {
+		t.Errorf("Expected build to need lint and test, got id %q needs %v", build.ID, build.Needs)
+	}
+	if build.When != "exists('Dockerfile')" {
+		t.Errorf("Expected build condition to be parsed, got %q", build.When)
+	}
+	if push := yamlWf.Steps[3]; push.When != "{{push}}" {
+		t.Errorf("Expected if to set the push condition, got %q", push.When)
+	}
+	if err := ValidateStepGraph(yamlWf.Steps); err != nil {
+		t.Errorf("Expected a valid step graph, got %v", err)
+	}
+}
+
+func TestMigraineParser_WhenAndIf(t *testing.T) {
+	script := `
+metadata {
+    name = "when-and-if"
+}
+workflow {
+    steps [
+        { cmd = "make", when = "true", if = "false" }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+	if _, err := parser.Parse(); err == nil || !strings.Contains(err.Error(), "both when and if") {
+		t.Errorf("Expected a step with when and if to be rejected, got %v", err)
+	}
+}
+
 func TestMigraineParser_BacktickStrings(t *testing.T) {
 	script := `
 metadata {
@@ -628,3 +797,269 @@ config {
 		t.Errorf("Roundtrip internal: steps count mismatch %d vs %d", len(internalWf.Steps), len(wf.Steps))
 	}
 }
+
+func TestMigraineParser_WorkflowHooks(t *testing.T) {
+	script := `
+metadata {
+    name = "hooks-test"
+}
+workflow {
+    steps [
+        { cmd = "make deploy" }
+    ]
+    on_success [
+        { cmd = "notify ok", on_fail = "run:echo notify failed" }
+    ]
+    on_failure [
+        { cmd = "notify failed" }
+    ]
+    finally [
+        { cmd = "docker rm -f tmp", timeout = "1m" },
+        { cmd = "rm -rf build" }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if len(yamlWf.OnSuccess) != 1 || yamlWf.OnSuccess[0].OnFail != "run:echo notify failed" {
+		t.Errorf("Expected 1 on_success step with its hook, got %+v", yamlWf.OnSuccess)
+	}
+	if len(yamlWf.OnFailure) != 1 || yamlWf.OnFailure[0].Command != "notify failed" {
+		t.Errorf("Expected 1 on_failure step, got %+v", yamlWf.OnFailure)
+	}
+	if len(yamlWf.Finally) != 2 || yamlWf.Finally[0].Timeout != "1m" || yamlWf.Finally[1].Command != "rm -rf build" {
+		t.Errorf("Expected 2 finally steps, got %+v", yamlWf.Finally)
+	}
+}
+
+func TestMigraineParser_DirAndEnv(t *testing.T) {
+	script := `
+metadata {
+    name = "env-test"
+}
+workflow {
+    dir = "{{root}}"
+    env = { STAGE = "prod" }
+    steps [
+        {
+            cmd = "go test ./..."
+            dir = "services/api"
+            env = { GOFLAGS = "-mod=mod", "CGO_ENABLED" = "0" }
+        }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if yamlWf.Dir != "{{root}}" || yamlWf.Env["STAGE"] != "prod" {
+		t.Errorf("Expected the workflow dir and env to be parsed, got %q %v", yamlWf.Dir, yamlWf.Env)
+	}
+	step := yamlWf.Steps[0]
+	if step.Dir != "services/api" || len(step.Env) != 2 || step.Env["GOFLAGS"] != "-mod=mod" || step.Env["CGO_ENABLED"] != "0" {
+		t.Errorf("Expected the step dir and env to be parsed, got %q %v", step.Dir, step.Env)
+	}
+}
+
+func TestMigraineParser_ExportVariables(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  VariableExports
+	}{
+		{`true`, VariableExports{All: true}},
+		{`false`, VariableExports{}},
+		{`["APP_NAME", "REGION"]`, VariableExports{Names: []string{"APP_NAME", "REGION"}}},
+	} {
+		script := `
+metadata {
+    name = "export-test"
+}
+workflow {
+    steps [
+        { cmd = "echo $APP_NAME" }
+    ]
+}
+config {
+    export_variables = ` + tc.value + `
+}
+`
+		parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+		if err != nil {
+			t.Fatalf("Failed to create parser: %v", err)
+		}
+
+		wf, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", tc.value, err)
+		}
+
+		got := ConvertInternalToYAML(wf, "").Config.ExportVariables
+		if got.All != tc.want.All || !slices.Equal(got.Names, tc.want.Names) {
+			t.Errorf("export_variables = %s: expected %+v, got %+v", tc.value, tc.want, got)
+		}
+	}
+}
+
+func TestMigraineParser_Outputs(t *testing.T) {
+	script := `
+metadata {
+    name = "outputs-test"
+}
+workflow {
+    steps [
+        {
+            id = "build"
+            cmd = "make image"
+            outputs = { version = "last_line", tag = { json = ".image.tag" }, "port" = { from = "file", regex = "port=(\d+)" } }
+        },
+        { cmd = "docker push app:{{steps.build.outputs.tag}}" }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	outputs := yamlWf.Steps[0].Outputs
+	if len(outputs) != 3 || outputs["version"] != (StepOutput{From: OutputFromLastLine}) ||
+		outputs["tag"] != (StepOutput{JSON: ".image.tag"}) || outputs["port"] != (StepOutput{From: OutputFromFile, Regex: `port=(\d+)`}) {
+		t.Errorf("Unexpected outputs %+v", outputs)
+	}
+	if len(yamlWf.Steps) != 2 || yamlWf.Steps[1].Command != "docker push app:{{steps.build.outputs.tag}}" {
+		t.Errorf("Expected the second step to be parsed, got %+v", yamlWf.Steps)
+	}
+	if err := ValidateYAMLWorkflow(yamlWf); err != nil {
+		t.Errorf("Expected the workflow to be valid, got %v", err)
+	}
+
+	parser, err = NewMigraineParserFromReader(strings.NewReader(`workflow { steps [ { id = "a", cmd = "x", outputs = { v = { pick = "x" } } } ] }`))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+	if _, err := parser.Parse(); err == nil || !strings.Contains(err.Error(), "unknown field pick") {
+		t.Errorf("Expected an unknown output field to be rejected, got %v", err)
+	}
+}
+
+func TestMigraineParser_ShellAndScript(t *testing.T) {
+	script := "workflow {\n" +
+		"    shell = \"bash -euo pipefail\"\n" +
+		"    steps [\n" +
+		"        {\n" +
+		"            shell = \"python3\"\n" +
+		"            script = `import json\nprint(json.dumps({\"ok\": True}))`\n" +
+		"        },\n" +
+		"        { cmd = \"make test\" }\n" +
+		"    ]\n" +
+		"}\n"
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if yamlWf.Shell != "bash -euo pipefail" {
+		t.Errorf("Expected the workflow shell, got %q", yamlWf.Shell)
+	}
+	if len(yamlWf.Steps) != 2 || yamlWf.Steps[0].Shell != "python3" || yamlWf.Steps[0].Command != "" ||
+		yamlWf.Steps[0].Script != "import json\nprint(json.dumps({\"ok\": True}))" {
+		t.Errorf("Unexpected steps %+v", yamlWf.Steps)
+	}
+	if err := ValidateYAMLWorkflow(yamlWf); err != nil {
+		t.Errorf("Expected the workflow to be valid, got %v", err)
+	}
+}
+
+func TestMigraineParser_Sudo(t *testing.T) {
+	parser, err := NewMigraineParserFromReader(strings.NewReader(`workflow { steps [ { cmd = "make" }, { cmd = "make install", sudo = true } ] }`))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	yamlWf := ConvertInternalToYAML(wf, "")
+	if len(yamlWf.Steps) != 2 || yamlWf.Steps[0].Sudo || !yamlWf.Steps[1].Sudo {
+		t.Errorf("Expected only the second step to use sudo, got %+v", yamlWf.Steps)
+	}
+	if internal, err := ConvertYAMLToInternal(yamlWf); err != nil || !internal.UsesSudo {
+		t.Errorf("Expected the workflow to use sudo, got %v", err)
+	}
+}
+
+func TestMigraineParser_VariableDeclarations(t *testing.T) {
+	script := `
+metadata {
+    name = "declarations"
+}
+variables {
+    region = "eu-west-1"
+    db_password = { default = "vault:DB_PASSWORD", secret = true },
+    api_token = { secret = true }
+    env = { type = "enum", values = ["staging", "prod"], required = true }
+}
+workflow {
+    steps [
+        {
+            cmd = "echo ok"
+        }
+    ]
+}
+`
+	parser, err := NewMigraineParserFromReader(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	wf, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if wf.Config.Variables["region"] != "eu-west-1" {
+		t.Errorf("Expected 'eu-west-1', got '%v'", wf.Config.Variables["region"])
+	}
+	want := map[string]interface{}{"default": "vault:DB_PASSWORD", "secret": true}
+	if got, ok := wf.Config.Variables["db_password"].(map[string]interface{}); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected declaration %v, got %#v", want, wf.Config.Variables["db_password"])
+	}
+	if got, ok := wf.Config.Variables["api_token"].(map[string]interface{}); !ok || got["secret"] != true {
+		t.Errorf("Expected a secret declaration, got %#v", wf.Config.Variables["api_token"])
+	}
+	d, err := ParseVariableDeclaration("env", wf.Config.Variables["env"])
+	if err != nil || d.Type != VariableEnum || !slices.Equal(d.Values, []string{"staging", "prod"}) || !d.Required {
+		t.Errorf("Expected an enum declaration, got %+v (%v)", d, err)
+	}
+}
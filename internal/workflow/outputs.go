@@ -0,0 +1,227 @@
+package workflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of step outputs
+const (
+	OutputFromStdout   = "stdout"    // The whole output of the step (default)
+	OutputFromLastLine = "last_line" // The last non-empty line of the output
+	OutputFromFile     = "file"      // The value written to $MIGRAINE_OUTPUT
+)
+
+// OutputFileEnv names the environment variable holding the path of the file
+// where steps with outputs can write `name=value` lines
+const OutputFileEnv = "MIGRAINE_OUTPUT"
+
+// StepOutput describes how a value is captured from a step. It is written as
+// a map, or as a string naming its source, e.g. `version: last_line`.
+type StepOutput struct {
+	From  string `yaml:"from,omitempty" json:"from,omitempty"`   // One of the OutputFrom values
+	JSON  string `yaml:"json,omitempty" json:"json,omitempty"`   // Path of a value in the source parsed as JSON, e.g. ".image.tag"
+	Regex string `yaml:"regex,omitempty" json:"regex,omitempty"` // Pattern whose first group, or whole match, is the value
+}
+
+// UnmarshalYAML accepts the source as a string or the full map
+func (o *StepOutput) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*o = StepOutput{From: node.Value}
+		return nil
+	}
+	type plain StepOutput
+	return node.Decode((*plain)(o))
+}
+
+// UnmarshalJSON accepts the source as a string or the full object
+func (o *StepOutput) UnmarshalJSON(data []byte) error {
+	var from string
+	if err := json.Unmarshal(data, &from); err == nil {
+		*o = StepOutput{From: from}
+		return nil
+	}
+	type plain StepOutput
+	return json.Unmarshal(data, (*plain)(o))
+}
+
+// Validate checks the source, JSON path and pattern of the output
+func (o StepOutput) Validate() error {
+	switch o.From {
+	case "", OutputFromStdout, OutputFromLastLine, OutputFromFile:
+	default:
+		return fmt.Errorf("invalid from %q (must be %s, %s or %s)", o.From, OutputFromStdout, OutputFromLastLine, OutputFromFile)
+	}
+	if o.JSON != "" && o.Regex != "" {
+		return fmt.Errorf("json and regex cannot be combined")
+	}
+	if o.JSON != "" {
+		if _, err := parseJSONPath(o.JSON); err != nil {
+			return err
+		}
+	}
+	if o.Regex != "" {
+		if _, err := regexp.Compile(o.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	return nil
+}
+
+// Extract returns the value of the output called name from the output of a
+// step and the values it wrote to $MIGRAINE_OUTPUT
+func (o StepOutput) Extract(name, stdout string, file map[string]string) (string, error) {
+	var value string
+	switch o.From {
+	case "", OutputFromStdout:
+		value = strings.TrimSpace(stdout)
+	case OutputFromLastLine:
+		lines := strings.Split(strings.TrimSpace(stdout), "\n")
+		value = strings.TrimSpace(lines[len(lines)-1])
+	case OutputFromFile:
+		v, ok := file[name]
+		if !ok {
+			return "", fmt.Errorf("%s was not written to $%s", name, OutputFileEnv)
+		}
+		value = v
+	default:
+		return "", fmt.Errorf("invalid from %q", o.From)
+	}
+
+	switch {
+	case o.JSON != "":
+		return extractJSON(value, o.JSON)
+	case o.Regex != "":
+		re, err := regexp.Compile(o.Regex)
+		if err != nil {
+			return "", fmt.Errorf("invalid regex: %v", err)
+		}
+		match := re.FindStringSubmatch(value)
+		if match == nil {
+			return "", fmt.Errorf("regex %q did not match", o.Regex)
+		}
+		if len(match) > 1 {
+			return match[1], nil
+		}
+		return match[0], nil
+	}
+	return value, nil
+}
+
+// String describes the output in plans, e.g. "last_line" or "stdout json .tag"
+func (o StepOutput) String() string {
+	from := o.From
+	if from == "" {
+		from = OutputFromStdout
+	}
+	switch {
+	case o.JSON != "":
+		return fmt.Sprintf("%s json %s", from, o.JSON)
+	case o.Regex != "":
+		return fmt.Sprintf("%s regex %s", from, o.Regex)
+	}
+	return from
+}
+
+// ParseOutputFile reads the `name=value` lines steps write to
+// $MIGRAINE_OUTPUT. Later lines take precedence; other lines are ignored.
+func ParseOutputFile(content string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSuffix(scanner.Text(), "\r"), "=")
+		if name = strings.TrimSpace(name); ok && name != "" {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// OutputVariable returns the variable name under which later steps read an
+// output of the step with id stepID
+func OutputVariable(stepID, name string) string {
+	return "steps." + stepID + ".outputs." + name
+}
+
+// ParseOutputVariable splits a variable name of the form
+// steps.<id>.outputs.<name>. ok is false for other variables.
+func ParseOutputVariable(variable string) (stepID, name string, ok bool) {
+	rest, ok := strings.CutPrefix(variable, "steps.")
+	if !ok {
+		return "", "", false
+	}
+	stepID, name, ok = strings.Cut(rest, ".outputs.")
+	if !ok || stepID == "" || name == "" {
+		return "", "", false
+	}
+	return stepID, name, true
+}
+
+// validOutputName reports whether name can be read back as
+// {{steps.<id>.outputs.<name>}}
+func validOutputName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ".{} \t\n")
+}
+
+// extractJSON returns the value at path in the JSON document data. Strings
+// are returned as is, other values as JSON.
+func extractJSON(data, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return "", fmt.Errorf("output is not valid JSON: %v", err)
+	}
+
+	keys, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			field, ok := v[key]
+			if !ok {
+				return "", fmt.Errorf("json path %s: no field %q", path, key)
+			}
+			value = field
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("json path %s: no element %q", path, key)
+			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("json path %s: cannot read %q of a %T", path, key, value)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// parseJSONPath splits a path like ".items[0].name" or "items.0.name" into
+// its keys
+func parseJSONPath(path string) ([]string, error) {
+	normalized := strings.NewReplacer("[", ".", "]", "").Replace(strings.TrimPrefix(path, "."))
+	if normalized == "" {
+		return nil, nil
+	}
+	keys := strings.Split(normalized, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid json path %q", path)
+		}
+	}
+	return keys, nil
+}
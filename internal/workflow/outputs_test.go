@@ -0,0 +1,87 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestStepOutput_Extract(t *testing.T) {
+	stdout := "building...\n{\"image\": {\"tag\": \"v1.2\", \"layers\": [3, 4]}, \"ok\": true}\n\n"
+	file := map[string]string{"url": "https://example.com"}
+
+	tests := []struct {
+		output StepOutput
+		name   string
+		want   string
+	}{
+		{StepOutput{}, "all", "building...\n{\"image\": {\"tag\": \"v1.2\", \"layers\": [3, 4]}, \"ok\": true}"},
+		{StepOutput{From: OutputFromLastLine, JSON: ".image.tag"}, "tag", "v1.2"},
+		{StepOutput{From: OutputFromLastLine, JSON: "image.layers[1]"}, "layer", "4"},
+		{StepOutput{From: OutputFromLastLine, JSON: ".image.layers"}, "layers", "[3,4]"},
+		{StepOutput{From: OutputFromLastLine, JSON: ".ok"}, "ok", "true"},
+		{StepOutput{Regex: `"tag": "([^"]+)"`}, "tag", "v1.2"},
+		{StepOutput{Regex: `build\w+`}, "word", "building"},
+		{StepOutput{From: OutputFromFile}, "url", "https://example.com"},
+		{StepOutput{From: OutputFromFile, Regex: `//(.+)`}, "url", "example.com"},
+	}
+	for _, tt := range tests {
+		got, err := tt.output.Extract(tt.name, stdout, file)
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", tt.output, err)
+		} else if got != tt.want {
+			t.Errorf("%+v: expected %q, got %q", tt.output, tt.want, got)
+		}
+	}
+
+	for _, output := range []StepOutput{
+		{JSON: ".image"},
+		{From: OutputFromLastLine, JSON: ".image.digest"},
+		{From: OutputFromLastLine, JSON: ".image.layers[5]"},
+		{Regex: "missing"},
+		{From: OutputFromFile},
+	} {
+		if _, err := output.Extract("sha", stdout, file); err == nil {
+			t.Errorf("%+v: expected an error", output)
+		}
+	}
+}
+
+func TestStepOutput_Unmarshal(t *testing.T) {
+	var step YAMLStep
+	content := "command: make\noutputs:\n  version: last_line\n  tag:\n    json: .image.tag\n"
+	if err := yaml.Unmarshal([]byte(content), &step); err != nil {
+		t.Fatalf("failed to unmarshal YAML: %v", err)
+	}
+	if step.Outputs["version"] != (StepOutput{From: OutputFromLastLine}) || step.Outputs["tag"] != (StepOutput{JSON: ".image.tag"}) {
+		t.Errorf("unexpected outputs %+v", step.Outputs)
+	}
+
+	step = YAMLStep{}
+	if err := json.Unmarshal([]byte(`{"outputs": {"url": "file", "port": {"regex": "port=(\\d+)"}}}`), &step); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+	if step.Outputs["url"] != (StepOutput{From: OutputFromFile}) || step.Outputs["port"] != (StepOutput{Regex: `port=(\d+)`}) {
+		t.Errorf("unexpected outputs %+v", step.Outputs)
+	}
+}
+
+func TestParseOutputFile(t *testing.T) {
+	values := ParseOutputFile("tag=v1\r\nurl=https://example.com/?a=b\nnot a value\ntag=v2\n")
+	if len(values) != 2 || values["tag"] != "v2" || values["url"] != "https://example.com/?a=b" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestParseOutputVariable(t *testing.T) {
+	stepID, name, ok := ParseOutputVariable(OutputVariable("build", "image_tag"))
+	if !ok || stepID != "build" || name != "image_tag" {
+		t.Errorf("expected build/image_tag, got %q %q %v", stepID, name, ok)
+	}
+	for _, variable := range []string{"env", "steps.build.succeeded", "steps..outputs.tag", "steps.build.outputs."} {
+		if _, _, ok := ParseOutputVariable(variable); ok {
+			t.Errorf("%s: expected no output reference", variable)
+		}
+	}
+}
@@ -98,8 +98,8 @@ func (tp *TemplateParser) ValidateWorkflow(wk *Workflow) error {
 	}
 
 	for i, step := range wk.Steps {
-		if step.Command == "" {
-			return fmt.Errorf("step %d must have a command", i+1)
+		if step.Command == "" && step.Script == "" {
+			return fmt.Errorf("step %d must have a command or a script", i+1)
 		}
 	}
 
@@ -13,12 +13,103 @@ import (
 
 // YAMLStep represents a step in a YAML workflow
 type YAMLStep struct {
-	Command     string  `yaml:"command" json:"command"`
-	Description *string `yaml:"description,omitempty" json:"description,omitempty"`
-	OnFail      string  `yaml:"on_fail,omitempty" json:"on_fail,omitempty"`
-	OnSuccess   string  `yaml:"on_success,omitempty" json:"on_success,omitempty"`
+	ID          string   `yaml:"id,omitempty" json:"id,omitempty"`       // Name other steps use in `needs`
+	Name        string   `yaml:"name,omitempty" json:"name,omitempty"`   // Label selected by --only and --skip
+	Tags        []string `yaml:"tags,omitempty" json:"tags,omitempty"`   // Labels selected by --tags
+	Needs       []string `yaml:"needs,omitempty" json:"needs,omitempty"` // Ids of the steps that must succeed first
+	Command     string   `yaml:"command,omitempty" json:"command,omitempty"`
+	Script      string   `yaml:"script,omitempty" json:"script,omitempty"` // Multi-line script run from a file, instead of a command
+	Description *string  `yaml:"description,omitempty" json:"description,omitempty"`
+	OnFail      string   `yaml:"on_fail,omitempty" json:"on_fail,omitempty"`
+	OnSuccess   string   `yaml:"on_success,omitempty" json:"on_success,omitempty"`
+	Timeout     Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"` // Stop the step after this long, e.g. 300 or "5m"
+	Retries     int      `yaml:"retries,omitempty" json:"retries,omitempty"` // Extra attempts after a failure
+	RetryDelay  Duration `yaml:"retry_delay,omitempty" json:"retry_delay,omitempty"`
+	Backoff     string   `yaml:"backoff,omitempty" json:"backoff,omitempty"` // "constant" (default) or "exponential"
+	Jitter      bool     `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	When        string   `yaml:"when,omitempty" json:"when,omitempty"` // Condition under which the step runs, see Condition
+	// AllowFailure lets the run go on when the step fails (steps only)
+	AllowFailure bool `yaml:"allow_failure,omitempty" json:"allow_failure,omitempty"`
+	// Severity of a failed pre-check: SeverityError (default) or SeverityWarn
+	Severity string `yaml:"severity,omitempty" json:"severity,omitempty"`
+	// Dir is the working directory of the command, relative to the workflow dir
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty"`
+	// Env adds variables to the environment of the command, over the workflow env
+	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// Outputs are values captured from the step, which later steps read as
+	// {{steps.<id>.outputs.<name>}}
+	Outputs map[string]StepOutput `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+	// Shell runs the command or script, e.g. "bash -euo pipefail" or
+	// "python3", instead of the workflow shell
+	Shell string `yaml:"shell,omitempty" json:"shell,omitempty"`
+	// Sudo runs the command as root through sudo
+	Sudo bool `yaml:"sudo,omitempty" json:"sudo,omitempty"`
 }
 
+// whenOrIf returns the condition of a step, given either as when or as its
+// alias if. A step may not set both.
+func whenOrIf(when, ifCondition string) (string, error) {
+	if when != "" && ifCondition != "" {
+		return "", fmt.Errorf("step sets both when and if, use one of them")
+	}
+	if ifCondition != "" {
+		return ifCondition, nil
+	}
+	return when, nil
+}
+
+// UnmarshalYAML accepts `if` as another name for `when`
+func (s *YAMLStep) UnmarshalYAML(node *yaml.Node) error {
+	type plain YAMLStep
+	var step struct {
+		plain `yaml:",inline"`
+		If    string `yaml:"if"`
+	}
+	if err := node.Decode(&step); err != nil {
+		return err
+	}
+	when, err := whenOrIf(step.When, step.If)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	*s = YAMLStep(step.plain)
+	s.When = when
+	return nil
+}
+
+// UnmarshalJSON accepts `if` as another name for `when`
+func (s *YAMLStep) UnmarshalJSON(data []byte) error {
+	type plain YAMLStep
+	var step struct {
+		plain
+		If string `json:"if"`
+	}
+	if err := json.Unmarshal(data, &step); err != nil {
+		return err
+	}
+	when, err := whenOrIf(step.When, step.If)
+	if err != nil {
+		return err
+	}
+	*s = YAMLStep(step.plain)
+	s.When = when
+	return nil
+}
+
+// Code returns the command of the step, or its script
+func (s YAMLStep) Code() string {
+	if s.Script != "" {
+		return s.Script
+	}
+	return s.Command
+}
+
+// Pre-check severities
+const (
+	SeverityError = "error" // A failed pre-check stops the run
+	SeverityWarn  = "warn"  // A failed pre-check is reported as a warning
+)
+
 // YAMLConfig represents configuration for a YAML workflow
 type YAMLConfig struct {
 	Variables      map[string]interface{} `yaml:"variables,omitempty" json:"variables,omitempty"`
@@ -26,6 +117,8 @@ type YAMLConfig struct {
 	StoreLogs      bool                   `yaml:"store_logs,omitempty" json:"store_logs,omitempty"`
 	Background     bool                   `yaml:"background,omitempty" json:"background,omitempty"`
 	Global         bool                   `yaml:"global,omitempty" json:"global,omitempty"`
+	// ExportVariables adds resolved variables to the environment of commands
+	ExportVariables VariableExports `yaml:"export_variables,omitempty" json:"export_variables,omitempty"`
 }
 
 // ProjectConfig represents the structure of migraine.yml or migraine.json
@@ -35,9 +128,78 @@ type ProjectConfig struct {
 	PreChecks   []YAMLStep          `yaml:"pre_checks,omitempty" json:"pre_checks,omitempty"`
 	Steps       []YAMLStep          `yaml:"steps" json:"steps"`
 	Actions     map[string]YAMLStep `yaml:"actions,omitempty" json:"actions,omitempty"`
+	OnSuccess   []YAMLStep          `yaml:"on_success,omitempty" json:"on_success,omitempty"`
+	OnFailure   []YAMLStep          `yaml:"on_failure,omitempty" json:"on_failure,omitempty"`
+	Finally     []YAMLStep          `yaml:"finally,omitempty" json:"finally,omitempty"`
+	Dir         string              `yaml:"dir,omitempty" json:"dir,omitempty"`
+	Env         map[string]string   `yaml:"env,omitempty" json:"env,omitempty"`
+	Shell       string              `yaml:"shell,omitempty" json:"shell,omitempty"`
 	Config      YAMLConfig          `yaml:"config,omitempty" json:"config,omitempty"`
 	UseVault    bool                `yaml:"use_vault,omitempty" json:"use_vault,omitempty"`
 	EnvFile     string              `yaml:"env_file,omitempty" json:"env_file,omitempty"`
+	// ProjectID names the project of the directory in the vault, instead of
+	// its git root (see ProjectID)
+	ProjectID string `yaml:"project_id,omitempty" json:"project_id,omitempty"`
+}
+
+// projectConfigFiles are the files that may set the project_id of a directory
+var projectConfigFiles = []string{"migraine.yml", "migraine.yaml", "migraine.json"}
+
+// ProjectID returns the identity of the project containing dir, which keys
+// its project-scoped vault variables: the project_id set in the migraine.yml,
+// migraine.yaml or migraine.json of dir or a parent, up to the git root;
+// otherwise the path of the git root; otherwise dir itself.
+func ProjectID(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the project of %s: %v", dir, err)
+	}
+
+	for current := dir; ; {
+		for _, name := range projectConfigFiles {
+			id, err := readProjectID(filepath.Join(current, name))
+			if err != nil {
+				return "", err
+			}
+			if id != "" {
+				return id, nil
+			}
+		}
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil {
+			return current, nil
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return dir, nil
+		}
+		current = parent
+	}
+}
+
+// readProjectID returns the project_id of a project config file, or an
+// empty string when the file does not exist or sets none
+func readProjectID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var config struct {
+		ProjectID string `yaml:"project_id" json:"project_id"`
+	}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the project_id of %s: %v", path, err)
+	}
+	return strings.TrimSpace(config.ProjectID), nil
 }
 
 // LoadProjectWorkflow loads a workflow from migraine.yml or migraine.json in the current directory
@@ -85,6 +247,12 @@ func loadProjectWorkflowFromYAML(filePath string) (*YAMLWorkflow, error) {
 		PreChecks:   config.PreChecks,
 		Steps:       config.Steps,
 		Actions:     config.Actions,
+		OnSuccess:   config.OnSuccess,
+		OnFailure:   config.OnFailure,
+		Finally:     config.Finally,
+		Dir:         config.Dir,
+		Env:         config.Env,
+		Shell:       config.Shell,
 		Config:      config.Config,
 		UseVault:    config.UseVault,
 		Path:        filePath,
@@ -112,6 +280,12 @@ func loadProjectWorkflowFromJSON(filePath string) (*YAMLWorkflow, error) {
 		PreChecks:   config.PreChecks,
 		Steps:       config.Steps,
 		Actions:     config.Actions,
+		OnSuccess:   config.OnSuccess,
+		OnFailure:   config.OnFailure,
+		Finally:     config.Finally,
+		Dir:         config.Dir,
+		Env:         config.Env,
+		Shell:       config.Shell,
 		Config:      config.Config,
 		UseVault:    config.UseVault,
 		Path:        filePath,
@@ -156,6 +330,12 @@ func UpsertProjectWorkflowToDB(wf *YAMLWorkflow, storage *sqlite.StorageService)
 		PreChecks:   wf.PreChecks,
 		Steps:       wf.Steps,
 		Actions:     wf.Actions,
+		OnSuccess:   wf.OnSuccess,
+		OnFailure:   wf.OnFailure,
+		Finally:     wf.Finally,
+		Dir:         wf.Dir,
+		Env:         wf.Env,
+		Shell:       wf.Shell,
 		Config:      wf.Config,
 		UseVault:    wf.UseVault,
 	}
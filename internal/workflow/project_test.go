@@ -0,0 +1,89 @@
+package workflow
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestYAMLStep_IfAlias(t *testing.T) {
+	var project ProjectConfig
+	content := "name: deploy\nsteps:\n  - command: make\n    if: \"{{env}} == 'prod'\"\n    timeout: 5m\n  - command: make test\n    when: previous.succeeded\n"
+	if err := yaml.Unmarshal([]byte(content), &project); err != nil {
+		t.Fatalf("failed to unmarshal YAML: %v", err)
+	}
+	if step := project.Steps[0]; step.When != "{{env}} == 'prod'" || step.Command != "make" || step.Timeout != "5m" {
+		t.Errorf("expected if to set the condition, got %+v", step)
+	}
+	if project.Steps[1].When != "previous.succeeded" {
+		t.Errorf("expected when to be kept, got %q", project.Steps[1].When)
+	}
+
+	var step YAMLStep
+	if err := json.Unmarshal([]byte(`{"command": "make", "if": "exists('go.mod')"}`), &step); err != nil || step.When != "exists('go.mod')" {
+		t.Errorf("expected if to set the condition, got %+v (%v)", step, err)
+	}
+
+	err := yaml.Unmarshal([]byte("command: make\nwhen: 'true'\nif: 'false'\n"), &step)
+	if err == nil || !strings.Contains(err.Error(), "line 1: step sets both when and if") {
+		t.Errorf("expected a step with when and if to be rejected, got %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"when": "true", "if": "false"}`), &step); err == nil {
+		t.Error("expected a step with when and if to be rejected")
+	}
+}
+
+func TestProjectID(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "api")
+	for _, dir := range []string{filepath.Join(repo, ".git"), filepath.Join(repo, "services", "billing"), filepath.Join(root, "scratch")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The git root, from anywhere in the repository
+	for _, dir := range []string{repo, filepath.Join(repo, "services", "billing")} {
+		if id, err := ProjectID(dir); err != nil || id != repo {
+			t.Errorf("%s: expected the git root %s, got %q (%v)", dir, repo, id, err)
+		}
+	}
+
+	// Without git, the directory itself
+	scratch := filepath.Join(root, "scratch")
+	if id, err := ProjectID(scratch); err != nil || id != scratch {
+		t.Errorf("expected %s, got %q (%v)", scratch, id, err)
+	}
+
+	// A project_id in a config file takes precedence, in the directory or a parent
+	if err := os.WriteFile(filepath.Join(repo, "migraine.yaml"), []byte("name: deploy\nproject_id: acme-api\nsteps: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "services", "billing", "migraine.json"), []byte(`{"name": "bill", "project_id": "acme-billing"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]string{repo: "acme-api", filepath.Join(repo, "services"): "acme-api", filepath.Join(repo, "services", "billing"): "acme-billing"} {
+		if id, err := ProjectID(dir); err != nil || id != want {
+			t.Errorf("%s: expected %q, got %q (%v)", dir, want, id, err)
+		}
+	}
+
+	// A config file without project_id is skipped
+	if err := os.WriteFile(filepath.Join(repo, "services", "billing", "migraine.json"), []byte(`{"name": "bill"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := ProjectID(filepath.Join(repo, "services", "billing")); id != "acme-api" {
+		t.Errorf("expected the project_id of the parent, got %q", id)
+	}
+
+	if err := os.WriteFile(filepath.Join(repo, "migraine.yaml"), []byte("project_id: [acme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProjectID(repo); err == nil || !strings.Contains(err.Error(), "migraine.yaml") {
+		t.Errorf("expected an invalid config file to be reported, got %v", err)
+	}
+}
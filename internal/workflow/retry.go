@@ -0,0 +1,92 @@
+package workflow
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff strategies between step retries
+const (
+	BackoffConstant    = "constant"
+	BackoffExponential = "exponential"
+)
+
+const (
+	// DefaultRetryDelay is the delay before a retry when a step sets retries but no retry_delay
+	DefaultRetryDelay = time.Second
+	// MaxRetryDelay caps the delay computed by exponential backoff
+	MaxRetryDelay = 5 * time.Minute
+)
+
+// RetryPolicy describes how often a failed step is retried and how long to
+// wait between attempts
+type RetryPolicy struct {
+	Retries int           // Attempts after the first one
+	Delay   time.Duration // Delay before the first retry
+	Backoff string        // BackoffConstant or BackoffExponential
+	Jitter  bool          // Randomize each delay between half and all of its value
+}
+
+// NewRetryPolicy validates retry settings and fills in defaults
+func NewRetryPolicy(retries int, delay time.Duration, backoff string, jitter bool) (RetryPolicy, error) {
+	if retries < 0 {
+		return RetryPolicy{}, fmt.Errorf("retries must not be negative, got %d", retries)
+	}
+	if err := validateBackoff(backoff); err != nil {
+		return RetryPolicy{}, err
+	}
+
+	if backoff == "" {
+		backoff = BackoffConstant
+	}
+	if delay == 0 && retries > 0 {
+		delay = DefaultRetryDelay
+	}
+
+	return RetryPolicy{
+		Retries: retries,
+		Delay:   delay,
+		Backoff: backoff,
+		Jitter:  jitter,
+	}, nil
+}
+
+// Attempts returns the total number of times the step may run
+func (p RetryPolicy) Attempts() int {
+	return p.Retries + 1
+}
+
+// DelayBefore returns how long to wait before the given attempt (2 for the
+// first retry). Exponential backoff doubles the delay on every retry.
+func (p RetryPolicy) DelayBefore(attempt int) time.Duration {
+	if attempt < 2 {
+		return 0
+	}
+
+	delay := p.Delay
+	if p.Backoff == BackoffExponential {
+		for i := 2; i < attempt && delay < MaxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > MaxRetryDelay {
+			delay = MaxRetryDelay
+		}
+	}
+
+	if p.Jitter && delay > 0 {
+		half := delay / 2
+		delay = half + time.Duration(rand.Int64N(int64(delay-half)+1))
+	}
+
+	return delay
+}
+
+func validateBackoff(backoff string) error {
+	switch backoff {
+	case "", BackoffConstant, BackoffExponential:
+		return nil
+	default:
+		return fmt.Errorf("unknown backoff %q (must be %q or %q)", backoff, BackoffConstant, BackoffExponential)
+	}
+}
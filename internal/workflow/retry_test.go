@@ -0,0 +1,75 @@
+package workflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRetryPolicy_Defaults(t *testing.T) {
+	p, err := NewRetryPolicy(3, 0, "", false)
+	if err != nil {
+		t.Fatalf("NewRetryPolicy failed: %v", err)
+	}
+	if p.Attempts() != 4 {
+		t.Errorf("expected 4 attempts, got %d", p.Attempts())
+	}
+	if p.Delay != DefaultRetryDelay {
+		t.Errorf("expected default delay %s, got %s", DefaultRetryDelay, p.Delay)
+	}
+	if p.Backoff != BackoffConstant {
+		t.Errorf("expected constant backoff, got %q", p.Backoff)
+	}
+
+	p, err = NewRetryPolicy(0, 0, "", false)
+	if err != nil {
+		t.Fatalf("NewRetryPolicy failed: %v", err)
+	}
+	if p.Attempts() != 1 || p.Delay != 0 {
+		t.Errorf("expected a single attempt without delay, got %+v", p)
+	}
+}
+
+func TestNewRetryPolicy_Invalid(t *testing.T) {
+	if _, err := NewRetryPolicy(-1, 0, "", false); err == nil {
+		t.Error("expected an error for negative retries")
+	}
+	if _, err := NewRetryPolicy(2, time.Second, "linear", false); err == nil {
+		t.Error("expected an error for an unknown backoff")
+	}
+}
+
+func TestRetryPolicy_DelayBefore(t *testing.T) {
+	constant := RetryPolicy{Retries: 3, Delay: 2 * time.Second, Backoff: BackoffConstant}
+	exponential := RetryPolicy{Retries: 12, Delay: 2 * time.Second, Backoff: BackoffExponential}
+
+	tests := []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{constant, 1, 0},
+		{constant, 2, 2 * time.Second},
+		{constant, 4, 2 * time.Second},
+		{exponential, 2, 2 * time.Second},
+		{exponential, 3, 4 * time.Second},
+		{exponential, 5, 16 * time.Second},
+		{exponential, 12, MaxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.DelayBefore(tt.attempt); got != tt.want {
+			t.Errorf("%s DelayBefore(%d) = %s, want %s", tt.policy.Backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Jitter(t *testing.T) {
+	p := RetryPolicy{Retries: 5, Delay: 4 * time.Second, Backoff: BackoffExponential, Jitter: true}
+
+	for i := 0; i < 100; i++ {
+		got := p.DelayBefore(3)
+		if got < 4*time.Second || got > 8*time.Second {
+			t.Fatalf("jittered delay %s outside [4s, 8s]", got)
+		}
+	}
+}
@@ -82,7 +82,10 @@ config:
   # These will be prompted for when running the workflow if not provided
   variables:
     # project_name:
-    #   - "slugify"  # Apply slugify transformation to the variable value
+    #   type: string              # string, int, bool, enum, path or url
+    #   pattern: "[a-z0-9-]+"     # The whole value must match
+    #   required: true            # Fail before any step runs when missing
+    #   description: "Name of the project"
   # Whether to store variables in the workflow (true) or prompt for them each time (false)
   store_variables: false
 
@@ -223,7 +226,10 @@ config:
   # Variables that can be used in the workflow
   variables:
     environment:
-      - "required"  # This variable is required
+      type: enum
+      values: ["staging", "production"]
+      required: true  # This variable is required
+      description: "Environment to deploy to"
   # Whether to store variables in the workflow or prompt for them
   store_variables: false
 
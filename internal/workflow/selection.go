@@ -0,0 +1,137 @@
+package workflow
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StepSelection picks the steps of a run by name, tag or position. The zero
+// value selects every step.
+type StepSelection struct {
+	Only  []string // Names or ids of the steps to run
+	Skip  []string // Names or ids of the steps not to run
+	Tags  []string // Run the steps with any of these tags
+	Steps string   // Positions of the steps to run, e.g. "2-4" or "1,3,5-6"
+}
+
+// IsZero reports whether the selection keeps every step
+func (s StepSelection) IsZero() bool {
+	return len(s.Only) == 0 && len(s.Skip) == 0 && len(s.Tags) == 0 && s.Steps == ""
+}
+
+// String describes the selection the way it is given on the command line,
+// e.g. "--only build,test --skip lint"
+func (s StepSelection) String() string {
+	var parts []string
+	if len(s.Only) > 0 {
+		parts = append(parts, "--only "+strings.Join(s.Only, ","))
+	}
+	if len(s.Tags) > 0 {
+		parts = append(parts, "--tags "+strings.Join(s.Tags, ","))
+	}
+	if s.Steps != "" {
+		parts = append(parts, "--steps "+s.Steps)
+	}
+	if len(s.Skip) > 0 {
+		parts = append(parts, "--skip "+strings.Join(s.Skip, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Select reports which of steps the selection keeps. Steps matching Only,
+// Tags or Steps are kept, or every step when none of them is set; steps
+// matching Skip are then left out. Names, tags and positions that match no
+// step are errors, so that a typo does not silently run nothing.
+func (s StepSelection) Select(steps []YAMLStep) ([]bool, error) {
+	selected := make([]bool, len(steps))
+	if len(s.Only) == 0 && len(s.Tags) == 0 && s.Steps == "" {
+		for i := range selected {
+			selected[i] = true
+		}
+	}
+
+	for _, name := range s.Only {
+		if err := markSteps(steps, selected, true, "step", name, stepHasName); err != nil {
+			return nil, err
+		}
+	}
+	for _, tag := range s.Tags {
+		if err := markSteps(steps, selected, true, "tag", tag, stepHasTag); err != nil {
+			return nil, err
+		}
+	}
+	if s.Steps != "" {
+		positions, err := parseStepRanges(s.Steps, len(steps))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range positions {
+			selected[i] = true
+		}
+	}
+	for _, name := range s.Skip {
+		if err := markSteps(steps, selected, false, "step", name, stepHasName); err != nil {
+			return nil, err
+		}
+	}
+
+	return selected, nil
+}
+
+// markSteps sets selected to value for every step matching value, failing
+// when none does
+func markSteps(steps []YAMLStep, selected []bool, value bool, kind, match string, matches func(YAMLStep, string) bool) error {
+	found := false
+	for i, step := range steps {
+		if matches(step, match) {
+			selected[i] = value
+			found = true
+		}
+	}
+	if !found {
+		if kind == "tag" {
+			return fmt.Errorf("no step has tag %q", match)
+		}
+		return fmt.Errorf("no step is named %q", match)
+	}
+	return nil
+}
+
+func stepHasName(step YAMLStep, name string) bool {
+	return step.Name == name || step.ID == name
+}
+
+func stepHasTag(step YAMLStep, tag string) bool {
+	return slices.Contains(step.Tags, tag)
+}
+
+// parseStepRanges parses 1-based positions and ranges such as "1,3,5-6" and
+// returns the matching 0-based step indexes
+func parseStepRanges(spec string, count int) ([]int, error) {
+	var indexes []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid step range %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("invalid step range %q", part)
+			}
+		}
+
+		if first < 1 || last < first || last > count {
+			return nil, fmt.Errorf("invalid step range %q: the workflow has %d steps", part, count)
+		}
+		for i := first; i <= last; i++ {
+			indexes = append(indexes, i-1)
+		}
+	}
+	return indexes, nil
+}
@@ -0,0 +1,75 @@
+package workflow
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStepSelection_Select(t *testing.T) {
+	steps := []YAMLStep{
+		{Name: "lint", Tags: []string{"fast"}},
+		{ID: "build"},
+		{Name: "test", Tags: []string{"fast", "unit"}},
+		{Name: "deploy"},
+	}
+
+	tests := []struct {
+		name      string
+		selection StepSelection
+		want      []bool
+	}{
+		{"zero", StepSelection{}, []bool{true, true, true, true}},
+		{"only names and ids", StepSelection{Only: []string{"build", "test"}}, []bool{false, true, true, false}},
+		{"skip", StepSelection{Skip: []string{"lint"}}, []bool{false, true, true, true}},
+		{"tags", StepSelection{Tags: []string{"fast"}}, []bool{true, false, true, false}},
+		{"tags and skip", StepSelection{Tags: []string{"fast"}, Skip: []string{"lint"}}, []bool{false, false, true, false}},
+		{"ranges", StepSelection{Steps: "1,3-4"}, []bool{true, false, true, true}},
+		{"only and ranges add up", StepSelection{Only: []string{"lint"}, Steps: "4"}, []bool{true, false, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selection.Select(steps)
+			if err != nil {
+				t.Fatalf("Select failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStepSelection_SelectErrors(t *testing.T) {
+	steps := []YAMLStep{{Name: "lint"}, {Name: "test", Tags: []string{"unit"}}}
+
+	tests := []struct {
+		selection StepSelection
+		want      string
+	}{
+		{StepSelection{Only: []string{"build"}}, `no step is named "build"`},
+		{StepSelection{Skip: []string{"deploy"}}, `no step is named "deploy"`},
+		{StepSelection{Tags: []string{"slow"}}, `no step has tag "slow"`},
+		{StepSelection{Steps: "2-3"}, `invalid step range "2-3": the workflow has 2 steps`},
+		{StepSelection{Steps: "2-1"}, `invalid step range "2-1"`},
+		{StepSelection{Steps: "first"}, `invalid step range "first"`},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.selection.Select(steps)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: expected error %q, got %v", tt.selection, tt.want, err)
+		}
+	}
+}
+
+func TestStepSelection_String(t *testing.T) {
+	s := StepSelection{Only: []string{"build", "test"}, Skip: []string{"lint"}, Steps: "2-4"}
+	if got, want := s.String(), "--only build,test --steps 2-4 --skip lint"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if !(StepSelection{}).IsZero() || s.IsZero() {
+		t.Error("IsZero should only be true for the zero value")
+	}
+}
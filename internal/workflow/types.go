@@ -1,29 +1,54 @@
 package workflow
 
 type Atom struct {
-	Command     string  `json:"command"`
-	Description *string `json:"description"`
-	OnFail      string  `json:"on_fail,omitempty"`
-	OnSuccess   string  `json:"on_success,omitempty"`
+	ID           string                `json:"id,omitempty"`
+	Name         string                `json:"name,omitempty"`
+	Tags         []string              `json:"tags,omitempty"`
+	Needs        []string              `json:"needs,omitempty"`
+	Command      string                `json:"command"`
+	Script       string                `json:"script,omitempty"`
+	Description  *string               `json:"description"`
+	OnFail       string                `json:"on_fail,omitempty"`
+	OnSuccess    string                `json:"on_success,omitempty"`
+	Timeout      Duration              `json:"timeout,omitempty"`
+	Retries      int                   `json:"retries,omitempty"`
+	RetryDelay   Duration              `json:"retry_delay,omitempty"`
+	Backoff      string                `json:"backoff,omitempty"`
+	Jitter       bool                  `json:"jitter,omitempty"`
+	When         string                `json:"when,omitempty"`
+	AllowFailure bool                  `json:"allow_failure,omitempty"`
+	Severity     string                `json:"severity,omitempty"`
+	Dir          string                `json:"dir,omitempty"`
+	Env          map[string]string     `json:"env,omitempty"`
+	Outputs      map[string]StepOutput `json:"outputs,omitempty"`
+	Shell        string                `json:"shell,omitempty"`
+	Sudo         bool                  `json:"sudo,omitempty"`
 }
 
 type Config struct {
-	Variables      map[string]interface{} `json:"variables"`
-	StoreVariables bool                   `json:"store_variables"`
-	StoreLogs      bool                   `json:"store_logs"`
-	Background     bool                   `json:"background"`
-	Global         bool                   `json:"global"`
+	Variables       map[string]interface{} `json:"variables"`
+	StoreVariables  bool                   `json:"store_variables"`
+	StoreLogs       bool                   `json:"store_logs"`
+	Background      bool                   `json:"background"`
+	Global          bool                   `json:"global"`
+	ExportVariables VariableExports        `json:"export_variables,omitempty"`
 }
 
 type Workflow struct {
-	ID          string          `json:"id"`
-	Name        string          `json:"name"`
-	PreChecks   []Atom          `json:"pre_checks"`
-	Steps       []Atom          `json:"steps"`
-	Description *string         `json:"description"`
-	Actions     map[string]Atom `json:"actions"`
-	Config      Config          `json:"config"`
-	UsesSudo    bool            `json:"uses_sudo"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	PreChecks   []Atom            `json:"pre_checks"`
+	Steps       []Atom            `json:"steps"`
+	Description *string           `json:"description"`
+	Actions     map[string]Atom   `json:"actions"`
+	OnSuccess   []Atom            `json:"on_success,omitempty"`
+	OnFailure   []Atom            `json:"on_failure,omitempty"`
+	Finally     []Atom            `json:"finally,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Shell       string            `json:"shell,omitempty"`
+	Config      Config            `json:"config"`
+	UsesSudo    bool              `json:"uses_sudo"`
 }
 
 type WorkflowMapper struct {
@@ -0,0 +1,207 @@
+package workflow
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tesh254/migraine/pkg/utils"
+)
+
+// ValidateYAMLWorkflow checks the variable declarations, the step settings
+// and the step dependency graph of a workflow, which can be verified before
+// it runs. Values containing {{variables}} are only checked once they are
+// resolved at run time.
+func ValidateYAMLWorkflow(wf *YAMLWorkflow) error {
+	var problems []string
+	if err := validateEnv(wf.Env); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if wf.Shell != "" && strings.TrimSpace(wf.Shell) == "" {
+		problems = append(problems, "shell must not be blank")
+	}
+	names := make([]string, 0, len(wf.Config.Variables))
+	for name := range wf.Config.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := ParseVariableDeclaration(name, wf.Config.Variables[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("variable %s: %v", name, err))
+		}
+	}
+	for _, name := range wf.Config.ExportVariables.Names {
+		if !ValidEnvName(name) {
+			problems = append(problems, fmt.Sprintf("export_variables: invalid env variable name %q", name))
+		}
+	}
+
+	graph, err := NewStepGraph(wf.Steps)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// Only steps can be conditional, allowed to fail or have outputs, and
+	// only pre-checks have a severity. index is the position of steps in
+	// wf.Steps.
+	check := func(label string, step YAMLStep, kind string, index int) {
+		err := validateStep(step)
+		if err == nil && step.When != "" && kind != "step" {
+			err = fmt.Errorf("when is only supported on steps")
+		}
+		if err == nil && step.AllowFailure && kind != "step" {
+			err = fmt.Errorf("allow_failure is only supported on steps")
+		}
+		if err == nil && step.Severity != "" && kind != "pre-check" {
+			err = fmt.Errorf("severity is only supported on pre-checks")
+		}
+		if err == nil && len(step.Outputs) > 0 && kind != "step" {
+			err = fmt.Errorf("outputs are only supported on steps")
+		}
+		if err == nil && len(step.Outputs) > 0 && step.ID == "" {
+			err = fmt.Errorf("outputs require an id, which later steps use to read them")
+		}
+		if err == nil {
+			err = validateOutputReferences(wf, step, kind, graph, index)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", label, err))
+		}
+	}
+
+	for i, step := range wf.PreChecks {
+		check(fmt.Sprintf("pre-check %d", i+1), step, "pre-check", -1)
+	}
+	for i, step := range wf.Steps {
+		check(fmt.Sprintf("step %d", i+1), step, "step", i)
+	}
+
+	for _, block := range []struct {
+		name  string
+		steps []YAMLStep
+	}{{"on_success", wf.OnSuccess}, {"on_failure", wf.OnFailure}, {"finally", wf.Finally}} {
+		for i, step := range block.steps {
+			check(fmt.Sprintf("%s %d", block.name, i+1), step, "hook", -1)
+		}
+	}
+
+	names = make([]string, 0, len(wf.Actions))
+	for name := range wf.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check(fmt.Sprintf("action %s", name), wf.Actions[name], "action", -1)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid workflow:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateStep(step YAMLStep) error {
+	if step.Command != "" && step.Script != "" {
+		return fmt.Errorf("command and script cannot be combined")
+	}
+	if strings.TrimSpace(step.Code()) == "" {
+		return fmt.Errorf("command or script is required")
+	}
+	if step.Shell != "" && strings.TrimSpace(step.Shell) == "" {
+		return fmt.Errorf("shell must not be blank")
+	}
+	if err := validateDuration("timeout", step.Timeout); err != nil {
+		return err
+	}
+	if err := validateDuration("retry_delay", step.RetryDelay); err != nil {
+		return err
+	}
+	if step.When != "" {
+		if _, err := ParseCondition(step.When); err != nil {
+			return fmt.Errorf("invalid when: %v", err)
+		}
+	}
+	switch step.Severity {
+	case "", SeverityError, SeverityWarn:
+	default:
+		return fmt.Errorf("invalid severity %q (must be %s or %s)", step.Severity, SeverityError, SeverityWarn)
+	}
+	if step.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", step.Retries)
+	}
+	if err := validateEnv(step.Env); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(step.Outputs))
+	for name := range step.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validOutputName(name) {
+			return fmt.Errorf("invalid output name %q", name)
+		}
+		if err := step.Outputs[name].Validate(); err != nil {
+			return fmt.Errorf("output %s: %v", name, err)
+		}
+	}
+	return validateBackoff(step.Backoff)
+}
+
+// validateOutputReferences checks that the {{steps.<id>.outputs.<name>}}
+// variables used by step name declared outputs. Steps can only read the
+// outputs of steps that run before them and pre-checks of none. graph is nil
+// when the step dependencies are invalid.
+func validateOutputReferences(wf *YAMLWorkflow, step YAMLStep, kind string, graph *StepGraph, index int) error {
+	texts := []string{step.Command, step.Script, step.When, step.Dir, string(step.Timeout), string(step.RetryDelay), step.OnFail, step.OnSuccess}
+	for _, value := range step.Env {
+		texts = append(texts, value)
+	}
+
+	for _, variable := range utils.ExtractTemplateVars(strings.Join(texts, "\n")) {
+		stepID, name, ok := ParseOutputVariable(variable)
+		if !ok {
+			continue
+		}
+		if kind == "pre-check" {
+			return fmt.Errorf("pre-checks run before steps and cannot use {{%s}}", variable)
+		}
+
+		j := slices.IndexFunc(wf.Steps, func(s YAMLStep) bool { return s.ID == stepID })
+		switch {
+		case j < 0:
+			return fmt.Errorf("{{%s}} refers to unknown step %q", variable, stepID)
+		case !hasOutput(wf.Steps[j], name):
+			return fmt.Errorf("{{%s}}: step %q has no output %q", variable, stepID, name)
+		case kind == "step" && graph != nil && !graph.RunsBefore(j, index):
+			return fmt.Errorf("{{%s}}: step %q does not run before this step, add it to needs", variable, stepID)
+		}
+	}
+	return nil
+}
+
+func hasOutput(step YAMLStep, name string) bool {
+	_, ok := step.Outputs[name]
+	return ok
+}
+
+// validateEnv checks that env only sets valid environment variable names
+func validateEnv(env map[string]string) error {
+	for name := range env {
+		if !ValidEnvName(name) {
+			return fmt.Errorf("invalid env variable name %q", name)
+		}
+	}
+	return nil
+}
+
+func validateDuration(field string, value Duration) error {
+	if strings.Contains(string(value), "{{") {
+		return nil
+	}
+	if _, err := ParseDuration(string(value)); err != nil {
+		return fmt.Errorf("invalid %s: %v", field, err)
+	}
+	return nil
+}
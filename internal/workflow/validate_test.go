@@ -0,0 +1,122 @@
+package workflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateYAMLWorkflow_Valid(t *testing.T) {
+	wf := &YAMLWorkflow{
+		Name:      "valid",
+		PreChecks: []YAMLStep{{Command: "docker info", Severity: SeverityWarn}},
+		Steps: []YAMLStep{
+			{Command: "docker push app", Timeout: "10m", Retries: 3, RetryDelay: "2s", Backoff: BackoffExponential, Jitter: true},
+			{Command: "make build", Timeout: "{{build_timeout}}", When: "{{env}} == 'prod' && exists('Makefile')"},
+			{Command: "make lint", AllowFailure: true},
+			{Command: "go test ./...", Dir: "services/{{service}}", Env: map[string]string{"GOFLAGS": "-mod=mod"}},
+			{Script: "set -e\nmake release", Shell: "bash -eu"},
+		},
+		Actions: map[string]YAMLStep{
+			"notify": {Command: "curl example.com", Retries: 2},
+		},
+	}
+
+	if err := ValidateYAMLWorkflow(wf); err != nil {
+		t.Errorf("expected workflow to be valid, got %v", err)
+	}
+}
+
+func TestValidateYAMLWorkflow_Invalid(t *testing.T) {
+	wf := &YAMLWorkflow{
+		Name: "invalid",
+		PreChecks: []YAMLStep{
+			{Command: ""},
+			{Command: "docker info", Severity: "fatal"},
+			{Command: "docker info", AllowFailure: true},
+		},
+		Steps: []YAMLStep{
+			{Command: "echo ok", Retries: -1},
+			{Command: "echo ok", Backoff: "linear"},
+			{Command: "echo ok", RetryDelay: "soon"},
+			{Command: "echo ok", Needs: []string{"missing"}},
+			{Command: "echo ok", When: "{{env}} = 'prod'"},
+			{Command: "echo ok", Severity: SeverityWarn},
+			{Command: "echo ok", Env: map[string]string{"BAD NAME": "x"}},
+			{Command: "echo ok", Script: "echo ok"},
+			{Command: "echo ok", Shell: "  "},
+		},
+		Actions: map[string]YAMLStep{
+			"notify": {Command: "curl example.com", When: "previous.failed"},
+		},
+		OnFailure: []YAMLStep{{Command: "curl example.com", AllowFailure: true}},
+		Finally:   []YAMLStep{{Command: ""}},
+		Config: YAMLConfig{Variables: map[string]interface{}{
+			"port": map[string]interface{}{"type": "integer"},
+		}},
+	}
+
+	err := ValidateYAMLWorkflow(wf)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+
+	for _, want := range []string{"pre-check 1: command or script is required", "step 1: retries", "step 2: unknown backoff", "step 3: invalid retry_delay", `step 4: needs unknown step "missing"`, "step 5: invalid when", "action notify: when is only supported on steps",
+		`pre-check 2: invalid severity "fatal"`, "pre-check 3: allow_failure is only supported on steps", "step 6: severity is only supported on pre-checks",
+		"on_failure 1: allow_failure is only supported on steps", "finally 1: command or script is required",
+		`step 7: invalid env variable name "BAD NAME"`, "step 8: command and script cannot be combined", "step 9: shell must not be blank",
+		`variable port: unknown type "integer"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateYAMLWorkflow_Outputs(t *testing.T) {
+	valid := &YAMLWorkflow{
+		Name: "outputs",
+		Steps: []YAMLStep{
+			{ID: "build", Command: "make image", Outputs: map[string]StepOutput{
+				"tag":  {From: OutputFromLastLine},
+				"sha":  {JSON: ".image.sha"},
+				"port": {From: OutputFromFile, Regex: `(\d+)`},
+			}},
+			{Command: "docker push app:{{steps.build.outputs.tag}}", When: "{{steps.build.outputs.sha}} != ''"},
+		},
+		Finally: []YAMLStep{{Command: "echo {{steps.build.outputs.port}}"}},
+	}
+	if err := ValidateYAMLWorkflow(valid); err != nil {
+		t.Errorf("expected workflow to be valid, got %v", err)
+	}
+
+	invalid := &YAMLWorkflow{
+		Name:      "outputs",
+		PreChecks: []YAMLStep{{Command: "echo {{steps.build.outputs.tag}}"}},
+		Steps: []YAMLStep{
+			{Command: "echo {{steps.deploy.outputs.url}}"},
+			{ID: "build", Command: "make", Outputs: map[string]StepOutput{"tag": {From: "stderr"}}},
+			{Command: "make", Outputs: map[string]StepOutput{"tag": {}}},
+			{ID: "lint", Command: "make lint", Outputs: map[string]StepOutput{"report": {JSON: ".a", Regex: "b"}}},
+			{ID: "test", Command: "make test", Outputs: map[string]StepOutput{"bad.name": {}}},
+			{ID: "deploy", Command: "echo {{steps.build.outputs.url}}", Needs: []string{"lint"}, Outputs: map[string]StepOutput{"url": {}}},
+		},
+		Actions: map[string]YAMLStep{"notify": {Command: "echo", Outputs: map[string]StepOutput{"id": {}}}},
+	}
+	err := ValidateYAMLWorkflow(invalid)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"pre-check 1: pre-checks run before steps",
+		"step 1: {{steps.deploy.outputs.url}}: step \"deploy\" does not run before this step",
+		`step 2: output tag: invalid from "stderr"`,
+		"step 3: outputs require an id",
+		"step 4: output report: json and regex cannot be combined",
+		`step 5: invalid output name "bad.name"`,
+		`step 6: {{steps.build.outputs.url}}: step "build" has no output "url"`,
+		"action notify: outputs are only supported on steps",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got:\n%v", want, err)
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 // VariableResolver handles variable resolution for workflows
 type VariableResolver struct {
 	storage *sqlite.StorageService
+	// vaultValues replaces the vault when set, see UseVaultValues
+	vaultValues map[string]string
 }
 
 func NewVariableResolver(storage *sqlite.StorageService) *VariableResolver {
@@ -20,73 +22,178 @@ func NewVariableResolver(storage *sqlite.StorageService) *VariableResolver {
 	}
 }
 
-// ResolveVariables resolves all variables for a workflow based on its configuration
+// UseVaultValues makes the resolver take the variables that come from the
+// vault from values, keyed by variable name, instead of reading the vault. A
+// background run gets them from the command that started it, since it cannot
+// ask for the vault passphrase. A nil map reads the vault again.
+func (vr *VariableResolver) UseVaultValues(values map[string]string) {
+	vr.vaultValues = values
+}
+
+// Sources reported by ResolveVariablesWithSources
+const (
+	SourceConfig = "config" // Static value in the workflow config
+	SourceFlag   = "flag"   // --var on the command line, directly or through args:
+	SourceVault  = "vault"
+)
+
+// ResolveVariables resolves all variables for a workflow based on its
+// configuration. It fails when a required variable has no value or a value
+// does not match its declaration, see VariableDeclaration.
 func (vr *VariableResolver) ResolveVariables(workflowID string, workflowUseVault bool, flags map[string]string, configVariables map[string]interface{}) (map[string]string, error) {
+	variables, sources, err := vr.ResolveVariablesWithSources(workflowID, workflowUseVault, flags, configVariables)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateVariables(configVariables, variables, sources); err != nil {
+		return nil, err
+	}
+	return variables, nil
+}
+
+// ResolveVariablesWithSources resolves variables like ResolveVariables and also
+// returns where each value came from: SourceConfig, SourceFlag, SourceVault,
+// "env:NAME" for environment variables or the path of the .env file. It does
+// not check the values against their declarations, so that missing ones can
+// be asked for first; check them with ValidateVariables.
+func (vr *VariableResolver) ResolveVariablesWithSources(workflowID string, workflowUseVault bool, flags map[string]string, configVariables map[string]interface{}) (map[string]string, map[string]string, error) {
 	variables := make(map[string]string)
+	sources := make(map[string]string)
 
-	// Process config variables first
-	for key, val := range configVariables {
+	declarations, err := ParseVariableDeclarations(configVariables)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Process config variables first. Variables declared without a default
+	// are set by a flag, the vault or a .env file.
+	for _, d := range declarations {
+		key, val := d.Name, d.Default
+		if val == nil {
+			continue
+		}
 		if s, ok := val.(string); ok {
 			if strings.HasPrefix(s, "args:") {
 				argName := strings.TrimPrefix(s, "args:")
 				if v, ok := flags[argName]; ok {
 					variables[key] = v
+					sources[key] = SourceFlag
 				}
 			} else if strings.HasPrefix(s, "env:") {
 				envName := strings.TrimPrefix(s, "env:")
 				if v := os.Getenv(envName); v != "" {
 					variables[key] = v
+					sources[key] = s
 				}
 			} else if strings.HasPrefix(s, "vault:") {
-				// Handled below if using vault, but we can also handle it here if specific key is requested
-				// For now let's assume vault variables are loaded separately
+				// A flag for the variable replaces the reference, so the
+				// vault does not need to hold it
+				if _, ok := flags[key]; ok {
+					continue
+				}
+				v, err := vr.resolveVaultReference(key, strings.TrimPrefix(s, "vault:"), workflowID)
+				if err != nil {
+					return nil, nil, err
+				}
+				variables[key] = v
+				sources[key] = SourceVault
 			} else {
 				// Static string value
 				variables[key] = s
+				sources[key] = SourceConfig
 			}
 		} else {
 			// Non-string value (e.g. bool, number), convert to string
 			variables[key] = fmt.Sprintf("%v", val)
+			sources[key] = SourceConfig
 		}
 	}
 
 	// First, use any variables provided via command line flags
 	for k, v := range flags {
 		variables[k] = v
+		sources[k] = SourceFlag
 	}
 
 	// If workflow is configured to use vault, get variables from there
 	if workflowUseVault {
-		vaultVars, err := vr.storage.VaultStore().GetAllVariablesForWorkflow(workflowID)
+		vaultVars, err := vr.workflowVaultVariables(workflowID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get variables from vault: %v", err)
+			return nil, nil, err
 		}
 
 		// Merge vault variables, but command-line flags take precedence
 		for k, v := range vaultVars {
 			if _, exists := variables[k]; !exists {
 				variables[k] = v
+				sources[k] = SourceVault
 			}
 		}
 	} else {
 		// If not using vault, fall back to environment files or prompting
-		envVars := vr.loadEnvFileVariables(workflowID)
+		envVars, path := vr.loadEnvFileVariables(workflowID)
 
 		// Merge env variables, but command-line flags and vault take precedence
 		for k, v := range envVars {
 			if _, exists := variables[k]; !exists {
 				variables[k] = v
+				sources[k] = path
 			}
 		}
 	}
 
-	return variables, nil
+	return variables, sources, nil
 }
 
-// loadEnvFileVariables loads variables from environment files
-func (vr *VariableResolver) loadEnvFileVariables(workflowID string) map[string]string {
-	variables := make(map[string]string)
+// workflowVaultVariables returns the vault variables of a workflow using the
+// vault, from the workflow, project and global scopes
+func (vr *VariableResolver) workflowVaultVariables(workflowID string) (map[string]string, error) {
+	if vr.vaultValues != nil {
+		return vr.vaultValues, nil
+	}
+	projectID, err := ProjectID(".")
+	if err != nil {
+		return nil, err
+	}
+	vaultVars, err := vr.storage.VaultStore().GetAllVariablesForWorkflow(workflowID, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get variables from vault: %v", err)
+	}
+	return vaultVars, nil
+}
 
+// resolveVaultReference looks up the vault key referenced by variable as
+// vault:KEY, falling back from workflow to project to global scope. The
+// project is that of the current directory. References are resolved whether
+// or not the workflow uses the vault.
+func (vr *VariableResolver) resolveVaultReference(variable, vaultKey, workflowID string) (string, error) {
+	if vaultKey == "" {
+		return "", fmt.Errorf("variable '%s' has an empty vault: reference", variable)
+	}
+	if vr.vaultValues != nil {
+		v, ok := vr.vaultValues[variable]
+		if !ok {
+			return "", fmt.Errorf("variable '%s' references vault:%s, which was not resolved", variable, vaultKey)
+		}
+		return v, nil
+	}
+	if vr.storage == nil {
+		return "", fmt.Errorf("variable '%s' references vault:%s but no vault is available", variable, vaultKey)
+	}
+	projectID, err := ProjectID(".")
+	if err != nil {
+		return "", err
+	}
+	entry, err := vr.storage.VaultStore().GetVariableWithFallback(vaultKey, workflowID, projectID)
+	if err != nil {
+		return "", fmt.Errorf("variable '%s' references vault:%s: %v", variable, vaultKey, err)
+	}
+	return entry.Value, nil
+}
+
+// loadEnvFileVariables loads variables from the first environment file found
+// and returns them with its path
+func (vr *VariableResolver) loadEnvFileVariables(workflowID string) (map[string]string, string) {
 	// Look for environment files in multiple locations
 	possiblePaths := []string{
 		fmt.Sprintf("./env/%s.env", workflowID),
@@ -97,17 +204,12 @@ func (vr *VariableResolver) loadEnvFileVariables(workflowID string) map[string]s
 
 	for _, path := range possiblePaths {
 		if _, err := os.Stat(path); err == nil {
-			// File exists, load it
-			envVars := vr.loadEnvFile(path)
-			for k, v := range envVars {
-				variables[k] = v
-			}
-			// Stop at the first file found
-			break
+			// File exists, load it and stop at the first file found
+			return vr.loadEnvFile(path), path
 		}
 	}
 
-	return variables
+	return map[string]string{}, ""
 }
 
 // loadEnvFile loads variables from a single .env file
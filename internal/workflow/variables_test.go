@@ -0,0 +1,235 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tesh254/migraine/internal/storage/sqlite"
+)
+
+// newTestStorage opens a database in a temporary home directory, with the
+// vault key in a key file there
+func newTestStorage(t *testing.T) *sqlite.StorageService {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(sqlite.PassphraseEnv, "")
+	t.Setenv(sqlite.KeyFileEnv, filepath.Join(home, "vault.key"))
+
+	db, err := sqlite.NewDBService("migraine")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	storage, err := sqlite.NewStorageService(db)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestResolveVariables_VaultReferences(t *testing.T) {
+	storage := newTestStorage(t)
+	if _, err := storage.GetDB().DB().Exec(`INSERT INTO workflows (id, name) VALUES ('deploy', 'deploy')`); err != nil {
+		t.Fatalf("failed to create workflow: %v", err)
+	}
+	workflowID := "deploy"
+	for _, entry := range []sqlite.VaultEntry{
+		{Key: "SLACK_WEBHOOK", Value: "https://hooks.example.com/global", Scope: "global"},
+		{Key: "DB_PASSWORD", Value: "global", Scope: "global"},
+		{Key: "DB_PASSWORD", Value: "workflow", Scope: "workflow", WorkflowID: &workflowID},
+	} {
+		if err := storage.VaultStore().CreateVariable(entry); err != nil {
+			t.Fatalf("failed to create %s: %v", entry.Key, err)
+		}
+	}
+
+	resolver := NewVariableResolver(storage)
+	config := map[string]interface{}{
+		"slack_webhook": "vault:SLACK_WEBHOOK",
+		"db_password":   "vault:DB_PASSWORD",
+	}
+
+	// References are resolved without use_vault, under their own names
+	variables, sources, err := resolver.ResolveVariablesWithSources(workflowID, false, nil, config)
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+	if variables["slack_webhook"] != "https://hooks.example.com/global" || sources["slack_webhook"] != SourceVault {
+		t.Errorf("expected the global value from the vault, got %q from %q", variables["slack_webhook"], sources["slack_webhook"])
+	}
+	if variables["db_password"] != "workflow" {
+		t.Errorf("expected the workflow scope to take precedence, got %q", variables["db_password"])
+	}
+	if _, ok := variables["SLACK_WEBHOOK"]; ok {
+		t.Error("expected only the referencing variable to be set")
+	}
+
+	// A flag replaces the reference, even when the vault does not have it
+	config["api_token"] = "vault:API_TOKEN"
+	variables, err = resolver.ResolveVariables(workflowID, false, map[string]string{"api_token": "from-flag"}, config)
+	if err != nil || variables["api_token"] != "from-flag" {
+		t.Errorf("expected the flag value, got %q (%v)", variables["api_token"], err)
+	}
+
+	_, err = resolver.ResolveVariables(workflowID, true, nil, config)
+	if err == nil {
+		t.Fatal("expected a missing vault key to fail")
+	}
+	for _, want := range []string{"api_token", "API_TOKEN", "workflow 'deploy'", "global scope"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got %v", want, err)
+		}
+	}
+}
+
+func TestResolveVariables_VaultReferenceWithoutVault(t *testing.T) {
+	resolver := NewVariableResolver(nil)
+	for ref, want := range map[string]string{
+		"vault:API_TOKEN": "no vault is available",
+		"vault:":          "empty vault: reference",
+	} {
+		_, err := resolver.ResolveVariables("deploy", false, nil, map[string]interface{}{"api_token": ref})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", ref, want, err)
+		}
+	}
+}
+
+func TestResolveVariables_VaultValues(t *testing.T) {
+	// Without storage, any read of the vault fails
+	resolver := NewVariableResolver(nil)
+	resolver.UseVaultValues(map[string]string{"api_token": "s3cr3t", "REGION": "eu-west-1"})
+	config := map[string]interface{}{"api_token": "vault:API_TOKEN"}
+
+	variables, sources, err := resolver.ResolveVariablesWithSources("deploy", true, map[string]string{"REGION": "us-east-1"}, config)
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+	if variables["api_token"] != "s3cr3t" || sources["api_token"] != SourceVault {
+		t.Errorf("expected the given vault value, got %q from %q", variables["api_token"], sources["api_token"])
+	}
+	if variables["REGION"] != "us-east-1" || sources["REGION"] != SourceFlag {
+		t.Errorf("expected the flag to take precedence, got %q from %q", variables["REGION"], sources["REGION"])
+	}
+
+	config["db_password"] = "vault:DB_PASSWORD"
+	if _, err := resolver.ResolveVariables("deploy", false, nil, config); err == nil || !strings.Contains(err.Error(), "DB_PASSWORD") {
+		t.Errorf("expected a reference without a given value to fail, got %v", err)
+	}
+}
+
+func TestResolveVariables_ProjectScope(t *testing.T) {
+	storage := newTestStorage(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "migraine.yaml"), []byte("project_id: acme-api\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	api, web := "acme-api", "acme-web"
+	for _, entry := range []sqlite.VaultEntry{
+		{Key: "DB_HOST", Value: "api-db", Scope: "project", ProjectID: &api},
+		{Key: "DB_HOST", Value: "web-db", Scope: "project", ProjectID: &web},
+		{Key: "CACHE_HOST", Value: "web-cache", Scope: "project", ProjectID: &web},
+	} {
+		if err := storage.VaultStore().CreateVariable(entry); err != nil {
+			t.Fatalf("failed to create %s: %v", entry.Key, err)
+		}
+	}
+
+	resolver := NewVariableResolver(storage)
+	variables, err := resolver.ResolveVariables("deploy", true, nil, map[string]interface{}{"db": "vault:DB_HOST"})
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+	if variables["db"] != "api-db" || variables["DB_HOST"] != "api-db" {
+		t.Errorf("expected the values of the current project, got %v", variables)
+	}
+	if _, ok := variables["CACHE_HOST"]; ok {
+		t.Error("expected the variables of other projects to be left out")
+	}
+}
+
+func TestSecretValues(t *testing.T) {
+	storage := newTestStorage(t)
+	if err := storage.VaultStore().CreateVariable(sqlite.VaultEntry{Key: "DB_PASSWORD", Value: "hunter2", Scope: "global"}); err != nil {
+		t.Fatalf("failed to create variable: %v", err)
+	}
+
+	config := map[string]interface{}{
+		"region":      "eu-west-1",
+		"db_password": map[string]interface{}{"default": "vault:DB_PASSWORD"},
+		"api_token":   map[string]interface{}{"secret": true},
+		"signing_key": map[string]string{"default": "env:SIGNING_KEY", "secret": "true"},
+		"debug":       map[string]interface{}{"default": false, "secret": false},
+	}
+	t.Setenv("SIGNING_KEY", "k3y")
+
+	variables, sources, err := NewVariableResolver(storage).ResolveVariablesWithSources("deploy", false, map[string]string{"api_token": "t0ken"}, config)
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+	if variables["db_password"] != "hunter2" || variables["signing_key"] != "k3y" || variables["debug"] != "false" {
+		t.Errorf("expected the defaults of the declarations, got %v", variables)
+	}
+
+	secrets := SecretValues(variables, sources, config)
+	slices.Sort(secrets)
+	if want := []string{"hunter2", "k3y", "t0ken"}; !slices.Equal(secrets, want) {
+		t.Errorf("expected secrets %v, got %v", want, secrets)
+	}
+}
+
+func TestResolveVariables_Declarations(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("DEPLOY_PORT", "8443")
+	resolver := NewVariableResolver(nil)
+	config := map[string]interface{}{
+		"env":      map[string]interface{}{"type": "enum", "values": []interface{}{"staging", "prod"}, "required": true, "description": "Environment to deploy to"},
+		"port":     map[string]interface{}{"type": "int", "default": "env:DEPLOY_PORT"},
+		"verbose":  map[string]interface{}{"type": "bool", "default": false},
+		"APP_NAME": []interface{}{"required"},
+	}
+
+	variables, err := resolver.ResolveVariables("deploy", false, map[string]string{"env": "prod", "APP_NAME": "api", "verbose": "1"}, config)
+	if err != nil {
+		t.Fatalf("failed to resolve variables: %v", err)
+	}
+	if variables["port"] != "8443" || variables["verbose"] != "true" || variables["APP_NAME"] != "api" {
+		t.Errorf("unexpected variables %v", variables)
+	}
+
+	// Every problem is reported at once
+	_, err = resolver.ResolveVariables("deploy", false, map[string]string{"env": "dev", "port": "https"}, config)
+	if err == nil {
+		t.Fatal("expected the declarations to be enforced")
+	}
+	for _, want := range []string{"APP_NAME is required", `env: expected one of staging, prod, got "dev"`, `port: expected an int, got "https"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q, got %v", want, err)
+		}
+	}
+
+	// Missing values are left to the prompts, checked afterwards
+	variables, sources, err := resolver.ResolveVariablesWithSources("deploy", false, map[string]string{"port": "https"}, config)
+	if err != nil || variables["port"] != "https" {
+		t.Errorf("expected the values to be resolved without checking them, got %v (%v)", variables, err)
+	}
+	variables["env"], variables["APP_NAME"] = "prod", "api"
+	if err := ValidateVariables(config, variables, sources); err == nil || !strings.Contains(err.Error(), `port: expected an int, got "https"`) {
+		t.Errorf("expected the resolved values to be checked, got %v", err)
+	}
+
+	// Values set after resolving, such as answers to prompts
+	if err := ValidateVariables(config, map[string]string{"env": "prod", "APP_NAME": "api", "port": "80"}, nil); err != nil {
+		t.Errorf("expected valid variables, got %v", err)
+	}
+	err = ValidateVariables(config, map[string]string{"APP_NAME": ""}, nil)
+	if err == nil || !strings.Contains(err.Error(), "env is required, set it with --var env=... (Environment to deploy to)") || !strings.Contains(err.Error(), "APP_NAME is required") {
+		t.Errorf("expected missing and empty required variables to be reported, got %v", err)
+	}
+}
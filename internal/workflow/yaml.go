@@ -12,11 +12,41 @@ type YAMLWorkflow struct {
 	PreChecks   []YAMLStep          `yaml:"pre_checks,omitempty"`
 	Steps       []YAMLStep          `yaml:"steps"`
 	Actions     map[string]YAMLStep `yaml:"actions,omitempty"`
+	OnSuccess   []YAMLStep          `yaml:"on_success,omitempty"` // Run once after the run succeeded
+	OnFailure   []YAMLStep          `yaml:"on_failure,omitempty"` // Run once after the run failed
+	Finally     []YAMLStep          `yaml:"finally,omitempty"`    // Run once after every run
+	Dir         string              `yaml:"dir,omitempty"`        // Working directory of every command
+	Env         map[string]string   `yaml:"env,omitempty"`        // Added to the environment of every command
+	Shell       string              `yaml:"shell,omitempty"`      // Runs every command, e.g. "bash -euo pipefail"
 	Config      YAMLConfig          `yaml:"config,omitempty"`
 	UseVault    bool                `yaml:"use_vault,omitempty"`
 	Path        string              `json:"-"` // Not stored in the YAML, but used for file location
 }
 
+// HookSteps returns the steps of the on_success, on_failure and finally
+// blocks, which run once after the pre-checks and steps
+func (wf *YAMLWorkflow) HookSteps() []YAMLStep {
+	steps := make([]YAMLStep, 0, len(wf.OnSuccess)+len(wf.OnFailure)+len(wf.Finally))
+	steps = append(steps, wf.OnSuccess...)
+	steps = append(steps, wf.OnFailure...)
+	return append(steps, wf.Finally...)
+}
+
+// UsesSudo reports whether any pre-check, step, action or workflow hook step
+// runs with sudo
+func (wf *YAMLWorkflow) UsesSudo() bool {
+	steps := append(append(wf.PreChecks[:len(wf.PreChecks):len(wf.PreChecks)], wf.Steps...), wf.HookSteps()...)
+	for _, action := range wf.Actions {
+		steps = append(steps, action)
+	}
+	for _, step := range steps {
+		if step.Sudo {
+			return true
+		}
+	}
+	return false
+}
+
 // LoadYAMLWorkflow loads a workflow from a YAML file
 func LoadYAMLWorkflow(filePath string) (*YAMLWorkflow, error) {
 	data, err := os.ReadFile(filePath)
@@ -49,41 +79,31 @@ func ConvertYAMLToInternal(yamlWf *YAMLWorkflow) (*Workflow, error) {
 	// Convert YAMLStep to internal Atom format
 	preChecks := make([]Atom, len(yamlWf.PreChecks))
 	for i, step := range yamlWf.PreChecks {
-		preChecks[i] = Atom{
-			Command:     step.Command,
-			Description: step.Description,
-			OnFail:      step.OnFail,
-			OnSuccess:   step.OnSuccess,
-		}
+		preChecks[i] = atomFromYAMLStep(step)
 	}
 
 	steps := make([]Atom, len(yamlWf.Steps))
 	for i, step := range yamlWf.Steps {
-		steps[i] = Atom{
-			Command:     step.Command,
-			Description: step.Description,
-			OnFail:      step.OnFail,
-			OnSuccess:   step.OnSuccess,
-		}
+		steps[i] = atomFromYAMLStep(step)
 	}
 
 	actions := make(map[string]Atom)
 	for name, action := range yamlWf.Actions {
-		actions[name] = Atom{
-			Command:     action.Command,
-			Description: action.Description,
-			OnFail:      action.OnFail,
-			OnSuccess:   action.OnSuccess,
-		}
+		actions[name] = atomFromYAMLStep(action)
 	}
 
+	onSuccess := atomsFromYAMLSteps(yamlWf.OnSuccess)
+	onFailure := atomsFromYAMLSteps(yamlWf.OnFailure)
+	finally := atomsFromYAMLSteps(yamlWf.Finally)
+
 	// Convert YAMLConfig to internal Config
 	config := Config{
-		Variables:      yamlWf.Config.Variables,
-		StoreVariables: yamlWf.Config.StoreVariables,
-		StoreLogs:      yamlWf.Config.StoreLogs,
-		Background:     yamlWf.Config.Background,
-		Global:         yamlWf.Config.Global,
+		Variables:       yamlWf.Config.Variables,
+		StoreVariables:  yamlWf.Config.StoreVariables,
+		StoreLogs:       yamlWf.Config.StoreLogs,
+		Background:      yamlWf.Config.Background,
+		Global:          yamlWf.Config.Global,
+		ExportVariables: yamlWf.Config.ExportVariables,
 	}
 
 	return &Workflow{
@@ -92,7 +112,14 @@ func ConvertYAMLToInternal(yamlWf *YAMLWorkflow) (*Workflow, error) {
 		PreChecks:   preChecks,
 		Steps:       steps,
 		Actions:     actions,
+		OnSuccess:   onSuccess,
+		OnFailure:   onFailure,
+		Finally:     finally,
+		Dir:         yamlWf.Dir,
+		Env:         yamlWf.Env,
+		Shell:       yamlWf.Shell,
 		Config:      config,
+		UsesSudo:    yamlWf.UsesSudo(),
 	}, nil
 }
 
@@ -101,41 +128,31 @@ func ConvertInternalToYAML(internalWf *Workflow, id string) *YAMLWorkflow {
 	// Convert internal Atom to YAMLStep
 	preChecks := make([]YAMLStep, len(internalWf.PreChecks))
 	for i, step := range internalWf.PreChecks {
-		preChecks[i] = YAMLStep{
-			Command:     step.Command,
-			Description: step.Description,
-			OnFail:      step.OnFail,
-			OnSuccess:   step.OnSuccess,
-		}
+		preChecks[i] = yamlStepFromAtom(step)
 	}
 
 	steps := make([]YAMLStep, len(internalWf.Steps))
 	for i, step := range internalWf.Steps {
-		steps[i] = YAMLStep{
-			Command:     step.Command,
-			Description: step.Description,
-			OnFail:      step.OnFail,
-			OnSuccess:   step.OnSuccess,
-		}
+		steps[i] = yamlStepFromAtom(step)
 	}
 
 	actions := make(map[string]YAMLStep)
 	for name, action := range internalWf.Actions {
-		actions[name] = YAMLStep{
-			Command:     action.Command,
-			Description: action.Description,
-			OnFail:      action.OnFail,
-			OnSuccess:   action.OnSuccess,
-		}
+		actions[name] = yamlStepFromAtom(action)
 	}
 
+	onSuccess := yamlStepsFromAtoms(internalWf.OnSuccess)
+	onFailure := yamlStepsFromAtoms(internalWf.OnFailure)
+	finally := yamlStepsFromAtoms(internalWf.Finally)
+
 	// Convert internal Config to YAMLConfig
 	config := YAMLConfig{
-		Variables:      internalWf.Config.Variables,
-		StoreVariables: internalWf.Config.StoreVariables,
-		StoreLogs:      internalWf.Config.StoreLogs,
-		Background:     internalWf.Config.Background,
-		Global:         internalWf.Config.Global,
+		Variables:       internalWf.Config.Variables,
+		StoreVariables:  internalWf.Config.StoreVariables,
+		StoreLogs:       internalWf.Config.StoreLogs,
+		Background:      internalWf.Config.Background,
+		Global:          internalWf.Config.Global,
+		ExportVariables: internalWf.Config.ExportVariables,
 	}
 
 	return &YAMLWorkflow{
@@ -144,7 +161,93 @@ func ConvertInternalToYAML(internalWf *Workflow, id string) *YAMLWorkflow {
 		PreChecks:   preChecks,
 		Steps:       steps,
 		Actions:     actions,
+		OnSuccess:   onSuccess,
+		OnFailure:   onFailure,
+		Finally:     finally,
+		Dir:         internalWf.Dir,
+		Env:         internalWf.Env,
+		Shell:       internalWf.Shell,
 		Config:      config,
 		// UseVault is not directly in Config, assuming false or passed separately
 	}
 }
+
+// atomsFromYAMLSteps converts a list of YAML steps, keeping nil lists nil
+func atomsFromYAMLSteps(steps []YAMLStep) []Atom {
+	if steps == nil {
+		return nil
+	}
+	atoms := make([]Atom, len(steps))
+	for i, step := range steps {
+		atoms[i] = atomFromYAMLStep(step)
+	}
+	return atoms
+}
+
+// yamlStepsFromAtoms converts a list of internal Atoms, keeping nil lists nil
+func yamlStepsFromAtoms(atoms []Atom) []YAMLStep {
+	if atoms == nil {
+		return nil
+	}
+	steps := make([]YAMLStep, len(atoms))
+	for i, atom := range atoms {
+		steps[i] = yamlStepFromAtom(atom)
+	}
+	return steps
+}
+
+// atomFromYAMLStep converts a single YAML step to the internal Atom format
+func atomFromYAMLStep(step YAMLStep) Atom {
+	return Atom{
+		ID:           step.ID,
+		Name:         step.Name,
+		Tags:         step.Tags,
+		Needs:        step.Needs,
+		Command:      step.Command,
+		Script:       step.Script,
+		Description:  step.Description,
+		OnFail:       step.OnFail,
+		OnSuccess:    step.OnSuccess,
+		Timeout:      step.Timeout,
+		Retries:      step.Retries,
+		RetryDelay:   step.RetryDelay,
+		Backoff:      step.Backoff,
+		Jitter:       step.Jitter,
+		When:         step.When,
+		AllowFailure: step.AllowFailure,
+		Severity:     step.Severity,
+		Dir:          step.Dir,
+		Env:          step.Env,
+		Outputs:      step.Outputs,
+		Shell:        step.Shell,
+		Sudo:         step.Sudo,
+	}
+}
+
+// yamlStepFromAtom converts a single internal Atom to a YAML step
+func yamlStepFromAtom(atom Atom) YAMLStep {
+	return YAMLStep{
+		ID:           atom.ID,
+		Name:         atom.Name,
+		Tags:         atom.Tags,
+		Needs:        atom.Needs,
+		Command:      atom.Command,
+		Script:       atom.Script,
+		Description:  atom.Description,
+		OnFail:       atom.OnFail,
+		OnSuccess:    atom.OnSuccess,
+		Timeout:      atom.Timeout,
+		Retries:      atom.Retries,
+		RetryDelay:   atom.RetryDelay,
+		Backoff:      atom.Backoff,
+		Jitter:       atom.Jitter,
+		When:         atom.When,
+		AllowFailure: atom.AllowFailure,
+		Severity:     atom.Severity,
+		Dir:          atom.Dir,
+		Env:          atom.Env,
+		Outputs:      atom.Outputs,
+		Shell:        atom.Shell,
+		Sudo:         atom.Sudo,
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration parses a duration like time.ParseDuration, additionally
+// accepting day ("30d") and week ("2w") units for retention style values.
+// A bare number is rejected rather than guessing its unit, and so are
+// negative durations.
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return 0, fmt.Errorf("duration %q needs a unit, such as %sd or %sh", value, value, value)
+	}
+
+	d, err := parseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	return d, nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
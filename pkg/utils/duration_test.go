@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "30d", want: 30 * 24 * time.Hour},
+		{input: "2w", want: 14 * 24 * time.Hour},
+		{input: "1.5d", want: 36 * time.Hour},
+		{input: "90m", want: 90 * time.Minute},
+		{input: "1h30m", want: 90 * time.Minute},
+		{input: " 2d ", want: 48 * time.Hour},
+		{input: "", wantErr: true},
+		{input: "soon", wantErr: true},
+		{input: "xd", wantErr: true},
+		{input: "30", wantErr: true},
+		{input: "-1d", wantErr: true},
+		{input: "{{build_timeout}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseDuration(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseDuration(%q) expected error, got %v", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDuration(%q) unexpected error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDuration(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}